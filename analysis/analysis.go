@@ -0,0 +1,262 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"midi-file-server/midi"
+)
+
+const (
+	percussionChan = 9
+
+	// SplitPitch divides the hands when measuring span: notes at or above are played by the right hand
+	SplitPitch = 60
+
+	// MinDifficulty and MaxDifficulty bound the difficulty grade
+	MinDifficulty = 1
+	MaxDifficulty = 10
+)
+
+// Krumhansl-Kessler key profiles, indexed by semitones above the tonic
+var (
+	majorProfile = [12]float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorProfile = [12]float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+	tonicNames   = [12]string{"C", "C#", "D", "Eb", "E", "F", "F#", "G", "Ab", "A", "Bb", "B"}
+)
+
+// Analysis holds the musical features of a song and the difficulty grade derived from them
+type Analysis struct {
+	NotesPerSecond   float64 `json:"notesPerSecond" bson:"notes_per_second"`
+	MaxPolyphony     int     `json:"maxPolyphony" bson:"max_polyphony"`
+	AveragePolyphony float64 `json:"averagePolyphony" bson:"average_polyphony"`
+	HandSpan         int     `json:"handSpan" bson:"hand_span"`
+	LowestPitch      uint8   `json:"lowestPitch" bson:"lowest_pitch"`
+	HighestPitch     uint8   `json:"highestPitch" bson:"highest_pitch"`
+	PitchRange       int     `json:"pitchRange" bson:"pitch_range"`
+	TempoChanges     int     `json:"tempoChanges" bson:"tempo_changes"`
+	Key              string  `json:"key" bson:"key"`
+	KeyCorrelation   float64 `json:"keyCorrelation" bson:"key_correlation"`
+	ChordDensity     float64 `json:"chordDensity" bson:"chord_density"`
+	Difficulty       int     `json:"difficulty" bson:"difficulty"`
+}
+
+// Key is a detected tonal center
+type Key struct {
+	Tonic       int // pitch class, 0 is C
+	Minor       bool
+	Correlation float64
+}
+
+// String returns the key name, e.g. "Eb major"
+func (k Key) String() string {
+	mode := "major"
+	if k.Minor {
+		mode = "minor"
+	}
+	return fmt.Sprintf("%s %s", tonicNames[k.Tonic%12], mode)
+}
+
+// Analyze computes the features of the file's pitched notes. Percussion is ignored.
+// A file without pitched notes gets the lowest difficulty and an empty key.
+func Analyze(file *midi.File) Analysis {
+	var notes []midi.Note
+	for _, note := range file.Notes() {
+		if note.Channel != percussionChan {
+			notes = append(notes, note)
+		}
+	}
+	a := Analysis{TempoChanges: len(file.Tempos()) - 1, Difficulty: MinDifficulty}
+	if len(notes) == 0 {
+		return a
+	}
+
+	tempoMap := file.TempoMap()
+	duration := tempoMap.Seconds(file.EndTick())
+	if duration > 0 {
+		a.NotesPerSecond = float64(len(notes)) / duration
+	}
+
+	a.LowestPitch, a.HighestPitch = notes[0].Pitch, notes[0].Pitch
+	for _, note := range notes {
+		a.LowestPitch = min(a.LowestPitch, note.Pitch)
+		a.HighestPitch = max(a.HighestPitch, note.Pitch)
+	}
+	a.PitchRange = int(a.HighestPitch) - int(a.LowestPitch)
+
+	a.MaxPolyphony, a.AveragePolyphony = polyphony(notes)
+
+	onsets := onsetGroups(notes, uint32(file.Division)/8)
+	chords := 0
+	for _, group := range onsets {
+		if len(group) >= 3 {
+			chords++
+		}
+		a.HandSpan = max(a.HandSpan, handSpan(group))
+	}
+	if duration > 0 {
+		a.ChordDensity = float64(chords) / duration
+	}
+
+	key := DetectKey(notes)
+	a.Key, a.KeyCorrelation = key.String(), key.Correlation
+	a.Difficulty = Grade(a, key)
+	return a
+}
+
+// polyphony sweeps note starts and ends, returning the most simultaneous notes and the
+// average number sounding while anything sounds
+func polyphony(notes []midi.Note) (int, float64) {
+	type edge struct {
+		tick  uint32
+		delta int
+	}
+	edges := make([]edge, 0, 2*len(notes))
+	for _, note := range notes {
+		edges = append(edges, edge{note.Start, 1}, edge{max(note.End, note.Start+1), -1})
+	}
+	// Ends sort before starts at the same tick so repeated notes don't count as overlapping
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].tick != edges[j].tick {
+			return edges[i].tick < edges[j].tick
+		}
+		return edges[i].delta < edges[j].delta
+	})
+
+	maxCount, count := 0, 0
+	var weighted, sounding float64
+	for i, e := range edges {
+		if i > 0 && count > 0 {
+			span := float64(e.tick - edges[i-1].tick)
+			weighted += span * float64(count)
+			sounding += span
+		}
+		count += e.delta
+		maxCount = max(maxCount, count)
+	}
+	if sounding == 0 {
+		return maxCount, float64(maxCount)
+	}
+	return maxCount, weighted / sounding
+}
+
+// onsetGroups collects notes that start within tolerance ticks of the first note of the group
+func onsetGroups(notes []midi.Note, tolerance uint32) [][]midi.Note {
+	var groups [][]midi.Note
+	for _, note := range notes {
+		if n := len(groups); n > 0 && note.Start-groups[n-1][0].Start <= tolerance {
+			groups[n-1] = append(groups[n-1], note)
+			continue
+		}
+		groups = append(groups, []midi.Note{note})
+	}
+	return groups
+}
+
+// handSpan is the widest interval, in semitones, one hand must cover within a group of simultaneous notes
+func handSpan(group []midi.Note) int {
+	span := 0
+	for _, right := range []bool{false, true} {
+		lowest, highest := -1, -1
+		for _, note := range group {
+			if (note.Pitch >= SplitPitch) != right {
+				continue
+			}
+			if lowest < 0 || int(note.Pitch) < lowest {
+				lowest = int(note.Pitch)
+			}
+			highest = max(highest, int(note.Pitch))
+		}
+		if lowest >= 0 {
+			span = max(span, highest-lowest)
+		}
+	}
+	return span
+}
+
+// DetectKey correlates the duration-weighted pitch class histogram against the Krumhansl-Kessler
+// profiles for all 24 keys and returns the best match
+func DetectKey(notes []midi.Note) Key {
+	var histogram [12]float64
+	for _, note := range notes {
+		histogram[note.Pitch%12] += float64(note.Duration())
+	}
+
+	best := Key{Correlation: math.Inf(-1)}
+	for tonic := 0; tonic < 12; tonic++ {
+		for _, minor := range []bool{false, true} {
+			profile := majorProfile
+			if minor {
+				profile = minorProfile
+			}
+			var rotated [12]float64
+			for i := range rotated {
+				rotated[i] = profile[(i-tonic+12)%12]
+			}
+			if r := correlation(histogram, rotated); r > best.Correlation {
+				best = Key{Tonic: tonic, Minor: minor, Correlation: r}
+			}
+		}
+	}
+	if math.IsInf(best.Correlation, -1) {
+		best.Correlation = 0
+	}
+	return best
+}
+
+func correlation(x, y [12]float64) float64 {
+	var meanX, meanY float64
+	for i := range x {
+		meanX += x[i] / 12
+		meanY += y[i] / 12
+	}
+	var cov, varX, varY float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// Grade maps the features onto a difficulty from MinDifficulty to MaxDifficulty.
+// Note density dominates, followed by how many notes and how wide a stretch each hand must manage;
+// keys far from C and frequent tempo changes add a little on top.
+func Grade(a Analysis, key Key) int {
+	factors := []struct {
+		value, ceiling, weight float64
+	}{
+		{a.NotesPerSecond, 10, 0.35},
+		{float64(a.MaxPolyphony - 1), 7, 0.15},
+		{float64(a.HandSpan), 14, 0.15},
+		{a.ChordDensity, 3, 0.15},
+		{float64(a.PitchRange - 12), 48, 0.10},
+		{float64(keyAccidentals(key)), 6, 0.05},
+		{float64(a.TempoChanges), 10, 0.05},
+	}
+	score := 0.0
+	for _, f := range factors {
+		score += f.weight * math.Max(0, math.Min(f.value/f.ceiling, 1))
+	}
+	return MinDifficulty + int(math.Round(score*(MaxDifficulty-MinDifficulty)))
+}
+
+// keyAccidentals is the number of sharps or flats in the key signature
+func keyAccidentals(key Key) int {
+	tonic := key.Tonic
+	if key.Minor {
+		// Relative major shares the signature
+		tonic = (tonic + 3) % 12
+	}
+	// Position on the circle of fifths, folded so that F# and Gb both count six
+	fifths := (tonic * 7) % 12
+	if fifths > 6 {
+		fifths = 12 - fifths
+	}
+	return fifths
+}
@@ -0,0 +1,74 @@
+package analysis
+
+import (
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const division = 96
+
+// scale builds one bar per beat of a major scale at 120 BPM, optionally with triads underneath
+func scale(tonic uint8, triads bool) *midi.File {
+	file := midi.NewFile(division)
+	track := file.AddTrack("Scale")
+	steps := []uint8{0, 2, 4, 5, 7, 9, 11, 12, 7, 4, 0}
+	for i, step := range steps {
+		start := uint32(i * division)
+		track.AddNote(0, tonic+step, 80, start, start+division)
+		if triads && i%2 == 0 {
+			for _, interval := range []uint8{0, 4, 7} {
+				track.AddNote(1, tonic-12+interval, 70, start, start+2*division)
+			}
+		}
+	}
+	return file
+}
+
+func TestDetectKey(t *testing.T) {
+	assert.Equal(t, "C major", DetectKey(scale(60, false).Notes()).String())
+	assert.Equal(t, "Eb major", DetectKey(scale(63, false).Notes()).String())
+
+	// A natural minor melody leaning on the tonic and dominant
+	var notes []midi.Note
+	for i, pitch := range []uint8{57, 59, 60, 62, 64, 65, 67, 69, 64, 57, 60, 57} {
+		notes = append(notes, midi.Note{Pitch: pitch, Start: uint32(i * division), End: uint32((i + 1) * division)})
+	}
+	key := DetectKey(notes)
+	assert.Equal(t, "A minor", key.String())
+	assert.Greater(t, key.Correlation, 0.5)
+}
+
+func TestAnalyze(t *testing.T) {
+	a := Analyze(scale(60, true))
+
+	assert.InDelta(t, 29.0/6, a.NotesPerSecond, 0.01)
+	assert.Equal(t, 4, a.MaxPolyphony)
+	assert.Equal(t, uint8(48), a.LowestPitch)
+	assert.Equal(t, uint8(72), a.HighestPitch)
+	assert.Equal(t, 24, a.PitchRange)
+	assert.Equal(t, 7, a.HandSpan)
+	assert.InDelta(t, 1, a.ChordDensity, 0.01)
+	assert.Equal(t, "C major", a.Key)
+	assert.Equal(t, 0, a.TempoChanges)
+	assert.GreaterOrEqual(t, a.Difficulty, MinDifficulty)
+	assert.Less(t, Analyze(scale(60, false)).Difficulty, a.Difficulty)
+}
+
+func TestAnalyze_Empty(t *testing.T) {
+	file := midi.NewFile(division)
+	file.AddTrack("Drums").AddNote(9, 36, 100, 0, division)
+
+	a := Analyze(file)
+	assert.Equal(t, MinDifficulty, a.Difficulty)
+	assert.Zero(t, a.NotesPerSecond)
+	assert.Empty(t, a.Key)
+}
+
+func TestGrade_Bounds(t *testing.T) {
+	hard := Analysis{NotesPerSecond: 40, MaxPolyphony: 12, HandSpan: 20, ChordDensity: 8, PitchRange: 80, TempoChanges: 30}
+	assert.Equal(t, MaxDifficulty, Grade(hard, Key{Tonic: 6}))
+	assert.Equal(t, MinDifficulty, Grade(Analysis{MaxPolyphony: 1}, Key{}))
+}
@@ -0,0 +1,144 @@
+package analysis
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"math"
+	"sort"
+
+	"midi-file-server/midi"
+)
+
+const (
+	// onsetsPerQuarter is the resolution onsets are snapped to; 12 keeps both sixteenths and triplets exact
+	onsetsPerQuarter = 12
+	shingleSize      = 4
+	minHashSize      = 64
+)
+
+// Fingerprint identifies a song by content.
+// SHA256 matches byte-identical files, Musical matches the same notes regardless of tempo,
+// track layout and channel assignment, and MinHash estimates how much two note sequences overlap.
+type Fingerprint struct {
+	SHA256  string   `json:"sha256" bson:"sha256"`
+	Musical string   `json:"musical" bson:"musical"`
+	MinHash []uint64 `json:"-" bson:"min_hash"`
+}
+
+// NewFingerprint fingerprints the raw file bytes and the parsed notes
+func NewFingerprint(data []byte, file *midi.File) Fingerprint {
+	sum := sha256.Sum256(data)
+	tokens := noteTokens(file)
+
+	musical := sha256.New()
+	for _, token := range tokens {
+		_ = binary.Write(musical, binary.BigEndian, token)
+	}
+	return Fingerprint{
+		SHA256:  hex.EncodeToString(sum[:]),
+		Musical: hex.EncodeToString(musical.Sum(nil)),
+		MinHash: minHash(tokens),
+	}
+}
+
+// Similarity estimates the Jaccard similarity of two fingerprints' note sequences, from 0 to 1
+func (f Fingerprint) Similarity(other Fingerprint) float64 {
+	if f.Musical != "" && f.Musical == other.Musical {
+		return 1
+	}
+	if len(f.MinHash) == 0 || len(f.MinHash) != len(other.MinHash) {
+		return 0
+	}
+	matches := 0
+	for i := range f.MinHash {
+		if f.MinHash[i] == other.MinHash[i] {
+			matches++
+		}
+	}
+	return float64(matches) / float64(len(f.MinHash))
+}
+
+// noteTokens reduces the file to one token per onset: the time since the previous onset in
+// fractions of a quarter note and the set of pitches starting there.
+// Measuring in quarters rather than seconds or ticks makes the sequence independent of tempo and resolution;
+// merging all tracks and channels makes it independent of how the arrangement is laid out.
+func noteTokens(file *midi.File) []uint64 {
+	if file.Division == 0 {
+		return nil
+	}
+	onsets := map[int][]uint8{}
+	for _, note := range file.Notes() {
+		if note.Channel == percussionChan {
+			continue
+		}
+		onset := int(math.Round(float64(note.Start) * onsetsPerQuarter / float64(file.Division)))
+		if !containsPitch(onsets[onset], note.Pitch) {
+			onsets[onset] = append(onsets[onset], note.Pitch)
+		}
+	}
+	times := make([]int, 0, len(onsets))
+	for onset := range onsets {
+		times = append(times, onset)
+	}
+	sort.Ints(times)
+
+	tokens := make([]uint64, 0, len(times))
+	previous := 0
+	for i, onset := range times {
+		pitches := onsets[onset]
+		sort.Slice(pitches, func(a, b int) bool { return pitches[a] < pitches[b] })
+		hash := fnv.New64a()
+		delta := 0
+		if i > 0 {
+			delta = onset - previous
+		}
+		_ = binary.Write(hash, binary.BigEndian, uint32(delta))
+		hash.Write(pitches)
+		tokens = append(tokens, hash.Sum64())
+		previous = onset
+	}
+	return tokens
+}
+
+// minHash summarizes the set of token shingles with minHashSize independent hash minimums
+func minHash(tokens []uint64) []uint64 {
+	if len(tokens) == 0 {
+		return nil
+	}
+	signature := make([]uint64, minHashSize)
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+	size := min(shingleSize, len(tokens))
+	for start := 0; start+size <= len(tokens); start++ {
+		shingle := uint64(0)
+		for _, token := range tokens[start : start+size] {
+			shingle = mix64(shingle ^ token)
+		}
+		for i := range signature {
+			signature[i] = min(signature[i], mix64(shingle+uint64(i)*0x9E3779B97F4A7C15))
+		}
+	}
+	return signature
+}
+
+// mix64 is the splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xBF58476D1CE4E5B9
+	x ^= x >> 27
+	x *= 0x94D049BB133111EB
+	x ^= x >> 31
+	return x
+}
+
+func containsPitch(pitches []uint8, pitch uint8) bool {
+	for _, p := range pitches {
+		if p == pitch {
+			return true
+		}
+	}
+	return false
+}
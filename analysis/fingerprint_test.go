@@ -0,0 +1,50 @@
+package analysis
+
+import (
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint_IndependentOfLayout(t *testing.T) {
+	original := scale(60, true)
+
+	// Same notes at a different tempo and resolution, with the triads moved to their own track and channel
+	rearranged := midi.NewFile(2 * division)
+	rearranged.AddTrack("Tempo").AddTempo(0, 72)
+	melody := rearranged.AddTrack("Melody")
+	for _, note := range original.Notes() {
+		if note.Channel == 0 {
+			melody.AddNote(3, note.Pitch, note.Velocity, 2*note.Start, 2*note.End)
+		}
+	}
+	chords := rearranged.AddTrack("Chords")
+	for _, note := range original.Notes() {
+		if note.Channel == 1 {
+			chords.AddNote(5, note.Pitch, note.Velocity, 2*note.Start, 2*note.End)
+		}
+	}
+
+	a := NewFingerprint(original.Encode(), original)
+	b := NewFingerprint(rearranged.Encode(), rearranged)
+	assert.NotEqual(t, a.SHA256, b.SHA256)
+	assert.Equal(t, a.Musical, b.Musical)
+	assert.Equal(t, 1.0, a.Similarity(b))
+}
+
+func TestFingerprint_Similarity(t *testing.T) {
+	a := NewFingerprint(nil, scale(60, false))
+	different := NewFingerprint(nil, scale(62, false))
+	assert.NotEqual(t, a.Musical, different.Musical)
+	assert.Less(t, a.Similarity(different), 0.2)
+
+	// Changing one note keeps most shingles in common
+	edited := scale(60, false)
+	edited.Tracks[0].Events[len(edited.Tracks[0].Events)-2].Data1 = 67
+	near := NewFingerprint(nil, edited)
+	assert.NotEqual(t, a.Musical, near.Musical)
+	assert.Greater(t, a.Similarity(near), 0.5)
+	assert.Less(t, a.Similarity(near), 1.0)
+}
@@ -0,0 +1,220 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"midi-file-server/midi"
+)
+
+// Hand is the hand assigned to a note. Percussion, and parts that aren't the piano when
+// tracks name the hands, belong to neither.
+type Hand int8
+
+const (
+	NoHand Hand = iota
+	LeftHand
+	RightHand
+)
+
+// How the hands were told apart, from the most to the least reliable
+const (
+	HandsByTrackName = "track-names"
+	HandsByTrack     = "tracks"
+	HandsByChannel   = "channels"
+	HandsByPitch     = "pitch-split"
+)
+
+const (
+	// maxHandReach is the widest interval, in semitones, a hand is expected to cover at once
+	maxHandReach = 14
+	// maxHandNotes is how many notes one hand can strike together
+	maxHandNotes = 5
+	// handStretchCost is added per semitone over maxHandReach and per note over maxHandNotes
+	handStretchCost = 10
+	// handDrift is how far a hand's position moves towards the notes it just played
+	handDrift = 0.5
+)
+
+// HandSplit summarises how a song's notes were assigned to the hands
+type HandSplit struct {
+	Method       string `json:"method" bson:"method"`
+	LeftNotes    int    `json:"leftNotes" bson:"left_notes"`
+	RightNotes   int    `json:"rightNotes" bson:"right_notes"`
+	LeftLowest   uint8  `json:"leftLowest,omitempty" bson:"left_lowest,omitempty"`
+	LeftHighest  uint8  `json:"leftHighest,omitempty" bson:"left_highest,omitempty"`
+	RightLowest  uint8  `json:"rightLowest,omitempty" bson:"right_lowest,omitempty"`
+	RightHighest uint8  `json:"rightHighest,omitempty" bson:"right_highest,omitempty"`
+}
+
+// SeparateHands assigns each note of file.Notes(), by index, to a hand. It trusts track names such as
+// "Piano RH" or "Left Hand" first, then a part written as two tracks or two channels, the lower being the
+// left hand. Anything else is split by pitch, following where each hand was playing so that a
+// melody dipping below middle C stays in the right hand when the left is busy lower down.
+func SeparateHands(file *midi.File) ([]Hand, HandSplit) {
+	notes := file.Notes()
+	hands := make([]Hand, len(notes))
+	split := HandSplit{Method: HandsByPitch}
+
+	var pitched []int
+	tracks := map[int]bool{}
+	channels := map[uint8]bool{}
+	for i, note := range notes {
+		if note.Channel != percussionChan {
+			pitched = append(pitched, i)
+			tracks[note.Track] = true
+			channels[note.Channel] = true
+		}
+	}
+
+	switch {
+	case assignByTrackNames(file, notes, pitched, hands):
+		split.Method = HandsByTrackName
+	case len(tracks) == 2:
+		assignByLowerPart(notes, pitched, hands, func(note midi.Note) int { return note.Track })
+		split.Method = HandsByTrack
+	case len(tracks) == 1 && len(channels) == 2:
+		assignByLowerPart(notes, pitched, hands, func(note midi.Note) int { return int(note.Channel) })
+		split.Method = HandsByChannel
+	default:
+		assignByPitch(notes, pitched, hands, uint32(file.Division)/8)
+	}
+
+	for i, note := range notes {
+		switch hands[i] {
+		case LeftHand:
+			if split.LeftNotes == 0 || note.Pitch < split.LeftLowest {
+				split.LeftLowest = note.Pitch
+			}
+			split.LeftHighest = max(split.LeftHighest, note.Pitch)
+			split.LeftNotes++
+		case RightHand:
+			if split.RightNotes == 0 || note.Pitch < split.RightLowest {
+				split.RightLowest = note.Pitch
+			}
+			split.RightHighest = max(split.RightHighest, note.Pitch)
+			split.RightNotes++
+		}
+	}
+	return hands, split
+}
+
+// handFromName reads a hand out of a track name, e.g. "Piano (Right)", "L.H." or "rh"
+func handFromName(name string) Hand {
+	words := strings.FieldsFunc(strings.ToLower(strings.ReplaceAll(name, ".", "")), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		switch word {
+		case "left", "lh":
+			return LeftHand
+		case "right", "rh":
+			return RightHand
+		}
+	}
+	return NoHand
+}
+
+// assignByTrackNames uses track names when at least one track names each hand; other tracks are left out
+func assignByTrackNames(file *midi.File, notes []midi.Note, pitched []int, hands []Hand) bool {
+	named := make([]Hand, len(file.Tracks))
+	found := map[Hand]bool{}
+	for i, track := range file.Tracks {
+		named[i] = handFromName(track.Name)
+		found[named[i]] = true
+	}
+	if !found[LeftHand] || !found[RightHand] {
+		return false
+	}
+	for _, i := range pitched {
+		hands[i] = named[notes[i].Track]
+	}
+	return true
+}
+
+// assignByLowerPart gives the part, by track or channel, with the lower average pitch to the left hand
+func assignByLowerPart(notes []midi.Note, pitched []int, hands []Hand, part func(midi.Note) int) {
+	sums, counts := map[int]float64{}, map[int]float64{}
+	for _, i := range pitched {
+		sums[part(notes[i])] += float64(notes[i].Pitch)
+		counts[part(notes[i])]++
+	}
+	lower, lowest := 0, math.Inf(1)
+	for p, sum := range sums {
+		if mean := sum / counts[p]; mean < lowest || (mean == lowest && p < lower) {
+			lower, lowest = p, mean
+		}
+	}
+	for _, i := range pitched {
+		hands[i] = RightHand
+		if part(notes[i]) == lower {
+			hands[i] = LeftHand
+		}
+	}
+}
+
+// assignByPitch splits each group of notes starting together into a lower part for the left hand and an
+// upper part for the right, choosing the split that keeps each hand nearest to where it was and within reach.
+// Each split point is costed in constant time from running sums, so a group of k notes takes O(k log k).
+func assignByPitch(notes []midi.Note, pitched []int, hands []Hand, tolerance uint32) {
+	left, right := float64(SplitPitch-12), float64(SplitPitch+12)
+	for start := 0; start < len(pitched); {
+		end := start + 1
+		for end < len(pitched) && notes[pitched[end]].Start-notes[pitched[start]].Start <= tolerance {
+			end++
+		}
+		group := append([]int(nil), pitched[start:end]...)
+		sort.SliceStable(group, func(a, b int) bool { return notes[group[a]].Pitch < notes[group[b]].Pitch })
+
+		// leftMoves[k] is how far the left hand moves for the k lowest notes, rightMoves[k] the right hand
+		// for the rest
+		n := len(group)
+		leftMoves, rightMoves := make([]float64, n+1), make([]float64, n+1)
+		for k, i := range group {
+			leftMoves[k+1] = leftMoves[k] + math.Abs(float64(notes[i].Pitch)-left)
+		}
+		for k := n - 1; k >= 0; k-- {
+			rightMoves[k] = rightMoves[k+1] + math.Abs(float64(notes[group[k]].Pitch)-right)
+		}
+
+		best, bestCost := 0, math.Inf(1)
+		for k := 0; k <= n; k++ {
+			cost := leftMoves[k] + handStretch(notes, group[:k]) + rightMoves[k] + handStretch(notes, group[k:])
+			if cost < bestCost {
+				best, bestCost = k, cost
+			}
+		}
+		for k, i := range group {
+			hands[i] = RightHand
+			if k < best {
+				hands[i] = LeftHand
+			}
+		}
+		if best > 0 {
+			left += handDrift * (meanPitch(notes, group[:best]) - left)
+		}
+		if best < n {
+			right += handDrift * (meanPitch(notes, group[best:]) - right)
+		}
+		start = end
+	}
+}
+
+// handStretch is the cost of one hand playing the notes, ordered by pitch, beyond its reach or its fingers
+func handStretch(notes []midi.Note, group []int) float64 {
+	if len(group) == 0 {
+		return 0
+	}
+	reach := int(notes[group[len(group)-1]].Pitch) - int(notes[group[0]].Pitch)
+	return handStretchCost * float64(max(0, reach-maxHandReach)+max(0, len(group)-maxHandNotes))
+}
+
+func meanPitch(notes []midi.Note, group []int) float64 {
+	var sum float64
+	for _, i := range group {
+		sum += float64(notes[i].Pitch)
+	}
+	return sum / float64(len(group))
+}
@@ -0,0 +1,90 @@
+package analysis
+
+import (
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeparateHands_TrackNames(t *testing.T) {
+	file := midi.NewFile(division)
+	file.AddTrack("Piano R.H.").AddNote(0, 72, 80, 0, division)
+	file.AddTrack("Strings").AddNote(1, 60, 80, 0, division)
+	file.AddTrack("Piano (Left)").AddNote(0, 48, 80, 0, division)
+
+	hands, split := SeparateHands(file)
+	assert.Equal(t, HandsByTrackName, split.Method)
+	// Notes come back ordered by pitch at the same onset
+	assert.Equal(t, []Hand{LeftHand, NoHand, RightHand}, hands)
+	assert.Equal(t, 1, split.LeftNotes)
+	assert.Equal(t, 1, split.RightNotes)
+}
+
+func TestSeparateHands_Channels(t *testing.T) {
+	file := scale(60, true)
+	notes := file.Notes()
+
+	hands, split := SeparateHands(file)
+	assert.Equal(t, HandsByChannel, split.Method)
+	for i, note := range notes {
+		if note.Channel == 1 {
+			assert.Equal(t, LeftHand, hands[i])
+		} else {
+			assert.Equal(t, RightHand, hands[i])
+		}
+	}
+}
+
+func TestSeparateHands_PitchSplit(t *testing.T) {
+	// A melody that dips below middle C over a low bass, then a wide chord split across the hands
+	file := midi.NewFile(division)
+	track := file.AddTrack("Piano")
+	melody := []uint8{67, 64, 59, 57, 60}
+	for i, pitch := range melody {
+		start := uint32(i * division)
+		track.AddNote(0, pitch, 80, start, start+division)
+		track.AddNote(0, 36, 70, start, start+division)
+	}
+	chord := uint32(len(melody) * division)
+	for _, pitch := range []uint8{36, 43, 48, 64, 67, 72} {
+		track.AddNote(0, pitch, 80, chord, chord+division)
+	}
+	file.AddTrack("Drums").AddNote(9, 42, 80, 0, division)
+
+	hands, split := SeparateHands(file)
+	assert.Equal(t, HandsByPitch, split.Method)
+	for i, note := range file.Notes() {
+		switch {
+		case note.Channel == 9:
+			assert.Equal(t, NoHand, hands[i])
+		case note.Pitch <= 48:
+			assert.Equal(t, LeftHand, hands[i], note)
+		default:
+			assert.Equal(t, RightHand, hands[i], note)
+		}
+	}
+	assert.Equal(t, uint8(36), split.LeftLowest)
+	assert.Equal(t, uint8(57), split.RightLowest)
+}
+
+func TestSeparateHands_LargeChord(t *testing.T) {
+	// Tens of thousands of notes starting together are split without costing every split point from scratch
+	file := midi.NewFile(division)
+	track := file.AddTrack("Piano")
+	for i := range 50000 {
+		pitch := uint8(36 + i%48)
+		track.AddNote(0, pitch, 80, 0, division)
+	}
+
+	hands, split := SeparateHands(file)
+	assert.Equal(t, HandsByPitch, split.Method)
+	for i, note := range file.Notes() {
+		if hands[i] == LeftHand {
+			assert.Less(t, note.Pitch, split.RightLowest)
+		}
+	}
+	assert.Positive(t, split.LeftNotes)
+	assert.Positive(t, split.RightNotes)
+}
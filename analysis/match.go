@@ -0,0 +1,63 @@
+package analysis
+
+// Local alignment scores for matching a played query against a stored melody.
+// A step off by a semitone still scores, since players often slip or misremember a note.
+const (
+	exactScore  = 2.0
+	nearScore   = 0.5
+	mismatch    = -1.0
+	gapPenalty  = -1.5
+	queryWeight = 0.8
+
+	// MinQueryNotes is the shortest snippet that carries enough intervals to match on
+	MinQueryNotes = 4
+	// MaxQueryNotes is the longest snippet searched with, as each note is matched against every song
+	MaxQueryNotes = 64
+)
+
+// MatchScore reports how well the query occurs anywhere inside the melody, from 0 to 1.
+// Both melodies are already transposition and tempo independent, so a query played in any key
+// or at any speed matches the same passage.
+func MatchScore(query, melody Melody) float64 {
+	intervals := alignment(query.Intervals, melody.Intervals)
+	if len(query.Rhythm) == 0 {
+		return intervals
+	}
+	return queryWeight*intervals + (1-queryWeight)*alignment(query.Rhythm, melody.Rhythm)
+}
+
+// alignment is the best Smith-Waterman local alignment of the whole query within the target,
+// normalized by the score of a perfect match of the query
+func alignment(query, target []int) float64 {
+	if len(query) == 0 || len(target) == 0 {
+		return 0
+	}
+	previous := make([]float64, len(target)+1)
+	current := make([]float64, len(target)+1)
+	best := 0.0
+	for i := 1; i <= len(query); i++ {
+		current[0] = 0
+		for j := 1; j <= len(target); j++ {
+			score := max(0,
+				previous[j-1]+substitution(query[i-1], target[j-1]),
+				previous[j]+gapPenalty,
+				current[j-1]+gapPenalty,
+			)
+			current[j] = score
+			best = max(best, score)
+		}
+		previous, current = current, previous
+	}
+	return best / (exactScore * float64(len(query)))
+}
+
+func substitution(a, b int) float64 {
+	switch diff := a - b; {
+	case diff == 0:
+		return exactScore
+	case diff == 1 || diff == -1:
+		return nearScore
+	default:
+		return mismatch
+	}
+}
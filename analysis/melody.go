@@ -0,0 +1,149 @@
+package analysis
+
+import (
+	"math"
+
+	"midi-file-server/midi"
+)
+
+const (
+	// maxMelodyNotes bounds the stored melody so long pieces don't bloat the catalog entry
+	maxMelodyNotes = 2000
+	maxInterval    = 12
+	maxRhythmStep  = 3
+	ngramSize      = 3
+
+	intervalWeight = 0.7
+	rhythmWeight   = 0.3
+)
+
+// Melody is the top line of a song reduced to transposition and tempo independent steps.
+// Intervals[i] is the semitone step from note i to note i+1, folded into an octave either way,
+// and Rhythm[i] is the log2 ratio of the inter-onset intervals around note i+1, so Rhythm is one shorter.
+type Melody struct {
+	Intervals []int `json:"intervals" bson:"intervals"`
+	Rhythm    []int `json:"rhythm" bson:"rhythm"`
+}
+
+// MelodyProfile counts the interval and rhythm n-grams of a melody for fast comparison
+type MelodyProfile struct {
+	intervals     map[int64]float64
+	rhythm        map[int64]float64
+	intervalsNorm float64
+	rhythmNorm    float64
+}
+
+// ExtractMelody takes the highest pitched note at every onset (the skyline) as the melody
+func ExtractMelody(file *midi.File) Melody {
+	var notes []midi.Note
+	for _, note := range file.Notes() {
+		if note.Channel != percussionChan {
+			notes = append(notes, note)
+		}
+	}
+
+	var skyline []midi.Note
+	for _, group := range onsetGroups(notes, uint32(file.Division)/8) {
+		top := group[0]
+		for _, note := range group[1:] {
+			if note.Pitch > top.Pitch {
+				top = note
+			}
+		}
+		skyline = append(skyline, top)
+		if len(skyline) == maxMelodyNotes {
+			break
+		}
+	}
+	return MelodyFromNotes(skyline)
+}
+
+// MelodyFromNotes reduces a monophonic note sequence, in onset order, to a melody
+func MelodyFromNotes(notes []midi.Note) Melody {
+	var m Melody
+	for i := 1; i < len(notes); i++ {
+		step := int(notes[i].Pitch) - int(notes[i-1].Pitch)
+		m.Intervals = append(m.Intervals, foldInterval(step))
+		if i >= 2 {
+			previous := float64(notes[i-1].Start - notes[i-2].Start)
+			current := float64(notes[i].Start - notes[i-1].Start)
+			m.Rhythm = append(m.Rhythm, rhythmStep(previous, current))
+		}
+	}
+	return m
+}
+
+// foldInterval keeps steps within an octave so octave displacements look like the same move
+func foldInterval(step int) int {
+	for step > maxInterval {
+		step -= 12
+	}
+	for step < -maxInterval {
+		step += 12
+	}
+	return step
+}
+
+// rhythmStep is the rounded log2 ratio between consecutive inter-onset intervals, e.g. 1 when the notes slow to half speed
+func rhythmStep(previous, current float64) int {
+	if previous <= 0 || current <= 0 {
+		return 0
+	}
+	step := int(math.Round(math.Log2(current / previous)))
+	return max(-maxRhythmStep, min(step, maxRhythmStep))
+}
+
+// NewMelodyProfile counts the n-grams of the melody's intervals and rhythm
+func NewMelodyProfile(m Melody) MelodyProfile {
+	p := MelodyProfile{intervals: ngrams(m.Intervals), rhythm: ngrams(m.Rhythm)}
+	p.intervalsNorm = norm(p.intervals)
+	p.rhythmNorm = norm(p.rhythm)
+	return p
+}
+
+// Similarity is the weighted cosine similarity of the interval and rhythm n-gram counts, from 0 to 1
+func (p MelodyProfile) Similarity(other MelodyProfile) float64 {
+	return intervalWeight*cosine(p.intervals, other.intervals, p.intervalsNorm, other.intervalsNorm) +
+		rhythmWeight*cosine(p.rhythm, other.rhythm, p.rhythmNorm, other.rhythmNorm)
+}
+
+// MelodicSimilarity compares two melodies by their interval and rhythm n-grams, from 0 to 1
+func MelodicSimilarity(a, b Melody) float64 {
+	return NewMelodyProfile(a).Similarity(NewMelodyProfile(b))
+}
+
+// ngrams counts every run of ngramSize consecutive values, packed into one key
+func ngrams(values []int) map[int64]float64 {
+	counts := map[int64]float64{}
+	for i := 0; i+ngramSize <= len(values); i++ {
+		var key int64
+		for _, v := range values[i : i+ngramSize] {
+			// Values stay within ±maxInterval, so 6 bits per value is enough
+			key = key<<6 | int64(v+32)
+		}
+		counts[key]++
+	}
+	return counts
+}
+
+func norm(counts map[int64]float64) float64 {
+	sum := 0.0
+	for _, c := range counts {
+		sum += c * c
+	}
+	return math.Sqrt(sum)
+}
+
+func cosine(a, b map[int64]float64, normA, normB float64) float64 {
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	dot := 0.0
+	for key, c := range a {
+		dot += c * b[key]
+	}
+	return dot / (normA * normB)
+}
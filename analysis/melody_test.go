@@ -0,0 +1,56 @@
+package analysis
+
+import (
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractMelody(t *testing.T) {
+	m := ExtractMelody(scale(60, true))
+
+	// The triads sit under the melody, so the skyline is the scale itself
+	assert.Equal(t, []int{2, 2, 1, 2, 2, 2, 1, -5, -3, -4}, m.Intervals)
+	assert.Equal(t, make([]int, 9), m.Rhythm)
+}
+
+func TestMelodyFromNotes_Rhythm(t *testing.T) {
+	notes := []midi.Note{{Pitch: 60, Start: 0}, {Pitch: 62, Start: 96}, {Pitch: 74, Start: 144}, {Pitch: 60, Start: 336}}
+	m := MelodyFromNotes(notes)
+	assert.Equal(t, []int{2, 12, -2}, m.Intervals)
+	assert.Equal(t, []int{-1, 2}, m.Rhythm)
+}
+
+func TestMelodicSimilarity(t *testing.T) {
+	c := ExtractMelody(scale(60, false))
+	// Transposed and with a different accompaniment, the melody is the same
+	assert.InDelta(t, 1, MelodicSimilarity(c, ExtractMelody(scale(67, true))), 0.001)
+
+	var notes []midi.Note
+	for i, pitch := range []uint8{60, 67, 64, 72, 60, 65, 62, 71, 60, 64, 60} {
+		notes = append(notes, midi.Note{Pitch: pitch, Start: uint32(i * i * division)})
+	}
+	other := MelodyFromNotes(notes)
+	assert.Less(t, MelodicSimilarity(c, other), 0.3)
+	assert.Zero(t, MelodicSimilarity(c, Melody{}))
+}
+
+func TestMatchScore(t *testing.T) {
+	song := Melody{Intervals: []int{0, 7, 0, 2, 0, -2, -2, 0, -1, 0, -2, 0, -2}}
+
+	// The opening phrase, played a fourth higher
+	query := Melody{Intervals: []int{0, 7, 0, 2, 0, -2}}
+	assert.InDelta(t, 1, MatchScore(query, song), 0.001)
+
+	// A passage from the middle with one wrong note
+	slipped := Melody{Intervals: []int{-2, 0, -1, 1, -2}}
+	score := MatchScore(slipped, song)
+	assert.Greater(t, score, 0.5)
+	assert.Less(t, score, 1.0)
+
+	unrelated := Melody{Intervals: []int{5, 5, -9, 11, 4}}
+	assert.Less(t, MatchScore(unrelated, song), 0.3)
+	assert.Zero(t, MatchScore(Melody{}, song))
+}
@@ -0,0 +1,314 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+
+	"midi-file-server/midi"
+)
+
+const (
+	// MaxAlignedNotes caps each side of an alignment; the cost matrix grows with the product of both
+	MaxAlignedNotes = 1500
+	// timingTolerance is the mean deviation, in seconds, at which the timing part of the score reaches zero
+	timingTolerance = 0.25
+	// minTempoGap ignores onsets closer than this when measuring local tempo, e.g. rolled chords
+	minTempoGap = 0.05
+)
+
+// PracticeResult compares a performance with the reference it was practising.
+// NoteAccuracy is the share of reference notes played and Precision the share of played notes that were
+// in the reference. Timing deviations are in milliseconds of played time, negative meaning early, and are
+// measured against the performance's own overall tempo, so playing slowly but evenly isn't penalised;
+// TempoRatio reports that tempo relative to the reference instead.
+type PracticeResult struct {
+	Score                 float64         `json:"score" bson:"score"`
+	NoteAccuracy          float64         `json:"noteAccuracy" bson:"note_accuracy"`
+	Precision             float64         `json:"precision" bson:"precision"`
+	ReferenceNotes        int             `json:"referenceNotes" bson:"reference_notes"`
+	PlayedNotes           int             `json:"playedNotes" bson:"played_notes"`
+	MatchedNotes          int             `json:"matchedNotes" bson:"matched_notes"`
+	MeanTimingDeviationMs float64         `json:"meanTimingDeviationMs" bson:"mean_timing_deviation_ms"`
+	TempoRatio            float64         `json:"tempoRatio" bson:"tempo_ratio"`
+	TempoStability        float64         `json:"tempoStability" bson:"tempo_stability"`
+	Measures              []MeasureTiming `json:"measures" bson:"measures"`
+	Missed                []PracticeNote  `json:"missed" bson:"missed"`
+	Extra                 []PracticeNote  `json:"extra" bson:"extra"`
+	Truncated             bool            `json:"truncated,omitempty" bson:"truncated,omitempty"`
+}
+
+// MeasureTiming summarises one measure of the reference; measures are numbered from 1
+type MeasureTiming struct {
+	Measure            int     `json:"measure" bson:"measure"`
+	Notes              int     `json:"notes" bson:"notes"`
+	Matched            int     `json:"matched" bson:"matched"`
+	MeanDeviationMs    float64 `json:"meanDeviationMs" bson:"mean_deviation_ms"`
+	MeanAbsDeviationMs float64 `json:"meanAbsDeviationMs" bson:"mean_abs_deviation_ms"`
+}
+
+// PracticeNote is a missed or extra note, at its time in its own file and the reference measure it falls in
+type PracticeNote struct {
+	Pitch   uint8   `json:"pitch" bson:"pitch"`
+	Measure int     `json:"measure" bson:"measure"`
+	Seconds float64 `json:"seconds" bson:"seconds"`
+}
+
+type timedNote struct {
+	pitch   uint8
+	tick    uint32
+	seconds float64
+}
+
+type notePair struct {
+	reference, played int
+}
+
+// ComparePerformance aligns the notes of a performance to the reference with dynamic time warping over
+// their onsets and scores the result from 0 to 100: half note accuracy, 30% timing and 20% tempo stability.
+func ComparePerformance(reference, performance *midi.File) PracticeResult {
+	ref, refTruncated := timedNotes(reference)
+	played, playedTruncated := timedNotes(performance)
+	result := PracticeResult{
+		ReferenceNotes: len(ref),
+		PlayedNotes:    len(played),
+		TempoRatio:     1,
+		Measures:       []MeasureTiming{},
+		Missed:         []PracticeNote{},
+		Extra:          []PracticeNote{},
+		Truncated:      refTruncated || playedTruncated,
+	}
+
+	var pairs []notePair
+	if len(ref) > 0 && len(played) > 0 {
+		pairs = alignNotes(ref, played)
+	}
+	result.MatchedNotes = len(pairs)
+
+	// Map reference time to played time; deviations are measured from this line
+	intercept, slope := fitTiming(ref, played, pairs)
+	if slope > 0 {
+		result.TempoRatio = 1 / slope
+	}
+
+	measureStarts := reference.MeasureStarts(reference.EndTick())
+	measureOf := func(tick uint32) int {
+		return sort.Search(len(measureStarts), func(i int) bool { return measureStarts[i] > tick })
+	}
+	measures := map[int]*MeasureTiming{}
+	measure := func(number int) *MeasureTiming {
+		if measures[number] == nil {
+			measures[number] = &MeasureTiming{Measure: number}
+		}
+		return measures[number]
+	}
+
+	refMatched := make([]bool, len(ref))
+	playedMatched := make([]bool, len(played))
+	var totalAbsDeviation float64
+	for _, pair := range pairs {
+		refMatched[pair.reference], playedMatched[pair.played] = true, true
+		deviation := played[pair.played].seconds - (intercept + slope*ref[pair.reference].seconds)
+		totalAbsDeviation += math.Abs(deviation)
+
+		m := measure(measureOf(ref[pair.reference].tick))
+		m.Matched++
+		m.MeanDeviationMs += deviation * 1000
+		m.MeanAbsDeviationMs += math.Abs(deviation) * 1000
+	}
+	for i, note := range ref {
+		m := measure(measureOf(note.tick))
+		m.Notes++
+		if !refMatched[i] {
+			result.Missed = append(result.Missed, PracticeNote{Pitch: note.pitch, Measure: m.Measure, Seconds: note.seconds})
+		}
+	}
+	tempoMap := reference.TempoMap()
+	for j, note := range played {
+		if playedMatched[j] {
+			continue
+		}
+		// Place the extra note in the measure where it would have fallen in the reference
+		number := 1
+		if slope > 0 {
+			number = measureOf(tempoMap.Ticks(math.Max(0, (note.seconds-intercept)/slope)))
+		}
+		result.Extra = append(result.Extra, PracticeNote{Pitch: note.pitch, Measure: number, Seconds: note.seconds})
+	}
+
+	for _, m := range measures {
+		if m.Matched > 0 {
+			m.MeanDeviationMs /= float64(m.Matched)
+			m.MeanAbsDeviationMs /= float64(m.Matched)
+		}
+		result.Measures = append(result.Measures, *m)
+	}
+	sort.Slice(result.Measures, func(i, j int) bool { return result.Measures[i].Measure < result.Measures[j].Measure })
+
+	if len(ref) > 0 {
+		result.NoteAccuracy = float64(len(pairs)) / float64(len(ref))
+	}
+	if len(played) > 0 {
+		result.Precision = float64(len(pairs)) / float64(len(played))
+	}
+	if len(pairs) > 0 {
+		result.MeanTimingDeviationMs = totalAbsDeviation / float64(len(pairs)) * 1000
+	}
+	result.TempoStability = tempoStability(ref, played, pairs)
+
+	var f1 float64
+	if result.NoteAccuracy+result.Precision > 0 {
+		f1 = 2 * result.NoteAccuracy * result.Precision / (result.NoteAccuracy + result.Precision)
+	}
+	timing := 0.0
+	if len(pairs) > 0 {
+		timing = math.Max(0, 1-result.MeanTimingDeviationMs/1000/timingTolerance)
+	}
+	result.Score = 100 * (0.5*f1 + 0.3*timing + 0.2*result.TempoStability)
+	return result
+}
+
+// timedNotes returns the file's notes with their onsets in seconds, capped at MaxAlignedNotes
+func timedNotes(file *midi.File) ([]timedNote, bool) {
+	notes := file.Notes()
+	truncated := len(notes) > MaxAlignedNotes
+	if truncated {
+		notes = notes[:MaxAlignedNotes]
+	}
+	tempoMap := file.TempoMap()
+	timed := make([]timedNote, len(notes))
+	for i, note := range notes {
+		timed[i] = timedNote{pitch: note.Pitch, tick: note.Start, seconds: tempoMap.Seconds(note.Start)}
+	}
+	return timed, truncated
+}
+
+// alignNotes finds the cheapest monotonic alignment of the two note sequences and returns the pairs on it
+// with the same pitch, each note used at most once. Both sides are compared on a common time scale:
+// relative to their first onset and stretched to the same overall length, so tempo differences don't count.
+func alignNotes(ref, played []timedNote) []notePair {
+	n, m := len(ref), len(played)
+	refStart, playedStart := ref[0].seconds, played[0].seconds
+	scale := 1.0
+	if refSpan, playedSpan := ref[n-1].seconds-refStart, played[m-1].seconds-playedStart; refSpan > 0 && playedSpan > 0 {
+		scale = refSpan / playedSpan
+	}
+
+	const (
+		fromDiagonal uint8 = iota
+		fromReference
+		fromPlayed
+	)
+	inf := float32(math.Inf(1))
+	cost := make([]float32, (n+1)*(m+1))
+	from := make([]uint8, (n+1)*(m+1))
+	width := m + 1
+	for i := range cost {
+		cost[i] = inf
+	}
+	cost[0] = 0
+
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			step := math.Min(1, math.Abs((ref[i-1].seconds-refStart)-(played[j-1].seconds-playedStart)*scale))
+			if ref[i-1].pitch != played[j-1].pitch {
+				step++
+			}
+			best, direction := cost[(i-1)*width+j-1], fromDiagonal
+			if c := cost[(i-1)*width+j]; c < best {
+				best, direction = c, fromReference
+			}
+			if c := cost[i*width+j-1]; c < best {
+				best, direction = c, fromPlayed
+			}
+			cost[i*width+j] = best + float32(step)
+			from[i*width+j] = direction
+		}
+	}
+
+	// Walk back from the end, then keep the same-pitch pairs in order
+	var path []notePair
+	for i, j := n, m; i > 0 && j > 0; {
+		path = append(path, notePair{i - 1, j - 1})
+		switch from[i*width+j] {
+		case fromDiagonal:
+			i, j = i-1, j-1
+		case fromReference:
+			i--
+		default:
+			j--
+		}
+	}
+	refUsed := make([]bool, n)
+	playedUsed := make([]bool, m)
+	var pairs []notePair
+	for k := len(path) - 1; k >= 0; k-- {
+		pair := path[k]
+		if refUsed[pair.reference] || playedUsed[pair.played] || ref[pair.reference].pitch != played[pair.played].pitch {
+			continue
+		}
+		refUsed[pair.reference], playedUsed[pair.played] = true, true
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// fitTiming fits played = intercept + slope*reference over the matched onsets by least squares
+func fitTiming(ref, played []timedNote, pairs []notePair) (float64, float64) {
+	var sumX, sumY, sumXX, sumXY float64
+	for _, pair := range pairs {
+		x, y := ref[pair.reference].seconds, played[pair.played].seconds
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	count := float64(len(pairs))
+	if count == 0 {
+		return 0, 1
+	}
+	denominator := count*sumXX - sumX*sumX
+	if denominator <= 0 {
+		// A single onset time gives no tempo; assume the reference's
+		return sumY/count - sumX/count, 1
+	}
+	slope := (count*sumXY - sumX*sumY) / denominator
+	return (sumY - slope*sumX) / count, slope
+}
+
+// tempoStability is 1 minus the coefficient of variation of the local tempo between successive matched
+// onsets, so a performance that speeds up and slows down scores lower than one played steadily at any tempo
+func tempoStability(ref, played []timedNote, pairs []notePair) float64 {
+	if len(pairs) == 0 {
+		return 0
+	}
+	var ratios []float64
+	last := -1
+	for k, pair := range pairs {
+		if last >= 0 {
+			refGap := ref[pair.reference].seconds - ref[pairs[last].reference].seconds
+			playedGap := played[pair.played].seconds - played[pairs[last].played].seconds
+			if refGap < minTempoGap {
+				continue
+			}
+			if playedGap > 0 {
+				ratios = append(ratios, playedGap/refGap)
+			}
+		}
+		last = k
+	}
+	if len(ratios) < 2 {
+		return 1
+	}
+
+	var mean float64
+	for _, ratio := range ratios {
+		mean += ratio
+	}
+	mean /= float64(len(ratios))
+	var variance float64
+	for _, ratio := range ratios {
+		variance += (ratio - mean) * (ratio - mean)
+	}
+	variance /= float64(len(ratios))
+	return math.Max(0, 1-math.Sqrt(variance)/mean)
+}
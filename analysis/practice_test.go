@@ -0,0 +1,69 @@
+package analysis
+
+import (
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparePerformance_Perfect(t *testing.T) {
+	result := ComparePerformance(scale(60, false), scale(60, false))
+
+	assert.Equal(t, 11, result.MatchedNotes)
+	assert.Equal(t, 1.0, result.NoteAccuracy)
+	assert.Equal(t, 1.0, result.Precision)
+	assert.InDelta(t, 1, result.TempoRatio, 1e-9)
+	assert.InDelta(t, 1, result.TempoStability, 1e-9)
+	assert.InDelta(t, 0, result.MeanTimingDeviationMs, 1e-6)
+	assert.InDelta(t, 100, result.Score, 1e-6)
+	assert.Len(t, result.Measures, 3)
+	assert.Empty(t, result.Missed)
+	assert.Empty(t, result.Extra)
+}
+
+func TestComparePerformance_SlowWithMistakes(t *testing.T) {
+	// The scale at half speed, skipping the sixth note, with a wrong note slipped in and the tenth note late
+	performance := midi.NewFile(division)
+	track := performance.AddTrack("Recording")
+	track.AddTempo(0, 60)
+	steps := []uint8{0, 2, 4, 5, 7, 9, 11, 12, 7, 4, 0}
+	for i, step := range steps {
+		if i == 5 {
+			continue
+		}
+		start := uint32(i * division)
+		if i == 9 {
+			start += division / 4
+		}
+		track.AddNote(0, 60+step, 80, start, start+division)
+	}
+	track.AddNote(0, 61, 60, 5*division/2, 11*division/4)
+
+	result := ComparePerformance(scale(60, false), performance)
+
+	assert.Equal(t, 10, result.MatchedNotes)
+	assert.InDelta(t, 10.0/11, result.NoteAccuracy, 1e-9)
+	assert.InDelta(t, 10.0/11, result.Precision, 1e-9)
+	assert.InDelta(t, 0.5, result.TempoRatio, 0.02)
+	assert.Equal(t, []PracticeNote{{Pitch: 69, Measure: 2, Seconds: 2.5}}, result.Missed)
+	assert.Equal(t, []PracticeNote{{Pitch: 61, Measure: 1, Seconds: 2.5}}, result.Extra)
+
+	assert.Len(t, result.Measures, 3)
+	assert.Equal(t, 3, result.Measures[1].Matched)
+	assert.Equal(t, 4, result.Measures[1].Notes)
+	assert.Greater(t, result.Measures[2].MeanAbsDeviationMs, result.Measures[0].MeanAbsDeviationMs)
+	assert.Less(t, result.TempoStability, 1.0)
+	assert.Less(t, result.Score, 100.0)
+	assert.Greater(t, result.Score, 50.0)
+}
+
+func TestComparePerformance_Empty(t *testing.T) {
+	result := ComparePerformance(scale(60, false), midi.NewFile(division))
+
+	assert.Equal(t, 0, result.MatchedNotes)
+	assert.Len(t, result.Missed, 11)
+	assert.Zero(t, result.NoteAccuracy)
+	assert.Zero(t, result.Score)
+}
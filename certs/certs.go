@@ -0,0 +1,158 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrLoadCertificate = fmt.Errorf("failed to load TLS certificate")
+	ErrLoadClientCAs   = fmt.Errorf("failed to load client CA certificates")
+)
+
+// Reloader serves a certificate and client CA pool read from PEM files, picking up new files while running
+// so that certificates can be rotated, e.g. by cert-manager updating a mounted Secret, without a restart
+type Reloader struct {
+	certFile, keyFile, clientCAFile string
+
+	current atomic.Pointer[material]
+}
+
+// material is everything read from the files at one time
+type material struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// contents of the files it was read from, to notice when they change
+	contents [][]byte
+}
+
+// NewReloader reads the certificate and key, and the client CAs when clientCAFile is set. Without client
+// CAs the server doesn't ask for client certificates.
+func NewReloader(certFile, keyFile, clientCAFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	contents, err := r.readFiles()
+	if err != nil {
+		return nil, err
+	}
+	m, err := r.parse(contents)
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(m)
+	return r, nil
+}
+
+// TLSConfig returns a server config that always uses the latest files. Client certificates are verified
+// against the client CAs when given but not required, so that apps signing in with a password still connect.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			m := r.current.Load()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*m.certificate},
+				// The config returned here replaces the server's, so it offers HTTP/2 again
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+			if m.clientCAs != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = m.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
+
+// Reload reads the files again if they changed. Files that don't form a valid certificate, as happens
+// halfway through a rotation, are rejected and the previous certificate kept.
+func (r *Reloader) Reload() error {
+	contents, err := r.readFiles()
+	if err != nil {
+		return err
+	}
+	if sameContents(contents, r.current.Load().contents) {
+		return nil
+	}
+	m, err := r.parse(contents)
+	if err != nil {
+		return err
+	}
+	r.current.Store(m)
+	event := log.Info().Str("certificate", r.certFile)
+	if m.certificate.Leaf != nil {
+		event = event.Time("notAfter", m.certificate.Leaf.NotAfter)
+	}
+	event.Msg("TLS certificate reloaded")
+	return nil
+}
+
+// Watch calls Reload every interval until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				log.Error().Err(err).Msg("TLS certificate reload failed, keeping the current one")
+			}
+		}
+	}
+}
+
+func (r *Reloader) parse(contents [][]byte) (*material, error) {
+	certificate, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrLoadCertificate, r.certFile, err)
+	}
+	m := &material{certificate: &certificate, contents: contents}
+	if r.clientCAFile != "" {
+		m.clientCAs = x509.NewCertPool()
+		if !m.clientCAs.AppendCertsFromPEM(contents[2]) {
+			return nil, fmt.Errorf("%w: %s: no PEM certificates found", ErrLoadClientCAs, r.clientCAFile)
+		}
+	}
+	return m, nil
+}
+
+func (r *Reloader) readFiles() ([][]byte, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if i == 2 {
+				return nil, fmt.Errorf("%w: %w", ErrLoadClientCAs, err)
+			}
+			return nil, fmt.Errorf("%w: %w", ErrLoadCertificate, err)
+		}
+		contents[i] = data
+	}
+	return contents, nil
+}
+
+func sameContents(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
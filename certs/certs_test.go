@@ -0,0 +1,148 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type keyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issue makes a certificate for name, signed by parent or self-signed when parent is nil
+func issue(t *testing.T, name string, parent *keyPair, serial int64) keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return keyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func write(t *testing.T, path string, data []byte) {
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+func TestReloaderServesTLSAndClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "Test CA", nil, 1)
+	server := issue(t, "localhost", &ca, 2)
+	device := issue(t, "SN-0001", &ca, 3)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	write(t, certFile, server.certPEM)
+	write(t, keyFile, server.keyPEM)
+	write(t, caFile, ca.certPEM)
+
+	reloader, err := NewReloader(certFile, keyFile, caFile)
+	require.NoError(t, err)
+
+	var clientName string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientName = ""
+		if len(r.TLS.VerifiedChains) > 0 {
+			clientName = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+	}))
+	ts.TLS = reloader.TLSConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certificates ...tls.Certificate) *http.Response {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certificates,
+		}}}
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// A password-signed-in app connects without a client certificate
+	resp := get()
+	assert.Equal(t, big.NewInt(2), resp.TLS.PeerCertificates[0].SerialNumber)
+	assert.Equal(t, "", clientName)
+
+	deviceCert, err := tls.X509KeyPair(device.certPEM, device.keyPEM)
+	require.NoError(t, err)
+	get(deviceCert)
+	assert.Equal(t, "SN-0001", clientName)
+
+	// A rotated certificate is served once reloaded
+	rotated := issue(t, "localhost", &ca, 4)
+	write(t, certFile, rotated.certPEM)
+	write(t, keyFile, rotated.keyPEM)
+	require.NoError(t, reloader.Reload())
+	resp = get()
+	assert.Equal(t, big.NewInt(4), resp.TLS.PeerCertificates[0].SerialNumber)
+
+	// Half a rotation is rejected and the last good certificate kept
+	write(t, certFile, server.certPEM)
+	assert.True(t, errors.Is(reloader.Reload(), ErrLoadCertificate))
+	resp = get()
+	assert.Equal(t, big.NewInt(4), resp.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func TestNewReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "Test CA", nil, 1)
+	server := issue(t, "localhost", &ca, 2)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	write(t, certFile, server.certPEM)
+	write(t, keyFile, server.keyPEM)
+
+	_, err := NewReloader(certFile, filepath.Join(dir, "missing.key"), "")
+	assert.True(t, errors.Is(err, ErrLoadCertificate))
+
+	badCA := filepath.Join(dir, "ca.crt")
+	write(t, badCA, []byte("not a certificate"))
+	_, err = NewReloader(certFile, keyFile, badCA)
+	assert.True(t, errors.Is(err, ErrLoadClientCAs))
+}
@@ -0,0 +1,629 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrInvalidConfig = fmt.Errorf("invalid configuration")
+	ErrConfigFile    = fmt.Errorf("failed to read config file")
+)
+
+const (
+	// ConfigFileEnv names the config file when the -config flag isn't given
+	ConfigFileEnv = "CONFIG_FILE"
+	redacted      = "[redacted]"
+	// maxSignedURLExpiry is the longest expiry Cloud Storage accepts for a V4 signed URL
+	maxSignedURLExpiry = 7 * 24 * time.Hour
+	// maxPreviewSeconds matches the longest audio preview the renderer produces
+	maxPreviewSeconds = 60
+)
+
+// Config holds every setting of the server. Load fills it from, in increasing precedence, the defaults,
+// a YAML or TOML file, environment variables and command line flags.
+type Config struct {
+	Server    Server
+	Mongo     Mongo
+	Storage   Storage
+	Preview   Preview
+	Catalog   Catalog
+	Auth      Auth
+	Schedule  Schedule
+	TLS       TLS
+	Log       Log
+	Features  Features
+	Mail      Mail
+	RateLimit RateLimit
+	// File is the config file the settings were read from, if any
+	File string
+}
+
+type Server struct {
+	// Host is the interface to listen on, empty for all of them
+	Host string
+	Port int
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout bound each connection, see http.Server.
+	// WriteTimeout must outlast RequestTimeout, and also caps requests that sign URLs.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish after SIGTERM
+	ShutdownTimeout time.Duration
+	// RequestTimeout bounds the work done for a request that doesn't sign URLs
+	RequestTimeout time.Duration
+	// SignedURLExpiry is both how long signed URLs stay valid and the timeout of requests that mint them
+	SignedURLExpiry time.Duration
+}
+
+type Mongo struct {
+	URI      string
+	Database string
+}
+
+type Storage struct {
+	SongsBucket      string
+	RecordingsBucket string
+}
+
+// Preview is the default audio preview window of uploads, in seconds
+type Preview struct {
+	StartSeconds  float64
+	LengthSeconds float64
+}
+
+type Catalog struct {
+	// DuplicateSimilarity is the default melodic similarity, from 0 to 1, at which songs count as near duplicates
+	DuplicateSimilarity float64
+	SimilarityRefresh   time.Duration
+}
+
+type Auth struct {
+	// AdminAPIKey enables the admin endpoints; they are disabled while it is empty
+	AdminAPIKey string
+	SessionTTL  time.Duration
+	// PairingURL is the app page where a user enters the code a device shows while pairing
+	PairingURL string
+	// AccountURL is the app page that email verification and password reset links open
+	AccountURL string
+	// VerificationTTL and ResetTTL are how long the tokens mailed to verify an address and to reset a password are valid
+	VerificationTTL time.Duration
+	ResetTTL        time.Duration
+	// LoginAttempts and LoginIPAttempts are the failed logins allowed for an account and from an address
+	// before each further failure locks them for LoginBackoff, doubling every time up to LoginLockout
+	LoginAttempts   int
+	LoginIPAttempts int
+	LoginBackoff    time.Duration
+	LoginLockout    time.Duration
+}
+
+type Schedule struct {
+	// Lead is how far ahead scheduled slots are handed to devices
+	Lead time.Duration
+}
+
+// TLS turns on HTTPS when a certificate and key are given. With client CAs as well, devices can present a
+// client certificate naming their serial number instead of signing in. The files are reread when they change.
+type TLS struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Enabled reports whether the server terminates TLS itself
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+type Log struct {
+	// Level is the least severe zerolog level written, e.g. "debug" or "warn"
+	Level string
+}
+
+// Features switch parts of the service off without a redeploy
+type Features struct {
+	Registration bool
+	Uploads      bool
+}
+
+// Mail sends account emails through an SMTP relay. Without an SMTP host they are only logged, and
+// written to OutboxDir when set, for development.
+type Mail struct {
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	// From is the sender, e.g. "MIDI Player <noreply@example.com>"
+	From      string
+	OutboxDir string
+}
+
+// RateLimit caps how often each user, device or, for anonymous requests, IP address calls a group of
+// endpoints. Default applies to every endpoint, the others to their group on top of it.
+type RateLimit struct {
+	// Store is "memory", counting on each replica, or "mongo", counting across replicas
+	Store     string
+	Default   RatePolicy
+	Auth      RatePolicy
+	SignedURL RatePolicy
+	Uploads   RatePolicy
+	// Analysis covers endpoints that compute over the catalog or a whole song, such as search by playing
+	Analysis RatePolicy
+}
+
+// RatePolicy is a token bucket holding Burst requests, refilled at Requests per Period. Written as
+// "60/1m", or "60/1m,20" for a burst other than Requests, or "off"; the zero value is no limit.
+type RatePolicy struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Enabled reports whether the policy limits anything
+func (p RatePolicy) Enabled() bool {
+	return p.Requests > 0
+}
+
+func (p RatePolicy) String() string {
+	if !p.Enabled() {
+		return "off"
+	}
+	value := fmt.Sprintf("%d/%s", p.Requests, p.Period)
+	if p.Burst != p.Requests {
+		value += fmt.Sprintf(",%d", p.Burst)
+	}
+	return value
+}
+
+// ParseRatePolicy reads a policy such as "60/1m", "60/1m,20" or "off"
+func ParseRatePolicy(value string) (RatePolicy, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "off" {
+		return RatePolicy{}, nil
+	}
+	invalid := fmt.Errorf("%q is not a rate such as 60/1m or 60/1m,20", value)
+	rate, burst, hasBurst := strings.Cut(value, ",")
+	requests, period, ok := strings.Cut(rate, "/")
+	if !ok {
+		return RatePolicy{}, invalid
+	}
+	var p RatePolicy
+	var err error
+	if p.Requests, err = strconv.Atoi(strings.TrimSpace(requests)); err != nil || p.Requests <= 0 {
+		return RatePolicy{}, invalid
+	}
+	if p.Period, err = time.ParseDuration(strings.TrimSpace(period)); err != nil || p.Period <= 0 {
+		return RatePolicy{}, invalid
+	}
+	p.Burst = p.Requests
+	if hasBurst {
+		if p.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || p.Burst <= 0 {
+			return RatePolicy{}, invalid
+		}
+	}
+	return p, nil
+}
+
+// setting is one configurable value under each of its names: key in the file, environment variable and flag
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	// reloadable settings take effect on a reload; the others keep their value until a restart
+	reloadable bool
+	set        func(string) error
+	get        func() string
+}
+
+// settings lists every value of the config. Durations given as plain numbers are read in their
+// variable's unit, so existing environments such as SESSION_TTL_MINUTES=10080 keep working.
+func (c *Config) settings() []setting {
+	return []setting{
+		stringSetting("server.host", "HOST", "interface the HTTP server listens on, empty for all", &c.Server.Host),
+		intSetting("server.port", "PORT", "port the HTTP server listens on", &c.Server.Port),
+		durationSetting("server.read_header_timeout", "HTTP_READ_HEADER_TIMEOUT", "time to read request headers", time.Second, &c.Server.ReadHeaderTimeout),
+		durationSetting("server.read_timeout", "HTTP_READ_TIMEOUT", "time to read a whole request", time.Second, &c.Server.ReadTimeout),
+		durationSetting("server.write_timeout", "HTTP_WRITE_TIMEOUT", "time to write a response", time.Second, &c.Server.WriteTimeout),
+		durationSetting("server.idle_timeout", "HTTP_IDLE_TIMEOUT", "time a keep-alive connection may sit idle", time.Second, &c.Server.IdleTimeout),
+		durationSetting("server.shutdown_timeout", "SHUTDOWN_TIMEOUT", "time in-flight requests get to finish on shutdown", time.Second, &c.Server.ShutdownTimeout),
+		reloadable(durationSetting("server.request_timeout", "HTTP_CONTEXT_TIMEOUT", "request timeout", time.Minute, &c.Server.RequestTimeout)),
+		reloadable(durationSetting("server.signed_url_expiry", "SIGNED_URL_EXPIRATION_MINUTES", "signed URL lifetime", time.Minute, &c.Server.SignedURLExpiry)),
+		stringSetting("mongo.uri", "MONGODB_URI", "MongoDB connection string", &c.Mongo.URI),
+		stringSetting("mongo.database", "DATABASE_NAME", "MongoDB database", &c.Mongo.Database),
+		stringSetting("storage.songs_bucket", "DEFAULT_BUCKET_NAME", "bucket holding songs and their derived files", &c.Storage.SongsBucket),
+		stringSetting("storage.recordings_bucket", "RECORDINGS_BUCKET_NAME", "bucket holding device recordings", &c.Storage.RecordingsBucket),
+		reloadable(floatSetting("preview.start_seconds", "PREVIEW_START_SECONDS", "default audio preview start", &c.Preview.StartSeconds)),
+		reloadable(floatSetting("preview.length_seconds", "PREVIEW_LENGTH_SECONDS", "default audio preview length", &c.Preview.LengthSeconds)),
+		reloadable(floatSetting("catalog.duplicate_similarity", "DUPLICATE_SIMILARITY", "melodic similarity of near duplicates, 0 to 1", &c.Catalog.DuplicateSimilarity)),
+		durationSetting("catalog.similarity_refresh", "SIMILARITY_REFRESH_MINUTES", "interval between similar song refreshes", time.Minute, &c.Catalog.SimilarityRefresh),
+		reloadable(secret(stringSetting("auth.admin_api_key", "ADMIN_API_KEY", "key for the admin endpoints, empty to disable them", &c.Auth.AdminAPIKey))),
+		reloadable(durationSetting("auth.session_ttl", "SESSION_TTL_MINUTES", "session lifetime", time.Minute, &c.Auth.SessionTTL)),
+		reloadable(stringSetting("auth.pairing_url", "PAIRING_URL", "app page where users enter device pairing codes", &c.Auth.PairingURL)),
+		reloadable(stringSetting("auth.account_url", "ACCOUNT_URL", "app page that opens email verification and password reset links", &c.Auth.AccountURL)),
+		reloadable(durationSetting("auth.verification_ttl", "VERIFICATION_TTL_HOURS", "lifetime of email verification links", time.Hour, &c.Auth.VerificationTTL)),
+		reloadable(durationSetting("auth.reset_ttl", "PASSWORD_RESET_TTL_MINUTES", "lifetime of password reset links", time.Minute, &c.Auth.ResetTTL)),
+		reloadable(intSetting("auth.login_attempts", "LOGIN_ATTEMPTS", "failed logins allowed for an account before it is locked for a while", &c.Auth.LoginAttempts)),
+		reloadable(intSetting("auth.login_ip_attempts", "LOGIN_IP_ATTEMPTS", "failed logins allowed from an IP address before it is locked for a while", &c.Auth.LoginIPAttempts)),
+		reloadable(durationSetting("auth.login_backoff", "LOGIN_BACKOFF_SECONDS", "first login lock, doubled with each further failure", time.Second, &c.Auth.LoginBackoff)),
+		reloadable(durationSetting("auth.login_lockout", "LOGIN_LOCKOUT_MINUTES", "longest login lock", time.Minute, &c.Auth.LoginLockout)),
+		durationSetting("schedule.lead", "SCHEDULE_LEAD_MINUTES", "how far ahead schedules are sent to devices", time.Minute, &c.Schedule.Lead),
+		stringSetting("tls.cert_file", "TLS_CERT_FILE", "PEM certificate chain, enables HTTPS", &c.TLS.CertFile),
+		stringSetting("tls.key_file", "TLS_KEY_FILE", "PEM private key of the certificate", &c.TLS.KeyFile),
+		stringSetting("tls.client_ca_file", "TLS_CLIENT_CA_FILE", "PEM CAs of device client certificates, enables mutual TLS", &c.TLS.ClientCAFile),
+		reloadable(stringSetting("log.level", "LOG_LEVEL", "least severe log level written: trace, debug, info, warn or error", &c.Log.Level)),
+		reloadable(boolSetting("features.registration", "FEATURE_REGISTRATION", "allow new accounts to register", &c.Features.Registration)),
+		reloadable(boolSetting("features.uploads", "FEATURE_UPLOADS", "allow MIDI uploads", &c.Features.Uploads)),
+		stringSetting("mail.smtp_host", "SMTP_HOST", "SMTP relay for account emails, empty to only log them", &c.Mail.SMTPHost),
+		intSetting("mail.smtp_port", "SMTP_PORT", "port of the SMTP relay", &c.Mail.SMTPPort),
+		stringSetting("mail.smtp_username", "SMTP_USERNAME", "SMTP user name, empty to send without signing in", &c.Mail.SMTPUsername),
+		secret(stringSetting("mail.smtp_password", "SMTP_PASSWORD", "SMTP password", &c.Mail.SMTPPassword)),
+		stringSetting("mail.from", "MAIL_FROM", "sender of account emails", &c.Mail.From),
+		stringSetting("ratelimit.store", "RATE_LIMIT_STORE", "where rate limits are counted: memory, per replica, or mongo, across replicas", &c.RateLimit.Store),
+		reloadable(ratePolicySetting("ratelimit.default", "RATE_LIMIT_DEFAULT", "rate limit of every endpoint", &c.RateLimit.Default)),
+		reloadable(ratePolicySetting("ratelimit.auth", "RATE_LIMIT_AUTH", "rate limit of registration, login, password reset and pairing", &c.RateLimit.Auth)),
+		reloadable(ratePolicySetting("ratelimit.signed_url", "RATE_LIMIT_SIGNED_URL", "rate limit of endpoints that sign URLs", &c.RateLimit.SignedURL)),
+		reloadable(ratePolicySetting("ratelimit.uploads", "RATE_LIMIT_UPLOADS", "rate limit of MIDI uploads", &c.RateLimit.Uploads)),
+		reloadable(ratePolicySetting("ratelimit.analysis", "RATE_LIMIT_ANALYSIS", "rate limit of search by playing, similar songs and MusicXML export", &c.RateLimit.Analysis)),
+		stringSetting("mail.outbox_dir", "MAIL_OUTBOX_DIR", "directory logged emails are also written to when there is no SMTP host", &c.Mail.OutboxDir),
+	}
+}
+
+// Default returns the configuration used when nothing is set
+func Default() Config {
+	return Config{
+		Server: Server{
+			Port:              8080,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      6 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   25 * time.Second,
+			RequestTimeout:    2 * time.Minute,
+			SignedURLExpiry:   5 * time.Minute,
+		},
+		Mongo:   Mongo{URI: "mongodb://mongodb-service:27017", Database: "testdb"},
+		Storage: Storage{SongsBucket: "midi_file_storage", RecordingsBucket: "midi_recordings"},
+		Preview: Preview{StartSeconds: 0, LengthSeconds: 30},
+		Catalog: Catalog{DuplicateSimilarity: 0.8, SimilarityRefresh: time.Hour},
+		Auth: Auth{
+			SessionTTL:      7 * 24 * time.Hour,
+			VerificationTTL: 48 * time.Hour,
+			ResetTTL:        30 * time.Minute,
+			LoginAttempts:   5,
+			LoginIPAttempts: 50,
+			LoginBackoff:    time.Second,
+			LoginLockout:    15 * time.Minute,
+		},
+		Schedule: Schedule{Lead: 10 * time.Minute},
+		Log:      Log{Level: "info"},
+		Features: Features{Registration: true, Uploads: true},
+		Mail:     Mail{SMTPPort: 587, From: "MIDI File Server <noreply@localhost>"},
+		RateLimit: RateLimit{
+			Store:     "memory",
+			Default:   RatePolicy{Requests: 600, Period: time.Minute, Burst: 120},
+			Auth:      RatePolicy{Requests: 30, Period: time.Minute, Burst: 10},
+			SignedURL: RatePolicy{Requests: 60, Period: time.Minute, Burst: 20},
+			Uploads:   RatePolicy{Requests: 30, Period: time.Hour, Burst: 10},
+			Analysis:  RatePolicy{Requests: 30, Period: time.Minute, Burst: 10},
+		},
+	}
+}
+
+// Load reads the configuration from a file, named by the -config flag or CONFIG_FILE, then the environment
+// and then the other flags, each overriding the last. Every problem found, in any source, is reported
+// together in one error wrapping ErrInvalidConfig.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	c := Default()
+	settings := c.settings()
+
+	flags := flag.NewFlagSet("midi-file-server", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configFile := flags.String("config", "", "YAML or TOML config file (env "+ConfigFileEnv+")")
+	values := make([]*string, len(settings))
+	for i, s := range settings {
+		values[i] = flags.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return c, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	var errs []error
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(ConfigFileEnv)
+	}
+	c.File = *configFile
+	if *configFile != "" {
+		fileValues, err := readFile(*configFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		byKey := map[string]setting{}
+		for _, s := range settings {
+			byKey[s.key] = s
+		}
+		keys := make([]string, 0, len(fileValues))
+		for key := range fileValues {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s, ok := byKey[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %s", *configFile, key))
+				continue
+			}
+			if err := s.set(fileValues[key]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", *configFile, key, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env); ok {
+			if err := s.set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for i, s := range settings {
+		if set[s.flag] {
+			if err := s.set(*values[i]); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", s.flag, err))
+			}
+		}
+	}
+
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return c, fmt.Errorf("%w:\n%w", ErrInvalidConfig, errors.Join(errs...))
+	}
+	return c, nil
+}
+
+// Address is the host:port the HTTP server listens on
+func (s Server) Address() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// Usage describes the flags and the environment variables they stand for
+func Usage() string {
+	var c Config
+	var b strings.Builder
+	b.WriteString("Usage of midi-file-server:\n  -config string\n    \tYAML or TOML config file (env " + ConfigFileEnv + ")\n")
+	for _, s := range c.settings() {
+		reload := ""
+		if s.reloadable {
+			reload = ", reloadable"
+		}
+		fmt.Fprintf(&b, "  -%s string\n    \t%s (env %s, file key %s%s)\n", s.flag, s.usage, s.env, s.key, reload)
+	}
+	return b.String()
+}
+
+// validate checks the values make sense together, returning every problem
+func (c Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535")
+	check(c.Server.RequestTimeout > 0, "server.request_timeout must be positive")
+	check(c.Server.SignedURLExpiry > 0 && c.Server.SignedURLExpiry <= maxSignedURLExpiry, "server.signed_url_expiry must be positive and at most %s", maxSignedURLExpiry)
+	check(c.Server.ReadHeaderTimeout > 0, "server.read_header_timeout must be positive")
+	check(c.Server.ReadTimeout >= c.Server.ReadHeaderTimeout, "server.read_timeout must be at least server.read_header_timeout")
+	check(c.Server.WriteTimeout > c.Server.RequestTimeout, "server.write_timeout must be longer than server.request_timeout")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	if uri, err := url.Parse(c.Mongo.URI); err != nil || (uri.Scheme != "mongodb" && uri.Scheme != "mongodb+srv") {
+		errs = append(errs, fmt.Errorf("mongo.uri must be a mongodb:// or mongodb+srv:// connection string"))
+	}
+	check(c.Mongo.Database != "", "mongo.database must be set")
+	check(c.Storage.SongsBucket != "", "storage.songs_bucket must be set")
+	check(c.Storage.RecordingsBucket != "", "storage.recordings_bucket must be set")
+	check(c.Preview.StartSeconds >= 0, "preview.start_seconds must not be negative")
+	check(c.Preview.LengthSeconds > 0 && c.Preview.LengthSeconds <= maxPreviewSeconds, "preview.length_seconds must be positive and at most %d", maxPreviewSeconds)
+	check(c.Catalog.DuplicateSimilarity > 0 && c.Catalog.DuplicateSimilarity <= 1, "catalog.duplicate_similarity must be above 0 and at most 1")
+	check(c.Catalog.SimilarityRefresh > 0, "catalog.similarity_refresh must be positive")
+	check(c.Auth.SessionTTL > 0, "auth.session_ttl must be positive")
+	if c.Auth.PairingURL != "" {
+		if uri, err := url.Parse(c.Auth.PairingURL); err != nil || !uri.IsAbs() {
+			errs = append(errs, fmt.Errorf("auth.pairing_url must be an absolute URL"))
+		}
+	}
+	if c.Auth.AccountURL != "" {
+		if uri, err := url.Parse(c.Auth.AccountURL); err != nil || !uri.IsAbs() {
+			errs = append(errs, fmt.Errorf("auth.account_url must be an absolute URL"))
+		}
+	}
+	check(c.Auth.VerificationTTL > 0, "auth.verification_ttl must be positive")
+	// Reset links stand in for the password, so they must not outlive an inbox left open for long
+	check(c.Auth.ResetTTL > 0 && c.Auth.ResetTTL <= 24*time.Hour, "auth.reset_ttl must be positive and at most 24h")
+	check(c.Auth.LoginAttempts > 0, "auth.login_attempts must be positive")
+	check(c.Auth.LoginIPAttempts > 0, "auth.login_ip_attempts must be positive")
+	check(c.Auth.LoginBackoff > 0, "auth.login_backoff must be positive")
+	check(c.Auth.LoginLockout >= c.Auth.LoginBackoff, "auth.login_lockout must be at least auth.login_backoff")
+	check(c.Schedule.Lead > 0, "schedule.lead must be positive")
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(c.TLS.ClientCAFile == "" || c.TLS.Enabled(), "tls.client_ca_file needs tls.cert_file and tls.key_file")
+	check(c.Mail.SMTPPort > 0 && c.Mail.SMTPPort < 65536, "mail.smtp_port must be between 1 and 65535")
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		errs = append(errs, fmt.Errorf("mail.from must be an email address, e.g. \"MIDI Player <noreply@example.com>\""))
+	}
+	check(c.Mail.SMTPPassword == "" || c.Mail.SMTPUsername != "", "mail.smtp_password needs mail.smtp_username")
+	check(c.RateLimit.Store == "memory" || c.RateLimit.Store == "mongo", "ratelimit.store must be memory or mongo")
+	_, err := zerolog.ParseLevel(c.Log.Level)
+	check(c.Log.Level != "" && err == nil, "log.level must be one of trace, debug, info, warn, error, fatal, panic or disabled")
+	return errs
+}
+
+// Redacted returns every setting by file key with secrets hidden, for logging at startup.
+// The password of the MongoDB connection string is hidden too.
+func (c Config) Redacted() map[string]string {
+	values := map[string]string{}
+	for _, s := range c.settings() {
+		value := s.get()
+		switch {
+		case s.secret && value != "":
+			value = redacted
+		case s.key == "mongo.uri":
+			if uri, err := url.Parse(value); err == nil {
+				value = uri.Redacted()
+			} else {
+				value = redacted
+			}
+		}
+		values[s.key] = value
+	}
+	return values
+}
+
+// readFile flattens a YAML or TOML file into dotted keys, e.g. "server.port"
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConfigFile, err)
+	}
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		values, err = parseYAML(data)
+	case ".toml":
+		values, err = parseTOML(data)
+	default:
+		return nil, fmt.Errorf("%w: %s: expected a .yaml, .yml, .json or .toml file", ErrConfigFile, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrConfigFile, path, err)
+	}
+	return values, nil
+}
+
+func secret(s setting) setting {
+	s.secret = true
+	return s
+}
+
+func reloadable(s setting) setting {
+	s.reloadable = true
+	return s
+}
+
+func newSetting(key, env, usage string, set func(string) error, get func() string) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		flag:  strings.ReplaceAll(strings.ReplaceAll(key, ".", "-"), "_", "-"),
+		usage: usage,
+		set:   set,
+		get:   get,
+	}
+}
+
+func stringSetting(key, env, usage string, target *string) setting {
+	return newSetting(key, env, usage,
+		func(value string) error { *target = value; return nil },
+		func() string { return *target })
+}
+
+func intSetting(key, env, usage string, target *int) setting {
+	return newSetting(key, env, usage,
+		func(value string) error {
+			parsed, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("%q is not a whole number", value)
+			}
+			*target = parsed
+			return nil
+		},
+		func() string { return strconv.Itoa(*target) })
+}
+
+func floatSetting(key, env, usage string, target *float64) setting {
+	return newSetting(key, env, usage,
+		func(value string) error {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", value)
+			}
+			*target = parsed
+			return nil
+		},
+		func() string { return strconv.FormatFloat(*target, 'f', -1, 64) })
+}
+
+func boolSetting(key, env, usage string, target *bool) setting {
+	return newSetting(key, env, usage+" (true or false)",
+		func(value string) error {
+			parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("%q is not true or false", value)
+			}
+			*target = parsed
+			return nil
+		},
+		func() string { return strconv.FormatBool(*target) })
+}
+
+// durationSetting accepts Go durations such as "90s" or "2h", or a plain number of unit
+func durationSetting(key, env, usage string, unit time.Duration, target *time.Duration) setting {
+	return newSetting(key, env, usage+" ("+unitName(unit)+" or a duration such as 90s)",
+		func(value string) error {
+			value = strings.TrimSpace(value)
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				*target = time.Duration(number * float64(unit))
+				return nil
+			}
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a duration", value)
+			}
+			*target = parsed
+			return nil
+		},
+		func() string { return target.String() })
+}
+
+// ratePolicySetting accepts a RatePolicy written as "60/1m", "60/1m,20" or "off"
+func ratePolicySetting(key, env, usage string, target *RatePolicy) setting {
+	return newSetting(key, env, usage+" (requests/period[,burst] such as 60/1m, or off)",
+		func(value string) error {
+			parsed, err := ParseRatePolicy(value)
+			if err != nil {
+				return err
+			}
+			*target = parsed
+			return nil
+		},
+		func() string { return target.String() })
+}
+
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Second:
+		return "seconds"
+	case time.Minute:
+		return "minutes"
+	}
+	return unit.String()
+}
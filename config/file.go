@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// parseYAML reads nested mappings of scalars, which also covers JSON
+func parseYAML(data []byte) (map[string]string, error) {
+	var document map[string]any
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if err := flatten("", document, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func flatten(prefix string, node map[string]any, values map[string]string) error {
+	for key, value := range node {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flatten(key, v, values); err != nil {
+				return err
+			}
+		case []any:
+			return fmt.Errorf("%s: lists are not supported", key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// parseTOML reads a TOML document; its tables flatten like YAML mappings
+func parseTOML(data []byte) (map[string]string, error) {
+	var document map[string]any
+	if err := toml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if err := flatten("", document, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
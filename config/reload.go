@@ -0,0 +1,138 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrReloadRejected = fmt.Errorf("configuration reload rejected")
+
+// Reload triggers, as recorded in the audit log
+const (
+	TriggerSignal = "SIGHUP"
+	TriggerFile   = "file-change"
+)
+
+// Store holds the running configuration. Handlers read it per request through Current, and a reload
+// swaps in a new one as a whole, so a request never sees half of one configuration and half of another.
+type Store struct {
+	current atomic.Pointer[Config]
+	load    func() (Config, error)
+	// contents is the config file as it was when the store was created, for Watch to compare against
+	contents []byte
+	// reloading serialises reloads so that they are applied in the order they were triggered
+	reloading sync.Mutex
+}
+
+// NewStore starts from a loaded configuration. load is called again on every reload, usually
+// Load with the process's arguments and environment.
+func NewStore(c Config, load func() (Config, error)) *Store {
+	s := &Store{load: load}
+	s.contents, _ = os.ReadFile(c.File)
+	s.current.Store(&c)
+	ApplyLogLevel(c)
+	return s
+}
+
+// Current returns the configuration in effect. It must not be modified.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Reload loads the configuration again and applies the settings that can change while running.
+// An invalid configuration is rejected as a whole and the running one kept. Changes to settings that
+// need a restart are ignored with a warning. Every attempt is written to the log for auditing.
+func (s *Store) Reload(trigger string) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	next, err := s.load()
+	if err != nil {
+		log.Error().Err(err).Str("trigger", trigger).Msg("Configuration reload rejected")
+		return fmt.Errorf("%w: %w", ErrReloadRejected, err)
+	}
+
+	previous := s.Current()
+	applied := *previous
+	before := previous.Redacted()
+	var restart []string
+	nextSettings := next.settings()
+	for i, setting := range applied.settings() {
+		value := nextSettings[i].get()
+		switch {
+		case value == setting.get():
+		case setting.reloadable:
+			// The value was produced by the same setting, so it always parses
+			_ = setting.set(value)
+		default:
+			restart = append(restart, setting.key)
+		}
+	}
+
+	after := applied.Redacted()
+	changes := map[string]string{}
+	for key, value := range after {
+		if before[key] != value {
+			changes[key] = fmt.Sprintf("%s -> %s", before[key], value)
+		}
+	}
+	s.current.Store(&applied)
+	ApplyLogLevel(applied)
+
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		log.Warn().Str("trigger", trigger).Strs("settings", restart).Msg("Configuration changes need a restart to take effect")
+	}
+	log.Info().Str("trigger", trigger).Interface("changes", changes).Msg("Configuration reloaded")
+	return nil
+}
+
+// Watch reloads on SIGHUP and whenever the config file's contents change, checking it every interval.
+// Polling the contents rather than watching for events also catches a Kubernetes ConfigMap update,
+// which swaps a symlink above the file. It returns when ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	path, contents := s.Current().File, s.contents
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			_ = s.Reload(TriggerSignal)
+		case <-ticker.C:
+			if path == "" {
+				continue
+			}
+			latest, err := os.ReadFile(path)
+			if err != nil || bytes.Equal(latest, contents) {
+				continue
+			}
+			contents = latest
+			_ = s.Reload(TriggerFile)
+		}
+	}
+}
+
+// ApplyLogLevel sets the global zerolog level from the configuration
+func ApplyLogLevel(c Config) {
+	if level, err := zerolog.ParseLevel(c.Log.Level); err == nil {
+		zerolog.SetGlobalLevel(level)
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fileStore(t *testing.T, content string) (*Store, string) {
+	path := writeFile(t, "config.yaml", content)
+	load := func() (Config, error) { return Load([]string{"-config", path}, env(nil)) }
+	cfg, err := load()
+	require.NoError(t, err)
+
+	level := zerolog.GlobalLevel()
+	t.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+	return NewStore(cfg, load), path
+}
+
+func TestReloadAppliesReloadableSettings(t *testing.T) {
+	store, path := fileStore(t, `
+server:
+  port: 9000
+  signed_url_expiry: 5m
+features:
+  registration: true
+`)
+	require.NoError(t, os.WriteFile(path, []byte(`
+server:
+  port: 9001
+  signed_url_expiry: 20m
+log:
+  level: warn
+features:
+  registration: false
+`), 0o600))
+
+	require.NoError(t, store.Reload(TriggerSignal))
+	cfg := store.Current()
+	assert.Equal(t, 20*time.Minute, cfg.Server.SignedURLExpiry)
+	assert.False(t, cfg.Features.Registration)
+	assert.Equal(t, "warn", cfg.Log.Level)
+	assert.Equal(t, zerolog.WarnLevel, zerolog.GlobalLevel())
+	assert.Equal(t, 9000, cfg.Server.Port, "the port needs a restart")
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	store, path := fileStore(t, "server:\n  signed_url_expiry: 5m\n")
+	before := store.Current()
+
+	require.NoError(t, os.WriteFile(path, []byte("server:\n  signed_url_expiry: 10m\nlog:\n  level: loud\n"), 0o600))
+	err := store.Reload(TriggerFile)
+	assert.True(t, errors.Is(err, ErrReloadRejected))
+	assert.Contains(t, err.Error(), "log.level")
+	assert.Same(t, before, store.Current(), "nothing of an invalid config is applied")
+}
+
+func TestWatchReloadsChangedFile(t *testing.T) {
+	store, path := fileStore(t, "server:\n  request_timeout: 1m\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		store.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	require.NoError(t, os.WriteFile(path, []byte("server:\n  request_timeout: 3m\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		return store.Current().Server.RequestTimeout == 3*time.Minute
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,212 @@
+package lyrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"midi-file-server/midi"
+)
+
+const (
+	// lineHold is how long a line stays up after its last syllable when nothing follows straight away
+	lineHold = 4.0
+	// minTextSyllables is how many text events a track needs before they are taken for karaoke lyrics
+	minTextSyllables = 8
+	// MaxSyllables and MaxSyllableBytes bound the lyrics kept with a song; text past them is dropped
+	MaxSyllables     = 4000
+	MaxSyllableBytes = 64
+)
+
+// Lyrics is the timed text of a song, in lines of syllables. Times are in seconds from the start of the file.
+// Concatenating a line's syllables gives its text, so a screen can highlight each one as it is sung.
+type Lyrics struct {
+	Lines []Line `json:"lines" bson:"lines"`
+}
+
+type Line struct {
+	Start     float64    `json:"start" bson:"start"`
+	End       float64    `json:"end" bson:"end"`
+	Text      string     `json:"text" bson:"text"`
+	Syllables []Syllable `json:"syllables" bson:"syllables"`
+}
+
+type Syllable struct {
+	Start float64 `json:"start" bson:"start"`
+	End   float64 `json:"end" bson:"end"`
+	Text  string  `json:"text" bson:"text"`
+}
+
+type syllable struct {
+	tick uint32
+	text string
+}
+
+// Extract reads the lyrics of a file. Lyric meta events are used when present, from the track with the
+// most of them; otherwise the text events of a karaoke (.kar) lyrics track, skipping its "@" header lines.
+// Lines break at carriage returns and newlines inside the events and before events starting with "/" or "\".
+// When the syllables carry no spaces of their own, words are spaced apart except after a trailing hyphen.
+func Extract(file *midi.File) Lyrics {
+	lines := splitLines(lyricEvents(file))
+	tempoMap := file.TempoMap()
+	duration := file.Duration()
+
+	result := Lyrics{Lines: []Line{}}
+	for i, line := range lines {
+		var l Line
+		for _, s := range line {
+			l.Syllables = append(l.Syllables, Syllable{Start: tempoMap.Seconds(s.tick), Text: s.text})
+		}
+		last := l.Syllables[len(l.Syllables)-1].Start
+		l.Start = l.Syllables[0].Start
+		l.End = math.Max(last, math.Min(duration, last+lineHold))
+		if i+1 < len(lines) {
+			l.End = math.Min(l.End, tempoMap.Seconds(lines[i+1][0].tick))
+		}
+		for k := range l.Syllables {
+			l.Syllables[k].End = l.End
+			if k+1 < len(l.Syllables) {
+				l.Syllables[k].End = l.Syllables[k+1].Start
+			}
+			l.Text += l.Syllables[k].Text
+		}
+		l.Text = strings.TrimSpace(l.Text)
+		result.Lines = append(result.Lines, l)
+	}
+	return result
+}
+
+// lyricEvents returns the lyric syllables of the best track in tick order
+func lyricEvents(file *midi.File) []midi.Event {
+	for _, metaType := range []byte{midi.MetaLyric, midi.MetaText} {
+		var best []midi.Event
+		for _, track := range file.Tracks {
+			var events []midi.Event
+			for _, event := range track.Events {
+				if event.Type != midi.Meta || event.MetaType != metaType {
+					continue
+				}
+				if metaType == midi.MetaText && strings.HasPrefix(string(event.Data), "@") {
+					continue
+				}
+				events = append(events, event)
+			}
+			if len(events) > len(best) {
+				best = events
+			}
+		}
+		if (metaType == midi.MetaLyric && len(best) > 0) || len(best) >= minTextSyllables {
+			return best
+		}
+	}
+	return nil
+}
+
+// splitLines breaks the events into lines of non-empty syllables and fixes up their spacing.
+// Only the first MaxSyllables syllables are kept, each cut to MaxSyllableBytes.
+func splitLines(events []midi.Event) [][]syllable {
+	var lines [][]syllable
+	var current []syllable
+	count := 0
+	endLine := func() {
+		if len(current) > 0 {
+			lines = append(lines, current)
+			current = nil
+		}
+	}
+	spaced := false
+	for _, event := range events {
+		text := strings.TrimRight(string(event.Data), "\x00")
+		if strings.HasPrefix(text, "/") || strings.HasPrefix(text, "\\") {
+			endLine()
+			text = text[1:]
+		}
+		text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+		for k, piece := range strings.Split(text, "\n") {
+			if k > 0 {
+				endLine()
+			}
+			if strings.TrimSpace(piece) == "" || count >= MaxSyllables {
+				continue
+			}
+			if len(piece) > MaxSyllableBytes {
+				piece = strings.ToValidUTF8(piece[:MaxSyllableBytes], "")
+			}
+			count++
+			spaced = spaced || strings.ContainsRune(piece, ' ')
+			current = append(current, syllable{tick: event.Tick, text: piece})
+		}
+	}
+	endLine()
+
+	if !spaced {
+		for _, line := range lines {
+			for k := range line {
+				if hyphenated := strings.TrimSuffix(line[k].text, "-"); hyphenated != line[k].text {
+					line[k].text = hyphenated
+				} else if k+1 < len(line) {
+					line[k].text += " "
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// LRC formats the lyrics as an enhanced LRC file: a timestamp per line, word timestamps inside lines of
+// more than one syllable, and an empty line to clear the screen when a line ends before the next begins
+func (l Lyrics) LRC(title string) string {
+	var b strings.Builder
+	if title != "" {
+		fmt.Fprintf(&b, "[ti:%s]\n", title)
+	}
+	for i, line := range l.Lines {
+		fmt.Fprintf(&b, "[%s]", lrcTime(line.Start))
+		for k, s := range line.Syllables {
+			if len(line.Syllables) > 1 {
+				fmt.Fprintf(&b, "<%s>", lrcTime(s.Start))
+			}
+			if k == len(line.Syllables)-1 {
+				b.WriteString(strings.TrimRight(s.Text, " "))
+			} else {
+				b.WriteString(s.Text)
+			}
+		}
+		b.WriteString("\n")
+		if i+1 == len(l.Lines) || l.Lines[i+1].Start > line.End {
+			fmt.Fprintf(&b, "[%s]\n", lrcTime(line.End))
+		}
+	}
+	return b.String()
+}
+
+// WebVTT formats the lyrics as WebVTT cues, one per line, with karaoke timestamps before each later syllable
+func (l Lyrics) WebVTT() string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i, line := range l.Lines {
+		fmt.Fprintf(&b, "\n%d\n%s --> %s\n", i+1, vttTime(line.Start), vttTime(line.End))
+		for k, s := range line.Syllables {
+			if k > 0 && s.Start > line.Start {
+				fmt.Fprintf(&b, "<%s>", vttTime(s.Start))
+			}
+			b.WriteString(vttEscaper.Replace(s.Text))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// lrcTime formats seconds as mm:ss.xx
+func lrcTime(seconds float64) string {
+	hundredths := int(math.Round(seconds * 100))
+	return fmt.Sprintf("%02d:%02d.%02d", hundredths/6000, hundredths/100%60, hundredths%100)
+}
+
+// vttTime formats seconds as hh:mm:ss.ttt
+func vttTime(seconds float64) string {
+	millis := int(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
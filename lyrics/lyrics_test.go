@@ -0,0 +1,90 @@
+package lyrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const division = 96
+
+// song has one syllable per beat at 120 BPM, so each beat is half a second
+func song(metaType byte, syllables ...string) *midi.Track {
+	file := midi.NewFile(division)
+	track := file.AddTrack("Vocals")
+	track.AddTempo(0, 120)
+	for i, text := range syllables {
+		start := uint32(i * division)
+		track.AddMeta(start, metaType, []byte(text))
+		track.AddNote(0, 60, 80, start, start+division)
+	}
+	return track
+}
+
+// parsed encodes and parses the file, as a stored song would be, so its events are in tick order
+func parsed(t *testing.T, track *midi.Track) *midi.File {
+	file := midi.NewFile(division)
+	file.Tracks = append(file.Tracks, *track)
+	result, err := midi.Parse(bytes.NewReader(file.Encode()))
+	assert.NoError(t, err)
+	return result
+}
+
+func TestExtract_LyricEvents(t *testing.T) {
+	track := song(midi.MetaLyric, "Hel-", "lo", "world\r", "Good-", "bye")
+	track.AddMeta(0, midi.MetaText, []byte("Sequenced by someone"))
+
+	lyrics := Extract(parsed(t, track))
+	assert.Len(t, lyrics.Lines, 2)
+	first := lyrics.Lines[0]
+	assert.Equal(t, "Hello world", first.Text)
+	assert.Equal(t, []Syllable{{0, 0.5, "Hel"}, {0.5, 1, "lo "}, {1, 1.5, "world"}}, first.Syllables)
+	assert.Equal(t, 1.5, first.End)
+	assert.Equal(t, "Goodbye", lyrics.Lines[1].Text)
+	// The last line is held until the end of the file
+	assert.Equal(t, 2.5, lyrics.Lines[1].End)
+}
+
+func TestExtract_Karaoke(t *testing.T) {
+	track := song(midi.MetaText, "@KMIDI KARAOKE FILE", "@TSong", "\\Twin", "kle ", "twin", "kle ", "/lit", "tle ", "star", "\\How ", "I ", "won", "der")
+	lyrics := Extract(parsed(t, track))
+	assert.Len(t, lyrics.Lines, 3)
+	assert.Equal(t, "Twinkle twinkle", lyrics.Lines[0].Text)
+	assert.Equal(t, "little star", lyrics.Lines[1].Text)
+	assert.Equal(t, "How I wonder", lyrics.Lines[2].Text)
+	assert.Equal(t, 1.0, lyrics.Lines[0].Start)
+
+	// A few text events are comments, not lyrics
+	assert.Empty(t, Extract(parsed(t, song(midi.MetaText, "Verse", "Chorus"))).Lines)
+}
+
+func TestSplitLines_Limits(t *testing.T) {
+	events := []midi.Event{{Data: []byte(strings.Repeat("la", MaxSyllableBytes) + "\n")}}
+	for i := 0; i < MaxSyllables+10; i++ {
+		events = append(events, midi.Event{Tick: uint32(i + 1), Data: []byte("la\n")})
+	}
+	lines := splitLines(events)
+	assert.Len(t, lines, MaxSyllables)
+	assert.Len(t, lines[0][0].text, MaxSyllableBytes)
+}
+
+func TestFormats(t *testing.T) {
+	lyrics := Lyrics{Lines: []Line{
+		{Start: 1, End: 2, Text: "Rock & roll", Syllables: []Syllable{{1, 1.5, "Rock "}, {1.5, 2, "& roll"}}},
+		{Start: 65.25, End: 67, Text: "Yeah", Syllables: []Syllable{{65.25, 67, "Yeah"}}},
+	}}
+
+	assert.Equal(t, "[ti:Song]\n"+
+		"[00:01.00]<00:01.00>Rock <00:01.50>& roll\n"+
+		"[00:02.00]\n"+
+		"[01:05.25]Yeah\n"+
+		"[01:07.00]\n", lyrics.LRC("Song"))
+
+	assert.Equal(t, "WEBVTT\n"+
+		"\n1\n00:00:01.000 --> 00:00:02.000\nRock <00:00:01.500>&amp; roll\n"+
+		"\n2\n00:01:05.250 --> 00:01:07.000\nYeah\n", lyrics.WebVTT())
+}
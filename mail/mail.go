@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"midi-file-server/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidMessage = fmt.Errorf("invalid mail message")
+	ErrSendMail       = fmt.Errorf("failed to send mail")
+)
+
+// Message is a plain text email to one recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends account emails, such as address verification and password reset links
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns an SMTPMailer when an SMTP host is configured and a LogMailer otherwise
+func New(cfg config.Mail) Mailer {
+	if cfg.SMTPHost == "" {
+		log.Warn().Str("outbox", cfg.OutboxDir).Msg("No SMTP host configured, mail is only logged")
+		return NewLogMailer(cfg.From, cfg.OutboxDir)
+	}
+	return NewSMTPMailer(cfg)
+}
+
+// SMTPMailer delivers mail through an SMTP relay, upgrading to TLS with STARTTLS when the server offers it.
+// Credentials are only sent over TLS, or to localhost.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+func NewSMTPMailer(cfg config.Mail) *SMTPMailer {
+	return &SMTPMailer{host: cfg.SMTPHost, port: cfg.SMTPPort, username: cfg.SMTPUsername, password: cfg.SMTPPassword, from: cfg.From}
+}
+
+// Send delivers msg, giving up when ctx is done
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := compose(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.host, strconv.Itoa(m.port)))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("%w: %w", ErrSendMail, err)
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("%w: %w", ErrSendMail, err)
+		}
+	}
+	if err := client.Mail(addressOf(m.from)); err != nil {
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	body, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	if _, err := body.Write(data); err != nil {
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	if err := body.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrSendMail, err)
+	}
+	return client.Quit()
+}
+
+// LogMailer logs each message instead of sending it, and also writes it to an .eml file when it has a
+// directory. It is meant for development and tests: the log holds the message body, links included.
+type LogMailer struct {
+	from string
+	dir  string
+}
+
+func NewLogMailer(from, dir string) *LogMailer {
+	return &LogMailer{from: from, dir: dir}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	data, err := compose(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	event := log.Info().Str("to", msg.To).Str("subject", msg.Subject).Str("body", msg.Body)
+	if m.dir != "" {
+		name := filepath.Join(m.dir, fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), randomSuffix()))
+		if err := os.WriteFile(name, data, 0o600); err != nil {
+			return fmt.Errorf("%w: %w", ErrSendMail, err)
+		}
+		event = event.Str("file", name)
+	}
+	event.Msg("Mail not sent, logged instead")
+	return nil
+}
+
+// compose formats msg as an RFC 5322 message with a quoted-printable UTF-8 body
+func compose(from string, msg Message, now time.Time) ([]byte, error) {
+	if _, err := mail.ParseAddress(msg.To); err != nil {
+		return nil, fmt.Errorf("%w: recipient %q: %w", ErrInvalidMessage, msg.To, err)
+	}
+	// A line break in a header would let the value add headers of its own
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, fmt.Errorf("%w: header contains a line break", ErrInvalidMessage)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	body := quotedprintable.NewWriter(&b)
+	if _, err := body.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// addressOf returns the bare address of a From such as "MIDI Player <noreply@example.com>"
+func addressOf(from string) string {
+	if address, err := mail.ParseAddress(from); err == nil {
+		return address.Address
+	}
+	return from
+}
+
+func randomSuffix() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
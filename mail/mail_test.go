@@ -0,0 +1,124 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"midi-file-server/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompose(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	data, err := compose("MIDI Player <noreply@example.com>", Message{To: "ann@example.com", Subject: "Réinitialiser", Body: "Open:\nhttps://example.com/account?token=abc"}, now)
+	require.NoError(t, err)
+	text := string(data)
+	assert.Contains(t, text, "From: MIDI Player <noreply@example.com>\r\n")
+	assert.Contains(t, text, "To: ann@example.com\r\n")
+	assert.Contains(t, text, "Subject: =?utf-8?q?R=C3=A9initialiser?=\r\n")
+	assert.Contains(t, text, "Date: Thu, 01 Oct 2026 12:00:00 +0000\r\n")
+	assert.Contains(t, text, "\r\n\r\nOpen:\r\nhttps://example.com/account?token=3Dabc")
+
+	_, err = compose("noreply@example.com", Message{To: "ann@example.com", Subject: "Hi\r\nBcc: eve@example.com"}, now)
+	assert.True(t, errors.Is(err, ErrInvalidMessage))
+	_, err = compose("noreply@example.com", Message{To: "not an address"}, now)
+	assert.True(t, errors.Is(err, ErrInvalidMessage))
+}
+
+func TestLogMailerWritesOutbox(t *testing.T) {
+	dir := t.TempDir()
+	mailer := NewLogMailer("noreply@example.com", dir)
+	require.NoError(t, mailer.Send(context.Background(), Message{To: "ann@example.com", Subject: "Verify", Body: "Code: 123"}))
+	require.NoError(t, mailer.Send(context.Background(), Message{To: "bob@example.com", Subject: "Verify", Body: "Code: 456"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Code: 123")
+}
+
+// fakeSMTP accepts one message without TLS or authentication and returns what was sent
+func fakeSMTP(t *testing.T) (string, int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var transcript strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return host, portNumber, received
+}
+
+func TestSMTPMailerSends(t *testing.T) {
+	host, port, received := fakeSMTP(t)
+	mailer := New(config.Mail{SMTPHost: host, SMTPPort: port, From: "MIDI Player <noreply@example.com>"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, mailer.Send(ctx, Message{To: "ann@example.com", Subject: "Reset your password", Body: "Code: 123"}))
+
+	transcript := <-received
+	assert.Contains(t, transcript, "MAIL FROM:<noreply@example.com>")
+	assert.Contains(t, transcript, "RCPT TO:<ann@example.com>")
+	assert.Contains(t, transcript, "Subject: Reset your password\r\n")
+	assert.Contains(t, transcript, "Code: 123")
+}
+
+func TestNewWithoutSMTPHostLogs(t *testing.T) {
+	_, ok := New(config.Mail{From: "noreply@example.com"}).(*LogMailer)
+	assert.True(t, ok)
+}
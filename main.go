@@ -3,11 +3,19 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"midi-file-server/certs"
+	"midi-file-server/config"
+	"midi-file-server/mail"
 	mongodb "midi-file-server/mongo_db"
+	"midi-file-server/ratelimit"
 	restapi "midi-file-server/rest_api"
 	"midi-file-server/utilities"
 
@@ -23,6 +31,8 @@ var (
 	ErrFileUpload        = errors.New("failed to upload file")
 	ErrFileOpen          = errors.New("failed to open file")
 	ErrFileClose         = errors.New("failed to close file")
+	ErrServe             = errors.New("HTTP server stopped")
+	ErrShutdown          = errors.New("failed to drain HTTP connections")
 )
 
 const (
@@ -32,37 +42,220 @@ const (
 	LoginEp                  = "login"
 	GetSignedUrl             = "get-signed-url"
 	ListAvailableMidiBuckets = "list-available-midi-files"
+	UploadMidiEp             = "upload-midi"
+	SongsEp                  = "songs"
+	MusicXMLEp               = "musicxml"
+	AdminEp                  = "admin"
+	DuplicatesEp             = "duplicates"
+	SimilarEp                = "similar"
+	SearchByPlayingEp        = "search-by-playing"
+	PlaylistsEp              = "playlists"
+	SharedPlaylistsEp        = "shared-playlists"
+	DevicesEp                = "devices"
+	MeEp                     = "me"
+	RecordingsEp             = "recordings"
+	PracticeSessionsEp       = "practice-sessions"
+	PracticeLoopEp           = "practice-loop"
+	HandsEp                  = "hands"
+	LyricsEp                 = "lyrics"
+	KeysEp                   = "keys"
+	PairingEp                = "pairing"
+	EmailEp                  = "email"
+	VerifyEmailEp            = "verify-email"
+	PasswordResetEp          = "password-reset"
+	LoginLocksEp             = "login-locks"
 )
 
+// configWatchInterval is how often the config file and TLS certificates are checked for changes
+const configWatchInterval = 10 * time.Second
+
 func main() {
 	// Initialize zerolog to use human-readable output in the console
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
+	if err := run(); err != nil {
+		log.Fatal().Err(err).Msg("Server failed")
+	}
+}
+
+// run serves until SIGTERM or SIGINT, then shuts down in order: the listener, letting in-flight requests
+// finish within the shutdown timeout, then the background workers and finally the MongoDB client
+func run() error {
+	load := func() (config.Config, error) { return config.Load(os.Args[1:], os.LookupEnv) }
+	cfg, err := load()
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, config.Usage())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Interface("config", cfg.Redacted()).Msg("Configuration loaded")
+	settings := config.NewStore(cfg, load)
+
 	// Use a background context for MongoDB connection to avoid it timing out with HTTP requests,
 	backgroundContext := context.Background()
 
-	mongoDB := mongodb.NewMongoDBClient(backgroundContext)
+	mongoDB := mongodb.NewMongoDBClient(backgroundContext, cfg.Mongo)
 
-	err := utilities.WrapError(mongoDB.Connect(), ErrMongoDBConnection)
+	err = utilities.WrapError(mongoDB.Connect(), ErrMongoDBConnection)
 	if err != nil {
-		utilities.LogErrorAndRespond(nil, "MongoDB connection error", http.StatusInternalServerError)
-		log.Fatal().Err(err).Msg("MongoDB connection error")
+		return err
 	}
-	defer mongoDB.Disconnect()
+	defer func() {
+		disconnectContext, cancel := context.WithTimeout(backgroundContext, cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := mongoDB.Disconnect(disconnectContext); err != nil {
+			log.Error().Err(err).Msg("MongoDB disconnect failed")
+		}
+	}()
 
 	err = utilities.WrapError(mongoDB.VerifyDB(), ErrMongoDBVerify)
 	if err != nil {
-		utilities.LogErrorAndRespond(nil, "MongoDB verification error", http.StatusInternalServerError)
-		log.Fatal().Err(err).Msg("MongoDB verification error")
+		return err
 	}
-	db := mongoDB.Client.Database(mongoDB.DatabaseName)
+	db := &restapi.Database{Database: mongoDB.Client.Database(mongoDB.DatabaseName), Settings: settings, Mailer: mail.New(cfg.Mail)}
+
+	// Background workers stop when workerContext is cancelled, after the server has drained
+	workerContext, stopWorkers := context.WithCancel(backgroundContext)
+	defer stopWorkers()
+
+	// Reloadable settings are read per request, so SIGHUP or an edited config file takes effect without a restart
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		settings.Watch(workerContext, configWatchInterval)
+	}()
+	expiry := func() time.Duration { return settings.Current().Server.SignedURLExpiry }
+	timeout := func() time.Duration { return settings.Current().Server.RequestTimeout }
+	adminKey := func() string { return settings.Current().Auth.AdminAPIKey }
+
+	// Rate limits count per user, device or IP address, in MongoDB when replicas share them
+	var rateLimits ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == "mongo" {
+		rateLimits = ratelimit.NewMongoStore(db.Collection(utilities.RateLimitsCollection))
+	}
+	limiter := ratelimit.New(rateLimits, restapi.RateLimitKey(db))
+	defaultLimit := func() config.RatePolicy { return settings.Current().RateLimit.Default }
+	authLimit := func() config.RatePolicy { return settings.Current().RateLimit.Auth }
+	signedURLLimit := func() config.RatePolicy { return settings.Current().RateLimit.SignedURL }
+	uploadsLimit := func() config.RatePolicy { return settings.Current().RateLimit.Uploads }
+	analysisLimit := func() config.RatePolicy { return settings.Current().RateLimit.Analysis }
 
 	// Register handlers with the shared context
-	http.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, HealthEp), utilities.WithTimeout(restapi.OnHealthSubmit))
-	http.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, GetSignedUrl), utilities.WithSignedUrlDuration(utilities.GetSignedTimeDurationMinutes(utilities.SIGNED_URL_EXPIRATION_MINUTES), restapi.GetSignedUrl))
-	http.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, ListAvailableMidiBuckets), utilities.WithTimeout(restapi.ListBucketHandler))
-	http.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, RegisterEp), utilities.WithTimeoutDb(db, restapi.RegisterUser))
-	http.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, LoginEp), utilities.WithTimeoutDb(db, restapi.LoginUser))
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, HealthEp), utilities.WithTimeout(timeout, restapi.OnHealthSubmit))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, GetSignedUrl), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.GetSignedUrl)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, ListAvailableMidiBuckets), utilities.WithTimeoutDb(timeout, db, restapi.ListBucketHandler))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, RegisterEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.RegisterUser)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, LoginEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.LoginUser)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s", VersionEp, MeEp, EmailEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.ChangeEmail)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, VerifyEmailEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.VerifyEmail)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, PasswordResetEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.RequestPasswordReset)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/confirm", VersionEp, PasswordResetEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.ConfirmPasswordReset)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, UploadMidiEp), limiter.Limit("uploads", uploadsLimit, utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.UploadMidi))))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, SongsEp), utilities.WithTimeoutDb(timeout, db, restapi.ListSongs))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}", VersionEp, SongsEp), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.GetSong)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/%s", VersionEp, SongsEp, MusicXMLEp), limiter.Limit("analysis", analysisLimit, utilities.WithTimeoutDb(timeout, db, restapi.GetSongMusicXML)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/%s", VersionEp, SongsEp, SimilarEp), limiter.Limit("analysis", analysisLimit, utilities.WithTimeoutDb(timeout, db, restapi.GetSimilarSongs)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, SearchByPlayingEp), limiter.Limit("analysis", analysisLimit, utilities.WithTimeoutDb(timeout, db, restapi.SearchByPlaying)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s", VersionEp, PlaylistsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.Playlists)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}", VersionEp, PlaylistsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.PlaylistByID)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/items", VersionEp, PlaylistsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.SetPlaylistItems)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/share", VersionEp, PlaylistsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.SharePlaylist)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/send", VersionEp, PlaylistsEp), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.WithUserDuration(restapi.SendPlaylistToDevice))))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{token}", VersionEp, SharedPlaylistsEp), utilities.WithTimeoutDb(timeout, db, restapi.GetSharedPlaylist))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/favorite", VersionEp, SongsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.SongFavorite)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/rating", VersionEp, SongsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.SongRating)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/favorites", VersionEp, MeEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.MyFavorites)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/history", VersionEp, MeEp), utilities.WithTimeoutDb(timeout, db, restapi.WithDevice("", restapi.ScopeReportStatus, restapi.MyHistory)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/most-played", VersionEp, MeEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.MostPlayed)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/recently-played", VersionEp, MeEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.RecentlyPlayed)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s", VersionEp, MeEp, RecordingsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithDevice("", restapi.ScopeReportStatus, restapi.Recordings)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s/{id}", VersionEp, MeEp, RecordingsEp), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.WithDeviceDuration("", restapi.ScopeReportStatus, restapi.RecordingByID))))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s", VersionEp, MeEp, PracticeSessionsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.PracticeSessions)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s/{id}", VersionEp, MeEp, PracticeSessionsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.PracticeSessionByID)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/%s", VersionEp, SongsEp, PracticeLoopEp), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.WithUserDuration(restapi.GetPracticeLoop))))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/%s", VersionEp, SongsEp, HandsEp), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.WithUserDuration(restapi.GetHands))))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/%s", VersionEp, SongsEp, LyricsEp), utilities.WithTimeoutDb(timeout, db, restapi.GetLyrics))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{id}/progress", VersionEp, SongsEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.SongProgress)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/queue", VersionEp, DevicesEp), utilities.WithTimeoutDb(timeout, db, restapi.WithDevice(restapi.ScopeReadLibrary, restapi.ScopeManageDevice, restapi.DeviceQueueHandler)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/queue/next", VersionEp, DevicesEp), limiter.Limit("signed-url", signedURLLimit, utilities.WithSignedUrlDurationDb(db, expiry, restapi.WithDeviceDuration(restapi.ScopeReadLibrary, restapi.ScopeReadLibrary, restapi.NextInQueue))))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/schedules", VersionEp, DevicesEp), utilities.WithTimeoutDb(timeout, db, restapi.WithDevice(restapi.ScopeReadLibrary, restapi.ScopeManageDevice, restapi.DeviceSchedules)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/schedules/{id}", VersionEp, DevicesEp), utilities.WithTimeoutDb(timeout, db, restapi.WithDevice(restapi.ScopeReadLibrary, restapi.ScopeManageDevice, restapi.DeviceScheduleByID)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/%s", VersionEp, DevicesEp, KeysEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.DeviceKeys)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/%s/{id}", VersionEp, DevicesEp, KeysEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.DeviceKeyByID)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/%s/{id}/rotate", VersionEp, DevicesEp, KeysEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.RotateDeviceKey)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/code", VersionEp, PairingEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.RequestDeviceCode)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/approve", VersionEp, PairingEp), utilities.WithTimeoutDb(timeout, db, restapi.WithUser(restapi.ApprovePairing)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/token", VersionEp, PairingEp), limiter.Limit("auth", authLimit, utilities.WithTimeoutDb(timeout, db, restapi.DeviceToken)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/{serial}/commands", VersionEp, DevicesEp), utilities.WithTimeoutDb(timeout, db, restapi.WithDevice(restapi.ScopeReadLibrary, restapi.ScopeReadLibrary, restapi.DeviceCommands)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s", VersionEp, AdminEp, DuplicatesEp), utilities.WithAdminKey(adminKey, utilities.WithTimeoutDb(timeout, db, restapi.FindDuplicates)))
+	mux.HandleFunc(fmt.Sprintf("/%s/%s/%s", VersionEp, AdminEp, LoginLocksEp), utilities.WithAdminKey(adminKey, utilities.WithTimeoutDb(timeout, db, restapi.LoginLocks)))
+
+	// Keep "songs like this" rankings current as the catalog grows
+	refreshing := restapi.StartSimilarityRefresh(workerContext, db, cfg.Catalog.SimilarityRefresh)
+
+	// Hand scheduled performances and alarms to devices ahead of time
+	scheduling := restapi.StartDeviceScheduler(workerContext, db, cfg.Schedule.Lead)
+
+	server := &http.Server{
+		Addr:              cfg.Server.Address(),
+		Handler:           limiter.Limit("default", defaultLimit, mux.ServeHTTP),
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	certificates := make(chan struct{})
+	if cfg.TLS.Enabled() {
+		reloader, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		// Rotated certificates are picked up without a restart
+		go func() {
+			defer close(certificates)
+			reloader.Watch(workerContext, configWatchInterval)
+		}()
+	} else {
+		close(certificates)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Info().Str("address", server.Addr).Bool("tls", cfg.TLS.Enabled()).Bool("clientCerts", cfg.TLS.ClientCAFile != "").Msg("Server listening")
+		if cfg.TLS.Enabled() {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	// Kubernetes sends SIGTERM on rollouts and waits terminationGracePeriodSeconds before killing the pod
+	signalContext, stopSignals := signal.NotifyContext(backgroundContext, syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+
+	select {
+	case err = <-serveErr:
+		err = utilities.WrapError(err, ErrServe)
+	case <-signalContext.Done():
+		log.Info().Dur("timeout", cfg.Server.ShutdownTimeout).Msg("Shutting down, draining connections")
+		shutdownContext, cancel := context.WithTimeout(backgroundContext, cfg.Server.ShutdownTimeout)
+		err = utilities.WrapError(server.Shutdown(shutdownContext), ErrShutdown)
+		cancel()
+		if err != nil {
+			// Requests still running past the deadline are cut off
+			server.Close()
+		}
+	}
 
-	log.Fatal().Err(http.ListenAndServe(":8080", nil)).Msg("Server failed")
+	stopWorkers()
+	<-watching
+	<-refreshing
+	<-scheduling
+	<-certificates
+	log.Info().Msg("Background workers stopped")
+	return err
 }
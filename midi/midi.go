@@ -0,0 +1,523 @@
+package midi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	utilities "midi-file-server/utilities"
+)
+
+var (
+	ErrInvalidHeader    = fmt.Errorf("invalid MIDI header")
+	ErrInvalidTrack     = fmt.Errorf("invalid MIDI track")
+	ErrUnsupportedTime  = fmt.Errorf("SMPTE time division is not supported")
+	ErrUnexpectedEOF    = fmt.Errorf("unexpected end of MIDI data")
+	ErrInvalidEvent     = fmt.Errorf("invalid MIDI event")
+	ErrMissingRunStatus = fmt.Errorf("data byte without running status")
+	ErrTooLong          = fmt.Errorf("MIDI file is too long")
+)
+
+// Limits on what a parsed file may span, so that a few bytes of delta times can't make every measure,
+// grid line and sample of a song hold millions of entries
+const (
+	// MaxQuarterNotes bounds the last tick of a file at this many quarter notes of its division
+	MaxQuarterNotes = 100000
+	// MaxDurationSeconds bounds the playing time of a file
+	MaxDurationSeconds = 4 * 60 * 60
+	// MaxMeasures bounds the measures listed by MeasureStarts
+	MaxMeasures = 20000
+)
+
+// Status bytes and meta event types used throughout the package
+const (
+	NoteOff         byte = 0x80
+	NoteOn          byte = 0x90
+	PolyPressure    byte = 0xA0
+	ControlChange   byte = 0xB0
+	ProgramChange   byte = 0xC0
+	ChannelPressure byte = 0xD0
+	PitchBend       byte = 0xE0
+	SysEx           byte = 0xF0
+	SysExEscape     byte = 0xF7
+	Meta            byte = 0xFF
+
+	MetaText          byte = 0x01
+	MetaCopyright     byte = 0x02
+	MetaTrackName     byte = 0x03
+	MetaInstrument    byte = 0x04
+	MetaLyric         byte = 0x05
+	MetaMarker        byte = 0x06
+	MetaEndOfTrack    byte = 0x2F
+	MetaTempo         byte = 0x51
+	MetaTimeSignature byte = 0x58
+	MetaKeySignature  byte = 0x59
+
+	// DefaultTempo is 120 BPM expressed in microseconds per quarter note
+	DefaultTempo uint32 = 500000
+)
+
+// File is a parsed Standard MIDI File
+type File struct {
+	Format   uint16
+	Division uint16 // ticks per quarter note
+	Tracks   []Track
+}
+
+// Track holds the events of a single MTrk chunk with absolute tick positions
+type Track struct {
+	Name   string
+	Events []Event
+}
+
+// Event is a single MIDI, SysEx or meta event.
+// For channel events Type is the status nibble (e.g. NoteOn) and Channel holds 0-15.
+// For meta events Type is Meta and MetaType identifies the kind of meta event.
+type Event struct {
+	Tick     uint32
+	Type     byte
+	Channel  uint8
+	Data1    byte
+	Data2    byte
+	MetaType byte
+	Data     []byte
+}
+
+// Note is a paired note-on/note-off
+type Note struct {
+	Track    int
+	Channel  uint8
+	Pitch    uint8
+	Velocity uint8
+	Start    uint32
+	End      uint32
+}
+
+// Duration returns the note length in ticks
+func (n Note) Duration() uint32 {
+	return n.End - n.Start
+}
+
+// TempoChange marks a tempo in microseconds per quarter note starting at Tick
+type TempoChange struct {
+	Tick             uint32
+	MicrosPerQuarter uint32
+}
+
+// BPM returns the tempo in beats per minute
+func (t TempoChange) BPM() float64 {
+	return 60000000 / float64(t.MicrosPerQuarter)
+}
+
+// TimeSignature marks a meter change starting at Tick; Denominator is the real value (4, 8, ...)
+type TimeSignature struct {
+	Tick        uint32
+	Numerator   uint8
+	Denominator uint8
+}
+
+// KeySignature marks a key change; Sharps is negative for flats
+type KeySignature struct {
+	Tick   uint32
+	Sharps int8
+	Minor  bool
+}
+
+// Parse reads a Standard MIDI File
+func Parse(r io.Reader) (*File, error) {
+	br := bufio.NewReader(r)
+
+	id, data, err := readChunk(br)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidHeader)
+	}
+	if id != "MThd" || len(data) < 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	file := &File{
+		Format:   binary.BigEndian.Uint16(data[0:2]),
+		Division: binary.BigEndian.Uint16(data[4:6]),
+	}
+	if file.Division&0x8000 != 0 {
+		return nil, ErrUnsupportedTime
+	}
+	if file.Division == 0 {
+		return nil, utilities.WrapError(fmt.Errorf("division is zero"), ErrInvalidHeader)
+	}
+	trackCount := int(binary.BigEndian.Uint16(data[2:4]))
+
+	for len(file.Tracks) < trackCount {
+		id, data, err := readChunk(br)
+		if err != nil {
+			return nil, utilities.WrapError(err, ErrInvalidTrack, fmt.Sprintf("track %d", len(file.Tracks)))
+		}
+		// Unknown chunk types must be skipped per the SMF spec
+		if id != "MTrk" {
+			continue
+		}
+		track, err := parseTrack(data)
+		if err != nil {
+			return nil, utilities.WrapError(err, ErrInvalidTrack, fmt.Sprintf("track %d", len(file.Tracks)))
+		}
+		file.Tracks = append(file.Tracks, track)
+	}
+
+	if end := file.EndTick(); uint64(end) > uint64(file.Division)*MaxQuarterNotes {
+		return nil, utilities.WrapError(fmt.Errorf("ends at tick %d", end), ErrTooLong)
+	}
+	if duration := file.Duration(); duration > MaxDurationSeconds {
+		return nil, utilities.WrapError(fmt.Errorf("lasts %.0f seconds", duration), ErrTooLong)
+	}
+	return file, nil
+}
+
+func readChunk(r io.Reader) (string, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, ErrUnexpectedEOF
+	}
+	// Copy rather than preallocate so a bogus length cannot force a huge allocation
+	length := binary.BigEndian.Uint32(header[4:8])
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(length)); err != nil {
+		return "", nil, ErrUnexpectedEOF
+	}
+	return string(header[0:4]), data.Bytes(), nil
+}
+
+func parseTrack(data []byte) (Track, error) {
+	var track Track
+	r := bytes.NewReader(data)
+	var tick uint32
+	var runningStatus byte
+
+	for r.Len() > 0 {
+		delta, err := readVarLen(r)
+		if err != nil {
+			return track, err
+		}
+		if delta > math.MaxUint32-tick {
+			return track, ErrTooLong
+		}
+		tick += delta
+
+		status, err := r.ReadByte()
+		if err != nil {
+			return track, ErrUnexpectedEOF
+		}
+
+		switch {
+		case status == Meta:
+			metaType, err := r.ReadByte()
+			if err != nil {
+				return track, ErrUnexpectedEOF
+			}
+			payload, err := readVarLenData(r)
+			if err != nil {
+				return track, err
+			}
+			if metaType == MetaTrackName && track.Name == "" {
+				track.Name = string(payload)
+			}
+			track.Events = append(track.Events, Event{Tick: tick, Type: Meta, MetaType: metaType, Data: payload})
+			if metaType == MetaEndOfTrack {
+				return track, nil
+			}
+
+		case status == SysEx || status == SysExEscape:
+			payload, err := readVarLenData(r)
+			if err != nil {
+				return track, err
+			}
+			track.Events = append(track.Events, Event{Tick: tick, Type: status, Data: payload})
+
+		case status >= 0xF0:
+			return track, utilities.WrapError(fmt.Errorf("status 0x%X", status), ErrInvalidEvent)
+
+		default:
+			var data1 byte
+			if status < 0x80 {
+				if runningStatus == 0 {
+					return track, ErrMissingRunStatus
+				}
+				data1 = status
+				status = runningStatus
+			} else {
+				runningStatus = status
+				if data1, err = r.ReadByte(); err != nil {
+					return track, ErrUnexpectedEOF
+				}
+			}
+
+			event := Event{Tick: tick, Type: status & 0xF0, Channel: status & 0x0F, Data1: data1}
+			if event.Type != ProgramChange && event.Type != ChannelPressure {
+				if event.Data2, err = r.ReadByte(); err != nil {
+					return track, ErrUnexpectedEOF
+				}
+			}
+			track.Events = append(track.Events, event)
+		}
+	}
+
+	return track, nil
+}
+
+func readVarLen(r io.ByteReader) (uint32, error) {
+	var value uint32
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, ErrUnexpectedEOF
+		}
+		value = value<<7 | uint32(b&0x7F)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, utilities.WrapError(fmt.Errorf("variable-length quantity exceeds 4 bytes"), ErrInvalidEvent)
+}
+
+func readVarLenData(r *bytes.Reader) ([]byte, error) {
+	length, err := readVarLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if int(length) > r.Len() {
+		return nil, ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, ErrUnexpectedEOF
+	}
+	return payload, nil
+}
+
+// Notes pairs note-on and note-off events across all tracks, sorted by start tick.
+// Notes still sounding at the end of a track are closed at the track's last tick.
+func (f *File) Notes() []Note {
+	type key struct {
+		channel uint8
+		pitch   uint8
+	}
+
+	var notes []Note
+	for trackIndex, track := range f.Tracks {
+		open := map[key][]Note{}
+		var lastTick uint32
+		for _, event := range track.Events {
+			lastTick = event.Tick
+			if event.Type != NoteOn && event.Type != NoteOff {
+				continue
+			}
+			k := key{event.Channel, event.Data1}
+			if event.Type == NoteOn && event.Data2 > 0 {
+				open[k] = append(open[k], Note{
+					Track:    trackIndex,
+					Channel:  event.Channel,
+					Pitch:    event.Data1,
+					Velocity: event.Data2,
+					Start:    event.Tick,
+				})
+				continue
+			}
+			// First in, first out matches how most sequencers pair overlapping notes
+			if pending := open[k]; len(pending) > 0 {
+				note := pending[0]
+				note.End = event.Tick
+				notes = append(notes, note)
+				open[k] = pending[1:]
+			}
+		}
+		for _, pending := range open {
+			for _, note := range pending {
+				note.End = lastTick
+				notes = append(notes, note)
+			}
+		}
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].Start != notes[j].Start {
+			return notes[i].Start < notes[j].Start
+		}
+		return notes[i].Pitch < notes[j].Pitch
+	})
+	return notes
+}
+
+// EndTick returns the tick of the last event in the file
+func (f *File) EndTick() uint32 {
+	var end uint32
+	for _, track := range f.Tracks {
+		if n := len(track.Events); n > 0 && track.Events[n-1].Tick > end {
+			end = track.Events[n-1].Tick
+		}
+	}
+	return end
+}
+
+// metaEvents returns all meta events of the given type across tracks, sorted by tick
+func (f *File) metaEvents(metaType byte) []Event {
+	var events []Event
+	for _, track := range f.Tracks {
+		for _, event := range track.Events {
+			if event.Type == Meta && event.MetaType == metaType {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Tick < events[j].Tick })
+	return events
+}
+
+// Tempos returns the tempo map, always starting with an entry at tick 0
+func (f *File) Tempos() []TempoChange {
+	tempos := []TempoChange{{Tick: 0, MicrosPerQuarter: DefaultTempo}}
+	for _, event := range f.metaEvents(MetaTempo) {
+		if len(event.Data) < 3 {
+			continue
+		}
+		change := TempoChange{
+			Tick:             event.Tick,
+			MicrosPerQuarter: uint32(event.Data[0])<<16 | uint32(event.Data[1])<<8 | uint32(event.Data[2]),
+		}
+		if change.MicrosPerQuarter == 0 {
+			continue
+		}
+		if change.Tick == tempos[len(tempos)-1].Tick {
+			tempos[len(tempos)-1] = change
+		} else {
+			tempos = append(tempos, change)
+		}
+	}
+	return tempos
+}
+
+// TimeSignatures returns the meter map, always starting with an entry at tick 0 (4/4 if unspecified)
+func (f *File) TimeSignatures() []TimeSignature {
+	signatures := []TimeSignature{{Tick: 0, Numerator: 4, Denominator: 4}}
+	for _, event := range f.metaEvents(MetaTimeSignature) {
+		if len(event.Data) < 2 || event.Data[0] == 0 || event.Data[1] > 7 {
+			continue
+		}
+		signature := TimeSignature{Tick: event.Tick, Numerator: event.Data[0], Denominator: 1 << event.Data[1]}
+		if signature.Tick == signatures[len(signatures)-1].Tick {
+			signatures[len(signatures)-1] = signature
+		} else {
+			signatures = append(signatures, signature)
+		}
+	}
+	return signatures
+}
+
+// KeySignatures returns all key signature events in tick order
+func (f *File) KeySignatures() []KeySignature {
+	var keys []KeySignature
+	for _, event := range f.metaEvents(MetaKeySignature) {
+		if len(event.Data) < 2 {
+			continue
+		}
+		keys = append(keys, KeySignature{Tick: event.Tick, Sharps: int8(event.Data[0]), Minor: event.Data[1] == 1})
+	}
+	return keys
+}
+
+// TempoMap converts between ticks and seconds. Build it once with File.TempoMap when
+// converting many positions; the File methods rebuild it on every call.
+type TempoMap struct {
+	division uint16
+	changes  []TempoChange
+	// elapsed is the time in seconds at each change, so a conversion is a binary search
+	elapsed []float64
+}
+
+// TempoMap returns the tempo map of the file
+func (f *File) TempoMap() TempoMap {
+	m := TempoMap{division: f.Division, changes: f.Tempos()}
+	m.elapsed = make([]float64, len(m.changes))
+	for i := 1; i < len(m.changes); i++ {
+		m.elapsed[i] = m.elapsed[i-1] + float64(m.changes[i].Tick-m.changes[i-1].Tick)*m.secondsPerTick(i-1)
+	}
+	return m
+}
+
+func (m TempoMap) secondsPerTick(i int) float64 {
+	return float64(m.changes[i].MicrosPerQuarter) / 1e6 / float64(m.division)
+}
+
+// Seconds converts an absolute tick position to seconds
+func (m TempoMap) Seconds(tick uint32) float64 {
+	// The last change before the tick sets its tempo
+	i := sort.Search(len(m.changes), func(i int) bool { return m.changes[i].Tick >= tick }) - 1
+	if i < 0 {
+		return 0
+	}
+	return m.elapsed[i] + float64(tick-m.changes[i].Tick)*m.secondsPerTick(i)
+}
+
+// Ticks converts a time in seconds to an absolute tick position
+func (m TempoMap) Ticks(seconds float64) uint32 {
+	if len(m.changes) == 0 {
+		return 0
+	}
+	// The first change whose span reaches the time sets its tempo
+	i := sort.Search(len(m.changes)-1, func(i int) bool { return m.elapsed[i+1] >= seconds })
+	return m.changes[i].Tick + uint32((seconds-m.elapsed[i])/m.secondsPerTick(i)+0.5)
+}
+
+// TicksToSeconds converts an absolute tick position to seconds using the tempo map
+func (f *File) TicksToSeconds(tick uint32) float64 {
+	return f.TempoMap().Seconds(tick)
+}
+
+// SecondsToTicks converts a time in seconds to an absolute tick position using the tempo map
+func (f *File) SecondsToTicks(seconds float64) uint32 {
+	return f.TempoMap().Ticks(seconds)
+}
+
+// Duration returns the length of the file in seconds
+func (f *File) Duration() float64 {
+	return f.TicksToSeconds(f.EndTick())
+}
+
+// TicksPerMeasure returns the length of one measure in ticks for the given meter
+func (f *File) TicksPerMeasure(signature TimeSignature) uint32 {
+	return uint32(signature.Numerator) * uint32(f.Division) * 4 / uint32(signature.Denominator)
+}
+
+// MeasureStarts returns the tick at which each measure begins, up to and including end, and at most MaxMeasures
+func (f *File) MeasureStarts(end uint32) []uint32 {
+	signatures := f.TimeSignatures()
+	var starts []uint32
+	tick := uint32(0)
+	for i, signature := range signatures {
+		length := f.TicksPerMeasure(signature)
+		if length == 0 {
+			continue
+		}
+		limit := end
+		if i+1 < len(signatures) && signatures[i+1].Tick < limit {
+			limit = signatures[i+1].Tick
+		}
+		for tick < limit || (i+1 == len(signatures) && tick <= end) {
+			if len(starts) == MaxMeasures {
+				return starts
+			}
+			starts = append(starts, tick)
+			if length > math.MaxUint32-tick {
+				return starts
+			}
+			tick += length
+		}
+		// A meter change that does not fall on a bar line starts a new measure
+		if i+1 < len(signatures) && tick > signatures[i+1].Tick {
+			tick = signatures[i+1].Tick
+		}
+	}
+	return starts
+}
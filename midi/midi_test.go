@@ -0,0 +1,127 @@
+package midi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildSMF wraps raw track bodies in a format 1 file with 96 ticks per quarter note
+func buildSMF(tracks ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	_ = binary.Write(&buf, binary.BigEndian, []uint32{6})
+	_ = binary.Write(&buf, binary.BigEndian, []uint16{1, uint16(len(tracks)), 96})
+	for _, track := range tracks {
+		buf.WriteString("MTrk")
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(track)))
+		buf.Write(track)
+	}
+	return buf.Bytes()
+}
+
+var testTrack = []byte{
+	0x00, 0xFF, 0x03, 0x04, 'T', 'e', 's', 't',
+	0x00, 0xFF, 0x58, 0x04, 0x03, 0x02, 0x18, 0x08, // 3/4
+	0x00, 0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20, // 120 BPM
+	0x00, 0x90, 0x3C, 0x64,
+	0x60, 0x80, 0x3C, 0x00,
+	0x00, 0x90, 0x40, 0x50,
+	0x81, 0x40, 0x40, 0x00, // running status note-on with zero velocity after 192 ticks
+	0x00, 0xFF, 0x2F, 0x00,
+}
+
+func TestParse_Success(t *testing.T) {
+	file, err := Parse(bytes.NewReader(buildSMF(testTrack)))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint16(1), file.Format)
+	assert.Equal(t, uint16(96), file.Division)
+	require.Len(t, file.Tracks, 1)
+	assert.Equal(t, "Test", file.Tracks[0].Name)
+	assert.Equal(t, uint32(288), file.EndTick())
+}
+
+func TestParse_InvalidHeader(t *testing.T) {
+	_, err := Parse(bytes.NewReader([]byte("RIFF0000")))
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestParse_TruncatedTrack(t *testing.T) {
+	data := buildSMF(testTrack)
+	_, err := Parse(bytes.NewReader(data[:len(data)-10]))
+	assert.ErrorIs(t, err, ErrInvalidTrack)
+}
+
+func TestParse_TooLong(t *testing.T) {
+	// A single delta time of 2^28-1 ticks at one tick per quarter note
+	data := []byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x01MTrk\x00\x00\x00\x08\xFF\xFF\xFF\x7F\xFF\x2F\x00\x00")
+	_, err := Parse(bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrTooLong)
+
+	// Deltas adding up past the largest tick
+	var track []byte
+	for range 17 {
+		track = append(track, 0xFF, 0xFF, 0xFF, 0x7F, 0xFF, 0x01, 0x00)
+	}
+	_, err = Parse(bytes.NewReader(buildSMF(track)))
+	assert.ErrorIs(t, err, ErrInvalidTrack)
+	assert.ErrorContains(t, err, ErrTooLong.Error())
+}
+
+func TestNotes(t *testing.T) {
+	file, err := Parse(bytes.NewReader(buildSMF(testTrack)))
+	require.NoError(t, err)
+
+	notes := file.Notes()
+	require.Len(t, notes, 2)
+	assert.Equal(t, Note{Track: 0, Channel: 0, Pitch: 60, Velocity: 100, Start: 0, End: 96}, notes[0])
+	assert.Equal(t, Note{Track: 0, Channel: 0, Pitch: 64, Velocity: 80, Start: 96, End: 288}, notes[1])
+}
+
+func TestTempoConversion(t *testing.T) {
+	file, err := Parse(bytes.NewReader(buildSMF(testTrack)))
+	require.NoError(t, err)
+
+	assert.InDelta(t, 1.5, file.TicksToSeconds(288), 1e-9)
+	assert.Equal(t, uint32(288), file.SecondsToTicks(1.5))
+	assert.InDelta(t, 120, file.Tempos()[0].BPM(), 1e-9)
+}
+
+func TestMeasureStarts(t *testing.T) {
+	file, err := Parse(bytes.NewReader(buildSMF(testTrack)))
+	require.NoError(t, err)
+
+	// 3/4 at 96 ticks per quarter is 288 ticks per measure
+	assert.Equal(t, []uint32{0, 288, 576}, file.MeasureStarts(600))
+	assert.Len(t, file.MeasureStarts(math.MaxUint32), MaxMeasures)
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	file := NewFile(480)
+	conductor := file.AddTrack("Conductor")
+	conductor.AddTempo(0, 90)
+	conductor.AddTimeSignature(0, 6, 8)
+	conductor.AddKeySignature(0, -2, true)
+	piano := file.AddTrack("Piano")
+	piano.AddProgramChange(0, 0, 0)
+	piano.AddNote(0, 60, 90, 0, 480)
+	piano.AddNote(0, 60, 70, 480, 100000) // delta needs a multi-byte quantity
+
+	parsed, err := Parse(bytes.NewReader(file.Encode()))
+	require.NoError(t, err)
+
+	require.Len(t, parsed.Tracks, 2)
+	assert.Equal(t, "Piano", parsed.Tracks[1].Name)
+	assert.InDelta(t, 90, parsed.Tempos()[0].BPM(), 0.01)
+	assert.Equal(t, TimeSignature{Tick: 0, Numerator: 6, Denominator: 8}, parsed.TimeSignatures()[0])
+	assert.Equal(t, []KeySignature{{Tick: 0, Sharps: -2, Minor: true}}, parsed.KeySignatures())
+	assert.Equal(t, []Note{
+		{Track: 1, Pitch: 60, Velocity: 90, Start: 0, End: 480},
+		{Track: 1, Pitch: 60, Velocity: 70, Start: 480, End: 100000},
+	}, parsed.Notes())
+}
@@ -0,0 +1,163 @@
+package midi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// NewFile creates an empty format 1 file with the given ticks per quarter note
+func NewFile(division uint16) *File {
+	return &File{Format: 1, Division: division}
+}
+
+// AddTrack appends an empty track and returns it for population.
+// The pointer is only valid until the next call to AddTrack.
+func (f *File) AddTrack(name string) *Track {
+	f.Tracks = append(f.Tracks, Track{Name: name})
+	track := &f.Tracks[len(f.Tracks)-1]
+	if name != "" {
+		track.AddMeta(0, MetaTrackName, []byte(name))
+	}
+	return track
+}
+
+// AddMeta appends a meta event
+func (t *Track) AddMeta(tick uint32, metaType byte, data []byte) {
+	t.Events = append(t.Events, Event{Tick: tick, Type: Meta, MetaType: metaType, Data: data})
+}
+
+// AddTempo appends a tempo change in beats per minute
+func (t *Track) AddTempo(tick uint32, bpm float64) {
+	micros := uint32(math.Round(60000000 / bpm))
+	t.AddMeta(tick, MetaTempo, []byte{byte(micros >> 16), byte(micros >> 8), byte(micros)})
+}
+
+// AddTimeSignature appends a meter change; denominator is the real value (4, 8, ...)
+func (t *Track) AddTimeSignature(tick uint32, numerator, denominator uint8) {
+	power := byte(0)
+	for d := denominator; d > 1; d >>= 1 {
+		power++
+	}
+	t.AddMeta(tick, MetaTimeSignature, []byte{numerator, power, 24, 8})
+}
+
+// AddKeySignature appends a key change; sharps is negative for flats
+func (t *Track) AddKeySignature(tick uint32, sharps int8, minor bool) {
+	mode := byte(0)
+	if minor {
+		mode = 1
+	}
+	t.AddMeta(tick, MetaKeySignature, []byte{byte(sharps), mode})
+}
+
+// AddProgramChange appends a program (instrument) change
+func (t *Track) AddProgramChange(tick uint32, channel, program uint8) {
+	t.Events = append(t.Events, Event{Tick: tick, Type: ProgramChange, Channel: channel, Data1: program})
+}
+
+// AddControlChange appends a controller change
+func (t *Track) AddControlChange(tick uint32, channel, controller, value uint8) {
+	t.Events = append(t.Events, Event{Tick: tick, Type: ControlChange, Channel: channel, Data1: controller, Data2: value})
+}
+
+// AddNote appends a note-on and its matching note-off.
+// Zero-length notes are stretched to one tick so the note-off cannot sort before the note-on.
+func (t *Track) AddNote(channel, pitch, velocity uint8, start, end uint32) {
+	if end <= start {
+		end = start + 1
+	}
+	t.Events = append(t.Events,
+		Event{Tick: start, Type: NoteOn, Channel: channel, Data1: pitch, Data2: velocity},
+		Event{Tick: end, Type: NoteOff, Channel: channel, Data1: pitch},
+	)
+}
+
+// eventOrder sorts events sharing a tick so meta events come first and
+// note-offs precede note-ons, keeping repeated notes from being cut short
+func eventOrder(e Event) int {
+	switch {
+	case e.Type == Meta:
+		return 0
+	case e.Type == NoteOff || (e.Type == NoteOn && e.Data2 == 0):
+		return 1
+	case e.Type == NoteOn:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Encode serializes the file as a Standard MIDI File.
+// Events are ordered by tick and every track is terminated with a single end-of-track event.
+func (f *File) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	_ = binary.Write(&buf, binary.BigEndian, uint32(6))
+	_ = binary.Write(&buf, binary.BigEndian, []uint16{f.Format, uint16(len(f.Tracks)), f.Division})
+
+	for _, track := range f.Tracks {
+		body := encodeTrack(track)
+		buf.WriteString("MTrk")
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(body)))
+		buf.Write(body)
+	}
+	return buf.Bytes()
+}
+
+func encodeTrack(track Track) []byte {
+	events := make([]Event, 0, len(track.Events))
+	var end uint32
+	for _, event := range track.Events {
+		end = max(end, event.Tick)
+		if event.Type == Meta && event.MetaType == MetaEndOfTrack {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Tick != events[j].Tick {
+			return events[i].Tick < events[j].Tick
+		}
+		return eventOrder(events[i]) < eventOrder(events[j])
+	})
+	events = append(events, Event{Tick: end, Type: Meta, MetaType: MetaEndOfTrack})
+
+	var buf bytes.Buffer
+	var last uint32
+	for _, event := range events {
+		writeVarLen(&buf, event.Tick-last)
+		last = event.Tick
+
+		switch event.Type {
+		case Meta:
+			buf.WriteByte(Meta)
+			buf.WriteByte(event.MetaType)
+			writeVarLen(&buf, uint32(len(event.Data)))
+			buf.Write(event.Data)
+		case SysEx, SysExEscape:
+			buf.WriteByte(event.Type)
+			writeVarLen(&buf, uint32(len(event.Data)))
+			buf.Write(event.Data)
+		default:
+			buf.WriteByte(event.Type | event.Channel&0x0F)
+			buf.WriteByte(event.Data1 & 0x7F)
+			if event.Type != ProgramChange && event.Type != ChannelPressure {
+				buf.WriteByte(event.Data2 & 0x7F)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeVarLen(buf *bytes.Buffer, value uint32) {
+	var scratch [4]byte
+	i := len(scratch) - 1
+	scratch[i] = byte(value & 0x7F)
+	for value >>= 7; value > 0; value >>= 7 {
+		i--
+		scratch[i] = byte(value&0x7F) | 0x80
+	}
+	buf.Write(scratch[i:])
+}
@@ -12,7 +12,9 @@ type ValidOTPSerial struct {
 }
 type MongoDBClient struct {
 	Client          *mongo.Client
+	URI             string
 	DatabaseName    string
 	UsersCollection string
+	SongsCollection string
 	Context         context.Context
 }
@@ -3,8 +3,8 @@ package mongodb
 import (
 	"context"
 	"fmt"
-	"log"
 
+	"midi-file-server/config"
 	utilities "midi-file-server/utilities" // Import utilities for WrapError
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -24,17 +24,19 @@ var (
 )
 
 // NewMongoDBClient creates a new instance of MongoDBClient.
-func NewMongoDBClient(ctx context.Context) *MongoDBClient {
+func NewMongoDBClient(ctx context.Context, cfg config.Mongo) *MongoDBClient {
 	return &MongoDBClient{
-		DatabaseName:    utilities.DatabaseName,
+		URI:             cfg.URI,
+		DatabaseName:    cfg.Database,
 		UsersCollection: utilities.UsersCollection,
+		SongsCollection: utilities.SongsCollection,
 		Context:         ctx,
 	}
 }
 
 // Connect establishes a connection to MongoDB and assigns it to the MongoDBClient.
 func (m *MongoDBClient) Connect() error {
-	clientOptions := options.Client().ApplyURI(utilities.MongoDBURI)
+	clientOptions := options.Client().ApplyURI(m.URI)
 	client, err := mongo.Connect(m.Context, clientOptions)
 	if err != nil {
 		return utilities.WrapError(err, ErrMongoDBConnection, "Connecting to MongoDB")
@@ -54,15 +56,16 @@ func (m *MongoDBClient) Connect() error {
 	return nil
 }
 
-// Disconnect closes the MongoDB connection.
-func (m *MongoDBClient) Disconnect() {
-	if m.Client != nil {
-		if err := m.Client.Disconnect(m.Context); err != nil {
-			log.Fatalf("Failed to disconnect from MongoDB: %v", err)
-		} else {
-			fmt.Println("Disconnected from MongoDB successfully.")
-		}
+// Disconnect closes the MongoDB connection, waiting for operations in progress until ctx is done.
+func (m *MongoDBClient) Disconnect(ctx context.Context) error {
+	if m.Client == nil {
+		return nil
+	}
+	if err := m.Client.Disconnect(ctx); err != nil {
+		return utilities.WrapError(err, ErrMongoDBDisconnect, "Disconnecting from MongoDB")
 	}
+	fmt.Println("Disconnected from MongoDB successfully.")
+	return nil
 }
 
 // VerifyDB  checks if the necessary collections exist in the database
@@ -90,6 +93,89 @@ func (m *MongoDBClient) VerifyDB() error {
 		return utilities.WrapError(err, ErrMongoDBCreateIdx, fmt.Sprintf("Database: %s, Collection: %s", m.DatabaseName, m.UsersCollection))
 	}
 
+	collectionIndexes := map[string][]mongo.IndexModel{
+		// An address recovers one account only; users without one are left out of the index
+		m.UsersCollection: {
+			{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		},
+		m.SongsCollection: {
+			{Keys: bson.D{{Key: "object_name", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "analysis.difficulty", Value: 1}}},
+			{Keys: bson.D{{Key: "fingerprint.sha256", Value: 1}}},
+			{Keys: bson.D{{Key: "fingerprint.musical", Value: 1}}},
+			{Keys: bson.D{{Key: "popularity.play_count", Value: -1}}},
+			{Keys: bson.D{{Key: "popularity.rating_average", Value: -1}}},
+		},
+		// Expired sessions are removed by MongoDB itself
+		utilities.SessionsCollection: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		utilities.PlaylistsCollection: {
+			{Keys: bson.D{{Key: "owner_id", Value: 1}}},
+			{Keys: bson.D{{Key: "share_token", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		},
+		utilities.FavoritesCollection: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "song_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		utilities.RatingsCollection: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "song_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		utilities.PlayEventsCollection: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "at", Value: -1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "song_id", Value: 1}, {Key: "at", Value: -1}}},
+		},
+		utilities.DeviceSchedulesCollection: {
+			{Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "serial_number", Value: 1}}},
+			{Keys: bson.D{{Key: "enabled", Value: 1}, {Key: "next_start", Value: 1}}},
+		},
+		// Commands are removed by MongoDB once their slot is over
+		utilities.DeviceCommandsCollection: {
+			{Keys: bson.D{{Key: "serial_number", Value: 1}, {Key: "owner_id", Value: 1}, {Key: "start_at", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Abandoned uploads expire; finished recordings have no expires_at and are kept
+		utilities.RecordingsCollection: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		utilities.PracticeSessionsCollection: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "song_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		utilities.DeviceKeysCollection: {
+			{Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "serial_number", Value: 1}, {Key: "created_at", Value: -1}}},
+		},
+		// Pairings expire unless the device collects its key in time
+		utilities.DeviceAuthorizationsCollection: {
+			{Keys: bson.D{{Key: "user_code", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Emailed tokens expire by themselves; each is deleted when used
+		utilities.AccountTokensCollection: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "purpose", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Failed logins are forgotten a while after the last one
+		utilities.LoginFailuresCollection: {
+			{Keys: bson.D{{Key: "locked_until", Value: -1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		// Rate limit buckets go once they have refilled
+		utilities.RateLimitsCollection: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		utilities.RecordingChunksCollection: {
+			{Keys: bson.D{{Key: "recording_id", Value: 1}, {Key: "offset", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	}
+	for collection, indexes := range collectionIndexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(m.Context, indexes); err != nil {
+			return utilities.WrapError(err, ErrMongoDBCreateIdx, fmt.Sprintf("Database: %s, Collection: %s", m.DatabaseName, collection))
+		}
+	}
+
 	fmt.Printf("Ensured that the '%s' database and '%s' collection exist.\n", m.DatabaseName, m.UsersCollection)
 	return nil
 }
@@ -106,7 +192,7 @@ func (m *MongoDBClient) AddDemoData() error {
 		// Add more as needed
 	}
 
-	_, err := db.Collection("valid_otp_serials").InsertMany(m.Context, otpSerials)
+	_, err := db.Collection(utilities.ValidOTPSerialsCollection).InsertMany(m.Context, otpSerials)
 	if err != nil {
 		return utilities.WrapError(err, ErrMongoDBInsertDemo, "Inserting demo data into MongoDB")
 	}
@@ -0,0 +1,831 @@
+package notation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+)
+
+// abcFields are the header letters recognised at the start of a line; A: is left out
+// because a body line such as "A:|" is far more common than the deprecated area field
+const abcFields = "BCDFGHIKLMmNOPQRrSsTUVWwXZ"
+
+// Limits on the numbers a tune may use, so that a few characters can't overflow a duration or unroll into
+// millions of measures
+const (
+	// maxLengthFactor bounds the multiplier and the divisor of a note length, e.g. A64 or A/64
+	maxLengthFactor = 64
+	// maxBrokenRhythm is the longest broken rhythm, ">>>"
+	maxBrokenRhythm = 3
+	// maxEnding is the highest numbered ending
+	maxEnding = maxRepeatTimes
+	// maxRestMeasures bounds a multi-measure rest such as Z16
+	maxRestMeasures = 1000
+)
+
+var (
+	majorFifths = map[string]int{
+		"C": 0, "G": 1, "D": 2, "A": 3, "E": 4, "B": 5, "F#": 6, "C#": 7,
+		"F": -1, "Bb": -2, "Eb": -3, "Ab": -4, "Db": -5, "Gb": -6, "Cb": -7,
+	}
+	modeOffsets = map[string]int{
+		"": 0, "maj": 0, "ion": 0, "m": -3, "min": -3, "aeo": -3,
+		"mix": -1, "dor": -2, "phr": -4, "lyd": 1, "loc": -5,
+	}
+	sharpOrder = "FCGDAEB"
+	flatOrder  = "BEADGCF"
+)
+
+// abcVoice accumulates the measures of one V: voice
+type abcVoice struct {
+	id             string
+	measures       []measure
+	current        measure
+	cursor         uint32
+	velocity       uint8
+	barAccidentals map[string]int
+	openTies       map[uint8]noteRef
+	activeEndings  []int
+	lastNote       *noteRef // for broken rhythm
+}
+
+// abcTune holds the parser state shared by all voices
+type abcTune struct {
+	title           string
+	unit            uint32 // ticks of the L: unit note length
+	unitSet         bool
+	meter           midi.TimeSignature
+	keyFifths       int
+	keyAccidentals  map[byte]int
+	voices          []*abcVoice
+	voice           *abcVoice
+	tupletRemaining int
+	tupletRatio     [2]uint32 // duration multiplier as numerator/denominator
+	brokenNext      [2]uint32
+}
+
+// ImportABC converts the first tune of an ABC notation file into a MIDI file.
+// Tempo, meter and key (including mid-tune changes), repeats with numbered endings,
+// chords, ties, tuplets, broken rhythm, dynamics decorations and multiple voices are supported.
+func ImportABC(r io.Reader) (*midi.File, error) {
+	tune := &abcTune{meter: midi.TimeSignature{Numerator: 4, Denominator: 4}, keyAccidentals: map[byte]int{}}
+	tune.selectVoice("")
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	inBody, seenTune := false, false
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if i := strings.Index(line, "%"); i >= 0 && (i == 0 || line[i-1] != '\\') {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+
+		if len(trimmed) >= 2 && trimmed[1] == ':' && strings.IndexByte(abcFields, trimmed[0]) >= 0 {
+			field, value := trimmed[0], strings.TrimSpace(trimmed[2:])
+			if field == 'X' {
+				// Only the first tune in a multi-tune file is imported
+				if seenTune {
+					break
+				}
+				seenTune = true
+			}
+			if err := tune.applyField(field, value, inBody); err != nil {
+				return nil, err
+			}
+			if field == 'K' {
+				inBody = true
+			}
+			continue
+		}
+
+		if !inBody {
+			// A blank line after the header without K: means an empty tune
+			continue
+		}
+		if trimmed == "" {
+			// A blank line ends the tune
+			if tune.hasNotes() {
+				break
+			}
+			continue
+		}
+		if err := tune.parseMusic(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidABC)
+	}
+	if !inBody {
+		return nil, utilities.WrapError(fmt.Errorf("missing K: field"), ErrInvalidABC)
+	}
+
+	s := score{title: tune.title}
+	for i, v := range tune.voices {
+		v.closeMeasure(false)
+		if len(v.measures) == 0 {
+			continue
+		}
+		s.parts = append(s.parts, part{name: v.id, channel: partChannel(i), program: 0, measures: v.measures})
+	}
+
+	file, err := buildFile(s)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidABC)
+	}
+	return file, nil
+}
+
+func (t *abcTune) hasNotes() bool {
+	for _, v := range t.voices {
+		if len(v.measures) > 0 || len(v.current.notes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *abcTune) selectVoice(id string) {
+	for _, v := range t.voices {
+		if v.id == id {
+			t.voice = v
+			return
+		}
+	}
+	// The unnamed default voice becomes the first named voice if it never received music
+	if len(t.voices) == 1 && t.voices[0].id == "" && !t.hasNotes() {
+		t.voices[0].id = id
+		t.voice = t.voices[0]
+		return
+	}
+	t.voice = &abcVoice{
+		id:             id,
+		velocity:       defaultVelocity,
+		barAccidentals: map[string]int{},
+		openTies:       map[uint8]noteRef{},
+	}
+	t.voices = append(t.voices, t.voice)
+}
+
+func (t *abcTune) applyField(field byte, value string, inBody bool) error {
+	switch field {
+	case 'T':
+		if t.title == "" {
+			t.title = value
+		}
+	case 'L':
+		num, den, ok := parseFraction(value)
+		if !ok || num > maxLengthFactor || den > maxLengthFactor {
+			return utilities.WrapError(fmt.Errorf("L:%s", value), ErrInvalidABC)
+		}
+		t.unit = uint32(Division * 4 * num / den)
+		t.unitSet = true
+	case 'M':
+		t.meter = parseMeter(value)
+		signature := t.meter
+		t.target(inBody).current.timeSignature = &signature
+		// Per the standard, the default unit length depends on the first meter
+		if !t.unitSet && !inBody {
+			t.unit = Division / 2
+			if float64(t.meter.Numerator)/float64(t.meter.Denominator) < 0.75 {
+				t.unit = Division / 4
+			}
+		}
+	case 'Q':
+		if bpm, ok := t.parseTempo(value); ok {
+			target := t.target(inBody)
+			target.current.tempos = append(target.current.tempos, timedTempo{tick: target.cursor, bpm: bpm})
+		}
+	case 'K':
+		t.applyKey(value, t.target(inBody))
+	case 'V':
+		id := strings.Fields(value)
+		if len(id) > 0 {
+			t.selectVoice(id[0])
+		}
+	}
+	if t.unit == 0 {
+		t.unit = Division / 2
+	}
+	return nil
+}
+
+// target returns the voice that tempo, meter and key fields apply to.
+// Header fields belong to the first voice, whose measures drive the conductor track.
+func (t *abcTune) target(inBody bool) *abcVoice {
+	if inBody {
+		return t.voice
+	}
+	return t.voices[0]
+}
+
+func (t *abcTune) applyKey(value string, target *abcVoice) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || fields[0] == "none" || strings.HasPrefix(fields[0], "H") {
+		t.keyFifths = 0
+		t.keyAccidentals = map[byte]int{}
+		return
+	}
+
+	tonic := fields[0]
+	root := strings.ToUpper(tonic[:1])
+	rest := tonic[1:]
+	if strings.HasPrefix(rest, "#") || strings.HasPrefix(rest, "b") {
+		root += rest[:1]
+		rest = rest[1:]
+	}
+	mode := strings.ToLower(rest)
+	if mode == "" && len(fields) > 1 {
+		mode = strings.ToLower(fields[1])
+	}
+	if len(mode) > 3 {
+		mode = mode[:3]
+	}
+
+	fifths := majorFifths[root] + modeOffsets[mode]
+	t.keyFifths = max(-7, min(7, fifths))
+	t.keyAccidentals = map[byte]int{}
+	for i := 0; i < t.keyFifths; i++ {
+		t.keyAccidentals[sharpOrder[i]] = 1
+	}
+	for i := 0; i < -t.keyFifths; i++ {
+		t.keyAccidentals[flatOrder[i]] = -1
+	}
+
+	minor := mode == "m" || mode == "min" || mode == "aeo"
+	target.current.keySignature = &midi.KeySignature{Sharps: int8(t.keyFifths), Minor: minor}
+}
+
+// parseTempo accepts "1/4=120", "3/8=60", "\"Allegro\" 1/4=120" and a bare number in unit notes per minute
+func (t *abcTune) parseTempo(value string) (float64, bool) {
+	if i := strings.LastIndex(value, "\""); i >= 0 {
+		value = value[i+1:]
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	beat, bpmText := "", value
+	if i := strings.Index(value, "="); i >= 0 {
+		beat, bpmText = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	}
+	bpm, err := strconv.ParseFloat(strings.Fields(bpmText)[0], 64)
+	if err != nil || bpm <= 0 {
+		return 0, false
+	}
+
+	beatTicks := float64(t.unit)
+	if beat != "" {
+		beatTicks = 0
+		// Several beat lengths such as "1/4 3/8=40" add up
+		for _, b := range strings.Fields(beat) {
+			if num, den, ok := parseFraction(b); ok {
+				beatTicks += float64(Division * 4 * num / den)
+			}
+		}
+		if beatTicks == 0 {
+			beatTicks = float64(t.unit)
+		}
+	}
+	return bpm * beatTicks / Division, true
+}
+
+func parseMeter(value string) midi.TimeSignature {
+	switch strings.TrimSpace(value) {
+	case "C":
+		return midi.TimeSignature{Numerator: 4, Denominator: 4}
+	case "C|":
+		return midi.TimeSignature{Numerator: 2, Denominator: 2}
+	}
+	num, den, ok := parseFraction(value)
+	if !ok || num > 255 || den > 128 {
+		return midi.TimeSignature{Numerator: 4, Denominator: 4}
+	}
+	return midi.TimeSignature{Numerator: uint8(num), Denominator: uint8(den)}
+}
+
+// parseFraction parses "3/4" and compound numerators such as "2+3/8"
+func parseFraction(value string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	num := 0
+	for _, n := range strings.Split(parts[0], "+") {
+		v, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil {
+			return 0, 0, false
+		}
+		num += v
+	}
+	den, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || num <= 0 || den <= 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
+
+// closeMeasure ends the current measure at a bar line.
+// Empty measures, such as the one before a leading "|:", are dropped but keep their attributes.
+func (v *abcVoice) closeMeasure(backwardRepeat bool) {
+	m := v.current
+	m.length = max(m.length, v.cursor)
+	m.backwardRepeat = m.backwardRepeat || backwardRepeat
+
+	if m.length == 0 && len(m.notes) == 0 {
+		v.current = measure{
+			timeSignature: m.timeSignature,
+			keySignature:  m.keySignature,
+			tempos:        m.tempos,
+			forwardRepeat: m.forwardRepeat,
+			endings:       m.endings,
+		}
+		if backwardRepeat && len(v.measures) > 0 {
+			v.measures[len(v.measures)-1].backwardRepeat = true
+		}
+		return
+	}
+
+	v.measures = append(v.measures, m)
+	v.current = measure{}
+	v.cursor = 0
+	v.barAccidentals = map[string]int{}
+}
+
+// parseMusic tokenizes one line of the tune body
+func (t *abcTune) parseMusic(line string) error {
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '`' || c == '\\':
+			i++
+
+		case c == '"':
+			// Chord symbols and annotations
+			end := strings.IndexByte(line[i+1:], '"')
+			if end < 0 {
+				return nil
+			}
+			i += end + 2
+
+		case c == '!' || (c == '+' && i+1 < len(line) && unicode.IsLetter(rune(line[i+1]))):
+			end := strings.IndexByte(line[i+1:], c)
+			if end < 0 {
+				return nil
+			}
+			if v, ok := dynamicVelocities[line[i+1:i+1+end]]; ok {
+				t.voice.velocity = v
+			}
+			i += end + 2
+
+		case c == '{':
+			// Grace notes take no time in this importer
+			end := strings.IndexByte(line[i:], '}')
+			if end < 0 {
+				return nil
+			}
+			i += end + 1
+
+		case c == '[' && i+2 < len(line) && line[i+2] == ':' && unicode.IsLetter(rune(line[i+1])):
+			// Inline field such as [K:D] or [Q:1/4=90]
+			end := strings.IndexByte(line[i:], ']')
+			if end < 0 {
+				return utilities.WrapError(fmt.Errorf("unterminated inline field"), ErrInvalidABC)
+			}
+			if err := t.applyField(line[i+1], strings.TrimSpace(line[i+3:i+end]), true); err != nil {
+				return err
+			}
+			i += end + 1
+
+		case c == '[' && i+1 < len(line) && unicode.IsDigit(rune(line[i+1])):
+			var err error
+			if i, err = t.parseEnding(line, i+1); err != nil {
+				return err
+			}
+
+		case c == '|' || c == ':' || (c == '[' && i+1 < len(line) && line[i+1] == '|'):
+			var err error
+			if i, err = t.parseBar(line, i); err != nil {
+				return err
+			}
+
+		case c == '(':
+			if i+1 < len(line) && unicode.IsDigit(rune(line[i+1])) {
+				i = t.parseTuplet(line, i+1)
+			} else {
+				i++ // slur
+			}
+
+		case c == ')' || c == '.' || c == '~' || c == 'H' || c == 'L' || c == 'M' || c == 'O' ||
+			c == 'P' || c == 'S' || c == 'T' || c == 'u' || c == 'v' || c == '-':
+			i++
+
+		case c == '>' || c == '<':
+			n := 1
+			for i+n < len(line) && line[i+n] == c {
+				n++
+			}
+			if n > maxBrokenRhythm {
+				return utilities.WrapError(fmt.Errorf("broken rhythm longer than %d", maxBrokenRhythm), ErrInvalidABC)
+			}
+			t.applyBrokenRhythm(c, n)
+			i += n
+
+		case c == '[':
+			var err error
+			if i, err = t.parseChord(line, i+1); err != nil {
+				return err
+			}
+
+		case c == 'z' || c == 'x':
+			num, den, next, err := parseLength(line, i+1)
+			if err != nil {
+				return err
+			}
+			t.advance(t.noteDuration(num, den))
+			i = next
+
+		case c == 'Z' || c == 'X':
+			bars, next := 1, i+1
+			for next < len(line) && unicode.IsDigit(rune(line[next])) {
+				next++
+			}
+			if next > i+1 {
+				var err error
+				if bars, err = strconv.Atoi(line[i+1 : next]); err != nil || bars > maxRestMeasures {
+					return utilities.WrapError(fmt.Errorf("rest of more than %d measures", maxRestMeasures), ErrInvalidABC)
+				}
+			}
+			measureTicks := uint32(Division*4*int(t.meter.Numerator)) / uint32(t.meter.Denominator)
+			for b := 0; b < bars; b++ {
+				t.advance(measureTicks)
+				if b < bars-1 {
+					t.voice.closeMeasure(false)
+				}
+			}
+			i = next
+
+		case strings.IndexByte("^_=ABCDEFGabcdefg", c) >= 0:
+			pitch, next, err := t.parsePitch(line, i)
+			if err != nil {
+				return err
+			}
+			num, den, next, err := parseLength(line, next)
+			if err != nil {
+				return err
+			}
+			tied := next < len(line) && line[next] == '-'
+			if tied {
+				next++
+			}
+			duration := t.noteDuration(num, den)
+			t.addNote(pitch, t.voice.cursor, duration, tied)
+			t.advance(duration)
+			i = next
+
+		default:
+			// Unknown symbols are skipped rather than failing the whole import
+			i++
+		}
+	}
+	return nil
+}
+
+func (t *abcTune) parseBar(line string, i int) (int, error) {
+	start := i
+	for i < len(line) && strings.IndexByte("|:[]", line[i]) >= 0 {
+		// Stop before "[1" so it is read as an ending, and before an inline field
+		if line[i] == '[' && i+1 < len(line) && line[i+1] != '|' {
+			break
+		}
+		i++
+	}
+	bar := line[start:i]
+
+	backward := strings.HasPrefix(bar, ":")
+	forward := strings.HasSuffix(bar, ":")
+	v := t.voice
+	v.closeMeasure(backward)
+
+	// Repeats and double bars end any running numbered ending
+	if backward || forward || strings.Contains(bar, "||") || strings.Contains(bar, "]") || strings.Contains(bar, "[|") {
+		v.activeEndings = nil
+	}
+	if forward {
+		v.current.forwardRepeat = true
+	}
+	v.current.endings = v.activeEndings
+
+	// "|1" and ":|2" carry the ending number directly after the bar
+	if i < len(line) && unicode.IsDigit(rune(line[i])) {
+		return t.parseEnding(line, i)
+	}
+	return i, nil
+}
+
+func (t *abcTune) parseEnding(line string, i int) (int, error) {
+	start := i
+	for i < len(line) && (unicode.IsDigit(rune(line[i])) || line[i] == ',' || line[i] == '-') {
+		i++
+	}
+	var numbers []int
+	tooHigh := utilities.WrapError(fmt.Errorf("ending above %d", maxEnding), ErrInvalidABC)
+	for _, field := range strings.Split(line[start:i], ",") {
+		if lo, hi, ok := strings.Cut(field, "-"); ok {
+			from, err1 := strconv.Atoi(lo)
+			to, err2 := strconv.Atoi(hi)
+			if err1 == nil && err2 == nil {
+				if from > maxEnding || to > maxEnding {
+					return i, tooHigh
+				}
+				for n := from; n <= to; n++ {
+					numbers = append(numbers, n)
+				}
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(field); err == nil {
+			if n > maxEnding {
+				return i, tooHigh
+			}
+			numbers = append(numbers, n)
+		}
+	}
+	t.voice.activeEndings = numbers
+	t.voice.current.endings = numbers
+	return i, nil
+}
+
+// parseTuplet handles "(3" and the general "(p:q:r" form
+func (t *abcTune) parseTuplet(line string, i int) int {
+	readInt := func() int {
+		start := i
+		for i < len(line) && unicode.IsDigit(rune(line[i])) {
+			i++
+		}
+		n, _ := strconv.Atoi(line[start:i])
+		return n
+	}
+
+	p := readInt()
+	q, r := 0, p
+	if i < len(line) && line[i] == ':' {
+		i++
+		q = readInt()
+		if i < len(line) && line[i] == ':' {
+			i++
+			r = readInt()
+		}
+	}
+	if q == 0 {
+		switch p {
+		case 2, 4, 8:
+			q = 3
+		case 3, 6:
+			q = 2
+		default:
+			// Odd tuplets take the time of two in simple meters and three in compound ones
+			q = 2
+			if t.meter.Numerator%3 == 0 && t.meter.Numerator > 3 {
+				q = 3
+			}
+		}
+	}
+	if p > 0 {
+		t.tupletRatio = [2]uint32{uint32(q), uint32(p)}
+		t.tupletRemaining = max(r, 1)
+	}
+	return i
+}
+
+func (t *abcTune) parseChord(line string, i int) (int, error) {
+	end := strings.IndexByte(line[i:], ']')
+	if end < 0 {
+		return len(line), utilities.WrapError(fmt.Errorf("unterminated chord"), ErrInvalidABC)
+	}
+	body := line[i : i+end]
+	next := i + end + 1
+	outerNum, outerDen, next, err := parseLength(line, next)
+	if err != nil {
+		return next, err
+	}
+	tied := next < len(line) && line[next] == '-'
+	if tied {
+		next++
+	}
+
+	var chordDuration uint32
+	start := t.voice.cursor
+	for j := 0; j < len(body); {
+		if strings.IndexByte("^_=ABCDEFGabcdefg", body[j]) < 0 {
+			j++
+			continue
+		}
+		pitch, after, err := t.parsePitch(body, j)
+		if err != nil {
+			return next, err
+		}
+		num, den, after, err := parseLength(body, after)
+		if err != nil {
+			return next, err
+		}
+		noteTied := tied || (after < len(body) && body[after] == '-')
+		duration := t.scaledDuration(num*outerNum, den*outerDen)
+		if chordDuration == 0 {
+			chordDuration = duration
+		}
+		t.addNote(pitch, start, duration, noteTied)
+		j = after
+	}
+	t.consumeModifiers()
+	t.advance(chordDuration)
+	return next, nil
+}
+
+// parsePitch reads accidentals, note letter and octave marks and returns the MIDI pitch
+func (t *abcTune) parsePitch(line string, i int) (uint8, int, error) {
+	accidental, explicit := 0, false
+	for i < len(line) && (line[i] == '^' || line[i] == '_' || line[i] == '=') {
+		explicit = true
+		switch line[i] {
+		case '^':
+			accidental++
+		case '_':
+			accidental--
+		case '=':
+			accidental = 0
+		}
+		i++
+	}
+	if i >= len(line) {
+		return 0, i, utilities.WrapError(fmt.Errorf("accidental without note"), ErrInvalidABC)
+	}
+
+	letter := line[i]
+	octave := 4
+	if letter >= 'a' && letter <= 'g' {
+		octave = 5
+	}
+	upper := byte(unicode.ToUpper(rune(letter)))
+	i++
+	for i < len(line) && (line[i] == '\'' || line[i] == ',') {
+		if line[i] == '\'' {
+			octave++
+		} else {
+			octave--
+		}
+		i++
+	}
+
+	// Explicit accidentals last until the bar line; otherwise the key signature applies
+	barKey := fmt.Sprintf("%c%d", upper, octave)
+	if explicit {
+		t.voice.barAccidentals[barKey] = accidental
+	} else if a, ok := t.voice.barAccidentals[barKey]; ok {
+		accidental = a
+	} else {
+		accidental = t.keyAccidentals[upper]
+	}
+
+	value := (octave+1)*12 + stepSemitones[string(upper)] + accidental
+	if value < 0 || value > 127 {
+		return 0, i, utilities.WrapError(fmt.Errorf("pitch out of range"), ErrInvalidABC)
+	}
+	return uint8(value), i, nil
+}
+
+// parseLength reads a note length multiplier such as "2", "/2", "3/2" or "//".
+// The multiplier and the divisor are each at most maxLengthFactor.
+func parseLength(line string, i int) (int, int, int, error) {
+	tooLong := utilities.WrapError(fmt.Errorf("note length beyond %d or 1/%d", maxLengthFactor, maxLengthFactor), ErrInvalidABC)
+	num, den := 1, 1
+	start := i
+	for i < len(line) && unicode.IsDigit(rune(line[i])) {
+		i++
+	}
+	if i > start {
+		n, err := strconv.Atoi(line[start:i])
+		if err != nil || n > maxLengthFactor {
+			return num, den, i, tooLong
+		}
+		num = n
+	}
+	for i < len(line) && line[i] == '/' {
+		i++
+		start = i
+		for i < len(line) && unicode.IsDigit(rune(line[i])) {
+			i++
+		}
+		d := 2
+		if i > start {
+			n, err := strconv.Atoi(line[start:i])
+			if err != nil {
+				return num, den, i, tooLong
+			}
+			d = max(n, 1)
+		}
+		if d > maxLengthFactor/den {
+			return num, den, i, tooLong
+		}
+		den *= d
+	}
+	return num, den, i, nil
+}
+
+// noteDuration applies the unit length, tuplets and broken rhythm to a note and consumes them
+func (t *abcTune) noteDuration(num, den int) uint32 {
+	duration := t.scaledDuration(num, den)
+	t.consumeModifiers()
+	return duration
+}
+
+func (t *abcTune) scaledDuration(num, den int) uint32 {
+	duration := t.unit * uint32(num) / uint32(den)
+	if t.tupletRemaining > 0 {
+		duration = duration * t.tupletRatio[0] / t.tupletRatio[1]
+	}
+	if t.brokenNext[1] > 0 {
+		duration = duration * t.brokenNext[0] / t.brokenNext[1]
+	}
+	return duration
+}
+
+func (t *abcTune) consumeModifiers() {
+	if t.tupletRemaining > 0 {
+		t.tupletRemaining--
+	}
+	t.brokenNext = [2]uint32{}
+}
+
+// applyBrokenRhythm lengthens or shortens the previous note and sets the factor for the next one
+func (t *abcTune) applyBrokenRhythm(direction byte, count int) {
+	// ">" is 3/2 then 1/2, ">>" is 7/4 then 1/4, ">>>" is 15/8 then 1/8
+	den := uint32(1) << count
+	long, short := [2]uint32{2*den - 1, den}, [2]uint32{1, den}
+	previous, next := long, short
+	if direction == '<' {
+		previous, next = short, long
+	}
+
+	v := t.voice
+	if ref := v.lastNote; ref != nil {
+		notes := v.noteSlice(ref.measure)
+		if ref.note < len(notes) {
+			oldStart := notes[ref.note].start
+			oldDuration := notes[ref.note].duration
+			newDuration := oldDuration * previous[0] / previous[1]
+			// Apply to every note of the previous chord and move the cursor accordingly
+			for n := range notes {
+				if notes[n].start == oldStart {
+					notes[n].duration = newDuration
+				}
+			}
+			if ref.measure == len(v.measures) {
+				v.cursor = oldStart + newDuration
+			}
+		}
+	}
+	t.brokenNext = next
+}
+
+func (v *abcVoice) noteSlice(measureIndex int) []timedNote {
+	if measureIndex == len(v.measures) {
+		return v.current.notes
+	}
+	return v.measures[measureIndex].notes
+}
+
+func (t *abcTune) addNote(pitch uint8, start, duration uint32, tied bool) {
+	v := t.voice
+	if ref, ok := v.openTies[pitch]; ok {
+		notes := v.noteSlice(ref.measure)
+		elapsed := tiedElapsed(v.measures, ref.measure, len(v.measures))
+		notes[ref.note].duration = elapsed + start + duration - notes[ref.note].start
+		if !tied {
+			delete(v.openTies, pitch)
+		}
+		v.lastNote = &ref
+		return
+	}
+
+	v.current.notes = append(v.current.notes, timedNote{start: start, duration: duration, pitch: pitch, velocity: v.velocity})
+	ref := noteRef{measure: len(v.measures), note: len(v.current.notes) - 1}
+	v.lastNote = &ref
+	if tied {
+		v.openTies[pitch] = ref
+	}
+}
+
+func (t *abcTune) advance(duration uint32) {
+	t.voice.cursor += duration
+	t.voice.current.length = max(t.voice.current.length, t.voice.cursor)
+}
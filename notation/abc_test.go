@@ -0,0 +1,124 @@
+package notation
+
+import (
+	"strings"
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pitches(notes []midi.Note) []uint8 {
+	var values []uint8
+	for _, note := range notes {
+		values = append(values, note.Pitch)
+	}
+	return values
+}
+
+func TestImportABC_HeaderAndKey(t *testing.T) {
+	tune := `X:1
+T:Scale in G
+M:3/4
+L:1/4
+Q:1/4=90
+K:G
+GAB|cde|f=fg|]
+`
+	file, err := ImportABC(strings.NewReader(tune))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Scale in G", file.Tracks[0].Name)
+	assert.InDelta(t, 90, file.Tempos()[0].BPM(), 0.01)
+	assert.Equal(t, midi.TimeSignature{Numerator: 3, Denominator: 4}, file.TimeSignatures()[0])
+	assert.Equal(t, []midi.KeySignature{{Sharps: 1}}, file.KeySignatures())
+
+	notes := file.Notes()
+	// F is sharp from the key until the natural sign, which lasts to the end of the bar
+	assert.Equal(t, []uint8{67, 69, 71, 72, 74, 76, 78, 77, 79}, pitches(notes))
+	assert.Equal(t, uint32(Division), notes[0].Duration())
+	assert.Equal(t, uint32(8*Division), notes[8].Start)
+}
+
+func TestImportABC_RepeatsAndEndings(t *testing.T) {
+	tune := `X:1
+T:Repeats
+M:2/4
+L:1/4
+K:C
+|:C D|[1 E F:|[2 G A|]
+`
+	file, err := ImportABC(strings.NewReader(tune))
+	require.NoError(t, err)
+
+	assert.Equal(t, []uint8{60, 62, 64, 65, 60, 62, 67, 69}, pitches(file.Notes()))
+}
+
+func TestImportABC_LengthsChordsTiesAndTuplets(t *testing.T) {
+	tune := `X:1
+T:Rhythm
+M:4/4
+L:1/8
+K:C
+A2 A/2A/2 A>A [CEG]2 (3ABc c4-|c4 z4|]
+`
+	file, err := ImportABC(strings.NewReader(tune))
+	require.NoError(t, err)
+
+	notes := file.Notes()
+	durations := []uint32{}
+	for _, note := range notes {
+		durations = append(durations, note.Duration())
+	}
+	// A2, two sixteenths, dotted eighth and sixteenth, a quarter chord, an eighth triplet,
+	// then a half note tied across the bar into another half note
+	assert.Equal(t, []uint32{480, 120, 120, 360, 120, 480, 480, 480, 160, 160, 160, 1920}, durations)
+	assert.Equal(t, []uint8{69, 69, 69, 69, 69, 60, 64, 67, 69, 71, 72, 72}, pitches(notes))
+}
+
+func TestImportABC_DynamicsAndVoices(t *testing.T) {
+	tune := `X:1
+T:Duet
+M:2/4
+L:1/4
+K:C
+V:1
+!p!c d|
+V:2
+!f!C, D,|
+`
+	file, err := ImportABC(strings.NewReader(tune))
+	require.NoError(t, err)
+
+	require.Len(t, file.Tracks, 3)
+	notes := file.Notes()
+	require.Len(t, notes, 4)
+	assert.Equal(t, uint8(49), notes[1].Velocity)
+	assert.Equal(t, uint8(96), notes[0].Velocity)
+	assert.NotEqual(t, notes[0].Channel, notes[1].Channel)
+}
+
+func TestImportABC_MissingKey(t *testing.T) {
+	_, err := ImportABC(strings.NewReader("X:1\nT:No key\nabc|\n"))
+	assert.ErrorIs(t, err, ErrInvalidABC)
+}
+
+func TestImportABC_Limits(t *testing.T) {
+	for _, body := range []string{
+		"A/4294967296|",      // a divisor wrapping to zero
+		"A////////////////|", // halved past the limit
+		"A>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>B|",
+		"A999999999999|",
+		"|:A:|[1-1000000000 B|",
+		"Z99999999|",
+		"[AB]/1000|",
+	} {
+		_, err := ImportABC(strings.NewReader("X:1\nL:1/8\nK:C\n" + body + "\n"))
+		assert.ErrorIs(t, err, ErrInvalidABC, body)
+	}
+
+	_, err := ImportABC(strings.NewReader("X:1\nL:1/8\nK:C\nA/64 B>>>c Z4|[1-3 d:|\n"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,432 @@
+package notation
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"sort"
+
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+)
+
+var (
+	ErrInvalidGrid   = fmt.Errorf("quantization grid must be a power of two between 1 and 32")
+	ErrExportFailure = fmt.Errorf("failed to export MusicXML")
+)
+
+const musicXMLDoctype = `<!DOCTYPE score-partwise PUBLIC "-//Recordare//DTD MusicXML 4.0 Partwise//EN" "http://www.musicxml.org/dtds/partwise.dtd">`
+
+// ExportOptions controls how MIDI timing and pitches are mapped onto notation
+type ExportOptions struct {
+	Grid       int   // quantization steps per quarter note, e.g. 4 for sixteenths
+	SplitPitch uint8 // notes at or above go to the treble staff, below to the bass staff
+}
+
+// DefaultExportOptions quantizes to sixteenth notes and splits the staves at middle C
+func DefaultExportOptions() ExportOptions {
+	return ExportOptions{Grid: 4, SplitPitch: 60}
+}
+
+// Validate reports whether the options can be rendered with standard note values
+func (o ExportOptions) Validate() error {
+	if o.Grid < 1 || o.Grid > 32 || o.Grid&(o.Grid-1) != 0 {
+		return ErrInvalidGrid
+	}
+	return nil
+}
+
+// noteTypes lists MusicXML note types with their length in quarter notes, longest first
+var noteTypes = []struct {
+	name     string
+	quarters float64
+}{
+	{"whole", 4}, {"half", 2}, {"quarter", 1}, {"eighth", 0.5}, {"16th", 0.25}, {"32nd", 0.125}, {"64th", 0.0625}, {"128th", 0.03125},
+}
+
+type pitchSpelling struct {
+	step  string
+	alter int
+}
+
+// Spellings of the twelve pitch classes with sharps and with flats
+var (
+	sharpSpelling = [12]pitchSpelling{{"C", 0}, {"C", 1}, {"D", 0}, {"D", 1}, {"E", 0}, {"F", 0}, {"F", 1}, {"G", 0}, {"G", 1}, {"A", 0}, {"A", 1}, {"B", 0}}
+	flatSpelling  = [12]pitchSpelling{{"C", 0}, {"D", -1}, {"D", 0}, {"E", -1}, {"E", 0}, {"F", 0}, {"G", -1}, {"G", 0}, {"A", -1}, {"A", 0}, {"B", -1}, {"B", 0}}
+)
+
+type xEmpty struct{}
+
+type xScorePartwise struct {
+	XMLName  xml.Name   `xml:"score-partwise"`
+	Version  string     `xml:"version,attr"`
+	Title    string     `xml:"work>work-title,omitempty"`
+	PartList xPartList  `xml:"part-list"`
+	Parts    []xOutPart `xml:"part"`
+}
+
+type xPartList struct {
+	ScorePart struct {
+		ID   string `xml:"id,attr"`
+		Name string `xml:"part-name"`
+	} `xml:"score-part"`
+}
+
+type xOutPart struct {
+	ID       string        `xml:"id,attr"`
+	Measures []xOutMeasure `xml:"measure"`
+}
+
+type xOutMeasure struct {
+	Number  int   `xml:"number,attr"`
+	Content []any // attributes, directions, notes and backups in document order
+}
+
+type xAttributes struct {
+	XMLName   xml.Name  `xml:"attributes"`
+	Divisions int       `xml:"divisions,omitempty"`
+	Key       *xKeyOut  `xml:"key"`
+	Time      *xTimeOut `xml:"time"`
+	Staves    int       `xml:"staves,omitempty"`
+	Clefs     []xClef   `xml:"clef"`
+}
+
+type xKeyOut struct {
+	Fifths int    `xml:"fifths"`
+	Mode   string `xml:"mode"`
+}
+
+type xTimeOut struct {
+	Beats    int `xml:"beats"`
+	BeatType int `xml:"beat-type"`
+}
+
+type xClef struct {
+	Number int    `xml:"number,attr"`
+	Sign   string `xml:"sign"`
+	Line   int    `xml:"line"`
+}
+
+type xDirection struct {
+	XMLName       xml.Name `xml:"direction"`
+	Placement     string   `xml:"placement,attr"`
+	DirectionType struct {
+		Metronome struct {
+			BeatUnit  string `xml:"beat-unit"`
+			PerMinute string `xml:"per-minute"`
+		} `xml:"metronome"`
+	} `xml:"direction-type"`
+	Sound struct {
+		Tempo string `xml:"tempo,attr"`
+	} `xml:"sound"`
+}
+
+type xBackup struct {
+	XMLName  xml.Name `xml:"backup"`
+	Duration int      `xml:"duration"`
+}
+
+type xNote struct {
+	XMLName   xml.Name    `xml:"note"`
+	Chord     *xEmpty     `xml:"chord"`
+	Pitch     *xPitchOut  `xml:"pitch"`
+	Rest      *xEmpty     `xml:"rest"`
+	Duration  int         `xml:"duration"`
+	Ties      []xTieOut   `xml:"tie"`
+	Voice     int         `xml:"voice"`
+	Type      string      `xml:"type"`
+	Dots      []xEmpty    `xml:"dot"`
+	Staff     int         `xml:"staff"`
+	Notations *xNotations `xml:"notations"`
+}
+
+type xPitchOut struct {
+	Step   string `xml:"step"`
+	Alter  int    `xml:"alter,omitempty"`
+	Octave int    `xml:"octave"`
+}
+
+type xNotations struct {
+	Tied []xTieOut `xml:"tied"`
+}
+
+type xTieOut struct {
+	Type string `xml:"type,attr"`
+}
+
+// segment is a chord or rest on one staff, in grid units
+type segment struct {
+	start, end int
+	pitches    []uint8 // empty for a rest
+}
+
+// ExportMusicXML writes the file as a two-staff piano score in partwise MusicXML.
+// Notes are quantized to the grid, split between treble and bass staves at the split pitch,
+// and each staff is reduced to a single voice of chords and rests. Percussion is left out.
+func ExportMusicXML(file *midi.File, title string, opts ExportOptions) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	gridTicks := float64(file.Division) / float64(opts.Grid)
+	quantize := func(tick uint32) int { return int(math.Round(float64(tick) / gridTicks)) }
+
+	// Quantize notes onto the two staves
+	var staves [2][]segment
+	var lastTick uint32
+	for _, note := range file.Notes() {
+		if note.Channel == percussionChan {
+			continue
+		}
+		start, end := quantize(note.Start), quantize(note.End)
+		if end <= start {
+			end = start + 1
+		}
+		staff := 0
+		if note.Pitch < opts.SplitPitch {
+			staff = 1
+		}
+		staves[staff] = append(staves[staff], segment{start: start, end: end, pitches: []uint8{note.Pitch}})
+		lastTick = max(lastTick, note.End)
+	}
+
+	// Measure boundaries in grid units, plus the meter in force at each
+	type bar struct {
+		start, end int
+		meter      midi.TimeSignature
+	}
+	signatures := file.TimeSignatures()
+	var bars []bar
+	for _, tick := range file.MeasureStarts(max(lastTick, 1)) {
+		meter := signatures[0]
+		for _, s := range signatures {
+			if s.Tick <= tick {
+				meter = s
+			}
+		}
+		if tick >= max(lastTick, 1) && len(bars) > 0 {
+			break
+		}
+		b := bar{start: quantize(tick), meter: meter}
+		b.end = quantize(tick + file.TicksPerMeasure(meter))
+		if n := len(bars); n > 0 {
+			bars[n-1].end = b.start
+		}
+		bars = append(bars, b)
+	}
+	totalEnd := bars[len(bars)-1].end
+
+	fifths, minor := 0, false
+	if keys := file.KeySignatures(); len(keys) > 0 {
+		fifths, minor = int(keys[0].Sharps), keys[0].Minor
+	}
+	spelling := sharpSpelling
+	if fifths < 0 {
+		spelling = flatSpelling
+	}
+
+	chords := [2][]segment{chordsAndRests(staves[0], totalEnd), chordsAndRests(staves[1], totalEnd)}
+	tempos := file.Tempos()
+	keys := file.KeySignatures()
+
+	doc := xScorePartwise{Version: "4.0", Title: title}
+	doc.PartList.ScorePart.ID = "P1"
+	doc.PartList.ScorePart.Name = "Piano"
+	part := xOutPart{ID: "P1"}
+
+	var prevMeter midi.TimeSignature
+	prevFifths, prevMinor := fifths, minor
+	for i, b := range bars {
+		measure := xOutMeasure{Number: i + 1}
+		attributes := xAttributes{}
+		changed := false
+
+		if i == 0 {
+			attributes.Divisions = opts.Grid
+			attributes.Staves = 2
+			attributes.Clefs = []xClef{{Number: 1, Sign: "G", Line: 2}, {Number: 2, Sign: "F", Line: 4}}
+			changed = true
+		}
+		// Key changes take effect at the bar they fall in
+		for _, k := range keys {
+			if q := quantize(k.Tick); q >= b.start && q < b.end && (i == 0 || int(k.Sharps) != prevFifths || k.Minor != prevMinor) {
+				prevFifths, prevMinor = int(k.Sharps), k.Minor
+				changed = true
+				spelling = sharpSpelling
+				if prevFifths < 0 {
+					spelling = flatSpelling
+				}
+			}
+		}
+		if i == 0 || changed {
+			mode := "major"
+			if prevMinor {
+				mode = "minor"
+			}
+			attributes.Key = &xKeyOut{Fifths: prevFifths, Mode: mode}
+		}
+		if b.meter.Numerator != prevMeter.Numerator || b.meter.Denominator != prevMeter.Denominator {
+			attributes.Time = &xTimeOut{Beats: int(b.meter.Numerator), BeatType: int(b.meter.Denominator)}
+			prevMeter = b.meter
+			changed = true
+		}
+		if changed {
+			measure.Content = append(measure.Content, attributes)
+		}
+
+		for _, tempo := range tempos {
+			if q := quantize(tempo.Tick); q >= b.start && q < b.end {
+				direction := xDirection{Placement: "above"}
+				direction.DirectionType.Metronome.BeatUnit = "quarter"
+				direction.DirectionType.Metronome.PerMinute = fmt.Sprintf("%.0f", tempo.BPM())
+				direction.Sound.Tempo = fmt.Sprintf("%.2f", tempo.BPM())
+				measure.Content = append(measure.Content, direction)
+			}
+		}
+
+		for staff := 0; staff < 2; staff++ {
+			if staff == 1 {
+				measure.Content = append(measure.Content, xBackup{Duration: b.end - b.start})
+			}
+			for _, s := range chords[staff] {
+				if s.end <= b.start || s.start >= b.end {
+					continue
+				}
+				pieceStart, pieceEnd := max(s.start, b.start), min(s.end, b.end)
+				tiedFromBefore, tiedToAfter := s.start < b.start, s.end > b.end
+				measure.Content = append(measure.Content,
+					segmentNotes(s.pitches, pieceEnd-pieceStart, tiedFromBefore, tiedToAfter, staff, opts.Grid, spelling)...)
+			}
+		}
+		part.Measures = append(part.Measures, measure)
+	}
+	doc.Parts = []xOutPart{part}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(musicXMLDoctype + "\n")
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return nil, utilities.WrapError(err, ErrExportFailure)
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// chordsAndRests reduces the notes of one staff to a single voice of chords separated by rests.
+// A chord lasts until the longest of its notes ends or the next onset, whichever is first.
+func chordsAndRests(notes []segment, end int) []segment {
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].start < notes[j].start })
+
+	var out []segment
+	cursor := 0
+	for i := 0; i < len(notes); {
+		start := notes[i].start
+		chord := segment{start: max(start, cursor)}
+		chordEnd := 0
+		for ; i < len(notes) && notes[i].start == start; i++ {
+			if !containsPitch(chord.pitches, notes[i].pitches[0]) {
+				chord.pitches = append(chord.pitches, notes[i].pitches[0])
+			}
+			chordEnd = max(chordEnd, notes[i].end)
+		}
+		if i < len(notes) {
+			chordEnd = min(chordEnd, notes[i].start)
+		}
+		// Chords swallowed entirely by the previous one are dropped
+		if chordEnd <= chord.start {
+			continue
+		}
+		if chord.start > cursor {
+			out = append(out, segment{start: cursor, end: chord.start})
+		}
+		chord.end = chordEnd
+		sort.Slice(chord.pitches, func(a, b int) bool { return chord.pitches[a] < chord.pitches[b] })
+		out = append(out, chord)
+		cursor = chordEnd
+	}
+	if cursor < end {
+		out = append(out, segment{start: cursor, end: end})
+	}
+	return out
+}
+
+func containsPitch(pitches []uint8, pitch uint8) bool {
+	for _, p := range pitches {
+		if p == pitch {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentNotes writes one chord or rest piece within a measure, splitting it into tied standard note values
+func segmentNotes(pitches []uint8, duration int, tiedFromBefore, tiedToAfter bool, staff, grid int, spelling [12]pitchSpelling) []any {
+	values := decomposeDuration(duration, grid)
+	var out []any
+	for v, value := range values {
+		tieStop := tiedFromBefore || v > 0
+		tieStart := tiedToAfter || v < len(values)-1
+
+		if len(pitches) == 0 {
+			out = append(out, xNote{Rest: &xEmpty{}, Duration: value.units, Voice: staff*4 + 1, Type: value.name, Dots: make([]xEmpty, value.dots), Staff: staff + 1})
+			continue
+		}
+		for p, pitch := range pitches {
+			note := xNote{Duration: value.units, Voice: staff*4 + 1, Type: value.name, Dots: make([]xEmpty, value.dots), Staff: staff + 1}
+			if p > 0 {
+				note.Chord = &xEmpty{}
+			}
+			sp := spelling[pitch%12]
+			// B# and Cb never occur with these spellings, so the octave follows the MIDI number directly
+			note.Pitch = &xPitchOut{Step: sp.step, Alter: sp.alter, Octave: int(pitch)/12 - 1}
+			var tied []xTieOut
+			if tieStop {
+				tied = append(tied, xTieOut{Type: "stop"})
+			}
+			if tieStart {
+				tied = append(tied, xTieOut{Type: "start"})
+			}
+			if len(tied) > 0 {
+				note.Ties = tied
+				note.Notations = &xNotations{Tied: tied}
+			}
+			out = append(out, note)
+		}
+	}
+	return out
+}
+
+type noteValue struct {
+	name  string
+	dots  int
+	units int
+}
+
+// decomposeDuration splits a duration in grid units into the fewest standard (optionally dotted) note values
+func decomposeDuration(units, grid int) []noteValue {
+	var candidates []noteValue
+	for _, t := range noteTypes {
+		base := t.quarters * float64(grid)
+		for dots, factor := range []float64{1, 1.5, 1.75} {
+			length := base * factor
+			if length >= 1 && length == math.Trunc(length) {
+				candidates = append(candidates, noteValue{name: t.name, dots: dots, units: int(length)})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].units > candidates[j].units })
+
+	var values []noteValue
+	for units > 0 {
+		for _, c := range candidates {
+			if c.units <= units {
+				values = append(values, c)
+				units -= c.units
+				break
+			}
+		}
+	}
+	return values
+}
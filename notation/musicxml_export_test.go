@@ -0,0 +1,65 @@
+package notation
+
+import (
+	"bytes"
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exportTestFile() *midi.File {
+	file := midi.NewFile(Division)
+	conductor := file.AddTrack("Export")
+	conductor.AddTempo(0, 90)
+	conductor.AddTimeSignature(0, 3, 4)
+	conductor.AddKeySignature(0, -2, false)
+	track := file.AddTrack("Piano")
+	// Held across the bar line, so it must be tied
+	track.AddNote(0, 70, 80, 0, 4*Division)
+	track.AddNote(0, 48, 80, 0, 3*Division)
+	// Slightly late, should snap to the downbeat of the second bar
+	track.AddNote(0, 50, 80, 3*Division+10, 4*Division-10)
+	// Percussion is left out of the score
+	track.AddNote(percussionChan, 36, 100, 0, Division)
+	return file
+}
+
+func TestExportMusicXML_RoundTrip(t *testing.T) {
+	data, err := ExportMusicXML(exportTestFile(), "Export", DefaultExportOptions())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "<step>B</step>")
+	assert.Contains(t, string(data), "<alter>-1</alter>")
+	assert.Contains(t, string(data), `<tied type="start"></tied>`)
+	assert.Contains(t, string(data), "<staff>2</staff>")
+
+	file, err := ImportMusicXML(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, "Export", file.Tracks[0].Name)
+	assert.InDelta(t, 90, file.Tempos()[0].BPM(), 0.01)
+	assert.Equal(t, midi.TimeSignature{Numerator: 3, Denominator: 4}, file.TimeSignatures()[0])
+	assert.Equal(t, []midi.KeySignature{{Sharps: -2}}, file.KeySignatures())
+
+	notes := file.Notes()
+	require.Equal(t, []uint8{48, 70, 50}, pitches(notes))
+	assert.Equal(t, uint32(3*Division), notes[0].Duration())
+	assert.Equal(t, uint32(4*Division), notes[1].Duration())
+	assert.Equal(t, uint32(3*Division), notes[2].Start)
+	assert.Equal(t, uint32(Division), notes[2].Duration())
+}
+
+func TestExportMusicXML_InvalidGrid(t *testing.T) {
+	_, err := ExportMusicXML(exportTestFile(), "", ExportOptions{Grid: 3, SplitPitch: 60})
+	assert.ErrorIs(t, err, ErrInvalidGrid)
+}
+
+func TestDecomposeDuration(t *testing.T) {
+	// With sixteenth-note resolution
+	assert.Equal(t, []noteValue{{name: "half", dots: 1, units: 12}}, decomposeDuration(12, 4))
+	assert.Equal(t, []noteValue{{name: "quarter", dots: 2, units: 7}}, decomposeDuration(7, 4))
+	assert.Equal(t, []noteValue{{name: "half", units: 8}, {name: "16th", units: 1}}, decomposeDuration(9, 4))
+	// A coarse grid only offers values it can express
+	assert.Equal(t, []noteValue{{name: "whole", units: 4}, {name: "quarter", units: 1}}, decomposeDuration(5, 1))
+}
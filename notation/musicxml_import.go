@@ -0,0 +1,421 @@
+package notation
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+)
+
+type mxScore struct {
+	XMLName       xml.Name      `xml:"score-partwise"`
+	WorkTitle     string        `xml:"work>work-title"`
+	MovementTitle string        `xml:"movement-title"`
+	ScoreParts    []mxScorePart `xml:"part-list>score-part"`
+	Parts         []mxPart      `xml:"part"`
+}
+
+type mxScorePart struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:"part-name"`
+	MidiChannel int    `xml:"midi-instrument>midi-channel"`
+	MidiProgram int    `xml:"midi-instrument>midi-program"`
+}
+
+type mxPart struct {
+	ID       string      `xml:"id,attr"`
+	Measures []mxMeasure `xml:"measure"`
+}
+
+// mxMeasure keeps its children in document order, which matters for backup/forward and chords
+type mxMeasure struct {
+	Number   string      `xml:"number,attr"`
+	Children []mxElement `xml:",any"`
+}
+
+// mxElement is a union of the measure children the importer understands
+type mxElement struct {
+	XMLName xml.Name
+
+	// <note>
+	Pitch    *mxPitch  `xml:"pitch"`
+	Rest     *struct{} `xml:"rest"`
+	Chord    *struct{} `xml:"chord"`
+	Grace    *struct{} `xml:"grace"`
+	Duration int       `xml:"duration"`
+	Ties     []mxTie   `xml:"tie"`
+
+	// <attributes>
+	Divisions int     `xml:"divisions"`
+	Key       *mxKey  `xml:"key"`
+	Time      *mxTime `xml:"time"`
+
+	// <direction>
+	DirectionTypes []mxDirectionType `xml:"direction-type"`
+	Sound          *mxSound          `xml:"sound"`
+
+	// <barline>
+	Repeat *mxRepeat `xml:"repeat"`
+	Ending *mxEnding `xml:"ending"`
+
+	// Attributes of <sound> as a direct measure child; dynamics is also a per-note attribute
+	Tempo    string `xml:"tempo,attr"`
+	Dynamics string `xml:"dynamics,attr"`
+}
+
+type mxPitch struct {
+	Step   string  `xml:"step"`
+	Alter  float64 `xml:"alter"`
+	Octave int     `xml:"octave"`
+}
+
+type mxTie struct {
+	Type string `xml:"type,attr"`
+}
+
+type mxKey struct {
+	Fifths int    `xml:"fifths"`
+	Mode   string `xml:"mode"`
+}
+
+type mxTime struct {
+	Beats    string `xml:"beats"`
+	BeatType string `xml:"beat-type"`
+}
+
+type mxDirectionType struct {
+	Dynamics *struct {
+		Marks []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"dynamics"`
+}
+
+type mxSound struct {
+	Tempo    string `xml:"tempo,attr"`
+	Dynamics string `xml:"dynamics,attr"`
+}
+
+type mxRepeat struct {
+	Direction string `xml:"direction,attr"`
+	Times     int    `xml:"times,attr"`
+}
+
+type mxEnding struct {
+	Number string `xml:"number,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+var stepSemitones = map[string]int{"C": 0, "D": 2, "E": 4, "F": 5, "G": 7, "A": 9, "B": 11}
+
+// musicXMLTitle returns the work or movement title of a partwise MusicXML document, if any
+func musicXMLTitle(s *mxScore) string {
+	if title := strings.TrimSpace(s.WorkTitle); title != "" {
+		return title
+	}
+	return strings.TrimSpace(s.MovementTitle)
+}
+
+// ImportMusicXML converts an uncompressed partwise MusicXML document into a MIDI file.
+// Tempo, time and key signatures, repeats with first/second endings, ties and dynamics are preserved.
+func ImportMusicXML(r io.Reader) (*midi.File, error) {
+	var doc mxScore
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidMusicXML)
+	}
+
+	s := score{title: musicXMLTitle(&doc)}
+	for i, p := range doc.Parts {
+		info := mxScorePart{}
+		for _, sp := range doc.ScoreParts {
+			if sp.ID == p.ID {
+				info = sp
+			}
+		}
+
+		imported := part{name: strings.TrimSpace(info.Name), channel: partChannel(i), program: info.MidiProgram - 1}
+		if info.MidiChannel >= 1 && info.MidiChannel <= 16 {
+			imported.channel = uint8(info.MidiChannel - 1)
+		}
+		measures, err := importMusicXMLPart(p)
+		if err != nil {
+			return nil, utilities.WrapError(err, ErrInvalidMusicXML, "part "+p.ID)
+		}
+		imported.measures = measures
+		s.parts = append(s.parts, imported)
+	}
+
+	file, err := buildFile(s)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidMusicXML)
+	}
+	return file, nil
+}
+
+// maxMXLEntryBytes bounds how much of an .mxl archive entry is decompressed
+const maxMXLEntryBytes = 32 << 20
+
+// ImportMXL converts a compressed MusicXML (.mxl) archive into a MIDI file
+func ImportMXL(data []byte) (*midi.File, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidMusicXML)
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	rootPath := ""
+	if rc, err := archive.Open("META-INF/container.xml"); err == nil {
+		if xml.NewDecoder(io.LimitReader(rc, maxMXLEntryBytes)).Decode(&container) == nil && len(container.Rootfiles) > 0 {
+			rootPath = container.Rootfiles[0].FullPath
+		}
+		rc.Close()
+	}
+	// Fall back to the first MusicXML file outside META-INF
+	if rootPath == "" {
+		for _, f := range archive.File {
+			ext := path.Ext(f.Name)
+			if !strings.HasPrefix(f.Name, "META-INF/") && (ext == ".xml" || ext == ".musicxml") {
+				rootPath = f.Name
+				break
+			}
+		}
+	}
+
+	rc, err := archive.Open(rootPath)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidMusicXML, "mxl root file")
+	}
+	defer rc.Close()
+	// The declared size can't be trusted, so the entry is read through a limit one byte past it
+	root, err := io.ReadAll(io.LimitReader(rc, maxMXLEntryBytes+1))
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidMusicXML, "mxl root file")
+	}
+	if len(root) > maxMXLEntryBytes {
+		return nil, utilities.WrapError(fmt.Errorf("root file is larger than %d bytes", maxMXLEntryBytes), ErrInvalidMusicXML)
+	}
+	return ImportMusicXML(bytes.NewReader(root))
+}
+
+// importMusicXMLPart walks a part's measures, converting MusicXML divisions to ticks.
+// Durations must be non-negative and at most maxNoteQuarters long.
+func importMusicXMLPart(p mxPart) ([]measure, error) {
+	divisions := 1
+	velocity := uint8(defaultVelocity)
+	var measures []measure
+	// openTies tracks notes waiting for a tie stop, keyed by pitch
+	openTies := map[uint8]noteRef{}
+	var activeEndings []int
+
+	for _, mx := range p.Measures {
+		m := measure{endings: activeEndings}
+		var cursor, lastStart uint32
+		closeEnding := false
+
+		// Split so that a large duration and divisions can't overflow the multiplication
+		toTicks := func(duration int) uint32 {
+			whole, rest := duration/divisions, duration%divisions
+			return uint32(whole*Division + rest*Division/divisions)
+		}
+
+		for _, el := range mx.Children {
+			if el.Duration < 0 || el.Duration/maxNoteQuarters > divisions {
+				return nil, fmt.Errorf("duration %d in measure %s is out of range", el.Duration, mx.Number)
+			}
+
+			switch el.XMLName.Local {
+			case "attributes":
+				if el.Divisions > 0 {
+					divisions = el.Divisions
+				}
+				if el.Time != nil {
+					if signature, ok := parseMusicXMLTime(el.Time); ok {
+						signature.Tick = cursor
+						m.timeSignature = &signature
+					}
+				}
+				if el.Key != nil {
+					m.keySignature = &midi.KeySignature{Tick: cursor, Sharps: int8(el.Key.Fifths), Minor: el.Key.Mode == "minor"}
+				}
+
+			case "direction":
+				for _, dt := range el.DirectionTypes {
+					if dt.Dynamics == nil {
+						continue
+					}
+					for _, mark := range dt.Dynamics.Marks {
+						if v, ok := dynamicVelocities[mark.XMLName.Local]; ok {
+							velocity = v
+						}
+					}
+				}
+				if el.Sound != nil {
+					applySound(&m, cursor, el.Sound.Tempo, el.Sound.Dynamics, &velocity)
+				}
+
+			case "sound":
+				applySound(&m, cursor, el.Tempo, el.Dynamics, &velocity)
+
+			case "backup":
+				cursor -= min(cursor, toTicks(el.Duration))
+
+			case "forward":
+				cursor += toTicks(el.Duration)
+				m.length = max(m.length, cursor)
+
+			case "barline":
+				if el.Repeat != nil {
+					if el.Repeat.Direction == "forward" {
+						m.forwardRepeat = true
+					} else {
+						m.backwardRepeat = true
+						m.repeatTimes = el.Repeat.Times
+					}
+				}
+				if el.Ending != nil {
+					switch el.Ending.Type {
+					case "start":
+						activeEndings = parseEndingNumbers(el.Ending.Number)
+						m.endings = activeEndings
+					case "stop", "discontinue":
+						closeEnding = true
+					}
+				}
+
+			case "note":
+				if el.Grace != nil {
+					continue
+				}
+				duration := toTicks(el.Duration)
+				start := cursor
+				if el.Chord != nil {
+					start = lastStart
+				} else {
+					lastStart = cursor
+					cursor += duration
+				}
+				m.length = max(m.length, start+duration)
+
+				if el.Rest != nil || el.Pitch == nil {
+					continue
+				}
+				pitch, ok := musicXMLPitch(el.Pitch)
+				if !ok {
+					continue
+				}
+
+				noteVelocity := velocity
+				if percent, err := strconv.ParseFloat(el.Dynamics, 64); err == nil {
+					noteVelocity = clampVelocity(percent * 90 / 100)
+				}
+
+				tieStart, tieStop := false, false
+				for _, tie := range el.Ties {
+					tieStart = tieStart || tie.Type == "start"
+					tieStop = tieStop || tie.Type == "stop"
+				}
+
+				if ref, ok := openTies[pitch]; ok && tieStop {
+					// Extend the tied note, which may live in an earlier measure, to the end of this one
+					var tied *timedNote
+					if ref.measure == len(measures) {
+						tied = &m.notes[ref.note]
+					} else {
+						tied = &measures[ref.measure].notes[ref.note]
+					}
+					tied.duration = tiedElapsed(measures, ref.measure, len(measures)) + start + duration - tied.start
+					if !tieStart {
+						delete(openTies, pitch)
+					}
+					continue
+				}
+
+				m.notes = append(m.notes, timedNote{start: start, duration: duration, pitch: pitch, velocity: noteVelocity})
+				if tieStart {
+					openTies[pitch] = noteRef{measure: len(measures), note: len(m.notes) - 1}
+				}
+			}
+		}
+
+		if closeEnding {
+			activeEndings = nil
+		}
+		measures = append(measures, m)
+	}
+	return measures, nil
+}
+
+// tiedElapsed returns the ticks between the start of measure from and the start of measure to
+func tiedElapsed(measures []measure, from, to int) uint32 {
+	var elapsed uint32
+	for i := from; i < to && i < len(measures); i++ {
+		elapsed += measures[i].length
+	}
+	return elapsed
+}
+
+// applySound handles the tempo and dynamics attributes of a <sound> element
+func applySound(m *measure, cursor uint32, tempo, dynamics string, velocity *uint8) {
+	if bpm, err := strconv.ParseFloat(tempo, 64); err == nil && bpm > 0 {
+		m.tempos = append(m.tempos, timedTempo{tick: cursor, bpm: bpm})
+	}
+	// <sound dynamics> is a percentage of a forte velocity of 90
+	if percent, err := strconv.ParseFloat(dynamics, 64); err == nil {
+		*velocity = clampVelocity(percent * 90 / 100)
+	}
+}
+
+func parseMusicXMLTime(t *mxTime) (midi.TimeSignature, bool) {
+	// Compound beats such as "3+2" are summed
+	numerator := 0
+	for _, part := range strings.Split(t.Beats, "+") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return midi.TimeSignature{}, false
+		}
+		numerator += n
+	}
+	denominator, err := strconv.Atoi(strings.TrimSpace(t.BeatType))
+	if err != nil || numerator <= 0 || numerator > 255 || denominator <= 0 || denominator > 128 {
+		return midi.TimeSignature{}, false
+	}
+	return midi.TimeSignature{Numerator: uint8(numerator), Denominator: uint8(denominator)}, true
+}
+
+func parseEndingNumbers(value string) []int {
+	var numbers []int
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if n, err := strconv.Atoi(field); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers
+}
+
+func musicXMLPitch(p *mxPitch) (uint8, bool) {
+	semitone, ok := stepSemitones[strings.ToUpper(strings.TrimSpace(p.Step))]
+	if !ok {
+		return 0, false
+	}
+	value := (p.Octave+1)*12 + semitone + int(math.Round(p.Alter))
+	if value < 0 || value > 127 {
+		return 0, false
+	}
+	return uint8(value), true
+}
+
+func clampVelocity(value float64) uint8 {
+	return uint8(max(1, min(127, math.Round(value))))
+}
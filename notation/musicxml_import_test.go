@@ -0,0 +1,125 @@
+package notation
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMusicXML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE score-partwise PUBLIC "-//Recordare//DTD MusicXML 4.0 Partwise//EN" "http://www.musicxml.org/dtds/partwise.dtd">
+<score-partwise version="4.0">
+  <work><work-title>Little Piece</work-title></work>
+  <part-list>
+    <score-part id="P1">
+      <part-name>Piano</part-name>
+      <midi-instrument id="P1-I1"><midi-channel>1</midi-channel><midi-program>1</midi-program></midi-instrument>
+    </score-part>
+  </part-list>
+  <part id="P1">
+    <measure number="1">
+      <attributes>
+        <divisions>2</divisions>
+        <key><fifths>-1</fifths><mode>minor</mode></key>
+        <time><beats>2</beats><beat-type>4</beat-type></time>
+      </attributes>
+      <direction><direction-type><dynamics><p/></dynamics></direction-type><sound tempo="100"/></direction>
+      <barline location="left"><repeat direction="forward"/></barline>
+      <note><pitch><step>D</step><octave>4</octave></pitch><duration>2</duration></note>
+      <note><pitch><step>F</step><octave>4</octave></pitch><duration>2</duration></note>
+      <note><chord/><pitch><step>A</step><octave>4</octave></pitch><duration>2</duration></note>
+      <backup><duration>4</duration></backup>
+      <note><pitch><step>D</step><octave>3</octave></pitch><duration>4</duration></note>
+    </measure>
+    <measure number="2">
+      <barline location="left"><ending number="1" type="start"/></barline>
+      <note><pitch><step>B</step><alter>-1</alter><octave>4</octave></pitch><duration>4</duration><tie type="start"/></note>
+      <barline location="right"><ending number="1" type="stop"/><repeat direction="backward"/></barline>
+    </measure>
+    <measure number="3">
+      <barline location="left"><ending number="2" type="start"/></barline>
+      <direction><direction-type><dynamics><ff/></dynamics></direction-type></direction>
+      <note><pitch><step>C</step><alter>1</alter><octave>5</octave></pitch><duration>2</duration><tie type="start"/></note>
+      <note><rest/><duration>2</duration></note>
+      <barline location="right"><ending number="2" type="stop"/></barline>
+    </measure>
+  </part>
+</score-partwise>`
+
+func TestImportMusicXML(t *testing.T) {
+	file, err := ImportMusicXML(strings.NewReader(testMusicXML))
+	require.NoError(t, err)
+
+	require.Len(t, file.Tracks, 2)
+	assert.Equal(t, "Little Piece", file.Tracks[0].Name)
+	assert.Equal(t, "Piano", file.Tracks[1].Name)
+	assert.InDelta(t, 100, file.Tempos()[0].BPM(), 0.01)
+	assert.Equal(t, midi.TimeSignature{Numerator: 2, Denominator: 4}, file.TimeSignatures()[0])
+	assert.Equal(t, []midi.KeySignature{{Sharps: -1, Minor: true}}, file.KeySignatures())
+
+	notes := file.Notes()
+	// Measure 1, first ending, measure 1 again, second ending
+	assert.Equal(t, []uint8{50, 62, 65, 69, 70, 50, 62, 65, 69, 73}, pitches(notes))
+	assert.Equal(t, uint32(Division), notes[1].Duration())
+	assert.Equal(t, uint32(2*Division), notes[0].Duration())
+	assert.Equal(t, notes[2].Start, notes[3].Start)
+	assert.Equal(t, uint8(49), notes[0].Velocity)
+	assert.Equal(t, uint8(112), notes[9].Velocity)
+	assert.Equal(t, uint32(6*Division), notes[9].Start)
+}
+
+func TestImportMXL(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	container, _ := archive.Create("META-INF/container.xml")
+	_, _ = container.Write([]byte(`<container><rootfiles><rootfile full-path="score.musicxml"/></rootfiles></container>`))
+	scoreFile, _ := archive.Create("score.musicxml")
+	_, _ = scoreFile.Write([]byte(testMusicXML))
+	require.NoError(t, archive.Close())
+
+	file, err := ImportMXL(buf.Bytes())
+	require.NoError(t, err)
+	assert.Len(t, file.Notes(), 10)
+}
+
+func TestImportMXL_TooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	scoreFile, _ := archive.Create("score.musicxml")
+	_, _ = scoreFile.Write([]byte(testMusicXML))
+	_, _ = scoreFile.Write(bytes.Repeat([]byte(" "), maxMXLEntryBytes))
+	require.NoError(t, archive.Close())
+
+	_, err := ImportMXL(buf.Bytes())
+	assert.ErrorIs(t, err, ErrInvalidMusicXML)
+}
+
+func TestImportMusicXML_Invalid(t *testing.T) {
+	_, err := ImportMusicXML(strings.NewReader("<score-timewise/>"))
+	assert.ErrorIs(t, err, ErrInvalidMusicXML)
+
+	for _, duration := range []string{"-4", "2000000000"} {
+		doc := strings.Replace(testMusicXML, "<rest/><duration>2</duration>", "<rest/><duration>"+duration+"</duration>", 1)
+		_, err = ImportMusicXML(strings.NewReader(doc))
+		assert.ErrorIs(t, err, ErrInvalidMusicXML, duration)
+	}
+}
+
+func TestPlaybackOrder(t *testing.T) {
+	measures := []measure{
+		{},
+		{forwardRepeat: true},
+		{backwardRepeat: true, repeatTimes: 3},
+		{},
+	}
+	assert.Equal(t, []int{0, 1, 2, 1, 2, 1, 2, 3}, playbackOrder(measures))
+
+	measures[2].repeatTimes = 2000000000
+	assert.Len(t, playbackOrder(measures), 2+2*maxRepeatTimes)
+}
@@ -0,0 +1,196 @@
+package notation
+
+import (
+	"fmt"
+
+	"midi-file-server/midi"
+)
+
+var (
+	ErrInvalidMusicXML = fmt.Errorf("invalid MusicXML document")
+	ErrInvalidABC      = fmt.Errorf("invalid ABC tune")
+	ErrNoParts         = fmt.Errorf("score contains no parts")
+)
+
+const (
+	// Division is the resolution, in ticks per quarter note, of imported files
+	Division = 480
+
+	defaultVelocity = 80
+	percussionChan  = 9
+
+	// maxRepeatTimes caps the passes through a repeat, however many a score asks for
+	maxRepeatTimes = 16
+	// maxNoteQuarters bounds the length of a note, rest or cursor move, in quarter notes
+	maxNoteQuarters = 256
+)
+
+// dynamicVelocities maps dynamic markings to MIDI velocities
+var dynamicVelocities = map[string]uint8{
+	"pppp": 8, "ppp": 16, "pp": 33, "p": 49, "mp": 64,
+	"mf": 80, "f": 96, "ff": 112, "fff": 120, "ffff": 127,
+	"sf": 112, "sfz": 112, "fp": 96, "fz": 112,
+}
+
+// score is the format-neutral intermediate that both importers build and buildFile turns into MIDI
+type score struct {
+	title string
+	parts []part
+}
+
+type part struct {
+	name     string
+	channel  uint8
+	program  int // -1 leaves the device default
+	measures []measure
+}
+
+// measure holds events relative to its own start so repeats can be unrolled by replaying measures
+type measure struct {
+	length         uint32
+	notes          []timedNote
+	tempos         []timedTempo
+	timeSignature  *midi.TimeSignature
+	keySignature   *midi.KeySignature
+	forwardRepeat  bool
+	backwardRepeat bool
+	repeatTimes    int   // total passes through a backward repeat, 2 if unspecified
+	endings        []int // volta numbers this measure is played on, empty for all passes
+}
+
+type timedNote struct {
+	start    uint32
+	duration uint32
+	pitch    uint8
+	velocity uint8
+}
+
+// noteRef locates a note by measure index and position within that measure
+type noteRef struct{ measure, note int }
+
+type timedTempo struct {
+	tick uint32
+	bpm  float64
+}
+
+// playbackOrder unrolls repeats and first/second endings into the sequence of measure indices to play.
+// Nested repeats are not supported; a backward repeat always returns to the most recent forward repeat.
+func playbackOrder(measures []measure) []int {
+	var order []int
+	repeatStart, pass := 0, 1
+	taken := map[int]int{}
+
+	for i := 0; i < len(measures); i++ {
+		m := measures[i]
+		if m.forwardRepeat && i != repeatStart {
+			repeatStart, pass = i, 1
+		}
+		if len(m.endings) > 0 && !containsInt(m.endings, pass) {
+			continue
+		}
+		order = append(order, i)
+
+		if m.backwardRepeat {
+			times := min(m.repeatTimes, maxRepeatTimes)
+			if times < 2 {
+				times = 2
+			}
+			if taken[i] < times-1 {
+				taken[i]++
+				pass++
+				i = repeatStart - 1
+				continue
+			}
+			repeatStart, pass = i+1, 1
+		}
+	}
+	return order
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFile renders the score as a format 1 MIDI file with a conductor track followed by one track per part.
+// Tempo, meter and key are taken from the first part.
+func buildFile(s score) (*midi.File, error) {
+	if len(s.parts) == 0 {
+		return nil, ErrNoParts
+	}
+
+	order := playbackOrder(s.parts[0].measures)
+
+	// Every part shares the bar lines of the longest part at each measure index
+	measureCount := 0
+	for _, p := range s.parts {
+		measureCount = max(measureCount, len(p.measures))
+	}
+	lengths := make([]uint32, measureCount)
+	for _, p := range s.parts {
+		for i, m := range p.measures {
+			lengths[i] = max(lengths[i], m.length)
+		}
+	}
+	offsets := make([]uint32, len(order))
+	var tick uint32
+	for i, index := range order {
+		offsets[i] = tick
+		tick += lengths[index]
+	}
+
+	// Replayed measures only re-emit meta events that actually change something
+	file := midi.NewFile(Division)
+	conductor := file.AddTrack(s.title)
+	var meter midi.TimeSignature
+	var key *midi.KeySignature
+	var bpm float64
+	for i, index := range order {
+		m := s.parts[0].measures[index]
+		if ts := m.timeSignature; ts != nil && (ts.Numerator != meter.Numerator || ts.Denominator != meter.Denominator) {
+			conductor.AddTimeSignature(offsets[i], ts.Numerator, ts.Denominator)
+			meter = *ts
+		}
+		if ks := m.keySignature; ks != nil && (key == nil || ks.Sharps != key.Sharps || ks.Minor != key.Minor) {
+			conductor.AddKeySignature(offsets[i], ks.Sharps, ks.Minor)
+			key = ks
+		}
+		for _, tempo := range m.tempos {
+			if tempo.bpm != bpm {
+				conductor.AddTempo(offsets[i]+tempo.tick, tempo.bpm)
+				bpm = tempo.bpm
+			}
+		}
+	}
+
+	for _, p := range s.parts {
+		track := file.AddTrack(p.name)
+		if p.program >= 0 && p.channel != percussionChan {
+			track.AddProgramChange(0, p.channel, uint8(p.program))
+		}
+		for i, index := range order {
+			if index >= len(p.measures) {
+				continue
+			}
+			for _, note := range p.measures[index].notes {
+				start := offsets[i] + note.start
+				track.AddNote(p.channel, note.pitch, note.velocity, start, start+note.duration)
+			}
+		}
+	}
+
+	return file, nil
+}
+
+// partChannel assigns sequential channels to parts, skipping the percussion channel
+func partChannel(index int) uint8 {
+	channel := index % 15
+	if channel >= percussionChan {
+		channel++
+	}
+	return uint8(channel)
+}
@@ -0,0 +1,119 @@
+package practice
+
+import (
+	"fmt"
+	"slices"
+
+	"midi-file-server/analysis"
+	"midi-file-server/midi"
+)
+
+var (
+	ErrInvalidHandMode = fmt.Errorf("invalid hand mode")
+	ErrNoFreeChannel   = fmt.Errorf("no free channel to move a hand to")
+)
+
+// HandMode picks what a per-hand download does with the hands
+type HandMode string
+
+const (
+	// MuteLeft and MuteRight drop one hand's notes so the student can play it against the other
+	MuteLeft  HandMode = "mute-left"
+	MuteRight HandMode = "mute-right"
+	// SplitChannels moves the left hand onto channels of its own, so a keyboard or player can
+	// mute, pan or light up each hand separately
+	SplitChannels HandMode = "split-channels"
+)
+
+// ParseHandMode checks a mode given by name
+func ParseHandMode(value string) (HandMode, error) {
+	switch mode := HandMode(value); mode {
+	case MuteLeft, MuteRight, SplitChannels:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%w: %q, expected %s, %s or %s", ErrInvalidHandMode, value, MuteLeft, MuteRight, SplitChannels)
+}
+
+// Hands rewrites the file for one hand mode, given the hand of each note of file.Notes() as assigned by
+// analysis.SeparateHands. Everything other than the notes, and notes belonging to neither hand, is kept as is.
+// When splitting, each channel's left hand moves to an unused channel that copies its instrument and controllers.
+func Hands(file *midi.File, hands []analysis.Hand, mode HandMode) (*midi.File, error) {
+	if _, err := ParseHandMode(string(mode)); err != nil {
+		return nil, err
+	}
+	notes := file.Notes()
+	if len(hands) != len(notes) {
+		return nil, fmt.Errorf("%w: %d hands for %d notes", ErrInvalidHandMode, len(hands), len(notes))
+	}
+
+	moved := map[uint8]uint8{}
+	if mode == SplitChannels {
+		var err error
+		if moved, err = leftHandChannels(file, notes, hands); err != nil {
+			return nil, err
+		}
+	}
+
+	out := midi.NewFile(file.Division)
+	out.Format = file.Format
+	for trackIndex, source := range file.Tracks {
+		track := midi.Track{Name: source.Name}
+		for _, event := range source.Events {
+			if event.Type == midi.NoteOn || event.Type == midi.NoteOff {
+				continue
+			}
+			track.Events = append(track.Events, event)
+			if to, ok := moved[event.Channel]; ok && isChannelEvent(event) {
+				event.Channel = to
+				track.Events = append(track.Events, event)
+			}
+		}
+		for i, note := range notes {
+			if note.Track != trackIndex {
+				continue
+			}
+			channel := note.Channel
+			switch {
+			case hands[i] == analysis.LeftHand && mode == MuteLeft, hands[i] == analysis.RightHand && mode == MuteRight:
+				continue
+			case hands[i] == analysis.LeftHand && mode == SplitChannels:
+				channel = moved[note.Channel]
+			}
+			track.AddNote(channel, note.Pitch, note.Velocity, note.Start, note.End)
+		}
+		out.Tracks = append(out.Tracks, track)
+	}
+	return out, nil
+}
+
+// leftHandChannels maps every channel with left hand notes to a channel the file doesn't use
+func leftHandChannels(file *midi.File, notes []midi.Note, hands []analysis.Hand) (map[uint8]uint8, error) {
+	used := map[uint8]bool{MetronomeChannel: true}
+	for _, track := range file.Tracks {
+		for _, event := range track.Events {
+			if isChannelEvent(event) {
+				used[event.Channel] = true
+			}
+		}
+	}
+	var sources []uint8
+	for i, note := range notes {
+		if hands[i] == analysis.LeftHand && !slices.Contains(sources, note.Channel) {
+			sources = append(sources, note.Channel)
+		}
+	}
+
+	moved := map[uint8]uint8{}
+	free := uint8(0)
+	for _, source := range sources {
+		for free < 16 && used[free] {
+			free++
+		}
+		if free == 16 {
+			return nil, ErrNoFreeChannel
+		}
+		moved[source] = free
+		used[free] = true
+	}
+	return moved, nil
+}
@@ -0,0 +1,70 @@
+package practice
+
+import (
+	"testing"
+
+	"midi-file-server/analysis"
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// twoHands is a piano part on channel 0: a bass note under each melody note
+func twoHands() (*midi.File, []analysis.Hand) {
+	file := midi.NewFile(division)
+	track := file.AddTrack("Piano")
+	track.AddProgramChange(0, 0, 4)
+	track.AddControlChange(0, 0, 64, 127)
+	for beat := uint32(0); beat < 4; beat++ {
+		track.AddNote(0, 40, 70, beat*division, (beat+1)*division)
+		track.AddNote(0, 72, 80, beat*division, (beat+1)*division)
+	}
+	hands := make([]analysis.Hand, 8)
+	for i, note := range file.Notes() {
+		hands[i] = analysis.RightHand
+		if note.Pitch == 40 {
+			hands[i] = analysis.LeftHand
+		}
+	}
+	return file, hands
+}
+
+func TestHands(t *testing.T) {
+	file, hands := twoHands()
+
+	muted, err := Hands(file, hands, MuteLeft)
+	assert.NoError(t, err)
+	for _, note := range muted.Notes() {
+		assert.Equal(t, uint8(72), note.Pitch)
+	}
+	assert.Len(t, muted.Notes(), 4)
+
+	muted, err = Hands(file, hands, MuteRight)
+	assert.NoError(t, err)
+	assert.Len(t, muted.Notes(), 4)
+	assert.Equal(t, uint8(40), muted.Notes()[0].Pitch)
+
+	split, err := Hands(file, hands, SplitChannels)
+	assert.NoError(t, err)
+	assert.Len(t, split.Notes(), 8)
+	for _, note := range split.Notes() {
+		if note.Pitch == 40 {
+			assert.Equal(t, uint8(1), note.Channel)
+		} else {
+			assert.Equal(t, uint8(0), note.Channel)
+		}
+	}
+	// The left hand's new channel plays the same instrument with the same pedal
+	var programs []uint8
+	for _, event := range split.Tracks[0].Events {
+		if event.Type == midi.ProgramChange {
+			programs = append(programs, event.Channel)
+		}
+	}
+	assert.Equal(t, []uint8{0, 1}, programs)
+
+	_, err = Hands(file, hands, HandMode("both"))
+	assert.ErrorIs(t, err, ErrInvalidHandMode)
+	_, err = Hands(file, hands[:3], MuteLeft)
+	assert.ErrorIs(t, err, ErrInvalidHandMode)
+}
@@ -0,0 +1,246 @@
+package practice
+
+import (
+	"fmt"
+
+	"midi-file-server/midi"
+)
+
+var (
+	ErrInvalidLoop     = fmt.Errorf("invalid loop options")
+	ErrInvalidMeasures = fmt.Errorf("measure range is outside the song")
+)
+
+const (
+	// MetronomeChannel is General MIDI channel 10, reserved for percussion
+	MetronomeChannel uint8 = 9
+	// accentClick and beatClick are the General MIDI high and low wood blocks
+	accentClick uint8 = 76
+	beatClick   uint8 = 77
+
+	MaxRepeats         = 50
+	MinTempoPercent    = 10
+	MaxTempoPercent    = 200
+	MaxTempoStep       = 50
+	MaxCountInMeasures = 4
+)
+
+// LoopOptions describe a practice loop: measures FromMeasure to ToMeasure (numbered from 1, inclusive)
+// played Repeats times, the first pass at TempoPercent of the original tempo and each following one
+// TempoStepPercent faster, up to MaxTempoPercent. CountInMeasures of metronome clicks come first.
+type LoopOptions struct {
+	FromMeasure      int
+	ToMeasure        int
+	Repeats          int
+	TempoPercent     float64
+	TempoStepPercent float64
+	CountInMeasures  int
+}
+
+// DefaultLoopOptions loops the first measure four times at the original tempo after a one measure count-in
+func DefaultLoopOptions() LoopOptions {
+	return LoopOptions{FromMeasure: 1, ToMeasure: 1, Repeats: 4, TempoPercent: 100, CountInMeasures: 1}
+}
+
+// Validate checks the options on their own; Loop also checks the range against the song
+func (o LoopOptions) Validate() error {
+	switch {
+	case o.FromMeasure < 1 || o.ToMeasure < o.FromMeasure:
+		return fmt.Errorf("%w: measures must run forwards from 1", ErrInvalidLoop)
+	case o.Repeats < 1 || o.Repeats > MaxRepeats:
+		return fmt.Errorf("%w: repeats must be between 1 and %d", ErrInvalidLoop, MaxRepeats)
+	case o.TempoPercent < MinTempoPercent || o.TempoPercent > MaxTempoPercent:
+		return fmt.Errorf("%w: tempo must be between %d%% and %d%%", ErrInvalidLoop, MinTempoPercent, MaxTempoPercent)
+	case o.TempoStepPercent < 0 || o.TempoStepPercent > MaxTempoStep:
+		return fmt.Errorf("%w: tempo step must be between 0%% and %d%%", ErrInvalidLoop, MaxTempoStep)
+	case o.CountInMeasures < 0 || o.CountInMeasures > MaxCountInMeasures:
+		return fmt.Errorf("%w: count-in must be between 0 and %d measures", ErrInvalidLoop, MaxCountInMeasures)
+	}
+	return nil
+}
+
+// passTempo returns the tempo percentage of the given pass, counted from 0
+func (o LoopOptions) passTempo(pass int) float64 {
+	return min(MaxTempoPercent, o.TempoPercent+float64(pass)*o.TempoStepPercent)
+}
+
+// MeasureCount returns the number of measures in the file, using its time signature map
+func MeasureCount(file *midi.File) int {
+	end := file.EndTick()
+	count := 0
+	for _, start := range file.MeasureStarts(end) {
+		if start < end {
+			count++
+		}
+	}
+	return count
+}
+
+// Loop generates a practice file from a range of measures. Each source track keeps its own track and
+// channels, with the instrument, controllers (such as the sustain pedal) and pitch bend in effect at the
+// start of the range restored at every pass. Notes still sounding at the end of the range are cut there.
+// The count-in is on MetronomeChannel, accenting the first beat of each measure.
+func Loop(file *midi.File, opts LoopOptions) (*midi.File, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	count := MeasureCount(file)
+	if opts.ToMeasure > count {
+		return nil, fmt.Errorf("%w: asked for measures %d-%d of %d", ErrInvalidMeasures, opts.FromMeasure, opts.ToMeasure, count)
+	}
+
+	end := file.EndTick()
+	starts := file.MeasureStarts(end)
+	sectionStart := starts[opts.FromMeasure-1]
+	sectionEnd := end
+	if opts.ToMeasure < count {
+		sectionEnd = starts[opts.ToMeasure]
+	}
+	length := sectionEnd - sectionStart
+
+	signature := signatureAt(file.TimeSignatures(), sectionStart)
+	countIn := uint32(opts.CountInMeasures) * file.TicksPerMeasure(signature)
+	passStart := func(pass int) uint32 { return countIn + uint32(pass)*length }
+	inSection := func(tick uint32) bool { return tick >= sectionStart && tick < sectionEnd }
+
+	out := midi.NewFile(file.Division)
+
+	// Tempo, meter and key, with the tempo scaled per pass
+	conductor := out.AddTrack("Practice loop")
+	tempos := file.Tempos()
+	startTempo := tempoAt(tempos, sectionStart)
+	conductor.AddTempo(0, startTempo.BPM()*opts.passTempo(0)/100)
+	conductor.AddTimeSignature(0, signature.Numerator, signature.Denominator)
+	if keys := file.KeySignatures(); len(keys) > 0 {
+		key := keys[0]
+		for _, k := range keys {
+			if k.Tick <= sectionStart {
+				key = k
+			}
+		}
+		conductor.AddKeySignature(0, key.Sharps, key.Minor)
+	}
+	for pass := 0; pass < opts.Repeats; pass++ {
+		scale := opts.passTempo(pass) / 100
+		offset := passStart(pass)
+		// The first pass carries on at the count-in's tempo and meter
+		if pass > 0 {
+			conductor.AddTempo(offset, startTempo.BPM()*scale)
+			conductor.AddTimeSignature(offset, signature.Numerator, signature.Denominator)
+		}
+		for _, tempo := range tempos {
+			if tempo.Tick > sectionStart && inSection(tempo.Tick) {
+				conductor.AddTempo(offset+tempo.Tick-sectionStart, tempo.BPM()*scale)
+			}
+		}
+		for _, s := range file.TimeSignatures() {
+			if s.Tick > sectionStart && inSection(s.Tick) {
+				conductor.AddTimeSignature(offset+s.Tick-sectionStart, s.Numerator, s.Denominator)
+			}
+		}
+	}
+
+	notes := file.Notes()
+	for trackIndex, source := range file.Tracks {
+		var trackNotes []midi.Note
+		for _, note := range notes {
+			if note.Track == trackIndex && inSection(note.Start) {
+				trackNotes = append(trackNotes, note)
+			}
+		}
+		if len(trackNotes) == 0 {
+			continue
+		}
+
+		state := channelState(source, sectionStart)
+		track := out.AddTrack(source.Name)
+		for pass := 0; pass < opts.Repeats; pass++ {
+			offset := passStart(pass)
+			for _, event := range state {
+				event.Tick = offset
+				track.Events = append(track.Events, event)
+			}
+			for _, event := range source.Events {
+				if isChannelEvent(event) && event.Type != midi.NoteOn && event.Type != midi.NoteOff && inSection(event.Tick) {
+					event.Tick = offset + event.Tick - sectionStart
+					track.Events = append(track.Events, event)
+				}
+			}
+			for _, note := range trackNotes {
+				noteEnd := min(note.End, sectionEnd)
+				track.AddNote(note.Channel, note.Pitch, note.Velocity, offset+note.Start-sectionStart, offset+noteEnd-sectionStart)
+			}
+		}
+	}
+
+	if countIn > 0 {
+		metronome := out.AddTrack("Count-in")
+		beat := uint32(file.Division) * 4 / uint32(signature.Denominator)
+		for tick, index := uint32(0), 0; tick < countIn; tick, index = tick+beat, index+1 {
+			pitch, velocity := beatClick, uint8(80)
+			if index%int(signature.Numerator) == 0 {
+				pitch, velocity = accentClick, 110
+			}
+			metronome.AddNote(MetronomeChannel, pitch, velocity, tick, tick+beat/4)
+		}
+	}
+	return out, nil
+}
+
+// channelState returns the last program change, pitch bend and value of each controller per channel
+// before tick, so a section sounds the same as it did in place
+func channelState(track midi.Track, tick uint32) []midi.Event {
+	type key struct {
+		eventType  byte
+		channel    uint8
+		controller byte
+	}
+	latest := map[key]midi.Event{}
+	var order []key
+	for _, event := range track.Events {
+		if event.Tick >= tick {
+			break
+		}
+		if event.Type != midi.ProgramChange && event.Type != midi.ControlChange && event.Type != midi.PitchBend {
+			continue
+		}
+		k := key{event.Type, event.Channel, 0}
+		if event.Type == midi.ControlChange {
+			k.controller = event.Data1
+		}
+		if _, seen := latest[k]; !seen {
+			order = append(order, k)
+		}
+		latest[k] = event
+	}
+
+	state := make([]midi.Event, 0, len(order))
+	for _, k := range order {
+		state = append(state, latest[k])
+	}
+	return state
+}
+
+func isChannelEvent(event midi.Event) bool {
+	return event.Type >= midi.NoteOff && event.Type <= midi.PitchBend
+}
+
+func tempoAt(tempos []midi.TempoChange, tick uint32) midi.TempoChange {
+	current := tempos[0]
+	for _, tempo := range tempos {
+		if tempo.Tick <= tick {
+			current = tempo
+		}
+	}
+	return current
+}
+
+func signatureAt(signatures []midi.TimeSignature, tick uint32) midi.TimeSignature {
+	current := signatures[0]
+	for _, signature := range signatures {
+		if signature.Tick <= tick {
+			current = signature
+		}
+	}
+	return current
+}
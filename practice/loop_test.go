@@ -0,0 +1,94 @@
+package practice
+
+import (
+	"bytes"
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const division = 96
+
+// fourMeasures is a piano part in 4/4 at 120 BPM: one note per beat, pitch 60 plus the measure number,
+// with the sustain pedal pressed from measure 2
+func fourMeasures() *midi.File {
+	file := midi.NewFile(division)
+	track := file.AddTrack("Piano")
+	track.AddTempo(0, 120)
+	track.AddTimeSignature(0, 4, 4)
+	track.AddProgramChange(0, 0, 4)
+	track.AddControlChange(4*division, 0, 64, 127)
+	for measure := 0; measure < 4; measure++ {
+		for beat := 0; beat < 4; beat++ {
+			start := uint32((measure*4 + beat) * division)
+			track.AddNote(0, uint8(61+measure), 80, start, start+division)
+		}
+	}
+	return file
+}
+
+func TestLoop(t *testing.T) {
+	opts := LoopOptions{FromMeasure: 2, ToMeasure: 3, Repeats: 3, TempoPercent: 50, TempoStepPercent: 25, CountInMeasures: 1}
+	looped, err := Loop(fourMeasures(), opts)
+	assert.NoError(t, err)
+
+	// Survives a round trip through the encoder
+	file, err := midi.Parse(bytes.NewReader(looped.Encode()))
+	assert.NoError(t, err)
+	assert.Len(t, file.Tracks, 3)
+	assert.Equal(t, 1+2*3, MeasureCount(file))
+
+	var clicks, piano []midi.Note
+	for _, note := range file.Notes() {
+		if note.Channel == MetronomeChannel {
+			clicks = append(clicks, note)
+		} else {
+			piano = append(piano, note)
+		}
+	}
+	assert.Len(t, clicks, 4)
+	assert.Equal(t, accentClick, clicks[0].Pitch)
+	assert.Equal(t, beatClick, clicks[1].Pitch)
+
+	assert.Len(t, piano, 8*3)
+	assert.Equal(t, uint32(4*division), piano[0].Start)
+	assert.Equal(t, uint8(62), piano[0].Pitch)
+	assert.Equal(t, uint8(63), piano[7].Pitch)
+	assert.Equal(t, uint8(62), piano[8].Pitch)
+	assert.Equal(t, uint32(12*division), piano[8].Start)
+
+	// The count-in and first pass at half speed, then 75% and 100%
+	var bpms []float64
+	for _, tempo := range file.Tempos() {
+		bpms = append(bpms, tempo.BPM())
+	}
+	assert.InDeltaSlice(t, []float64{60, 90, 120}, bpms, 0.01)
+
+	// The instrument and the pedal pressed before the section are restored at each pass
+	var restored int
+	for _, event := range file.Tracks[1].Events {
+		if event.Type == midi.ControlChange && event.Data1 == 64 && event.Data2 == 127 {
+			restored++
+		}
+	}
+	assert.Equal(t, 3, restored)
+}
+
+func TestLoop_Invalid(t *testing.T) {
+	_, err := Loop(fourMeasures(), LoopOptions{FromMeasure: 3, ToMeasure: 5, Repeats: 1, TempoPercent: 100})
+	assert.ErrorIs(t, err, ErrInvalidMeasures)
+
+	for _, opts := range []LoopOptions{
+		{FromMeasure: 0, ToMeasure: 1, Repeats: 1, TempoPercent: 100},
+		{FromMeasure: 2, ToMeasure: 1, Repeats: 1, TempoPercent: 100},
+		{FromMeasure: 1, ToMeasure: 1, Repeats: 0, TempoPercent: 100},
+		{FromMeasure: 1, ToMeasure: 1, Repeats: 1, TempoPercent: 5},
+		{FromMeasure: 1, ToMeasure: 1, Repeats: 1, TempoPercent: 100, TempoStepPercent: -5},
+		{FromMeasure: 1, ToMeasure: 1, Repeats: 1, TempoPercent: 100, CountInMeasures: 9},
+	} {
+		_, err := Loop(fourMeasures(), opts)
+		assert.ErrorIs(t, err, ErrInvalidLoop, opts)
+	}
+}
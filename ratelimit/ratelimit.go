@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"midi-file-server/config"
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrRateLimited = fmt.Errorf("rate limit exceeded, try again later")
+	ErrStore       = fmt.Errorf("failed to count request for rate limit")
+)
+
+const (
+	// storeTimeout bounds counting a request, so a slow store delays requests only briefly
+	storeTimeout = 2 * time.Second
+	// sweepInterval is how often the memory store drops buckets that have refilled
+	sweepInterval = time.Minute
+)
+
+// Decision is the outcome of taking a request's token from its bucket
+type Decision struct {
+	Allowed bool
+	// Limit is the bucket's size and Remaining the whole tokens left in it
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until a token is available, when the request wasn't allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Store keeps token buckets by key
+type Store interface {
+	Take(ctx context.Context, key string, policy config.RatePolicy, now time.Time) (Decision, error)
+}
+
+// Limiter applies rate policies to handlers, counting requests in a Store under the key of their caller
+type Limiter struct {
+	store Store
+	keyOf func(*http.Request) string
+}
+
+// callerKey is the context key under which a request's caller is kept once named
+type callerKey struct{}
+
+// New returns a Limiter. keyOf names the caller of a request, e.g. its user, device or IP address. It is
+// asked once per request, however many limits the request passes through.
+func New(store Store, keyOf func(*http.Request) string) *Limiter {
+	return &Limiter{store: store, keyOf: keyOf}
+}
+
+// Limit lets requests through to handler while their caller has tokens in the route's bucket and answers
+// 429 Too Many Requests otherwise. Each response carries X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset, so a handler limited twice reports the inner, more specific, limit. policy is asked
+// for every request, so a reloaded value applies straight away. Requests are let through when the store fails.
+func (l *Limiter) Limit(route string, policy func() config.RatePolicy, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := policy()
+		if !p.Enabled() {
+			handler(w, r)
+			return
+		}
+		caller, r := l.callerOf(r)
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		key := route + ":" + caller
+		decision, err := l.store.Take(ctx, key, p, time.Now())
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("route", route).Msg("Rate limit not applied")
+			handler(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		header.Set("X-RateLimit-Reset", seconds(decision.Reset))
+		if !decision.Allowed {
+			header.Set("Retry-After", seconds(decision.RetryAfter))
+			log.Warn().Str("route", route).Str("key", key).Msg("Rate limited")
+			utilities.LogErrorAndRespond(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// callerOf names the caller of a request, reusing the name an outer limit found, and returns the request
+// carrying it for inner limits
+func (l *Limiter) callerOf(r *http.Request) (string, *http.Request) {
+	if caller, ok := r.Context().Value(callerKey{}).(string); ok {
+		return caller, r
+	}
+	caller := l.keyOf(r)
+	return caller, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+}
+
+// MemoryStore counts in the process, so each replica allows the full rate
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled, after which it is the same as no bucket
+	full time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]bucket{}}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, policy config.RatePolicy, now time.Time) (Decision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	tokens := float64(policy.Burst)
+	if b, ok := s.buckets[key]; ok {
+		tokens = refill(b.tokens, now.Sub(b.updated), policy)
+	}
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	decision := decide(allowed, tokens, policy)
+	s.buckets[key] = bucket{tokens: tokens, updated: now, full: now.Add(decision.Reset)}
+	return decision, nil
+}
+
+// MongoStore counts in a MongoDB collection shared by every replica. Each request is a single atomic
+// update timed by the database's clock, so replicas with skewed clocks still agree.
+type MongoStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoStore(collection *mongo.Collection) *MongoStore {
+	return &MongoStore{collection: collection}
+}
+
+// Take refills and takes from the bucket in one pipeline update; now is unused as the database keeps time
+func (s *MongoStore) Take(ctx context.Context, key string, policy config.RatePolicy, now time.Time) (Decision, error) {
+	burst := float64(policy.Burst)
+	perMillisecond := float64(policy.Requests) / float64(policy.Period.Milliseconds())
+	elapsed := bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{"$$NOW", bson.M{"$ifNull": bson.A{"$updated_at", "$$NOW"}}}}}}
+	refilled := bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", burst}},
+		bson.M{"$multiply": bson.A{elapsed, perMillisecond}},
+	}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "tokens", Value: refilled}, {Key: "updated_at", Value: "$$NOW"}}}},
+		{{Key: "$set", Value: bson.D{{Key: "allowed", Value: bson.M{"$gte": bson.A{"$tokens", 1}}}}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "tokens", Value: bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}}},
+			// A bucket that has refilled is the same as none, so MongoDB may remove it
+			{Key: "expires_at", Value: bson.M{"$add": bson.A{"$$NOW", int64(math.Ceil(burst / perMillisecond))}}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var result struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	if err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, opts).Decode(&result); err != nil {
+		return Decision{}, utilities.WrapError(err, ErrStore)
+	}
+	return decide(result.Allowed, result.Tokens, policy), nil
+}
+
+// refill adds the tokens earned over elapsed to a bucket, up to its size
+func refill(tokens float64, elapsed time.Duration, policy config.RatePolicy) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(policy.Burst), tokens+elapsed.Seconds()*perSecond(policy))
+}
+
+// decide describes a bucket left with tokens after a request was allowed or not
+func decide(allowed bool, tokens float64, policy config.RatePolicy) Decision {
+	rate := perSecond(policy)
+	decision := Decision{
+		Allowed:   allowed,
+		Limit:     policy.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     time.Duration(math.Max(0, float64(policy.Burst)-tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		decision.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return decision
+}
+
+func perSecond(policy config.RatePolicy) float64 {
+	return float64(policy.Requests) / policy.Period.Seconds()
+}
+
+// seconds rounds up to whole seconds, as HTTP headers count them
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
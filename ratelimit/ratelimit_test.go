@@ -0,0 +1,192 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"midi-file-server/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemoryStoreTokenBucket(t *testing.T) {
+	store := NewMemoryStore()
+	policy := config.RatePolicy{Requests: 60, Period: time.Minute, Burst: 3}
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	take := func(key string, at time.Time) Decision {
+		decision, err := store.Take(context.Background(), key, policy, at)
+		require.NoError(t, err)
+		return decision
+	}
+
+	// A burst is allowed at once, then requests wait for the refill of one a second
+	for remaining := 2; remaining >= 0; remaining-- {
+		decision := take("ann", now)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, 3, decision.Limit)
+		assert.Equal(t, remaining, decision.Remaining)
+	}
+	decision := take("ann", now)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+	assert.Equal(t, 3*time.Second, decision.Reset)
+
+	assert.True(t, take("bob", now).Allowed, "each key has its own bucket")
+	assert.False(t, take("ann", now.Add(500*time.Millisecond)).Allowed)
+	assert.True(t, take("ann", now.Add(time.Second)).Allowed)
+
+	// Buckets refill up to their size, no further
+	decision = take("ann", now.Add(time.Hour))
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 2, decision.Remaining)
+	assert.Len(t, store.buckets, 1, "refilled buckets are swept")
+}
+
+func TestMemoryStoreShrunkPolicy(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	_, err := store.Take(context.Background(), "ann", config.RatePolicy{Requests: 100, Period: time.Minute, Burst: 100}, now)
+	require.NoError(t, err)
+
+	// A reload to a smaller bucket applies to buckets already filled
+	decision, err := store.Take(context.Background(), "ann", config.RatePolicy{Requests: 5, Period: time.Minute, Burst: 5}, now)
+	require.NoError(t, err)
+	assert.Equal(t, 4, decision.Remaining)
+}
+
+// mongoCollection returns a fresh collection on the MongoDB named by MONGODB_TEST_URI, skipping the test without one
+func mongoCollection(t *testing.T) *mongo.Collection {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+	require.NoError(t, client.Ping(ctx, nil))
+	collection := client.Database("midi_test").Collection(fmt.Sprintf("rate_limits_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		collection.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return collection
+}
+
+func TestMongoStoreTokenBucket(t *testing.T) {
+	store := NewMongoStore(mongoCollection(t))
+	// A token every 100ms, so the test can wait for one
+	policy := config.RatePolicy{Requests: 10, Period: time.Second, Burst: 2}
+	take := func() Decision {
+		decision, err := store.Take(context.Background(), "ann", policy, time.Now())
+		require.NoError(t, err)
+		return decision
+	}
+
+	assert.True(t, take().Allowed)
+	decision := take()
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	decision = take()
+	assert.False(t, decision.Allowed)
+	assert.Positive(t, decision.RetryAfter)
+
+	time.Sleep(250 * time.Millisecond)
+	assert.True(t, take().Allowed, "the bucket refills over time")
+}
+
+func TestMongoStoreConcurrentTakes(t *testing.T) {
+	store := NewMongoStore(mongoCollection(t))
+	policy := config.RatePolicy{Requests: 20, Period: time.Hour, Burst: 20}
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decision, err := store.Take(context.Background(), "ann", policy, time.Now())
+			if assert.NoError(t, err) && decision.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(20), allowed.Load(), "each token is taken once across concurrent updates")
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, config.RatePolicy, time.Time) (Decision, error) {
+	return Decision{}, ErrStore
+}
+
+func TestLimit(t *testing.T) {
+	policy := config.RatePolicy{Requests: 2, Period: time.Minute, Burst: 2}
+	limiter := New(NewMemoryStore(), func(r *http.Request) string { return r.Header.Get("X-Caller") })
+	handler := limiter.Limit("signed-url", func() config.RatePolicy { return policy }, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	call := func(caller string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/get-signed-url", nil)
+		req.Header.Set("X-Caller", caller)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := call("ann")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("X-RateLimit-Reset"))
+	assert.Equal(t, http.StatusNoContent, call("ann").Code)
+
+	w = call("ann")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, http.StatusNoContent, call("bob").Code)
+
+	// Turning the policy off, e.g. by a reload, lets everything through
+	policy = config.RatePolicy{}
+	w = call("ann")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("X-RateLimit-Limit"))
+}
+
+func TestLimitNamesCallerOnce(t *testing.T) {
+	policy := func() config.RatePolicy { return config.RatePolicy{Requests: 10, Period: time.Minute, Burst: 10} }
+	lookups := 0
+	limiter := New(NewMemoryStore(), func(*http.Request) string {
+		lookups++
+		return "ann"
+	})
+	handler := limiter.Limit("default", policy, limiter.Limit("uploads", policy, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/v1/upload-midi", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 1, lookups)
+	assert.Equal(t, "9", w.Header().Get("X-RateLimit-Remaining"))
+}
+
+func TestLimitFailsOpen(t *testing.T) {
+	limiter := New(failingStore{}, func(*http.Request) string { return "ann" })
+	handler := limiter.Limit("default", func() config.RatePolicy { return config.RatePolicy{Requests: 1, Period: time.Minute, Burst: 1} },
+		func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
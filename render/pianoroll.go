@@ -0,0 +1,205 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+)
+
+var (
+	ErrNoNotes      = fmt.Errorf("MIDI file contains no notes")
+	ErrEncodePNG    = fmt.Errorf("failed to encode piano roll PNG")
+	ErrInvalidWidth = fmt.Errorf("piano roll width must be positive")
+)
+
+// PianoRollOptions controls the size of the rendered piano roll
+type PianoRollOptions struct {
+	Width      int // total image width in pixels
+	NoteHeight int // height of one semitone row in pixels
+	Padding    int // semitones of headroom above and below the played range
+}
+
+// DefaultPianoRollOptions returns the sizing used for song previews
+func DefaultPianoRollOptions() PianoRollOptions {
+	return PianoRollOptions{Width: 1200, NoteHeight: 4, Padding: 2}
+}
+
+var (
+	backgroundColor = color.RGBA{R: 0x1E, G: 0x1E, B: 0x24, A: 0xFF}
+	blackKeyColor   = color.RGBA{R: 0x19, G: 0x19, B: 0x1E, A: 0xFF}
+	measureColor    = color.RGBA{R: 0x55, G: 0x55, B: 0x60, A: 0xFF}
+
+	// One hue per MIDI channel; channel 10 (index 9) is percussion
+	channelColors = [16]color.RGBA{
+		{0x4E, 0x9A, 0xF1, 0xFF}, {0xF1, 0x6A, 0x4E, 0xFF}, {0x5C, 0xD1, 0x7A, 0xFF}, {0xF1, 0xC4, 0x4E, 0xFF},
+		{0xB0, 0x6A, 0xF1, 0xFF}, {0x4E, 0xE0, 0xE0, 0xFF}, {0xF1, 0x4E, 0xA8, 0xFF}, {0xA8, 0xD1, 0x4E, 0xFF},
+		{0xF1, 0x93, 0x4E, 0xFF}, {0xC0, 0xC0, 0xC0, 0xFF}, {0x6A, 0x7C, 0xF1, 0xFF}, {0x4E, 0xF1, 0x9E, 0xFF},
+		{0xE0, 0x4E, 0x4E, 0xFF}, {0x8C, 0xB4, 0xF1, 0xFF}, {0xF1, 0xE0, 0x8C, 0xFF}, {0xD1, 0x8C, 0xF1, 0xFF},
+	}
+)
+
+// pianoRoll holds the geometry shared by the PNG and SVG renderers
+type pianoRoll struct {
+	opts          PianoRollOptions
+	notes         []midi.Note
+	measures      []uint32
+	lowPitch      int
+	highPitch     int
+	endTick       uint32
+	height        int
+	pixelsPerTick float64
+}
+
+func newPianoRoll(file *midi.File, opts PianoRollOptions) (*pianoRoll, error) {
+	if opts.Width <= 0 || opts.NoteHeight <= 0 {
+		return nil, ErrInvalidWidth
+	}
+
+	notes := file.Notes()
+	if len(notes) == 0 {
+		return nil, ErrNoNotes
+	}
+
+	low, high := 127, 0
+	var end uint32
+	for _, note := range notes {
+		low = min(low, int(note.Pitch))
+		high = max(high, int(note.Pitch))
+		end = max(end, note.End)
+	}
+	low = max(0, low-opts.Padding)
+	high = min(127, high+opts.Padding)
+	end = max(end, 1)
+
+	roll := &pianoRoll{
+		opts:          opts,
+		notes:         notes,
+		lowPitch:      low,
+		highPitch:     high,
+		endTick:       end,
+		height:        (high - low + 1) * opts.NoteHeight,
+		pixelsPerTick: float64(opts.Width) / float64(end),
+	}
+	// Measures closer together than a pixel share one line, so there are never more lines than columns
+	column := -1
+	for _, tick := range file.MeasureStarts(end) {
+		if x := roll.x(tick); x > column {
+			roll.measures = append(roll.measures, tick)
+			column = x
+		}
+	}
+	return roll, nil
+}
+
+func (p *pianoRoll) x(tick uint32) int {
+	return int(float64(tick) * p.pixelsPerTick)
+}
+
+func (p *pianoRoll) y(pitch int) int {
+	return (p.highPitch - pitch) * p.opts.NoteHeight
+}
+
+// noteColor shades the channel color by velocity so louder notes read brighter
+func noteColor(note midi.Note) color.RGBA {
+	base := channelColors[note.Channel%16]
+	scale := 0.35 + 0.65*float64(note.Velocity)/127
+	return color.RGBA{
+		R: uint8(float64(base.R) * scale),
+		G: uint8(float64(base.G) * scale),
+		B: uint8(float64(base.B) * scale),
+		A: 0xFF,
+	}
+}
+
+func isBlackKey(pitch int) bool {
+	switch pitch % 12 {
+	case 1, 3, 6, 8, 10:
+		return true
+	}
+	return false
+}
+
+// PianoRollPNG renders the notes of a MIDI file as a PNG image.
+// Time runs left to right, pitch bottom to top, and measure lines follow the time signature map.
+func PianoRollPNG(file *midi.File, opts PianoRollOptions) ([]byte, error) {
+	roll, err := newPianoRoll(file, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, roll.height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{backgroundColor}, image.Point{}, draw.Src)
+
+	for pitch := roll.lowPitch; pitch <= roll.highPitch; pitch++ {
+		if isBlackKey(pitch) {
+			row := image.Rect(0, roll.y(pitch), opts.Width, roll.y(pitch)+opts.NoteHeight)
+			draw.Draw(img, row, &image.Uniform{blackKeyColor}, image.Point{}, draw.Src)
+		}
+	}
+
+	for _, tick := range roll.measures {
+		line := image.Rect(roll.x(tick), 0, roll.x(tick)+1, roll.height)
+		draw.Draw(img, line, &image.Uniform{measureColor}, image.Point{}, draw.Src)
+	}
+
+	for _, note := range roll.notes {
+		x0, x1 := roll.x(note.Start), roll.x(note.End)
+		if x1 <= x0 {
+			x1 = x0 + 1
+		}
+		y0 := roll.y(int(note.Pitch))
+		rect := image.Rect(x0, y0, x1, y0+opts.NoteHeight)
+		draw.Draw(img, rect, &image.Uniform{noteColor(note)}, image.Point{}, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, utilities.WrapError(err, ErrEncodePNG)
+	}
+	return buf.Bytes(), nil
+}
+
+// PianoRollSVG renders the same piano roll as PianoRollPNG as a scalable SVG document
+func PianoRollSVG(file *midi.File, opts PianoRollOptions) ([]byte, error) {
+	roll, err := newPianoRoll(file, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		opts.Width, roll.height, opts.Width, roll.height)
+	fmt.Fprintf(&sb, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hexColor(backgroundColor))
+
+	for pitch := roll.lowPitch; pitch <= roll.highPitch; pitch++ {
+		if isBlackKey(pitch) {
+			fmt.Fprintf(&sb, `<rect x="0" y="%d" width="%d" height="%d" fill="%s"/>`+"\n",
+				roll.y(pitch), opts.Width, opts.NoteHeight, hexColor(blackKeyColor))
+		}
+	}
+
+	for _, tick := range roll.measures {
+		fmt.Fprintf(&sb, `<line x1="%d" y1="0" x2="%d" y2="%d" stroke="%s" stroke-width="1"/>`+"\n",
+			roll.x(tick), roll.x(tick), roll.height, hexColor(measureColor))
+	}
+
+	for _, note := range roll.notes {
+		width := max(roll.x(note.End)-roll.x(note.Start), 1)
+		fmt.Fprintf(&sb, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`+"\n",
+			roll.x(note.Start), roll.y(int(note.Pitch)), width, opts.NoteHeight, hexColor(noteColor(note)))
+	}
+
+	sb.WriteString("</svg>\n")
+	return []byte(sb.String()), nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,63 @@
+package render
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"strings"
+	"testing"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFile(t *testing.T, track []byte) *midi.File {
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	_ = binary.Write(&buf, binary.BigEndian, []uint32{6})
+	_ = binary.Write(&buf, binary.BigEndian, []uint16{0, 1, 96})
+	buf.WriteString("MTrk")
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(track)))
+	buf.Write(track)
+
+	file, err := midi.Parse(&buf)
+	require.NoError(t, err)
+	return file
+}
+
+var twoNotes = []byte{
+	0x00, 0x90, 0x3C, 0x64,
+	0x60, 0x80, 0x3C, 0x00,
+	0x00, 0x91, 0x43, 0x40,
+	0x60, 0x81, 0x43, 0x00,
+	0x00, 0xFF, 0x2F, 0x00,
+}
+
+func TestPianoRollPNG(t *testing.T) {
+	opts := PianoRollOptions{Width: 200, NoteHeight: 3, Padding: 1}
+	data, err := PianoRollPNG(testFile(t, twoNotes), opts)
+	require.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	// Pitches 60..67 plus one semitone of padding on each side
+	assert.Equal(t, 200, img.Bounds().Dx())
+	assert.Equal(t, 10*3, img.Bounds().Dy())
+}
+
+func TestPianoRollSVG(t *testing.T) {
+	data, err := PianoRollSVG(testFile(t, twoNotes), DefaultPianoRollOptions())
+	require.NoError(t, err)
+
+	svg := string(data)
+	assert.True(t, strings.HasPrefix(svg, "<svg"))
+	assert.Contains(t, svg, hexColor(noteColor(midi.Note{Channel: 1, Velocity: 0x40})))
+	assert.Contains(t, svg, "<line")
+}
+
+func TestPianoRoll_NoNotes(t *testing.T) {
+	_, err := PianoRollPNG(testFile(t, []byte{0x00, 0xFF, 0x2F, 0x00}), DefaultPianoRollOptions())
+	assert.ErrorIs(t, err, ErrNoNotes)
+}
@@ -0,0 +1,217 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"midi-file-server/midi"
+)
+
+var (
+	ErrInvalidPreviewWindow = fmt.Errorf("preview start must be non-negative and length positive")
+	ErrInvalidSampleRate    = fmt.Errorf("sample rate must be positive")
+	ErrPreviewTooLong       = fmt.Errorf("preview is too long")
+)
+
+const (
+	// MaxPreviewSeconds is the longest section of a song rendered to audio
+	MaxPreviewSeconds = 60
+	// maxSamples bounds the buffer allocated for a preview, a minute at 48 kHz
+	maxSamples = MaxPreviewSeconds * 48000
+	// maxVoices bounds the notes rendered into a preview, and maxPolyphony the samples they render all told,
+	// as many times the preview's length. Notes past either are left out.
+	maxVoices    = 2000
+	maxPolyphony = 16
+)
+
+const (
+	percussionChannel = 9
+
+	attackSeconds   = 0.005
+	releaseSeconds  = 0.12
+	fadeOutSeconds  = 0.5
+	maxVoiceSeconds = 6.0
+	silenceLevel    = 1e-4
+)
+
+// partialWeights are the relative amplitudes of the harmonics of the piano voice
+var partialWeights = []float64{1.0, 0.45, 0.25, 0.12, 0.06}
+
+// SynthOptions selects the section of the song to render and the output format
+type SynthOptions struct {
+	SampleRate int
+	Start      float64 // seconds into the song
+	Length     float64 // seconds of audio to render
+}
+
+// DefaultSynthOptions renders the first 30 seconds at a sample rate suited to phone speakers
+func DefaultSynthOptions() SynthOptions {
+	return SynthOptions{SampleRate: 22050, Start: 0, Length: 30}
+}
+
+// Synthesize renders a section of a MIDI file with a simple additive piano voice to normalized mono samples
+// in the range [-1, 1], for EncodeWAV. Percussion on channel 10 is skipped. The section is at most
+// MaxPreviewSeconds long and ends with the song, and its first notes are played up to maxVoices and maxPolyphony.
+// Rendering stops with ctx's error once ctx is done.
+func Synthesize(ctx context.Context, file *midi.File, opts SynthOptions) ([]float64, error) {
+	if opts.SampleRate <= 0 {
+		return nil, ErrInvalidSampleRate
+	}
+	if opts.Start < 0 || opts.Length <= 0 {
+		return nil, ErrInvalidPreviewWindow
+	}
+	if opts.Length > MaxPreviewSeconds {
+		return nil, ErrPreviewTooLong
+	}
+
+	// Never render past the end of the song plus its release tail
+	length := min(opts.Length, file.Duration()-opts.Start+releaseSeconds)
+	if length <= 0 {
+		return nil, ErrInvalidPreviewWindow
+	}
+	samples := length * float64(opts.SampleRate)
+	if samples > maxSamples {
+		return nil, ErrPreviewTooLong
+	}
+	buffer := make([]float64, int(samples))
+	windowEnd := opts.Start + length
+
+	tempoMap := file.TempoMap()
+	// Notes outside the window, give or take a tick of rounding, are dropped before converting their times
+	firstTick := tempoMap.Ticks(max(0, opts.Start-releaseSeconds))
+	lastTick := tempoMap.Ticks(windowEnd)
+	notes := file.Notes()
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].Start < notes[j].Start })
+	voices, budget := 0, len(buffer)*maxPolyphony
+	for _, note := range notes {
+		if note.Start > lastTick {
+			break
+		}
+		if note.Channel == percussionChannel || note.End+1 < firstTick {
+			continue
+		}
+		start := tempoMap.Seconds(note.Start)
+		end := tempoMap.Seconds(note.End)
+		if end+releaseSeconds < opts.Start || start >= windowEnd {
+			continue
+		}
+		if voices == maxVoices || budget <= 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		budget -= renderVoice(buffer, opts, note, start, end)
+		voices++
+	}
+
+	normalize(buffer)
+	fadeOut(buffer, opts.SampleRate)
+	return buffer, nil
+}
+
+// renderVoice adds one note to the buffer and returns how many samples it took. Higher partials decay faster,
+// as on a real string.
+func renderVoice(buffer []float64, opts SynthOptions, note midi.Note, start, end float64) int {
+	rate := float64(opts.SampleRate)
+	frequency := 440 * math.Pow(2, (float64(note.Pitch)-69)/12)
+	gain := 0.3 * math.Pow(float64(note.Velocity)/127, 1.5)
+	// Low notes ring longer than high notes
+	decay := 0.6 + float64(note.Pitch)/40
+
+	held := max(end-start, attackSeconds)
+	voiceLength := min(held+releaseSeconds, maxVoiceSeconds)
+	first := int(math.Ceil((start - opts.Start) * rate))
+	last := min(int((start-opts.Start+voiceLength)*rate), len(buffer))
+
+	rendered := 0
+	for i := max(first, 0); i < last; i++ {
+		rendered++
+		t := float64(i)/rate + opts.Start - start
+		envelope := math.Exp(-t * decay)
+		if t < attackSeconds {
+			envelope *= t / attackSeconds
+		}
+		if t > held {
+			envelope *= math.Max(0, 1-(t-held)/releaseSeconds)
+		}
+		if envelope < silenceLevel {
+			if t > attackSeconds {
+				break
+			}
+			continue
+		}
+
+		var sample float64
+		for n, weight := range partialWeights {
+			harmonic := float64(n + 1)
+			if frequency*harmonic >= rate/2 {
+				break
+			}
+			sample += weight * math.Exp(-t*decay*harmonic*0.5) * math.Sin(2*math.Pi*frequency*harmonic*t)
+		}
+		buffer[i] += gain * envelope * sample
+	}
+	return rendered
+}
+
+// normalize scales the buffer down if it clips, leaving quiet songs untouched
+func normalize(buffer []float64) {
+	var peak float64
+	for _, sample := range buffer {
+		peak = max(peak, math.Abs(sample))
+	}
+	if peak <= 0.95 {
+		return
+	}
+	scale := 0.95 / peak
+	for i := range buffer {
+		buffer[i] *= scale
+	}
+}
+
+// fadeOut avoids an audible click when the preview is cut mid-phrase
+func fadeOut(buffer []float64, sampleRate int) {
+	fadeSamples := min(int(fadeOutSeconds*float64(sampleRate)), len(buffer))
+	offset := len(buffer) - fadeSamples
+	for i := 0; i < fadeSamples; i++ {
+		buffer[offset+i] *= 1 - float64(i)/float64(fadeSamples)
+	}
+}
+
+// EncodeWAV encodes mono samples in the range [-1, 1] as a 16-bit PCM WAV file
+func EncodeWAV(samples []float64, sampleRate int) []byte {
+	const (
+		channels      = 1
+		bitsPerSample = 16
+	)
+	dataSize := uint32(len(samples) * bitsPerSample / 8)
+
+	var buf bytes.Buffer
+	buf.Grow(44 + int(dataSize))
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, 36+dataSize)
+	buf.WriteString("WAVEfmt ")
+	_ = binary.Write(&buf, binary.LittleEndian, struct {
+		ChunkSize     uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{16, 1, channels, uint32(sampleRate), uint32(sampleRate * channels * bitsPerSample / 8), channels * bitsPerSample / 8, bitsPerSample})
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, dataSize)
+
+	pcm := make([]int16, len(samples))
+	for i, sample := range samples {
+		pcm[i] = int16(math.Max(-1, math.Min(1, sample)) * math.MaxInt16)
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, pcm)
+	return buf.Bytes()
+}
@@ -0,0 +1,84 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"midi-file-server/midi"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSynthesize(t *testing.T) {
+	file := testFile(t, twoNotes)
+	opts := SynthOptions{SampleRate: 8000, Start: 0, Length: 30}
+
+	samples, err := Synthesize(context.Background(), file, opts)
+	require.NoError(t, err)
+
+	// Two eighth notes at 120 BPM last one second, plus the release tail
+	assert.Equal(t, int((1+releaseSeconds)*8000), len(samples))
+	var peak float64
+	for _, sample := range samples {
+		assert.LessOrEqual(t, sample, 1.0)
+		assert.GreaterOrEqual(t, sample, -1.0)
+		peak = max(peak, sample)
+	}
+	assert.Greater(t, peak, 0.01)
+}
+
+func TestSynthesize_InvalidWindow(t *testing.T) {
+	file := testFile(t, twoNotes)
+
+	_, err := Synthesize(context.Background(), file, SynthOptions{SampleRate: 8000, Start: -1, Length: 5})
+	assert.ErrorIs(t, err, ErrInvalidPreviewWindow)
+
+	_, err = Synthesize(context.Background(), file, SynthOptions{SampleRate: 8000, Start: 10, Length: 5})
+	assert.ErrorIs(t, err, ErrInvalidPreviewWindow)
+
+	_, err = Synthesize(context.Background(), file, SynthOptions{SampleRate: 8000, Start: 0, Length: 1e12})
+	assert.ErrorIs(t, err, ErrPreviewTooLong)
+
+	_, err = Synthesize(context.Background(), file, SynthOptions{SampleRate: 1 << 30, Start: 0, Length: 1})
+	assert.ErrorIs(t, err, ErrPreviewTooLong)
+}
+
+func TestSynthesize_ManyTempoChangesAndNotes(t *testing.T) {
+	file := midi.NewFile(96)
+	track := file.AddTrack("Piano")
+	for tick := uint32(0); tick < 150000; tick++ {
+		track.AddTempo(tick, 120+float64(tick%7))
+	}
+	for tick := uint32(0); tick < 100000; tick++ {
+		track.AddNote(0, uint8(40+tick%48), 80, tick, tick+24)
+	}
+	parsed, err := midi.Parse(bytes.NewReader(file.Encode()))
+	require.NoError(t, err)
+
+	began := time.Now()
+	for _, start := range []float64{0, 700} {
+		samples, err := Synthesize(context.Background(), parsed, SynthOptions{SampleRate: 22050, Start: start, Length: MaxPreviewSeconds})
+		require.NoError(t, err)
+		assert.NotEmpty(t, samples)
+	}
+	assert.Less(t, time.Since(began), 10*time.Second, "conversions and voices are bounded")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Synthesize(ctx, parsed, SynthOptions{SampleRate: 22050, Length: MaxPreviewSeconds})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestEncodeWAV(t *testing.T) {
+	data := EncodeWAV([]float64{0, 1, -1}, 8000)
+
+	require.Len(t, data, 44+6)
+	assert.Equal(t, "RIFF", string(data[0:4]))
+	assert.Equal(t, "WAVE", string(data[8:12]))
+	assert.Equal(t, uint32(8000), binary.LittleEndian.Uint32(data[24:28]))
+	assert.Equal(t, int16(32767), int16(binary.LittleEndian.Uint16(data[46:48])))
+}
@@ -0,0 +1,302 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"midi-file-server/mail"
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrInvalidEmail          = fmt.Errorf("invalid email address")
+	ErrEmailExists           = fmt.Errorf("email address is used by another account")
+	ErrInvalidAccountToken   = fmt.Errorf("invalid or expired token")
+	ErrEmailChanged          = fmt.Errorf("email address changed since the token was sent")
+	ErrMissingPassword       = fmt.Errorf("password is required")
+	ErrFailedSendMail        = fmt.Errorf("failed to send email")
+	ErrFailedUpdateEmail     = fmt.Errorf("failed to update email address")
+	ErrFailedIssueToken      = fmt.Errorf("failed to issue account token")
+	ErrFailedResetPassword   = fmt.Errorf("failed to reset password")
+	ErrInvalidAccountRequest = fmt.Errorf("invalid account request")
+)
+
+// Purposes of account tokens
+const (
+	PurposeVerifyEmail   = "verify-email"
+	PurposeResetPassword = "reset-password"
+)
+
+// resetMailTimeout bounds sending a reset email, which happens after the response
+const resetMailTimeout = time.Minute
+
+// passwordResetAccepted is the answer to every well-formed reset request, whether or not an account has
+// the address, so the endpoint can't be used to find out who has an account
+const passwordResetAccepted = "If a verified account has this email address, a password reset link has been sent to it"
+
+// ChangeEmail sets the signed-in user's email address and mails a link to verify it. Posting the current,
+// not yet verified, address sends a new link.
+func ChangeEmail(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidAccountRequest).Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if email == user.Email && user.EmailVerified {
+		respondAccount(w, http.StatusOK, "Email address already verified")
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"email": email, "emailVerified": false}}
+	if _, err := db.Collection(utilities.UsersCollection).UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			utilities.LogErrorAndRespond(w, ErrEmailExists.Error(), http.StatusConflict)
+			return
+		}
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedUpdateEmail).Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := sendVerification(ctx, db, user.ID, email); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	respondAccount(w, http.StatusAccepted, "Verification email sent")
+}
+
+// VerifyEmail marks the address a verification token was sent to as verified
+func VerifyEmail(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utilities.LogErrorAndRespond(w, ErrInvalidAccountToken.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := consumeAccountToken(ctx, db, req.Token, PurposeVerifyEmail)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.M{"_id": token.UserID, "email": token.Email}
+	result, err := db.Collection(utilities.UsersCollection).UpdateOne(ctx, filter, bson.M{"$set": bson.M{"emailVerified": true}})
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedUpdateEmail).Error(), http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		utilities.LogErrorAndRespond(w, ErrEmailChanged.Error(), http.StatusConflict)
+		return
+	}
+	log.Info().Str("user_id", token.UserID.Hex()).Msg("Email address verified")
+	respondAccount(w, http.StatusOK, "Email address verified")
+}
+
+// RequestPasswordReset mails a password reset link to the account with the verified address. It answers the
+// same, and as fast, whether or not there is such an account; the email is sent after responding.
+func RequestPasswordReset(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var req EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidAccountRequest).Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	err = db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"email": email, "emailVerified": true}).Decode(&user)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		log.Info().Msg("Password reset requested for an address without a verified account")
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to look up account for password reset")
+	default:
+		settings := db.Config().Auth
+		go func() {
+			mailContext, cancel := context.WithTimeout(context.Background(), resetMailTimeout)
+			defer cancel()
+			token, err := issueAccountToken(mailContext, db, user.ID, email, PurposeResetPassword, settings.ResetTTL)
+			if err == nil {
+				err = db.Mailer.Send(mailContext, resetMessage(settings.AccountURL, email, token, settings.ResetTTL))
+			}
+			if err != nil {
+				log.Error().Err(err).Str("username", user.Username).Msg("Failed to send password reset email")
+			}
+		}()
+	}
+	respondAccount(w, http.StatusAccepted, passwordResetAccepted)
+}
+
+// ConfirmPasswordReset sets a new password with a reset token. Every session of the account is ended, so
+// whoever knew the old password is signed out, and the account's login lock is lifted; device keys are kept.
+func ConfirmPasswordReset(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var req PasswordResetConfirmation
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		utilities.LogErrorAndRespond(w, ErrInvalidAccountToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		utilities.LogErrorAndRespond(w, ErrMissingPassword.Error(), http.StatusBadRequest)
+		return
+	}
+	// Hashing first keeps a slow hash from using up a token that then fails
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedHashPassword).Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := consumeAccountToken(ctx, db, req.Token, PurposeResetPassword)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.M{"_id": token.UserID, "email": token.Email}
+	result, err := db.Collection(utilities.UsersCollection).UpdateOne(ctx, filter, bson.M{"$set": bson.M{"password": hashedPassword}})
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedResetPassword).Error(), http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		utilities.LogErrorAndRespond(w, ErrEmailChanged.Error(), http.StatusConflict)
+		return
+	}
+	if _, err := db.Collection(utilities.SessionsCollection).DeleteMany(ctx, bson.M{"user_id": token.UserID}); err != nil {
+		log.Error().Err(err).Str("user_id", token.UserID.Hex()).Msg("Failed to end sessions after password reset")
+	}
+	// Proving the address is as good as the password, so a login lock on the account is lifted too
+	var user User
+	if err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"_id": token.UserID}).Decode(&user); err == nil {
+		clearLoginFailures(ctx, db, user.Username)
+	}
+	log.Info().Str("user_id", token.UserID.Hex()).Msg("Password reset")
+	respondAccount(w, http.StatusOK, "Password reset, sign in with the new password")
+}
+
+// sendVerification mails a link that verifies email for the user
+func sendVerification(ctx context.Context, db *Database, userID primitive.ObjectID, email string) error {
+	settings := db.Config().Auth
+	token, err := issueAccountToken(ctx, db, userID, email, PurposeVerifyEmail, settings.VerificationTTL)
+	if err != nil {
+		return err
+	}
+	if err := db.Mailer.Send(ctx, verificationMessage(settings.AccountURL, email, token, settings.VerificationTTL)); err != nil {
+		return utilities.WrapError(err, ErrFailedSendMail)
+	}
+	return nil
+}
+
+// issueAccountToken stores a new token for the user and purpose, replacing any sent before, and returns it
+func issueAccountToken(ctx context.Context, db *Database, userID primitive.ObjectID, email, purpose string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", utilities.WrapError(err, ErrFailedIssueToken)
+	}
+	collection := db.Collection(utilities.AccountTokensCollection)
+	if _, err := collection.DeleteMany(ctx, bson.M{"user_id": userID, "purpose": purpose}); err != nil {
+		return "", utilities.WrapError(err, ErrFailedIssueToken)
+	}
+	now := time.Now().UTC()
+	record := AccountToken{
+		TokenHash: hashToken(token),
+		Purpose:   purpose,
+		UserID:    userID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		return "", utilities.WrapError(err, ErrFailedIssueToken)
+	}
+	return token, nil
+}
+
+// consumeAccountToken removes an unexpired token for purpose and returns it, so each token works once
+func consumeAccountToken(ctx context.Context, db *Database, token, purpose string) (AccountToken, error) {
+	var record AccountToken
+	filter := bson.M{"_id": hashToken(token), "purpose": purpose, "expires_at": bson.M{"$gt": time.Now().UTC()}}
+	if err := db.Collection(utilities.AccountTokensCollection).FindOneAndDelete(ctx, filter).Decode(&record); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return record, ErrInvalidAccountToken
+		}
+		return record, utilities.WrapError(err, ErrInvalidAccountToken)
+	}
+	return record, nil
+}
+
+// normalizeEmail accepts a bare address, e.g. "Ann@Example.com", and returns it lower case
+func normalizeEmail(raw string) (string, error) {
+	trimmed := strings.TrimSpace(raw)
+	address, err := netmail.ParseAddress(trimmed)
+	if err != nil || address.Address != trimmed {
+		return "", utilities.WrapError(fmt.Errorf("expected an address such as name@example.com"), ErrInvalidEmail)
+	}
+	return strings.ToLower(address.Address), nil
+}
+
+func verificationMessage(accountURL, to, token string, ttl time.Duration) mail.Message {
+	return mail.Message{
+		To:      to,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm that this is your email address so you can recover your account:\n\n%s\n\nIt expires in %s. If you didn't add this address, ignore this email.\n",
+			accountLink(accountURL, PurposeVerifyEmail, token), ttl),
+	}
+}
+
+func resetMessage(accountURL, to, token string, ttl time.Duration) mail.Message {
+	return mail.Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account. To choose a new password, open:\n\n%s\n\nIt works once and expires in %s. If it wasn't you, ignore this email; your password is unchanged.\n",
+			accountLink(accountURL, PurposeResetPassword, token), ttl),
+	}
+}
+
+// accountLink is the link of an emailed token. Without an account page to open, the token itself is given
+// for the user to paste into the app.
+func accountLink(accountURL, purpose, token string) string {
+	if accountURL == "" {
+		return "Code: " + token
+	}
+	return withQuery(withQuery(accountURL, "action", purpose), "token", token)
+}
+
+func respondAccount(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(AccountResponse{Message: message}); err != nil {
+		log.Error().Err(err).Msg("Failed to encode account response")
+	}
+}
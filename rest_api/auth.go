@@ -0,0 +1,214 @@
+package restapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrMissingToken        = fmt.Errorf("missing bearer token")
+	ErrInvalidToken        = fmt.Errorf("invalid or expired token")
+	ErrFailedCreateSession = fmt.Errorf("failed to create session")
+	ErrUnknownDeviceCert   = fmt.Errorf("client certificate doesn't name a registered device")
+	ErrDeviceNotClaimed    = fmt.Errorf("device is not registered to a user")
+)
+
+// Session is a login; only the SHA-256 of its bearer token is stored
+type Session struct {
+	TokenHash string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// WithUser authenticates the request's bearer token and passes the signed-in user to the handler
+func WithUser(handler func(context.Context, *Database, http.ResponseWriter, *http.Request, User)) func(context.Context, *Database, http.ResponseWriter, *http.Request) {
+	return func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(ctx, db, r)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(ctx, db, w, r, user)
+	}
+}
+
+// WithUserDuration is WithUser for handlers that also sign URLs
+func WithUserDuration(handler func(context.Context, *Database, http.ResponseWriter, *http.Request, time.Duration, User)) func(context.Context, *Database, http.ResponseWriter, *http.Request, time.Duration) {
+	return func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration) {
+		user, err := authenticate(ctx, db, r)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(ctx, db, w, r, d, user)
+	}
+}
+
+// WithDevice is WithUser for endpoints a player calls. Besides a bearer token they accept a device key
+// in the X-Device-Key header, if it has the read scope for GET requests or the write scope for others, and
+// a client certificate naming the device, so headless players can authenticate without a password.
+// An empty scope keeps device keys out.
+func WithDevice(read, write string, handler func(context.Context, *Database, http.ResponseWriter, *http.Request, User)) func(context.Context, *Database, http.ResponseWriter, *http.Request) {
+	return func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+		user, err := authenticateDevice(ctx, db, r, requiredScope(r, read, write))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), authStatus(err))
+			return
+		}
+		handler(ctx, db, w, r, user)
+	}
+}
+
+// WithDeviceDuration is WithDevice for handlers that also sign URLs
+func WithDeviceDuration(read, write string, handler func(context.Context, *Database, http.ResponseWriter, *http.Request, time.Duration, User)) func(context.Context, *Database, http.ResponseWriter, *http.Request, time.Duration) {
+	return func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration) {
+		user, err := authenticateDevice(ctx, db, r, requiredScope(r, read, write))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), authStatus(err))
+			return
+		}
+		handler(ctx, db, w, r, d, user)
+	}
+}
+
+// authStatus is 403 for a valid device key used beyond its scopes and 401 otherwise
+func authStatus(err error) int {
+	if errors.Is(err, ErrMissingScope) || errors.Is(err, ErrDeviceKeyNotAccepted) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// authenticateDevice uses the bearer token when there is one, then a device key with the scope. Otherwise
+// a client certificate verified against the configured client CAs signs in as the user who registered the
+// device it names. Either way the handlers' requireDevice keeps the request to that device.
+func authenticateDevice(ctx context.Context, db *Database, r *http.Request, scope string) (User, error) {
+	if _, ok := bearerToken(r); ok {
+		return authenticate(ctx, db, r)
+	}
+	if key := strings.TrimSpace(r.Header.Get(DeviceKeyHeader)); key != "" {
+		return authenticateDeviceKey(ctx, db, key, scope)
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return authenticate(ctx, db, r)
+	}
+	var user User
+	serial, err := certificateSerial(ctx, db, r.TLS.VerifiedChains[0][0])
+	if err != nil {
+		return user, err
+	}
+	err = db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"serialNumber": serial}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, ErrDeviceNotClaimed
+	}
+	if err != nil {
+		return user, utilities.WrapError(err, ErrInvalidToken)
+	}
+	return user, nil
+}
+
+// certificateSerial finds the registered serial number named by a client certificate, as its common name
+// or one of its DNS names. A certificate naming more than one registered device is refused.
+func certificateSerial(ctx context.Context, db *Database, cert *x509.Certificate) (string, error) {
+	filter := bson.M{"serial_number": bson.M{"$in": certificateNames(cert)}}
+	serials, err := db.Collection(utilities.ValidOTPSerialsCollection).Distinct(ctx, "serial_number", filter)
+	if err != nil {
+		return "", utilities.WrapError(err, ErrUnknownDeviceCert)
+	}
+	if len(serials) != 1 {
+		return "", ErrUnknownDeviceCert
+	}
+	serial, ok := serials[0].(string)
+	if !ok {
+		return "", ErrUnknownDeviceCert
+	}
+	return serial, nil
+}
+
+// certificateNames lists the names a device certificate may carry its serial number under
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		if name != "" && name != cert.Subject.CommonName {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// authenticate resolves the Authorization: Bearer token to its user
+func authenticate(ctx context.Context, db *Database, r *http.Request) (User, error) {
+	var user User
+	token, ok := bearerToken(r)
+	if !ok {
+		return user, ErrMissingToken
+	}
+
+	var session Session
+	filter := bson.M{"_id": hashToken(token), "expires_at": bson.M{"$gt": time.Now().UTC()}}
+	if err := db.Collection(utilities.SessionsCollection).FindOne(ctx, filter).Decode(&session); err != nil {
+		return user, utilities.WrapError(err, ErrInvalidToken)
+	}
+	if err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"_id": session.UserID}).Decode(&user); err != nil {
+		return user, utilities.WrapError(err, ErrInvalidToken)
+	}
+	return user, nil
+}
+
+// createSession starts a session for the user and returns its bearer token
+func createSession(ctx context.Context, db *Database, userID primitive.ObjectID) (string, time.Time, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, utilities.WrapError(err, ErrFailedCreateSession)
+	}
+	now := time.Now().UTC()
+	session := Session{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(db.Config().Auth.SessionTTL),
+	}
+	if _, err := db.Collection(utilities.SessionsCollection).InsertOne(ctx, session); err != nil {
+		return "", time.Time{}, utilities.WrapError(err, ErrFailedCreateSession)
+	}
+	return token, session.ExpiresAt, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	token = strings.TrimSpace(token)
+	return token, found && token != ""
+}
+
+// randomToken returns 32 random bytes, hex encoded
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
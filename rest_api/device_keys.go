@@ -0,0 +1,278 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidDeviceKey        = fmt.Errorf("invalid or revoked device key")
+	ErrMissingScope            = fmt.Errorf("device key lacks the scope for this request")
+	ErrInvalidScopes           = fmt.Errorf("invalid device key scopes")
+	ErrDeviceKeyNotFound       = fmt.Errorf("device key not found")
+	ErrFailedCreateDeviceKey   = fmt.Errorf("failed to create device key")
+	ErrFailedLoadDeviceKeys    = fmt.Errorf("failed to load device keys")
+	ErrFailedRevokeDeviceKey   = fmt.Errorf("failed to revoke device key")
+	ErrDeviceKeyNotAccepted    = fmt.Errorf("device keys can't be used for this request")
+	ErrInvalidDeviceKeyRequest = fmt.Errorf("invalid device key request")
+)
+
+// Scopes a device key can be given
+const (
+	// ScopeReadLibrary reads the device's queue, schedules and commands and plays through its queue
+	ScopeReadLibrary = "read-library"
+	// ScopeReportStatus reports plays and uploads recordings
+	ScopeReportStatus = "report-status"
+	// ScopeManageDevice changes the device's queue settings and schedules
+	ScopeManageDevice = "manage-device"
+)
+
+const (
+	// DeviceKeyHeader carries a device key on requests
+	DeviceKeyHeader = "X-Device-Key"
+	deviceKeyPrefix = "dk_"
+	// deviceKeyPrefixLength is how much of a key is kept to recognise it by
+	deviceKeyPrefixLength = len(deviceKeyPrefix) + 8
+	// lastUsedGranularity limits how often a key's last use is written, as devices poll often
+	lastUsedGranularity = time.Minute
+)
+
+// DefaultDeviceScopes are given to keys created without scopes, including the one created when a device is claimed
+var DefaultDeviceScopes = []string{ScopeReadLibrary, ScopeReportStatus}
+
+var deviceScopes = []string{ScopeReadLibrary, ScopeReportStatus, ScopeManageDevice}
+
+// DeviceKeys lists the active keys of a device with GET and creates one with POST. The new key is in the
+// response and can't be retrieved again.
+func DeviceKeys(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	serial := r.PathValue("serial")
+	if err := requireDevice(user, serial); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{"serial_number": serial, "user_id": user.ID, "revoked_at": nil}
+		cursor, err := db.Collection(utilities.DeviceKeysCollection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadDeviceKeys).Error(), http.StatusInternalServerError)
+			return
+		}
+		keys := []DeviceKey{}
+		if err := cursor.All(ctx, &keys); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadDeviceKeys).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(keys); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device keys")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		var req DeviceKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidDeviceKeyRequest).Error(), http.StatusBadRequest)
+			return
+		}
+		scopes, err := parseScopes(req.Scopes)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := createDeviceKey(ctx, db, user.ID, serial, req.Name, scopes)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondDeviceKey(w, created)
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// DeviceKeyByID revokes a device key with DELETE
+func DeviceKeyByID(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodDelete {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	key, status, err := findActiveDeviceKey(ctx, db, r.PathValue("serial"), r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	if err := revokeDeviceKey(ctx, db, key.ID); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateDeviceKey replaces a device key with a new one of the same name and scopes, revoking the old one
+func RotateDeviceKey(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	key, status, err := findActiveDeviceKey(ctx, db, r.PathValue("serial"), r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	created, err := createDeviceKey(ctx, db, user.ID, key.SerialNumber, key.Name, key.Scopes)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := revokeDeviceKey(ctx, db, key.ID); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondDeviceKey(w, created)
+}
+
+func respondDeviceKey(w http.ResponseWriter, created DeviceKeyResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device key")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// createDeviceKey stores a new key for the device and returns it with the key itself
+func createDeviceKey(ctx context.Context, db *Database, userID primitive.ObjectID, serial, name string, scopes []string) (DeviceKeyResponse, error) {
+	created, err := newDeviceKey(userID, serial, name, scopes, time.Now().UTC())
+	if err != nil {
+		return created, utilities.WrapError(err, ErrFailedCreateDeviceKey)
+	}
+	result, err := db.Collection(utilities.DeviceKeysCollection).InsertOne(ctx, created.DeviceKey)
+	if err != nil {
+		return created, utilities.WrapError(err, ErrFailedCreateDeviceKey)
+	}
+	created.ID, _ = result.InsertedID.(primitive.ObjectID)
+	return created, nil
+}
+
+// newDeviceKey generates a random key and the record stored for it
+func newDeviceKey(userID primitive.ObjectID, serial, name string, scopes []string, now time.Time) (DeviceKeyResponse, error) {
+	token, err := randomToken()
+	if err != nil {
+		return DeviceKeyResponse{}, err
+	}
+	key := deviceKeyPrefix + token
+	return DeviceKeyResponse{
+		DeviceKey: DeviceKey{
+			UserID:       userID,
+			SerialNumber: serial,
+			Name:         strings.TrimSpace(name),
+			KeyHash:      hashToken(key),
+			Prefix:       key[:deviceKeyPrefixLength],
+			Scopes:       scopes,
+			CreatedAt:    now,
+		},
+		Key: key,
+	}, nil
+}
+
+func findActiveDeviceKey(ctx context.Context, db *Database, serial, hexID string, user User) (DeviceKey, int, error) {
+	var key DeviceKey
+	if err := requireDevice(user, serial); err != nil {
+		return key, http.StatusForbidden, err
+	}
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return key, http.StatusNotFound, ErrDeviceKeyNotFound
+	}
+	filter := bson.M{"_id": id, "serial_number": serial, "user_id": user.ID, "revoked_at": nil}
+	err = db.Collection(utilities.DeviceKeysCollection).FindOne(ctx, filter).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return key, http.StatusNotFound, ErrDeviceKeyNotFound
+	}
+	if err != nil {
+		return key, http.StatusInternalServerError, utilities.WrapError(err, ErrFailedLoadDeviceKeys)
+	}
+	return key, http.StatusOK, nil
+}
+
+func revokeDeviceKey(ctx context.Context, db *Database, id primitive.ObjectID) error {
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}}
+	if _, err := db.Collection(utilities.DeviceKeysCollection).UpdateOne(ctx, bson.M{"_id": id, "revoked_at": nil}, update); err != nil {
+		return utilities.WrapError(err, ErrFailedRevokeDeviceKey)
+	}
+	return nil
+}
+
+// parseScopes checks requested scopes, defaulting to DefaultDeviceScopes, and returns them sorted without repeats
+func parseScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return slices.Clone(DefaultDeviceScopes), nil
+	}
+	var scopes []string
+	for _, scope := range requested {
+		if !slices.Contains(deviceScopes, scope) {
+			return nil, fmt.Errorf("%w: unknown scope %q, expected %s", ErrInvalidScopes, scope, strings.Join(deviceScopes, ", "))
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	slices.Sort(scopes)
+	return scopes, nil
+}
+
+// requiredScope picks the scope a device key needs for the request: read for GET and write otherwise.
+// An empty scope means device keys aren't accepted.
+func requiredScope(r *http.Request, read, write string) string {
+	if r.Method == http.MethodGet {
+		return read
+	}
+	return write
+}
+
+// authenticateDeviceKey signs in as the owner of the device a key belongs to, if the key has the scope.
+// Its last use is recorded at most once per lastUsedGranularity.
+func authenticateDeviceKey(ctx context.Context, db *Database, key, scope string) (User, error) {
+	var user User
+	if scope == "" {
+		return user, ErrDeviceKeyNotAccepted
+	}
+	var deviceKey DeviceKey
+	filter := bson.M{"key_hash": hashToken(key), "revoked_at": nil}
+	if err := db.Collection(utilities.DeviceKeysCollection).FindOne(ctx, filter).Decode(&deviceKey); err != nil {
+		return user, utilities.WrapError(err, ErrInvalidDeviceKey)
+	}
+	if !slices.Contains(deviceKey.Scopes, scope) {
+		return user, fmt.Errorf("%w: needs %s", ErrMissingScope, scope)
+	}
+	if err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"_id": deviceKey.UserID}).Decode(&user); err != nil {
+		return user, utilities.WrapError(err, ErrInvalidDeviceKey)
+	}
+	// A device claimed again by someone else no longer answers to its previous owner's keys
+	if user.SerialNumber != deviceKey.SerialNumber {
+		return User{}, ErrInvalidDeviceKey
+	}
+
+	now := time.Now().UTC()
+	if deviceKey.LastUsedAt == nil || now.Sub(*deviceKey.LastUsedAt) >= lastUsedGranularity {
+		if _, err := db.Collection(utilities.DeviceKeysCollection).UpdateOne(ctx, bson.M{"_id": deviceKey.ID}, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+			log.Error().Err(err).Str("prefix", deviceKey.Prefix).Msg("Failed to record device key use")
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,291 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrDeviceNotOwned     = fmt.Errorf("device is not registered to this user")
+	ErrQueueNotFound      = fmt.Errorf("no playlist has been sent to this device")
+	ErrInvalidQueue       = fmt.Errorf("invalid queue settings")
+	ErrFailedSaveQueue    = fmt.Errorf("failed to save device queue")
+	ErrEmptyPlaylist      = fmt.Errorf("playlist has no songs")
+	ErrFailedSignPlaylist = fmt.Errorf("failed to sign playlist")
+)
+
+// Repeat modes of a device queue
+const (
+	RepeatOff = "off"
+	RepeatOne = "one"
+	RepeatAll = "all"
+)
+
+// SendPlaylistToDevice queues one of the user's playlists on one of their devices and returns signed
+// download URLs for the whole queue, in play order. The device's shuffle and repeat settings carry over.
+func SendPlaylistToDevice(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration, user User) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SendPlaylistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("invalid send request")).Error(), http.StatusBadRequest)
+		return
+	}
+	if err := requireDevice(user, req.SerialNumber); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	playlist, status, err := findOwnedPlaylist(ctx, db, r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	if len(playlist.Items) == 0 {
+		utilities.LogErrorAndRespond(w, ErrEmptyPlaylist.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queue := DeviceQueue{Repeat: RepeatOff}
+	if previous, err := findDeviceQueue(ctx, db, req.SerialNumber, user.ID); err == nil {
+		queue.Shuffle, queue.Repeat = previous.Shuffle, previous.Repeat
+	}
+	// A queue left by the device's previous owner makes way for the new one
+	if _, err := db.Collection(utilities.DeviceQueuesCollection).DeleteOne(ctx, bson.M{"_id": req.SerialNumber, "owner_id": bson.M{"$ne": user.ID}}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveQueue, req.SerialNumber).Error(), http.StatusInternalServerError)
+		return
+	}
+	queue.SerialNumber = req.SerialNumber
+	queue.OwnerID = user.ID
+	queue.PlaylistID = playlist.ID
+	queue.Items = playlist.Items
+	queue.Order = queueOrder(len(queue.Items), queue.Shuffle, -1)
+	queue.Position = 0
+	queue.StartedAt = time.Now().UTC()
+	if err := saveDeviceQueue(ctx, db, &queue); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	downloads, err := signObjectNames(ctx, db.Config().Storage.SongsBucket, queue.objectNames(), d)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSignPlaylist).Error(), http.StatusInternalServerError)
+		return
+	}
+	// The device starts on the first song right away
+	recordFetches(ctx, db, user, []string{queue.current().ObjectName}, queue.SerialNumber)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(DeviceQueueResponse{Queue: queue, Downloads: downloads, Lyrics: songLyrics(ctx, db, queue.current().SongID)}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device queue")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeviceQueueHandler returns (GET) or changes (PUT with shuffle and/or repeat) a device's queue.
+// Turning shuffle on or off keeps the current song playing and reorders the rest.
+func DeviceQueueHandler(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	serial := r.PathValue("serial")
+	if err := requireDevice(user, serial); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	queue, err := findDeviceQueue(ctx, db, serial, user.ID)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req DeviceQueueSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidQueue).Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Repeat != nil {
+			if !validRepeat(*req.Repeat) {
+				utilities.LogErrorAndRespond(w, utilities.WrapError(fmt.Errorf("repeat must be off, one or all"), ErrInvalidQueue).Error(), http.StatusBadRequest)
+				return
+			}
+			queue.Repeat = *req.Repeat
+		}
+		if req.Shuffle != nil && *req.Shuffle != queue.Shuffle {
+			queue.setShuffle(*req.Shuffle)
+		}
+		if err := saveDeviceQueue(ctx, db, &queue); err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(queue); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device queue")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// NextInQueue moves a device to its next song, following the repeat mode, and returns a signed URL for it.
+// Responds 204 No Content once the queue has finished.
+func NextInQueue(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration, user User) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	serial := r.PathValue("serial")
+	if err := requireDevice(user, serial); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	queue, err := findDeviceQueue(ctx, db, serial, user.ID)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	more := queue.advance()
+	queue.StartedAt = time.Now().UTC()
+	if err := saveDeviceQueue(ctx, db, &queue); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !more {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	item := queue.current()
+	downloads, err := signObjectNames(ctx, db.Config().Storage.SongsBucket, []string{item.ObjectName}, d)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordFetches(ctx, db, user, []string{item.ObjectName}, serial)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(DeviceQueueResponse{Queue: queue, Downloads: downloads, Lyrics: songLyrics(ctx, db, item.SongID)}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device queue")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// requireDevice checks the serial number belongs to the device the user registered with
+func requireDevice(user User, serial string) error {
+	if serial == "" || serial != user.SerialNumber {
+		return ErrDeviceNotOwned
+	}
+	return nil
+}
+
+// findDeviceQueue loads the queue the owner set on a device; a queue left by anyone else is not found
+func findDeviceQueue(ctx context.Context, db *Database, serial string, ownerID primitive.ObjectID) (DeviceQueue, error) {
+	var queue DeviceQueue
+	err := db.Collection(utilities.DeviceQueuesCollection).FindOne(ctx, bson.M{"_id": serial, "owner_id": ownerID}).Decode(&queue)
+	if err == mongo.ErrNoDocuments {
+		return queue, ErrQueueNotFound
+	}
+	if err != nil {
+		return queue, utilities.WrapError(err, fmt.Errorf("failed to load device queue"))
+	}
+	return queue, nil
+}
+
+func saveDeviceQueue(ctx context.Context, db *Database, queue *DeviceQueue) error {
+	queue.UpdatedAt = time.Now().UTC()
+	filter := bson.M{"_id": queue.SerialNumber, "owner_id": queue.OwnerID}
+	_, err := db.Collection(utilities.DeviceQueuesCollection).ReplaceOne(ctx, filter, queue, options.Replace().SetUpsert(true))
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedSaveQueue, queue.SerialNumber)
+	}
+	return nil
+}
+
+func validRepeat(mode string) bool {
+	return mode == RepeatOff || mode == RepeatOne || mode == RepeatAll
+}
+
+// queueOrder returns the play order of n items: in sequence, or shuffled with first (if not -1) kept at the front
+func queueOrder(n int, shuffle bool, first int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	if !shuffle {
+		return order
+	}
+	rand.Shuffle(n, func(i, j int) { order[i], order[j] = order[j], order[i] })
+	if first >= 0 {
+		for i, item := range order {
+			if item == first {
+				order[0], order[i] = order[i], order[0]
+				break
+			}
+		}
+	}
+	return order
+}
+
+// setShuffle reorders the queue so the current song stays current and the rest follow in the new mode.
+// Going back to sequential order resumes after the current song.
+func (q *DeviceQueue) setShuffle(shuffle bool) {
+	q.Shuffle = shuffle
+	if len(q.Order) == 0 {
+		return
+	}
+	current := q.Order[q.Position]
+	q.Order = queueOrder(len(q.Items), shuffle, current)
+	q.Position = 0
+	if !shuffle {
+		q.Position = current
+	}
+}
+
+// advance moves to the next song and reports whether there is one.
+// At the end of the queue, repeat all starts over (reshuffled when shuffling) and repeat off stops.
+func (q *DeviceQueue) advance() bool {
+	if len(q.Order) == 0 {
+		return false
+	}
+	switch {
+	case q.Repeat == RepeatOne:
+		return true
+	case q.Position+1 < len(q.Order):
+		q.Position++
+		return true
+	case q.Repeat == RepeatAll:
+		q.Order = queueOrder(len(q.Items), q.Shuffle, -1)
+		q.Position = 0
+		return true
+	default:
+		q.Position = len(q.Order) - 1
+		return false
+	}
+}
+
+func (q DeviceQueue) current() PlaylistItem {
+	return q.Items[q.Order[q.Position]]
+}
+
+// objectNames lists the queued songs' objects in play order from the current position
+func (q DeviceQueue) objectNames() []string {
+	names := make([]string, 0, len(q.Order))
+	for _, index := range q.Order[q.Position:] {
+		names = append(names, q.Items[index].ObjectName)
+	}
+	return names
+}
@@ -0,0 +1,149 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrDuplicateSong        = fmt.Errorf("song is an exact duplicate of an existing song")
+	ErrFailedFindDuplicates = fmt.Errorf("failed to find duplicate songs")
+)
+
+// Duplicate group kinds, from strictest to loosest
+const (
+	DuplicateExact   = "exact"
+	DuplicateMusical = "musical"
+	DuplicateSimilar = "similar"
+)
+
+// FindDuplicates reports groups of songs that are exact, musical or near duplicates of each other.
+// The similarity query parameter overrides the configured catalog.duplicate_similarity as the threshold for near duplicates.
+func FindDuplicates(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	threshold := db.Config().Catalog.DuplicateSimilarity
+	if value := r.URL.Query().Get("similarity"); value != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			utilities.LogErrorAndRespond(w, "similarity must be greater than 0 and at most 1", http.StatusBadRequest)
+			return
+		}
+	}
+
+	projection := bson.M{"object_name": 1, "title": 1, "fingerprint": 1}
+	cursor, err := db.Collection(utilities.SongsCollection).Find(ctx, bson.M{"fingerprint": bson.M{"$exists": true}}, options.Find().SetProjection(projection))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedFindDuplicates).Error(), http.StatusInternalServerError)
+		return
+	}
+	var songs []Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedFindDuplicates).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(duplicateGroups(songs, threshold)); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode duplicates")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// findExactDuplicate returns another song with the same file contents, if there is one
+func findExactDuplicate(ctx context.Context, db *Database, song Song) (*Song, error) {
+	filter := bson.M{"fingerprint.sha256": song.Fingerprint.SHA256, "object_name": bson.M{"$ne": song.ObjectName}}
+	var existing Song
+	err := db.Collection(utilities.SongsCollection).FindOne(ctx, filter).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// duplicateGroups links every pair of songs whose similarity reaches the threshold and returns the
+// connected groups, largest first. Comparing all pairs is fine for a library of a few thousand songs.
+func duplicateGroups(songs []Song, threshold float64) []DuplicateGroup {
+	parent := make([]int, len(songs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	lowest := map[int]float64{}
+	for i := range songs {
+		for j := i + 1; j < len(songs); j++ {
+			similarity := songs[i].Fingerprint.Similarity(*songs[j].Fingerprint)
+			if similarity < threshold {
+				continue
+			}
+			a, b := find(i), find(j)
+			if a != b {
+				parent[b] = a
+			}
+			root := find(i)
+			lowest[root] = min(similarity, minOr(lowest, a, 1), minOr(lowest, b, 1))
+		}
+	}
+
+	members := map[int][]int{}
+	for i := range songs {
+		members[find(i)] = append(members[find(i)], i)
+	}
+
+	groups := []DuplicateGroup{}
+	for root, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		group := DuplicateGroup{Kind: DuplicateExact, Similarity: lowest[root]}
+		first := songs[indexes[0]].Fingerprint
+		for _, i := range indexes {
+			song := songs[i]
+			if song.Fingerprint.SHA256 != first.SHA256 && group.Kind == DuplicateExact {
+				group.Kind = DuplicateMusical
+			}
+			if song.Fingerprint.Musical != first.Musical {
+				group.Kind = DuplicateSimilar
+			}
+			group.Songs = append(group.Songs, DuplicateSong{ID: song.ID, ObjectName: song.ObjectName, Title: song.Title})
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Songs) != len(groups[j].Songs) {
+			return len(groups[i].Songs) > len(groups[j].Songs)
+		}
+		return groups[i].Songs[0].ObjectName < groups[j].Songs[0].ObjectName
+	})
+	return groups
+}
+
+func minOr(values map[int]float64, key int, fallback float64) float64 {
+	if value, ok := values[key]; ok {
+		return value
+	}
+	return fallback
+}
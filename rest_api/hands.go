@@ -0,0 +1,79 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"midi-file-server/analysis"
+	"midi-file-server/practice"
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrFailedSeparateHands = fmt.Errorf("failed to generate per-hand file")
+
+// GetHands returns a signed URL to a version of a song for practising one hand: mode=mute-left or mute-right
+// drops that hand's notes, and mode=split-channels moves the left hand onto a channel of its own.
+// Songs catalogued before hands were separated get their hand split saved on the first request.
+// The file is stored under practicePrefix, named after the song and the mode.
+func GetHands(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration, user User) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode, err := practice.ParseHandMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	file, err := downloadMidi(ctx, db.Config().Storage.SongsBucket, song.ObjectName)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSeparateHands).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hands, split := analysis.SeparateHands(file)
+	if song.Hands == nil {
+		if _, err := db.Collection(utilities.SongsCollection).UpdateByID(ctx, song.ID, bson.M{"$set": bson.M{"hands": split}}); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveSong).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	separated, err := practice.Hands(file, hands, mode)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, practice.ErrNoFreeChannel) {
+			status = http.StatusUnprocessableEntity
+		}
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSeparateHands).Error(), status)
+		return
+	}
+
+	objectName := practiceObjectName(song.ObjectName, fmt.Sprintf(".%s.mid", mode))
+	if err := uploadArtifacts(ctx, db.Config().Storage.SongsBucket, []artifact{{objectName: objectName, contentType: "audio/midi", data: separated.Encode()}}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSeparateHands).Error(), http.StatusInternalServerError)
+		return
+	}
+	signedURL, err := generateSignedURL(ctx, db.Config().Storage.SongsBucket, objectName, d)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateSignedURL).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(HandsResponse{ObjectName: objectName, SignedURL: signedURL, Mode: string(mode), Hands: &split}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode hands")).Error(), http.StatusInternalServerError)
+	}
+}
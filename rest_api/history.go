@@ -0,0 +1,386 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidRating       = fmt.Errorf("rating must be between 1 and 5 stars")
+	ErrInvalidPlayEvent    = fmt.Errorf("invalid playback event")
+	ErrFailedSaveFavorite  = fmt.Errorf("failed to save favorite")
+	ErrFailedSaveRating    = fmt.Errorf("failed to save rating")
+	ErrFailedRecordPlay    = fmt.Errorf("failed to record play")
+	ErrFailedLoadHistory   = fmt.Errorf("failed to load play history")
+	ErrFailedLoadFavorites = fmt.Errorf("failed to load favorites")
+)
+
+// Play history event types
+const (
+	PlayEventFetch  = "fetch"
+	PlayEventStart  = "start"
+	PlayEventFinish = "finish"
+)
+
+const (
+	// playDedupWindow stops a device that fetches a song and then reports starting it, or fetches it again,
+	// from counting two plays
+	playDedupWindow    = 10 * time.Minute
+	defaultHistorySize = 50
+	maxHistorySize     = 500
+)
+
+// SongFavorite adds (PUT) or removes (DELETE) a song from the user's favorites
+func SongFavorite(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	key := bson.M{"user_id": user.ID, "song_id": song.ID}
+	collection := db.Collection(utilities.FavoritesCollection)
+	change := 0
+	switch r.Method {
+	case http.MethodPut:
+		favorite := bson.M{"$setOnInsert": Favorite{UserID: user.ID, SongID: song.ID, ObjectName: song.ObjectName, Title: song.Title, CreatedAt: time.Now().UTC()}}
+		result, err := collection.UpdateOne(ctx, key, favorite, options.Update().SetUpsert(true))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveFavorite).Error(), http.StatusInternalServerError)
+			return
+		}
+		change = int(result.UpsertedCount)
+	case http.MethodDelete:
+		result, err := collection.DeleteOne(ctx, key)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveFavorite).Error(), http.StatusInternalServerError)
+			return
+		}
+		change = -int(result.DeletedCount)
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if change != 0 {
+		if err := updatePopularity(ctx, db, song.ID, bson.M{"popularity.favorite_count": change}); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveFavorite).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SongRating sets (PUT with stars) or clears (DELETE) the user's rating of a song
+func SongRating(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	key := bson.M{"user_id": user.ID, "song_id": song.ID}
+	collection := db.Collection(utilities.RatingsCollection)
+	var previous Rating
+	var inc bson.M
+	switch r.Method {
+	case http.MethodPut:
+		var req Rating
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Stars < 1 || req.Stars > 5 {
+			utilities.LogErrorAndRespond(w, ErrInvalidRating.Error(), http.StatusBadRequest)
+			return
+		}
+		update := bson.M{"$set": bson.M{"stars": req.Stars, "updated_at": time.Now().UTC()}}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+		err := collection.FindOneAndUpdate(ctx, key, update, opts).Decode(&previous)
+		if err != nil && err != mongo.ErrNoDocuments {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveRating).Error(), http.StatusInternalServerError)
+			return
+		}
+		inc = ratingChange(previous.Stars, req.Stars)
+	case http.MethodDelete:
+		err := collection.FindOneAndDelete(ctx, key).Decode(&previous)
+		if err != nil && err != mongo.ErrNoDocuments {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveRating).Error(), http.StatusInternalServerError)
+			return
+		}
+		inc = ratingChange(previous.Stars, 0)
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(inc) > 0 {
+		if err := updatePopularity(ctx, db, song.ID, inc); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveRating).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MyFavorites lists the user's favorite songs, newest first
+func MyFavorites(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := db.Collection(utilities.FavoritesCollection).Find(ctx, bson.M{"user_id": user.ID}, opts)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadFavorites).Error(), http.StatusInternalServerError)
+		return
+	}
+	favorites := []Favorite{}
+	if err := cursor.All(ctx, &favorites); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadFavorites).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(favorites); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode favorites")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// MyHistory returns the user's play history, newest first (GET), or records a playback start or
+// finish reported by a device (POST with songId, event and optionally serialNumber)
+func MyHistory(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, err := historyLimit(r)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(int64(limit))
+		cursor, err := db.Collection(utilities.PlayEventsCollection).Find(ctx, bson.M{"user_id": user.ID}, opts)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadHistory).Error(), http.StatusInternalServerError)
+			return
+		}
+		events := []PlayEvent{}
+		if err := cursor.All(ctx, &events); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadHistory).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(events); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode history")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		var req PlayEventRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Event != PlayEventStart && req.Event != PlayEventFinish) {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(fmt.Errorf("event must be start or finish"), ErrInvalidPlayEvent).Error(), http.StatusBadRequest)
+			return
+		}
+		if req.SerialNumber != "" {
+			if err := requireDevice(user, req.SerialNumber); err != nil {
+				utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		song, status, err := findSong(ctx, db, req.SongID)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+		event, err := recordPlayEvent(ctx, db, user, song, req.Event, req.SerialNumber)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(event); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode play event")).Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// MostPlayed lists the songs the user has played most, with their play counts
+func MostPlayed(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	playSummary(ctx, db, w, r, user, bson.D{{Key: "plays", Value: -1}, {Key: "last_played", Value: -1}})
+}
+
+// RecentlyPlayed lists the songs the user has played, most recent first, each once
+func RecentlyPlayed(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	playSummary(ctx, db, w, r, user, bson.D{{Key: "last_played", Value: -1}})
+}
+
+// playSummary groups the user's counted plays by song and returns them in the given order
+func playSummary(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User, order bson.D) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	limit, err := historyLimit(r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": user.ID, "counted": true}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         "$song_id",
+			"object_name": bson.M{"$last": "$object_name"},
+			"title":       bson.M{"$last": "$title"},
+			"plays":       bson.M{"$sum": 1},
+			"last_played": bson.M{"$max": "$at"},
+		}}},
+		{{Key: "$sort", Value: order}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := db.Collection(utilities.PlayEventsCollection).Aggregate(ctx, pipeline)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadHistory).Error(), http.StatusInternalServerError)
+		return
+	}
+	summaries := []PlaySummary{}
+	if err := cursor.All(ctx, &summaries); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadHistory).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode play summary")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// recordPlayEvent adds an event to the user's history and, when it counts as a new play, to the song's play count
+func recordPlayEvent(ctx context.Context, db *Database, user User, song Song, event, serial string) (PlayEvent, error) {
+	collection := db.Collection(utilities.PlayEventsCollection)
+	now := time.Now().UTC()
+
+	var previous *PlayEvent
+	var last PlayEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}})
+	err := collection.FindOne(ctx, bson.M{"user_id": user.ID, "song_id": song.ID}, opts).Decode(&last)
+	if err == nil {
+		previous = &last
+	} else if err != mongo.ErrNoDocuments {
+		return PlayEvent{}, utilities.WrapError(err, ErrFailedRecordPlay)
+	}
+
+	playEvent := PlayEvent{
+		UserID:       user.ID,
+		SongID:       song.ID,
+		ObjectName:   song.ObjectName,
+		Title:        song.Title,
+		Event:        event,
+		SerialNumber: serial,
+		Counted:      countsAsPlay(previous, event, now),
+		At:           now,
+	}
+	result, err := collection.InsertOne(ctx, playEvent)
+	if err != nil {
+		return PlayEvent{}, utilities.WrapError(err, ErrFailedRecordPlay)
+	}
+	playEvent.ID = result.InsertedID.(primitive.ObjectID)
+
+	if playEvent.Counted {
+		if err := updatePopularity(ctx, db, song.ID, bson.M{"popularity.play_count": 1}); err != nil {
+			return playEvent, utilities.WrapError(err, ErrFailedRecordPlay)
+		}
+	}
+	return playEvent, nil
+}
+
+// recordFetches adds a fetch event for each catalog song among the signed objects.
+// It only logs failures, since history must never stop a device from getting its music.
+func recordFetches(ctx context.Context, db *Database, user User, objectNames []string, serial string) {
+	if len(objectNames) == 0 {
+		return
+	}
+	cursor, err := db.Collection(utilities.SongsCollection).Find(ctx, bson.M{"object_name": bson.M{"$in": objectNames}},
+		options.Find().SetProjection(bson.M{"object_name": 1, "title": 1}))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up fetched songs for play history")
+		return
+	}
+	var songs []Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		log.Error().Err(err).Msg("Failed to look up fetched songs for play history")
+		return
+	}
+	for _, song := range songs {
+		if _, err := recordPlayEvent(ctx, db, user, song, PlayEventFetch, serial); err != nil {
+			log.Error().Err(err).Str("object", song.ObjectName).Msg("Failed to record fetch")
+		}
+	}
+}
+
+// countsAsPlay decides whether an event starts a new play. Finishing never does, starting right after the
+// device fetched the same song is the same play, and so is fetching it again while it is being played.
+func countsAsPlay(previous *PlayEvent, event string, now time.Time) bool {
+	switch event {
+	case PlayEventFetch:
+		return previous == nil || (previous.Event != PlayEventFetch && previous.Event != PlayEventStart) || now.Sub(previous.At) > playDedupWindow
+	case PlayEventStart:
+		return previous == nil || previous.Event != PlayEventFetch || now.Sub(previous.At) > playDedupWindow
+	default:
+		return false
+	}
+}
+
+// ratingChange is the popularity increment for replacing a rating of before stars with after stars, where 0 means no rating
+func ratingChange(before, after int) bson.M {
+	inc := bson.M{}
+	if before == after {
+		return inc
+	}
+	inc["popularity.rating_total"] = after - before
+	switch {
+	case before == 0:
+		inc["popularity.rating_count"] = 1
+	case after == 0:
+		inc["popularity.rating_count"] = -1
+	}
+	return inc
+}
+
+// updatePopularity applies the increments and refreshes the stored average rating used for sorting
+func updatePopularity(ctx context.Context, db *Database, songID primitive.ObjectID, inc bson.M) error {
+	collection := db.Collection(utilities.SongsCollection)
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": songID}, bson.M{"$inc": inc}); err != nil {
+		return err
+	}
+	average := mongo.Pipeline{{{Key: "$set", Value: bson.M{"popularity.rating_average": bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{"$popularity.rating_count", 0}},
+		bson.M{"$divide": bson.A{"$popularity.rating_total", "$popularity.rating_count"}},
+		0,
+	}}}}}}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": songID}, average)
+	return err
+}
+
+func historyLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultHistorySize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxHistorySize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxHistorySize)
+	}
+	return limit, nil
+}
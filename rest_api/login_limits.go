@@ -0,0 +1,190 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"midi-file-server/config"
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrLoginLocked       = fmt.Errorf("too many failed logins, try again later")
+	ErrInvalidLoginLock  = fmt.Errorf("give a username or an ip to unlock")
+	ErrFailedUnlockLogin = fmt.Errorf("failed to unlock login")
+	ErrFailedListLocks   = fmt.Errorf("failed to list login locks")
+)
+
+// Kinds of login failure counters
+const (
+	LoginKindUser = "user"
+	LoginKindIP   = "ip"
+)
+
+// maxListedLocks caps the login locks listed at once
+const maxListedLocks = 100
+
+// dummyPasswordHash is compared against when the username is unknown, so that a failed login takes as long
+// whether or not the account exists
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not a password anyone has"), bcrypt.DefaultCost)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to hash dummy password")
+	}
+	return hash
+})
+
+// loginCounter names one failure counter and how many failures it allows
+type loginCounter struct {
+	kind, value string
+	allowed     int
+}
+
+func (c loginCounter) id() string {
+	return c.kind + ":" + c.value
+}
+
+// loginCounters are the counters a login attempt is charged to: the account and the client's address
+func loginCounters(r *http.Request, username string, settings config.Auth) []loginCounter {
+	return []loginCounter{
+		{kind: LoginKindUser, value: username, allowed: settings.LoginAttempts},
+		{kind: LoginKindIP, value: utilities.ClientIP(r), allowed: settings.LoginIPAttempts},
+	}
+}
+
+// loginLockedFor returns how much longer logins are locked for any of the counters, zero if they aren't.
+// Unknown usernames are counted and locked like others, so a lock doesn't tell whether an account exists.
+func loginLockedFor(ctx context.Context, db *Database, counters []loginCounter, now time.Time) (time.Duration, error) {
+	ids := make([]string, len(counters))
+	for i, counter := range counters {
+		ids[i] = counter.id()
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "locked_until": bson.M{"$gt": now}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "locked_until", Value: -1}})
+	var failures LoginFailures
+	err := db.Collection(utilities.LoginFailuresCollection).FindOne(ctx, filter, opts).Decode(&failures)
+	if err != nil {
+		return 0, err
+	}
+	return failures.LockedUntil.Sub(now), nil
+}
+
+// recordLoginFailure counts a failed login against each counter and locks those past their allowance.
+// The count and the lock are each a single atomic update, so replicas counting at once don't lose failures
+// or shorten a lock.
+func recordLoginFailure(ctx context.Context, db *Database, counters []loginCounter, settings config.Auth, now time.Time) {
+	collection := db.Collection(utilities.LoginFailuresCollection)
+	for _, counter := range counters {
+		update := bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"kind": counter.kind, "value": counter.value, "last_failure": now, "expires_at": now.Add(2 * settings.LoginLockout)},
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		var failures LoginFailures
+		if err := collection.FindOneAndUpdate(ctx, bson.M{"_id": counter.id()}, update, opts).Decode(&failures); err != nil {
+			log.Error().Err(err).Str("counter", counter.kind).Msg("Failed to count failed login")
+			continue
+		}
+		delay := loginBackoff(failures.Failures, counter.allowed, settings.LoginBackoff, settings.LoginLockout)
+		if delay == 0 {
+			continue
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": counter.id()}, bson.M{"$max": bson.M{"locked_until": now.Add(delay)}}); err != nil {
+			log.Error().Err(err).Str("counter", counter.kind).Msg("Failed to lock login")
+			continue
+		}
+		log.Warn().Str("kind", counter.kind).Str("value", counter.value).Int("failures", failures.Failures).Dur("locked_for", delay).Msg("Login locked after failed attempts")
+	}
+}
+
+// clearLoginFailures forgets the failures of the account after it signs in. The address keeps its count, so
+// signing in to one account doesn't reset guessing at others from the same address.
+func clearLoginFailures(ctx context.Context, db *Database, username string) {
+	counter := loginCounter{kind: LoginKindUser, value: username}
+	if _, err := db.Collection(utilities.LoginFailuresCollection).DeleteOne(ctx, bson.M{"_id": counter.id()}); err != nil {
+		log.Error().Err(err).Str("username", username).Msg("Failed to clear failed logins")
+	}
+}
+
+// loginBackoff is how long to lock logins after the given number of failures: nothing within the allowance,
+// then backoff, doubling with each further failure up to lockout
+func loginBackoff(failures, allowed int, backoff, lockout time.Duration) time.Duration {
+	if failures <= allowed {
+		return 0
+	}
+	exponent := failures - allowed - 1
+	if exponent >= 62 || float64(backoff)*math.Pow(2, float64(exponent)) >= float64(lockout) {
+		return lockout
+	}
+	return backoff << exponent
+}
+
+// respondLoginLocked answers 429 with the seconds to wait in Retry-After
+func respondLoginLocked(w http.ResponseWriter, lockedFor time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+	utilities.LogErrorAndRespond(w, ErrLoginLocked.Error(), http.StatusTooManyRequests)
+}
+
+// LoginLocks lets an admin see the accounts and addresses with failed logins, and unlock one with DELETE and
+// a username or ip query parameter
+func LoginLocks(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{}
+		if r.URL.Query().Get("locked") == "true" {
+			filter["locked_until"] = bson.M{"$gt": time.Now().UTC()}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "locked_until", Value: -1}, {Key: "last_failure", Value: -1}}).SetLimit(maxListedLocks)
+		cursor, err := db.Collection(utilities.LoginFailuresCollection).Find(ctx, filter, opts)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListLocks).Error(), http.StatusInternalServerError)
+			return
+		}
+		locks := []LoginFailures{}
+		if err := cursor.All(ctx, &locks); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListLocks).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(locks); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode login locks")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodDelete:
+		var ids []string
+		if username := r.URL.Query().Get("username"); username != "" {
+			ids = append(ids, loginCounter{kind: LoginKindUser, value: username}.id())
+		}
+		if ip := r.URL.Query().Get("ip"); ip != "" {
+			ids = append(ids, loginCounter{kind: LoginKindIP, value: ip}.id())
+		}
+		if len(ids) == 0 {
+			utilities.LogErrorAndRespond(w, ErrInvalidLoginLock.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := db.Collection(utilities.LoginFailuresCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedUnlockLogin).Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info().Strs("counters", ids).Int64("cleared", result.DeletedCount).Msg("Login unlocked by admin")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(UnlockLoginResponse{Cleared: result.DeletedCount}); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode unlock")).Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,99 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"midi-file-server/lyrics"
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNoLyrics           = fmt.Errorf("song has no lyrics")
+	ErrInvalidLyricFormat = fmt.Errorf("lyrics format must be lrc, vtt or json")
+)
+
+const (
+	LyricFormatLRC  = "lrc"
+	LyricFormatVTT  = "vtt"
+	LyricFormatJSON = "json"
+)
+
+// GetLyrics returns a song's timed lyrics as enhanced LRC (the default), WebVTT or JSON, chosen with the
+// format query parameter or, failing that, an Accept header of text/vtt or application/json.
+// Both text formats carry a timestamp per syllable for karaoke-style highlighting.
+func GetLyrics(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	format, err := lyricFormat(r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	if song.Lyrics == nil || len(song.Lyrics.Lines) == 0 {
+		utilities.LogErrorAndRespond(w, ErrNoLyrics.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch format {
+	case LyricFormatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(song.Lyrics); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode lyrics")).Error(), http.StatusInternalServerError)
+		}
+	case LyricFormatVTT:
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		fmt.Fprint(w, song.Lyrics.WebVTT())
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", derivedObjectName(song.ObjectName, ".lrc")))
+		fmt.Fprint(w, song.Lyrics.LRC(song.Title))
+	}
+}
+
+// lyricFormat picks the response format from the query, then the Accept header
+func lyricFormat(r *http.Request) (string, error) {
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case LyricFormatLRC, LyricFormatVTT, LyricFormatJSON:
+		return format, nil
+	case "":
+	default:
+		return "", ErrInvalidLyricFormat
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/vtt"):
+		return LyricFormatVTT, nil
+	case strings.Contains(accept, "application/json"):
+		return LyricFormatJSON, nil
+	}
+	return LyricFormatLRC, nil
+}
+
+// songLyrics loads the lyrics of a song for a playback response; a song without them, or a failed
+// lookup, just plays without lyrics
+func songLyrics(ctx context.Context, db *Database, songID primitive.ObjectID) *lyrics.Lyrics {
+	var song Song
+	err := db.Collection(utilities.SongsCollection).FindOne(ctx, bson.M{"_id": songID}, options.FindOne().SetProjection(bson.M{"lyrics": 1})).Decode(&song)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Error().Err(err).Str("song", songID.Hex()).Msg("Failed to look up lyrics for playback")
+	}
+	return song.Lyrics
+}
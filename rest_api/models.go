@@ -1,6 +1,13 @@
 package restapi
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"midi-file-server/analysis"
+	"midi-file-server/lyrics"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type HealthCheckResponse struct {
 	Health    string `json:"health"`
@@ -13,6 +20,22 @@ type User struct {
 	Password        string             `json:"password" bson:"password"`
 	OneTimePassword string             `json:"otp" bson:"otp"`
 	SerialNumber    string             `json:"serialNumber" bson:"serialNumber"`
+	// Email is optional and used to recover the account once verified; it is stored lower case
+	Email         string `json:"email,omitempty" bson:"email,omitempty"`
+	EmailVerified bool   `json:"emailVerified" bson:"emailVerified"`
+}
+
+type RegisterResponse struct {
+	Message string `json:"message"`
+	// DeviceKey lets the player claimed by the registration call the API without the password. It is only
+	// shown here; absent if it couldn't be created, in which case one can be created from the keys endpoint.
+	DeviceKey *DeviceKeyResponse `json:"deviceKey,omitempty"`
+}
+
+type LoginResponse struct {
+	Message   string    `json:"message"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
 }
 
 type SignedUrlRequest struct {
@@ -27,7 +50,443 @@ type DownloadResponse struct {
 	ObjectName string `json:"objectName"`
 }
 
+// Song is a catalog entry for an ingested MIDI object and its derived artifacts.
+// Object names are stored; signed URLs are minted per request since they expire.
+type Song struct {
+	ID                 primitive.ObjectID    `json:"id,omitempty" bson:"_id,omitempty"`
+	ObjectName         string                `json:"objectName" bson:"object_name"`
+	SourceObject       string                `json:"sourceObject,omitempty" bson:"source_object,omitempty"`
+	Title              string                `json:"title" bson:"title"`
+	DurationSeconds    float64               `json:"durationSeconds" bson:"duration_seconds"`
+	TrackCount         int                   `json:"trackCount" bson:"track_count"`
+	NoteCount          int                   `json:"noteCount" bson:"note_count"`
+	PianoRollPngObject string                `json:"pianoRollPngObject,omitempty" bson:"piano_roll_png_object,omitempty"`
+	PianoRollSvgObject string                `json:"pianoRollSvgObject,omitempty" bson:"piano_roll_svg_object,omitempty"`
+	AudioPreviewObject string                `json:"audioPreviewObject,omitempty" bson:"audio_preview_object,omitempty"`
+	Analysis           *analysis.Analysis    `json:"analysis,omitempty" bson:"analysis,omitempty"`
+	Fingerprint        *analysis.Fingerprint `json:"fingerprint,omitempty" bson:"fingerprint,omitempty"`
+	Melody             *analysis.Melody      `json:"-" bson:"melody,omitempty"`
+	Hands              *analysis.HandSplit   `json:"hands,omitempty" bson:"hands,omitempty"`
+	Lyrics             *lyrics.Lyrics        `json:"-" bson:"lyrics,omitempty"`
+	LyricLines         int                   `json:"lyricLines,omitempty" bson:"lyric_lines,omitempty"`
+	DuplicateOf        string                `json:"duplicateOf,omitempty" bson:"duplicate_of,omitempty"`
+	UploadedBy         primitive.ObjectID    `json:"uploadedBy,omitempty" bson:"uploaded_by,omitempty"`
+	Popularity         *Popularity           `json:"popularity,omitempty" bson:"popularity,omitempty"`
+	MusicXMLObject     string                `json:"musicXmlObject,omitempty" bson:"music_xml_object,omitempty"`
+	PreviewStart       float64               `json:"previewStart" bson:"preview_start"`
+	PreviewLength      float64               `json:"previewLength" bson:"preview_length"`
+	PianoRollPngURL    string                `json:"pianoRollPngUrl,omitempty" bson:"-"`
+	PianoRollSvgURL    string                `json:"pianoRollSvgUrl,omitempty" bson:"-"`
+	AudioPreviewURL    string                `json:"audioPreviewUrl,omitempty" bson:"-"`
+	MusicXMLURL        string                `json:"musicXmlUrl,omitempty" bson:"-"`
+	SignedURL          string                `json:"signedUrl,omitempty" bson:"-"`
+	SourceURL          string                `json:"sourceUrl,omitempty" bson:"-"`
+	CreatedAt          time.Time             `json:"createdAt" bson:"created_at"`
+}
+
 var UserCredentials struct {
 	PrivateKey  string `json:"private_key"`
 	ClientEmail string `json:"client_email"`
 }
+
+// DuplicateGroup is a set of songs that are copies or near copies of each other
+type DuplicateGroup struct {
+	Kind       string          `json:"kind"`
+	Similarity float64         `json:"similarity"`
+	Songs      []DuplicateSong `json:"songs"`
+}
+
+type DuplicateSong struct {
+	ID         primitive.ObjectID `json:"id"`
+	ObjectName string             `json:"objectName"`
+	Title      string             `json:"title"`
+}
+
+// SimilarSongs is the stored neighbour ranking of one song
+type SimilarSongs struct {
+	SongID    primitive.ObjectID `json:"songId" bson:"_id"`
+	Similar   []SimilarSong      `json:"similar" bson:"similar"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updated_at"`
+}
+
+type SimilarSong struct {
+	ID         primitive.ObjectID `json:"id" bson:"id"`
+	ObjectName string             `json:"objectName" bson:"object_name"`
+	Title      string             `json:"title" bson:"title"`
+	Score      float64            `json:"score" bson:"score"`
+}
+
+type Playlist struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OwnerID    primitive.ObjectID `json:"ownerId,omitempty" bson:"owner_id"`
+	Name       string             `json:"name" bson:"name"`
+	Items      []PlaylistItem     `json:"items" bson:"items"`
+	ShareToken string             `json:"shareToken,omitempty" bson:"share_token,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"created_at"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updated_at"`
+}
+
+type PlaylistItem struct {
+	SongID     primitive.ObjectID `json:"songId" bson:"song_id"`
+	ObjectName string             `json:"objectName" bson:"object_name"`
+	Title      string             `json:"title" bson:"title"`
+}
+
+type PlaylistRequest struct {
+	Name    string   `json:"name"`
+	SongIDs []string `json:"songIds"`
+}
+
+type PlaylistShare struct {
+	ShareToken string `json:"shareToken"`
+	Path       string `json:"path"`
+}
+
+type SendPlaylistRequest struct {
+	SerialNumber string `json:"serialNumber"`
+}
+
+// DeviceQueue is the server-side playback state of one device.
+// Items is a snapshot of the playlist when it was sent; Order holds item indexes in play order.
+// StartedAt is when the current song was started, so a companion screen can follow along with its lyrics.
+type DeviceQueue struct {
+	SerialNumber string             `json:"serialNumber" bson:"_id"`
+	OwnerID      primitive.ObjectID `json:"-" bson:"owner_id"`
+	PlaylistID   primitive.ObjectID `json:"playlistId" bson:"playlist_id"`
+	Items        []PlaylistItem     `json:"items" bson:"items"`
+	Order        []int              `json:"order" bson:"order"`
+	Position     int                `json:"position" bson:"position"`
+	Shuffle      bool               `json:"shuffle" bson:"shuffle"`
+	Repeat       string             `json:"repeat" bson:"repeat"`
+	StartedAt    time.Time          `json:"startedAt" bson:"started_at"`
+	UpdatedAt    time.Time          `json:"updatedAt" bson:"updated_at"`
+}
+
+type DeviceQueueSettings struct {
+	Shuffle *bool   `json:"shuffle"`
+	Repeat  *string `json:"repeat"`
+}
+
+type DeviceQueueResponse struct {
+	Queue     DeviceQueue        `json:"queue"`
+	Downloads []DownloadResponse `json:"downloads"`
+	Lyrics    *lyrics.Lyrics     `json:"lyrics,omitempty"`
+}
+
+// Popularity aggregates listener activity on a song; it is maintained incrementally, not recomputed
+type Popularity struct {
+	PlayCount     int     `json:"playCount" bson:"play_count"`
+	FavoriteCount int     `json:"favoriteCount" bson:"favorite_count"`
+	RatingCount   int     `json:"ratingCount" bson:"rating_count"`
+	RatingTotal   int     `json:"-" bson:"rating_total"`
+	RatingAverage float64 `json:"ratingAverage" bson:"rating_average"`
+}
+
+type Favorite struct {
+	UserID     primitive.ObjectID `json:"-" bson:"user_id"`
+	SongID     primitive.ObjectID `json:"songId" bson:"song_id"`
+	ObjectName string             `json:"objectName" bson:"object_name"`
+	Title      string             `json:"title" bson:"title"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"created_at"`
+}
+
+type Rating struct {
+	Stars int `json:"stars" bson:"stars"`
+}
+
+// PlayEvent is one entry in a user's play history.
+// Counted marks the events that started a new play, which are the ones play counts are built from.
+type PlayEvent struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID       primitive.ObjectID `json:"-" bson:"user_id"`
+	SongID       primitive.ObjectID `json:"songId" bson:"song_id"`
+	ObjectName   string             `json:"objectName" bson:"object_name"`
+	Title        string             `json:"title" bson:"title"`
+	Event        string             `json:"event" bson:"event"`
+	SerialNumber string             `json:"serialNumber,omitempty" bson:"serial_number,omitempty"`
+	Counted      bool               `json:"counted" bson:"counted"`
+	At           time.Time          `json:"at" bson:"at"`
+}
+
+type PlayEventRequest struct {
+	SongID       string `json:"songId"`
+	Event        string `json:"event"`
+	SerialNumber string `json:"serialNumber"`
+}
+
+type PlaySummary struct {
+	SongID     primitive.ObjectID `json:"songId" bson:"_id"`
+	ObjectName string             `json:"objectName" bson:"object_name"`
+	Title      string             `json:"title" bson:"title"`
+	Plays      int                `json:"plays" bson:"plays"`
+	LastPlayed time.Time          `json:"lastPlayed" bson:"last_played"`
+}
+
+// DeviceSchedule plays on a device at recurring times: a playlist through a window (play) or a song
+// or playlist once as it starts (alarm). NextStart and NextEnd are the slot the scheduler dispatches next.
+type DeviceSchedule struct {
+	ID              primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	OwnerID         primitive.ObjectID  `json:"-" bson:"owner_id"`
+	SerialNumber    string              `json:"serialNumber" bson:"serial_number"`
+	Name            string              `json:"name" bson:"name"`
+	Action          string              `json:"action" bson:"action"`
+	PlaylistID      *primitive.ObjectID `json:"playlistId,omitempty" bson:"playlist_id,omitempty"`
+	SongID          *primitive.ObjectID `json:"songId,omitempty" bson:"song_id,omitempty"`
+	Cron            string              `json:"cron" bson:"cron"`
+	TimeZone        string              `json:"timeZone" bson:"time_zone"`
+	DurationMinutes int                 `json:"durationMinutes" bson:"duration_minutes"`
+	Exceptions      []string            `json:"exceptions" bson:"exceptions"`
+	Enabled         bool                `json:"enabled" bson:"enabled"`
+	NextStart       *time.Time          `json:"nextStart,omitempty" bson:"next_start,omitempty"`
+	NextEnd         *time.Time          `json:"nextEnd,omitempty" bson:"next_end,omitempty"`
+	CreatedAt       time.Time           `json:"createdAt" bson:"created_at"`
+	UpdatedAt       time.Time           `json:"updatedAt" bson:"updated_at"`
+}
+
+type DeviceScheduleRequest struct {
+	Name            string   `json:"name"`
+	Action          string   `json:"action"`
+	PlaylistID      string   `json:"playlistId"`
+	SongID          string   `json:"songId"`
+	Cron            string   `json:"cron"`
+	TimeZone        string   `json:"timeZone"`
+	DurationMinutes int      `json:"durationMinutes"`
+	Exceptions      []string `json:"exceptions"`
+	Enabled         *bool    `json:"enabled"`
+}
+
+// DeviceCommand is a scheduled slot handed to a device ahead of time.
+// The device downloads the files on receipt, starts playing at StartAt and, for windows, stops at EndAt.
+type DeviceCommand struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SerialNumber string             `json:"-" bson:"serial_number"`
+	OwnerID      primitive.ObjectID `json:"-" bson:"owner_id"`
+	ScheduleID   primitive.ObjectID `json:"scheduleId" bson:"schedule_id"`
+	Action       string             `json:"action" bson:"action"`
+	StartAt      time.Time          `json:"startAt" bson:"start_at"`
+	EndAt        *time.Time         `json:"endAt,omitempty" bson:"end_at,omitempty"`
+	Repeat       string             `json:"repeat" bson:"repeat"`
+	Downloads    []DownloadResponse `json:"downloads" bson:"downloads"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"created_at"`
+	ExpiresAt    time.Time          `json:"expiresAt" bson:"expires_at"`
+}
+
+// Recording is a performance captured on a device. While Status is uploading, Offset counts the bytes
+// received so far; once complete the MIDI file is in the recordings bucket and its metadata is filled in.
+type Recording struct {
+	ID              primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID          primitive.ObjectID `json:"-" bson:"user_id"`
+	SerialNumber    string             `json:"serialNumber,omitempty" bson:"serial_number,omitempty"`
+	Title           string             `json:"title" bson:"title"`
+	Status          string             `json:"status" bson:"status"`
+	Size            int64              `json:"size" bson:"size"`
+	Offset          int64              `json:"offset" bson:"offset"`
+	ObjectName      string             `json:"objectName,omitempty" bson:"object_name,omitempty"`
+	DurationSeconds float64            `json:"durationSeconds" bson:"duration_seconds"`
+	TrackCount      int                `json:"trackCount" bson:"track_count"`
+	NoteCount       int                `json:"noteCount" bson:"note_count"`
+	TempoBPM        float64            `json:"tempoBpm" bson:"tempo_bpm"`
+	TimeSignature   string             `json:"timeSignature,omitempty" bson:"time_signature,omitempty"`
+	LowestPitch     uint8              `json:"lowestPitch" bson:"lowest_pitch"`
+	HighestPitch    uint8              `json:"highestPitch" bson:"highest_pitch"`
+	SignedURL       string             `json:"signedUrl,omitempty" bson:"-"`
+	CreatedAt       time.Time          `json:"createdAt" bson:"created_at"`
+	CompletedAt     *time.Time         `json:"completedAt,omitempty" bson:"completed_at,omitempty"`
+	// LastChunk is the chunk that ends the bytes received so far, while uploading
+	LastChunk string `json:"-" bson:"last_chunk,omitempty"`
+	// ExpiresAt lets MongoDB drop abandoned uploads; it is removed once the upload completes
+	ExpiresAt *time.Time `json:"-" bson:"expires_at,omitempty"`
+}
+
+type RecordingRequest struct {
+	Title        string `json:"title"`
+	SerialNumber string `json:"serialNumber"`
+	Size         int64  `json:"size"`
+}
+
+// RecordingChunk is one received piece of an upload in progress. Each links to the chunk before it, so the
+// upload is the chain ending at the recording's LastChunk.
+type RecordingChunk struct {
+	ID          string             `bson:"_id"`
+	RecordingID primitive.ObjectID `bson:"recording_id"`
+	Offset      int64              `bson:"offset"`
+	Previous    string             `bson:"previous,omitempty"`
+	Data        []byte             `bson:"data"`
+	ExpiresAt   time.Time          `bson:"expires_at"`
+}
+
+// PracticeSession is one recording scored against the catalog song it was practising
+type PracticeSession struct {
+	ID             primitive.ObjectID      `json:"id" bson:"_id,omitempty"`
+	UserID         primitive.ObjectID      `json:"-" bson:"user_id"`
+	RecordingID    primitive.ObjectID      `json:"recordingId" bson:"recording_id"`
+	RecordingTitle string                  `json:"recordingTitle" bson:"recording_title"`
+	SongID         primitive.ObjectID      `json:"songId" bson:"song_id"`
+	SongTitle      string                  `json:"songTitle" bson:"song_title"`
+	Result         analysis.PracticeResult `json:"result" bson:"result"`
+	CreatedAt      time.Time               `json:"createdAt" bson:"created_at"`
+}
+
+type PracticeRequest struct {
+	RecordingID string `json:"recordingId"`
+	SongID      string `json:"songId"`
+}
+
+// PracticeProgress summarises a user's practice sessions on one song, oldest first
+type PracticeProgress struct {
+	SongID      primitive.ObjectID `json:"songId"`
+	Sessions    int                `json:"sessions"`
+	BestScore   float64            `json:"bestScore"`
+	LatestScore float64            `json:"latestScore"`
+	Improvement float64            `json:"improvement"`
+	Points      []ProgressPoint    `json:"points"`
+}
+
+type ProgressPoint struct {
+	SessionID             primitive.ObjectID `json:"sessionId"`
+	At                    time.Time          `json:"at"`
+	Score                 float64            `json:"score"`
+	NoteAccuracy          float64            `json:"noteAccuracy"`
+	MeanTimingDeviationMs float64            `json:"meanTimingDeviationMs"`
+	TempoRatio            float64            `json:"tempoRatio"`
+	TempoStability        float64            `json:"tempoStability"`
+}
+
+type PracticeLoopResponse struct {
+	ObjectName      string  `json:"objectName"`
+	SignedURL       string  `json:"signedUrl"`
+	FromMeasure     int     `json:"fromMeasure"`
+	ToMeasure       int     `json:"toMeasure"`
+	Repeats         int     `json:"repeats"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+type HandsResponse struct {
+	ObjectName string              `json:"objectName"`
+	SignedURL  string              `json:"signedUrl"`
+	Mode       string              `json:"mode"`
+	Hands      *analysis.HandSplit `json:"hands"`
+}
+
+// DeviceKey is an API key for a headless player, scoped to one device and to what it may do there.
+// Only the SHA-256 of the key is stored; Prefix, its first characters, tells keys apart in listings.
+type DeviceKey struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID       primitive.ObjectID `json:"-" bson:"user_id"`
+	SerialNumber string             `json:"serialNumber" bson:"serial_number"`
+	Name         string             `json:"name,omitempty" bson:"name,omitempty"`
+	KeyHash      string             `json:"-" bson:"key_hash"`
+	Prefix       string             `json:"prefix" bson:"prefix"`
+	Scopes       []string           `json:"scopes" bson:"scopes"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"created_at"`
+	LastUsedAt   *time.Time         `json:"lastUsedAt,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt    *time.Time         `json:"revokedAt,omitempty" bson:"revoked_at,omitempty"`
+}
+
+type DeviceKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// DeviceKeyResponse carries a new key, the only time it is shown
+type DeviceKeyResponse struct {
+	DeviceKey
+	Key string `json:"key"`
+}
+
+// DeviceAuthorization is one device pairing, from the device asking for a code until it collects its key.
+// Only the SHA-256 of the device code is stored.
+type DeviceAuthorization struct {
+	DeviceCodeHash string             `bson:"_id"`
+	UserCode       string             `bson:"user_code"`
+	SerialNumber   string             `bson:"serial_number"`
+	Status         string             `bson:"status"`
+	UserID         primitive.ObjectID `bson:"user_id,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at"`
+	ExpiresAt      time.Time          `bson:"expires_at"`
+	LastPolledAt   *time.Time         `bson:"last_polled_at,omitempty"`
+	// Interval is the seconds the device must wait between polls, raised each time it polls too fast
+	Interval int `bson:"interval"`
+}
+
+type DeviceCodeRequest struct {
+	SerialNumber string `json:"serialNumber"`
+	OTP          string `json:"otp"`
+}
+
+// DeviceCodeResponse, DeviceTokenResponse and DeviceTokenError use the field names of RFC 8628, so
+// device firmware can use an OAuth device flow client
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri,omitempty"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type DeviceTokenResponse struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	Scope       string    `json:"scope"`
+	DeviceKey   DeviceKey `json:"deviceKey"`
+}
+
+type DeviceTokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type PairingApproval struct {
+	UserCode string `json:"userCode"`
+	Approve  bool   `json:"approve"`
+}
+
+type PairingApprovalResponse struct {
+	SerialNumber string `json:"serialNumber"`
+	Status       string `json:"status"`
+}
+
+// AccountToken is a single use token mailed to a user, stored by its hash. Email is the address it was
+// sent to, so a verification token stops working once the address is changed again.
+type AccountToken struct {
+	TokenHash string             `bson:"_id"`
+	Purpose   string             `bson:"purpose"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Email     string             `bson:"email"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetConfirmation struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type AccountResponse struct {
+	Message string `json:"message"`
+}
+
+// LoginFailures counts the failed logins of one account or IP address. ID is Kind and Value joined,
+// e.g. "user:ann", so that each has a single document however many replicas count.
+type LoginFailures struct {
+	ID          string    `json:"-" bson:"_id"`
+	Kind        string    `json:"kind" bson:"kind"`
+	Value       string    `json:"value" bson:"value"`
+	Failures    int       `json:"failures" bson:"failures"`
+	LastFailure time.Time `json:"lastFailure" bson:"last_failure"`
+	LockedUntil time.Time `json:"lockedUntil" bson:"locked_until,omitempty"`
+	ExpiresAt   time.Time `json:"-" bson:"expires_at"`
+}
+
+type UnlockLoginResponse struct {
+	Cleared int64 `json:"cleared"`
+}
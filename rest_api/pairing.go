@@ -0,0 +1,343 @@
+package restapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidPairingRequest = fmt.Errorf("invalid pairing request")
+	ErrPairingCodeNotFound   = fmt.Errorf("pairing code not found or expired")
+	ErrDeviceClaimed         = fmt.Errorf("device is registered to another account")
+	ErrFailedStartPairing    = fmt.Errorf("failed to start pairing")
+	ErrFailedApprovePairing  = fmt.Errorf("failed to approve pairing")
+)
+
+// Pairing statuses
+const (
+	PairingPending  = "pending"
+	PairingApproved = "approved"
+	PairingDenied   = "denied"
+)
+
+// Token endpoint errors of RFC 8628 and RFC 6749
+const (
+	TokenErrorPending          = "authorization_pending"
+	TokenErrorSlowDown         = "slow_down"
+	TokenErrorAccessDenied     = "access_denied"
+	TokenErrorExpired          = "expired_token"
+	TokenErrorInvalidRequest   = "invalid_request"
+	TokenErrorUnsupportedGrant = "unsupported_grant_type"
+	TokenErrorServer           = "server_error"
+)
+
+const (
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// userCodeAlphabet has no vowels, so codes don't spell words, and no easily confused characters
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+	pairingLifetime  = 10 * time.Minute
+	// pairingInterval is the seconds a device waits between polls to begin with; slowDownStep is added each time it polls too fast
+	pairingInterval = 5
+	slowDownStep    = 5
+	// userCodeAttempts is how many codes to try when one is already in use
+	userCodeAttempts = 3
+)
+
+// RequestDeviceCode starts pairing a device. The device proves it is a registered unit with its serial
+// number and the OTP it was shipped with, then shows the user code and polls DeviceToken every interval.
+func RequestDeviceCode(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var req DeviceCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SerialNumber == "" || req.OTP == "" {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(fmt.Errorf("serialNumber and otp are required"), ErrInvalidPairingRequest).Error(), http.StatusBadRequest)
+		return
+	}
+	if !validateOTPAndSerial(ctx, db, req.OTP, req.SerialNumber) {
+		utilities.LogErrorAndRespond(w, ErrInvalidOTPSerial.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	deviceCode, err := randomToken()
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedStartPairing).Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	authorization := DeviceAuthorization{
+		DeviceCodeHash: hashToken(deviceCode),
+		SerialNumber:   req.SerialNumber,
+		Status:         PairingPending,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(pairingLifetime),
+		Interval:       pairingInterval,
+	}
+	for attempt := 1; ; attempt++ {
+		if authorization.UserCode, err = newUserCode(); err == nil {
+			_, err = db.Collection(utilities.DeviceAuthorizationsCollection).InsertOne(ctx, authorization)
+		}
+		if err == nil || !mongo.IsDuplicateKeyError(err) || attempt == userCodeAttempts {
+			break
+		}
+	}
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedStartPairing).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := DeviceCodeResponse{
+		DeviceCode: deviceCode,
+		UserCode:   formatUserCode(authorization.UserCode),
+		ExpiresIn:  int(pairingLifetime.Seconds()),
+		Interval:   pairingInterval,
+	}
+	if pairingURL := db.Config().Auth.PairingURL; pairingURL != "" {
+		response.VerificationURI = pairingURL
+		response.VerificationURIComplete = withQuery(pairingURL, "code", response.UserCode)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device code")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// ApprovePairing lets the signed-in user approve, or deny, the device showing the code. Approving makes it
+// the user's device, in place of any device they had before.
+func ApprovePairing(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var req PairingApproval
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidPairingRequest).Error(), http.StatusBadRequest)
+		return
+	}
+
+	collection := db.Collection(utilities.DeviceAuthorizationsCollection)
+	filter := bson.M{"user_code": normalizeUserCode(req.UserCode), "status": PairingPending, "expires_at": bson.M{"$gt": time.Now().UTC()}}
+	var authorization DeviceAuthorization
+	if err := collection.FindOne(ctx, filter).Decode(&authorization); err != nil {
+		if err == mongo.ErrNoDocuments {
+			utilities.LogErrorAndRespond(w, ErrPairingCodeNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedApprovePairing).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := PairingDenied
+	if req.Approve {
+		status = PairingApproved
+		owner := bson.M{"serialNumber": authorization.SerialNumber, "_id": bson.M{"$ne": user.ID}}
+		if err := db.Collection(utilities.UsersCollection).FindOne(ctx, owner).Err(); err != mongo.ErrNoDocuments {
+			if err == nil {
+				utilities.LogErrorAndRespond(w, ErrDeviceClaimed.Error(), http.StatusConflict)
+				return
+			}
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedApprovePairing).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only a pairing still pending is decided, so two approvals of the same code can't both succeed
+	update := bson.M{"$set": bson.M{"status": status, "user_id": user.ID}}
+	filter = bson.M{"_id": authorization.DeviceCodeHash, "status": PairingPending}
+	if err := collection.FindOneAndUpdate(ctx, filter, update).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			utilities.LogErrorAndRespond(w, ErrPairingCodeNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedApprovePairing).Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Approve {
+		_, err := db.Collection(utilities.UsersCollection).UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"serialNumber": authorization.SerialNumber}})
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedApprovePairing).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Info().Str("username", user.Username).Str("serial", authorization.SerialNumber).Str("status", status).Msg("Device pairing decided")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(PairingApprovalResponse{SerialNumber: authorization.SerialNumber, Status: status}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode pairing")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeviceToken is polled by a pairing device with its device code. Until the user decides it answers
+// authorization_pending, or slow_down when polled faster than the interval. Once approved it hands
+// the device a device key, exactly once. Unknown and expired codes alike are expired_token.
+// It takes a form, as in RFC 8628, or the same fields as JSON.
+func DeviceToken(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	grantType, deviceCode, err := tokenRequest(r)
+	if err != nil {
+		respondTokenError(w, TokenErrorInvalidRequest, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if grantType != DeviceCodeGrantType {
+		respondTokenError(w, TokenErrorUnsupportedGrant, "", http.StatusBadRequest)
+		return
+	}
+
+	collection := db.Collection(utilities.DeviceAuthorizationsCollection)
+	now := time.Now().UTC()
+	var authorization DeviceAuthorization
+	err = collection.FindOne(ctx, bson.M{"_id": hashToken(deviceCode)}).Decode(&authorization)
+	if err == mongo.ErrNoDocuments || (err == nil && !now.Before(authorization.ExpiresAt)) {
+		respondTokenError(w, TokenErrorExpired, "", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondTokenError(w, TokenErrorServer, "", http.StatusInternalServerError)
+		return
+	}
+
+	switch authorization.Status {
+	case PairingDenied:
+		_, _ = collection.DeleteOne(ctx, bson.M{"_id": authorization.DeviceCodeHash})
+		respondTokenError(w, TokenErrorAccessDenied, "", http.StatusBadRequest)
+		return
+
+	case PairingPending:
+		tooSoon := authorization.LastPolledAt != nil && now.Sub(*authorization.LastPolledAt) < time.Duration(authorization.Interval)*time.Second
+		update := bson.M{"$set": bson.M{"last_polled_at": now}}
+		if tooSoon {
+			update["$inc"] = bson.M{"interval": slowDownStep}
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": authorization.DeviceCodeHash}, update); err != nil {
+			log.Error().Err(err).Str("serial", authorization.SerialNumber).Msg("Failed to record pairing poll")
+		}
+		if tooSoon {
+			respondTokenError(w, TokenErrorSlowDown, "", http.StatusBadRequest)
+			return
+		}
+		respondTokenError(w, TokenErrorPending, "", http.StatusBadRequest)
+		return
+	}
+
+	// Taking the approved pairing out first means a repeated poll can't collect a second key
+	filter := bson.M{"_id": authorization.DeviceCodeHash, "status": PairingApproved}
+	if err := collection.FindOneAndDelete(ctx, filter, options.FindOneAndDelete()).Decode(&authorization); err != nil {
+		respondTokenError(w, TokenErrorExpired, "", http.StatusBadRequest)
+		return
+	}
+	created, err := createDeviceKey(ctx, db, authorization.UserID, authorization.SerialNumber, "paired", DefaultDeviceScopes)
+	if err != nil {
+		log.Error().Err(err).Str("serial", authorization.SerialNumber).Msg("Failed to create device key for pairing")
+		respondTokenError(w, TokenErrorServer, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := DeviceTokenResponse{
+		AccessToken: created.Key,
+		TokenType:   "DeviceKey",
+		Scope:       strings.Join(created.Scopes, " "),
+		DeviceKey:   created.DeviceKey,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device token")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// tokenRequest reads grant_type and device_code from a form or a JSON body
+func tokenRequest(r *http.Request) (string, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var req struct {
+			GrantType  string `json:"grant_type"`
+			DeviceCode string `json:"device_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return "", "", fmt.Errorf("malformed JSON body")
+		}
+		return req.GrantType, req.DeviceCode, requireDeviceCode(req.DeviceCode)
+	}
+	if err := r.ParseForm(); err != nil {
+		return "", "", fmt.Errorf("malformed form body")
+	}
+	return r.PostForm.Get("grant_type"), r.PostForm.Get("device_code"), requireDeviceCode(r.PostForm.Get("device_code"))
+}
+
+func requireDeviceCode(deviceCode string) error {
+	if deviceCode == "" {
+		return fmt.Errorf("device_code is required")
+	}
+	return nil
+}
+
+// respondTokenError answers in the error format of RFC 6749. Pending and slow down are the expected
+// answers to polling, so they aren't logged.
+func respondTokenError(w http.ResponseWriter, code, description string, status int) {
+	if code != TokenErrorPending && code != TokenErrorSlowDown {
+		log.Error().Int("status_code", status).Str("error", code).Msg("Device token request failed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(DeviceTokenError{Error: code, Description: description}); err != nil {
+		log.Error().Err(err).Msg("Failed to encode device token error")
+	}
+}
+
+// newUserCode returns a random code of userCodeLength characters from userCodeAlphabet
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits a code in two halves for reading, e.g. "BDFG-HJKL"
+func formatUserCode(code string) string {
+	return code[:len(code)/2] + "-" + code[len(code)/2:]
+}
+
+// normalizeUserCode undoes formatting and typing slips: case, dashes and spaces
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// withQuery adds a query parameter to a URL that may already have some
+func withQuery(rawURL, key, value string) string {
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+}
@@ -0,0 +1,325 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrPlaylistNotFound     = fmt.Errorf("playlist not found")
+	ErrInvalidPlaylistID    = fmt.Errorf("invalid playlist id")
+	ErrInvalidPlaylist      = fmt.Errorf("invalid playlist data")
+	ErrFailedSavePlaylist   = fmt.Errorf("failed to save playlist")
+	ErrFailedListPlaylists  = fmt.Errorf("failed to list playlists")
+	ErrFailedDeletePlaylist = fmt.Errorf("failed to delete playlist")
+)
+
+const sharedPlaylistsPath = "/v1/shared-playlists/"
+
+const (
+	// maxPlaylistItems caps the songs in a playlist, and maxPlaylistRequestBytes the request naming them
+	maxPlaylistItems        = 500
+	maxPlaylistRequestBytes = 64 << 10
+)
+
+// Playlists lists the signed-in user's playlists (GET) or creates one (POST) from a name and optional song ids
+func Playlists(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := db.Collection(utilities.PlaylistsCollection).Find(ctx, bson.M{"owner_id": user.ID}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListPlaylists).Error(), http.StatusInternalServerError)
+			return
+		}
+		playlists := []Playlist{}
+		if err := cursor.All(ctx, &playlists); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListPlaylists).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(playlists); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode playlists")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		req, err := decodePlaylistRequest(w, r)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(fmt.Errorf("name is required"), ErrInvalidPlaylist).Error(), http.StatusBadRequest)
+			return
+		}
+		items, status, err := resolvePlaylistItems(ctx, db, req.SongIDs)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+
+		now := time.Now().UTC()
+		playlist := Playlist{OwnerID: user.ID, Name: strings.TrimSpace(req.Name), Items: items, CreatedAt: now, UpdatedAt: now}
+		result, err := db.Collection(utilities.PlaylistsCollection).InsertOne(ctx, playlist)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSavePlaylist).Error(), http.StatusInternalServerError)
+			return
+		}
+		playlist.ID = result.InsertedID.(primitive.ObjectID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(playlist); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode playlist")).Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// PlaylistByID returns (GET), renames (PATCH with a name) or deletes (DELETE) one of the user's playlists
+func PlaylistByID(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	playlist, status, err := findOwnedPlaylist(ctx, db, r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		req, err := decodePlaylistRequest(w, r)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(fmt.Errorf("name is required"), ErrInvalidPlaylist).Error(), http.StatusBadRequest)
+			return
+		}
+		playlist.Name = strings.TrimSpace(req.Name)
+		if err := updatePlaylist(ctx, db, &playlist, bson.M{"name": playlist.Name}); err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if _, err := db.Collection(utilities.PlaylistsCollection).DeleteOne(ctx, bson.M{"_id": playlist.ID}); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedDeletePlaylist).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(playlist); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode playlist")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// SetPlaylistItems replaces a playlist's songs with the given song ids, in order.
+// Adding, removing and reordering are all done by sending the full new list.
+func SetPlaylistItems(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodPut {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	playlist, status, err := findOwnedPlaylist(ctx, db, r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	req, err := decodePlaylistRequest(w, r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, status, err := resolvePlaylistItems(ctx, db, req.SongIDs)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	playlist.Items = items
+	if err := updatePlaylist(ctx, db, &playlist, bson.M{"items": items}); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(playlist); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode playlist")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// SharePlaylist creates (POST) or revokes (DELETE) a read-only link to a playlist.
+// Creating a link again replaces the previous one.
+func SharePlaylist(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	playlist, status, err := findOwnedPlaylist(ctx, db, r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		token, err := randomToken()
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSavePlaylist).Error(), http.StatusInternalServerError)
+			return
+		}
+		playlist.ShareToken = token
+		if err := updatePlaylist(ctx, db, &playlist, bson.M{"share_token": token}); err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(PlaylistShare{ShareToken: token, Path: sharedPlaylistsPath + token}); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode share link")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodDelete:
+		_, err := db.Collection(utilities.PlaylistsCollection).UpdateOne(ctx, bson.M{"_id": playlist.ID}, bson.M{"$unset": bson.M{"share_token": ""}})
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSavePlaylist).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// GetSharedPlaylist returns a playlist by its share token; no sign-in is needed
+func GetSharedPlaylist(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var playlist Playlist
+	err := db.Collection(utilities.PlaylistsCollection).FindOne(ctx, bson.M{"share_token": r.PathValue("token")}).Decode(&playlist)
+	if err == mongo.ErrNoDocuments {
+		utilities.LogErrorAndRespond(w, ErrPlaylistNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to load playlist")).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Viewers only see the songs, not who owns the list or how to share it further
+	playlist.OwnerID = primitive.NilObjectID
+	playlist.ShareToken = ""
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(playlist); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode playlist")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// decodePlaylistRequest reads a playlist's name and songs, at most maxPlaylistItems of them
+func decodePlaylistRequest(w http.ResponseWriter, r *http.Request) (PlaylistRequest, error) {
+	var req PlaylistRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlaylistRequestBytes)).Decode(&req); err != nil {
+		return req, utilities.WrapError(err, ErrInvalidPlaylist)
+	}
+	if len(req.SongIDs) > maxPlaylistItems {
+		return req, utilities.WrapError(fmt.Errorf("a playlist holds at most %d songs", maxPlaylistItems), ErrInvalidPlaylist)
+	}
+	return req, nil
+}
+
+// findOwnedPlaylist loads a playlist of the user; other users' playlists are reported as not found
+func findOwnedPlaylist(ctx context.Context, db *Database, hexID string, user User) (Playlist, int, error) {
+	var playlist Playlist
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return playlist, http.StatusBadRequest, utilities.WrapError(err, ErrInvalidPlaylistID)
+	}
+
+	err = db.Collection(utilities.PlaylistsCollection).FindOne(ctx, bson.M{"_id": id, "owner_id": user.ID}).Decode(&playlist)
+	if err == mongo.ErrNoDocuments {
+		return playlist, http.StatusNotFound, ErrPlaylistNotFound
+	}
+	if err != nil {
+		return playlist, http.StatusInternalServerError, utilities.WrapError(err, fmt.Errorf("failed to load playlist"))
+	}
+	return playlist, http.StatusOK, nil
+}
+
+// resolvePlaylistItems looks up the songs for a list of ids, keeping the list's order and repeats
+func resolvePlaylistItems(ctx context.Context, db *Database, hexIDs []string) ([]PlaylistItem, int, error) {
+	items := []PlaylistItem{}
+	if len(hexIDs) == 0 {
+		return items, http.StatusOK, nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(hexIDs))
+	for _, hexID := range hexIDs {
+		id, err := primitive.ObjectIDFromHex(hexID)
+		if err != nil {
+			return nil, http.StatusBadRequest, utilities.WrapError(err, ErrInvalidSongID, hexID)
+		}
+		ids = append(ids, id)
+	}
+
+	projection := bson.M{"object_name": 1, "title": 1}
+	cursor, err := db.Collection(utilities.SongsCollection).Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, http.StatusInternalServerError, utilities.WrapError(err, fmt.Errorf("failed to load songs"))
+	}
+	var songs []Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return nil, http.StatusInternalServerError, utilities.WrapError(err, fmt.Errorf("failed to load songs"))
+	}
+
+	items, err = orderPlaylistItems(ids, songs)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return items, http.StatusOK, nil
+}
+
+// orderPlaylistItems arranges the found songs in the requested order
+func orderPlaylistItems(ids []primitive.ObjectID, songs []Song) ([]PlaylistItem, error) {
+	byID := map[primitive.ObjectID]Song{}
+	for _, song := range songs {
+		byID[song.ID] = song
+	}
+	items := make([]PlaylistItem, 0, len(ids))
+	for _, id := range ids {
+		song, ok := byID[id]
+		if !ok {
+			return nil, utilities.WrapError(errors.New(id.Hex()), ErrSongNotFound)
+		}
+		items = append(items, PlaylistItem{SongID: song.ID, ObjectName: song.ObjectName, Title: song.Title})
+	}
+	return items, nil
+}
+
+// updatePlaylist sets the given fields and bumps the modification time
+func updatePlaylist(ctx context.Context, db *Database, playlist *Playlist, fields bson.M) error {
+	playlist.UpdatedAt = time.Now().UTC()
+	fields["updated_at"] = playlist.UpdatedAt
+	if _, err := db.Collection(utilities.PlaylistsCollection).UpdateOne(ctx, bson.M{"_id": playlist.ID}, bson.M{"$set": fields}); err != nil {
+		return utilities.WrapError(err, ErrFailedSavePlaylist)
+	}
+	return nil
+}
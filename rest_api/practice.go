@@ -0,0 +1,227 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"midi-file-server/analysis"
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidPractice         = fmt.Errorf("invalid practice request")
+	ErrRecordingNotReady       = fmt.Errorf("recording has not finished uploading")
+	ErrPracticeNotFound        = fmt.Errorf("practice session not found")
+	ErrInvalidPracticeID       = fmt.Errorf("invalid practice session id")
+	ErrFailedScorePractice     = fmt.Errorf("failed to score practice")
+	ErrFailedListPractice      = fmt.Errorf("failed to list practice sessions")
+	ErrFailedLoadPracticeFiles = fmt.Errorf("failed to load files to compare")
+)
+
+// PracticeSessions lists the signed-in user's practice sessions, newest first, optionally for one songId and
+// limited by limit (GET), or scores one of their recordings against a catalog song and stores the result (POST).
+func PracticeSessions(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, err := historyLimit(r)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter := bson.M{"user_id": user.ID}
+		if value := r.URL.Query().Get("songId"); value != "" {
+			songID, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidSongID).Error(), http.StatusBadRequest)
+				return
+			}
+			filter["song_id"] = songID
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit))
+		sessions, err := findPracticeSessions(ctx, db, filter, opts)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode practice sessions")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		var req PracticeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidPractice).Error(), http.StatusBadRequest)
+			return
+		}
+		session, status, err := scorePractice(ctx, db, req, user)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(session); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode practice session")).Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// PracticeSessionByID returns one of the signed-in user's practice sessions with its full feedback
+func PracticeSessionByID(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidPracticeID).Error(), http.StatusBadRequest)
+		return
+	}
+
+	var session PracticeSession
+	err = db.Collection(utilities.PracticeSessionsCollection).FindOne(ctx, bson.M{"_id": id, "user_id": user.ID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		utilities.LogErrorAndRespond(w, ErrPracticeNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to load practice session")).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(session); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode practice session")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// SongProgress charts the signed-in user's practice scores on a song over time
+func SongProgress(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	songID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidSongID).Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Per-measure details and note lists aren't needed for the chart
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetProjection(bson.M{"result.measures": 0, "result.missed": 0, "result.extra": 0})
+	sessions, err := findPracticeSessions(ctx, db, bson.M{"user_id": user.ID, "song_id": songID}, opts)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summarizeProgress(songID, sessions)); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode progress")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// scorePractice compares the user's finished recording with the song and stores the session
+func scorePractice(ctx context.Context, db *Database, req PracticeRequest, user User) (PracticeSession, int, error) {
+	recording, status, err := findOwnedRecording(ctx, db, req.RecordingID, user)
+	if err != nil {
+		return PracticeSession{}, status, err
+	}
+	if recording.Status != RecordingComplete {
+		return PracticeSession{}, http.StatusConflict, ErrRecordingNotReady
+	}
+	song, status, err := findSong(ctx, db, req.SongID)
+	if err != nil {
+		return PracticeSession{}, status, err
+	}
+
+	reference, err := downloadMidi(ctx, db.Config().Storage.SongsBucket, song.ObjectName)
+	if err != nil {
+		return PracticeSession{}, http.StatusInternalServerError, utilities.WrapError(err, ErrFailedLoadPracticeFiles)
+	}
+	performance, err := downloadMidi(ctx, db.Config().Storage.RecordingsBucket, recording.ObjectName)
+	if err != nil {
+		return PracticeSession{}, http.StatusInternalServerError, utilities.WrapError(err, ErrFailedLoadPracticeFiles)
+	}
+
+	session := PracticeSession{
+		UserID:         user.ID,
+		RecordingID:    recording.ID,
+		RecordingTitle: recording.Title,
+		SongID:         song.ID,
+		SongTitle:      song.Title,
+		Result:         analysis.ComparePerformance(reference, performance),
+		CreatedAt:      time.Now().UTC(),
+	}
+	result, err := db.Collection(utilities.PracticeSessionsCollection).InsertOne(ctx, session)
+	if err != nil {
+		return PracticeSession{}, http.StatusInternalServerError, utilities.WrapError(err, ErrFailedScorePractice)
+	}
+	session.ID = result.InsertedID.(primitive.ObjectID)
+	return session, http.StatusCreated, nil
+}
+
+func downloadMidi(ctx context.Context, bucketName, objectName string) (*midi.File, error) {
+	data, err := downloadObject(ctx, bucketName, objectName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := midi.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrInvalidMidi, objectName)
+	}
+	return file, nil
+}
+
+func findPracticeSessions(ctx context.Context, db *Database, filter bson.M, opts *options.FindOptions) ([]PracticeSession, error) {
+	cursor, err := db.Collection(utilities.PracticeSessionsCollection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrFailedListPractice)
+	}
+	sessions := []PracticeSession{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, utilities.WrapError(err, ErrFailedListPractice)
+	}
+	return sessions, nil
+}
+
+// summarizeProgress turns sessions, oldest first, into chart points with the best and latest score
+func summarizeProgress(songID primitive.ObjectID, sessions []PracticeSession) PracticeProgress {
+	progress := PracticeProgress{SongID: songID, Sessions: len(sessions), Points: []ProgressPoint{}}
+	for _, session := range sessions {
+		result := session.Result
+		progress.Points = append(progress.Points, ProgressPoint{
+			SessionID:             session.ID,
+			At:                    session.CreatedAt,
+			Score:                 result.Score,
+			NoteAccuracy:          result.NoteAccuracy,
+			MeanTimingDeviationMs: result.MeanTimingDeviationMs,
+			TempoRatio:            result.TempoRatio,
+			TempoStability:        result.TempoStability,
+		})
+		if result.Score > progress.BestScore {
+			progress.BestScore = result.Score
+		}
+	}
+	if len(sessions) > 0 {
+		progress.LatestScore = sessions[len(sessions)-1].Result.Score
+		progress.Improvement = progress.LatestScore - sessions[0].Result.Score
+	}
+	return progress
+}
@@ -0,0 +1,143 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"midi-file-server/practice"
+	utilities "midi-file-server/utilities"
+)
+
+var (
+	ErrInvalidLoopOptions = fmt.Errorf("invalid practice loop options")
+	ErrFailedGenerateLoop = fmt.Errorf("failed to generate practice loop")
+)
+
+// practicePrefix keeps generated practice files apart from the catalog, so a bucket lifecycle rule can delete
+// them after a while; uploads may not use it
+const practicePrefix = "practice/"
+
+// practiceObjectName names a practice file generated from a song
+func practiceObjectName(songObject, suffix string) string {
+	return practicePrefix + derivedObjectName(songObject, suffix)
+}
+
+// GetPracticeLoop generates a practice file looping a range of a song's measures and returns a signed URL to it.
+// Query parameters: from and to (measures, numbered from 1), repeats, tempo (percent of the original for the
+// first pass), tempoStep (percent added per pass) and countIn (measures of metronome clicks before the loop).
+// Tempos are whole percents, so there are few enough names for the files, which are stored under practicePrefix
+// with a name made of the options. Asking again reuses the same object.
+func GetPracticeLoop(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration, user User) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := parseLoopOptions(r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+	file, err := downloadMidi(ctx, db.Config().Storage.SongsBucket, song.ObjectName)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateLoop).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	looped, err := practice.Loop(file, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, practice.ErrInvalidMeasures) {
+			status = http.StatusBadRequest
+		}
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateLoop).Error(), status)
+		return
+	}
+
+	objectName := practiceObjectName(song.ObjectName, loopSuffix(opts))
+	if err := uploadArtifacts(ctx, db.Config().Storage.SongsBucket, []artifact{{objectName: objectName, contentType: "audio/midi", data: looped.Encode()}}); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateLoop).Error(), http.StatusInternalServerError)
+		return
+	}
+	signedURL, err := generateSignedURL(ctx, db.Config().Storage.SongsBucket, objectName, d)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateSignedURL).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := PracticeLoopResponse{
+		ObjectName:      objectName,
+		SignedURL:       signedURL,
+		FromMeasure:     opts.FromMeasure,
+		ToMeasure:       opts.ToMeasure,
+		Repeats:         opts.Repeats,
+		DurationSeconds: looped.Duration(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode practice loop")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseLoopOptions reads the loop query parameters over the generator defaults; to defaults to from
+func parseLoopOptions(r *http.Request) (practice.LoopOptions, error) {
+	opts := practice.DefaultLoopOptions()
+	query := r.URL.Query()
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"from", &opts.FromMeasure},
+		{"to", &opts.ToMeasure},
+		{"repeats", &opts.Repeats},
+		{"countIn", &opts.CountInMeasures},
+	}
+	for _, param := range ints {
+		if value := query.Get(param.name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, utilities.WrapError(err, ErrInvalidLoopOptions, param.name)
+			}
+			*param.value = parsed
+		}
+	}
+	if query.Get("to") == "" {
+		opts.ToMeasure = opts.FromMeasure
+	}
+	percents := []struct {
+		name  string
+		value *float64
+	}{
+		{"tempo", &opts.TempoPercent},
+		{"tempoStep", &opts.TempoStepPercent},
+	}
+	for _, param := range percents {
+		if value := query.Get(param.name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, utilities.WrapError(err, ErrInvalidLoopOptions, param.name+" must be a whole percent")
+			}
+			*param.value = float64(parsed)
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, utilities.WrapError(err, ErrInvalidLoopOptions)
+	}
+	return opts, nil
+}
+
+// loopSuffix names a practice file after its options, e.g. song.loop-m12-16-r4-t70-s5-c1.mid
+func loopSuffix(opts practice.LoopOptions) string {
+	return fmt.Sprintf(".loop-m%d-%d-r%d-t%d-s%d-c%d.mid", opts.FromMeasure, opts.ToMeasure, opts.Repeats,
+		int(opts.TempoPercent), int(opts.TempoStepPercent), opts.CountInMeasures)
+}
@@ -0,0 +1,47 @@
+package restapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	utilities "midi-file-server/utilities"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// rateLimitLookupTimeout bounds resolving a request's credentials to count it
+const rateLimitLookupTimeout = 2 * time.Second
+
+// RateLimitKey names who a request is counted against: the signed-in user, the device of a device key or
+// client certificate, or else the client's IP address. Credentials that don't check out count against
+// the address, so made-up tokens can't open fresh buckets.
+func RateLimitKey(db *Database) func(*http.Request) string {
+	return func(r *http.Request) string {
+		ctx, cancel := context.WithTimeout(r.Context(), rateLimitLookupTimeout)
+		defer cancel()
+		now := time.Now().UTC()
+
+		if token, ok := bearerToken(r); ok {
+			var session Session
+			filter := bson.M{"_id": hashToken(token), "expires_at": bson.M{"$gt": now}}
+			if err := db.Collection(utilities.SessionsCollection).FindOne(ctx, filter).Decode(&session); err == nil {
+				return "user:" + session.UserID.Hex()
+			}
+		}
+		if key := r.Header.Get(DeviceKeyHeader); key != "" {
+			var deviceKey DeviceKey
+			filter := bson.M{"key_hash": hashToken(key), "revoked_at": nil}
+			if err := db.Collection(utilities.DeviceKeysCollection).FindOne(ctx, filter).Decode(&deviceKey); err == nil {
+				return "device:" + deviceKey.SerialNumber
+			}
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			// The serial is found as device sign-in finds it, in the common name or a DNS name
+			if serial, err := certificateSerial(ctx, db, r.TLS.VerifiedChains[0][0]); err == nil {
+				return "device:" + serial
+			}
+		}
+		return "ip:" + utilities.ClientIP(r)
+	}
+}
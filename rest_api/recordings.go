@@ -0,0 +1,422 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+
+	"cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidRecording       = fmt.Errorf("invalid recording")
+	ErrInvalidRecordingID     = fmt.Errorf("invalid recording id")
+	ErrRecordingNotFound      = fmt.Errorf("recording not found")
+	ErrOffsetMismatch         = fmt.Errorf("upload offset does not match the bytes received")
+	ErrRecordingComplete      = fmt.Errorf("recording is already uploaded")
+	ErrFailedSaveRecording    = fmt.Errorf("failed to save recording")
+	ErrFailedSaveChunk        = fmt.Errorf("failed to save recording chunk")
+	ErrFailedListRecordings   = fmt.Errorf("failed to list recordings")
+	ErrFailedFinishRecording  = fmt.Errorf("failed to finish recording")
+	ErrFailedDeleteRecording  = fmt.Errorf("failed to delete recording")
+	ErrFailedSignRecordingURL = fmt.Errorf("failed to sign recording URL")
+	ErrTooManyUploads         = fmt.Errorf("too many unfinished uploads, finish or delete one first")
+)
+
+// Recording upload states
+const (
+	RecordingUploading = "uploading"
+	RecordingComplete  = "complete"
+)
+
+const (
+	// uploadOffsetHeader carries the byte position of a chunk, and the bytes received in responses
+	uploadOffsetHeader    = "Upload-Offset"
+	maxRecordingBytes     = 8 << 20
+	maxRecordingChunk     = 1 << 20
+	recordingUploadTTL    = 24 * time.Hour
+	maxRecordingTitleLen  = 100
+	recordingsPath        = "/v1/me/recordings/"
+	recordingObjectSuffix = ".mid"
+	// maxOpenUploads caps the unfinished uploads of a user, each holding a document and chunks until it expires
+	maxOpenUploads = 3
+)
+
+// Recordings lists the signed-in user's finished recordings, newest first (GET), or starts an upload (POST)
+// from the recording's size in bytes, an optional title and the serial number of the device that captured it.
+func Recordings(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{"user_id": user.ID, "status": RecordingComplete}
+		cursor, err := db.Collection(utilities.RecordingsCollection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListRecordings).Error(), http.StatusInternalServerError)
+			return
+		}
+		recordings := []Recording{}
+		if err := cursor.All(ctx, &recordings); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListRecordings).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(recordings); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode recordings")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		var req RecordingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidRecording).Error(), http.StatusBadRequest)
+			return
+		}
+		recording, err := newRecording(req, user, time.Now().UTC())
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrDeviceNotOwned) {
+				status = http.StatusForbidden
+			}
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+		open, err := db.Collection(utilities.RecordingsCollection).CountDocuments(ctx,
+			bson.M{"user_id": user.ID, "status": RecordingUploading, "expires_at": bson.M{"$gt": recording.CreatedAt}},
+			options.Count().SetLimit(maxOpenUploads))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveRecording).Error(), http.StatusInternalServerError)
+			return
+		}
+		if open >= maxOpenUploads {
+			utilities.LogErrorAndRespond(w, ErrTooManyUploads.Error(), http.StatusTooManyRequests)
+			return
+		}
+		result, err := db.Collection(utilities.RecordingsCollection).InsertOne(ctx, recording)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveRecording).Error(), http.StatusInternalServerError)
+			return
+		}
+		recording.ID = result.InsertedID.(primitive.ObjectID)
+
+		w.Header().Set("Location", recordingsPath+recording.ID.Hex())
+		w.Header().Set(uploadOffsetHeader, "0")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(recording); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode recording")).Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// RecordingByID manages one recording.
+// GET returns it, with a signed download URL once complete, and HEAD reports the bytes received so far in the
+// Upload-Offset header so a device can resume after losing its connection. PATCH appends the raw body as the
+// chunk starting at Upload-Offset; the chunk that completes the file has it parsed and stored. DELETE removes it.
+func RecordingByID(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration, user User) {
+	recording, status, err := findOwnedRecording(ctx, db, r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(recording.Offset, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet:
+		if recording.Status == RecordingComplete {
+			recording.SignedURL, err = generateSignedURL(ctx, db.Config().Storage.RecordingsBucket, recording.ObjectName, d)
+			if err != nil {
+				utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSignRecordingURL).Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	case http.MethodPatch:
+		if status, err := appendRecordingChunk(ctx, db, w, r, &recording); err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(recording.Offset, 10))
+	case http.MethodDelete:
+		if err := deleteRecording(ctx, db, recording); err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recording); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode recording")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// newRecording validates an upload request and returns the recording to create
+func newRecording(req RecordingRequest, user User, now time.Time) (Recording, error) {
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = "Recording " + now.Format("2006-01-02 15:04")
+	}
+	if len(title) > maxRecordingTitleLen {
+		return Recording{}, utilities.WrapError(fmt.Errorf("title is longer than %d characters", maxRecordingTitleLen), ErrInvalidRecording)
+	}
+	if req.Size < 1 || req.Size > maxRecordingBytes {
+		return Recording{}, utilities.WrapError(fmt.Errorf("size must be between 1 and %d bytes", maxRecordingBytes), ErrInvalidRecording)
+	}
+	if req.SerialNumber != "" {
+		if err := requireDevice(user, req.SerialNumber); err != nil {
+			return Recording{}, err
+		}
+	}
+
+	expires := now.Add(recordingUploadTTL)
+	return Recording{
+		UserID:       user.ID,
+		SerialNumber: req.SerialNumber,
+		Title:        title,
+		Status:       RecordingUploading,
+		Size:         req.Size,
+		CreatedAt:    now,
+		ExpiresAt:    &expires,
+	}, nil
+}
+
+// appendRecordingChunk stores the request body as the chunk at Upload-Offset and finishes the recording
+// once every byte has arrived. A PATCH with an empty body at the final offset retries a failed finish.
+func appendRecordingChunk(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, recording *Recording) (int, error) {
+	if recording.Status == RecordingComplete {
+		return http.StatusConflict, ErrRecordingComplete
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, utilities.WrapError(fmt.Errorf("missing or invalid %s header", uploadOffsetHeader), ErrInvalidRecording)
+	}
+	if offset != recording.Offset {
+		// The device resumes from the offset it is told
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(recording.Offset, 10))
+		return http.StatusConflict, fmt.Errorf("%w: sent %d, received %d", ErrOffsetMismatch, offset, recording.Offset)
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRecordingChunk))
+	if err != nil {
+		return http.StatusRequestEntityTooLarge, utilities.WrapError(err, ErrUploadTooLarge)
+	}
+	if offset+int64(len(data)) > recording.Size {
+		return http.StatusBadRequest, utilities.WrapError(fmt.Errorf("chunk runs past the declared size of %d bytes", recording.Size), ErrInvalidRecording)
+	}
+
+	if len(data) > 0 {
+		// Every attempt writes its own chunk, linked to the chunk it follows. The recording only takes it as its
+		// last chunk if nothing advanced the offset meanwhile, so a chunk sent twice at once is kept only once.
+		chunk := RecordingChunk{
+			ID:          fmt.Sprintf("%s:%d:%s", recording.ID.Hex(), offset, primitive.NewObjectID().Hex()),
+			RecordingID: recording.ID,
+			Offset:      offset,
+			Previous:    recording.LastChunk,
+			Data:        data,
+			ExpiresAt:   *recording.ExpiresAt,
+		}
+		chunks := db.Collection(utilities.RecordingChunksCollection)
+		if _, err := chunks.InsertOne(ctx, chunk); err != nil {
+			return http.StatusInternalServerError, utilities.WrapError(err, ErrFailedSaveChunk)
+		}
+		newOffset := offset + int64(len(data))
+		update := bson.M{"$set": bson.M{"offset": newOffset, "last_chunk": chunk.ID}}
+		result, err := db.Collection(utilities.RecordingsCollection).UpdateOne(ctx, bson.M{"_id": recording.ID, "offset": offset}, update)
+		if err != nil || result.ModifiedCount == 0 {
+			if _, deleteErr := chunks.DeleteOne(ctx, bson.M{"_id": chunk.ID}); deleteErr != nil {
+				log.Error().Err(deleteErr).Str("chunk", chunk.ID).Msg("Failed to delete unused recording chunk")
+			}
+			if err != nil {
+				return http.StatusInternalServerError, utilities.WrapError(err, ErrFailedSaveChunk)
+			}
+			return http.StatusConflict, ErrOffsetMismatch
+		}
+		recording.Offset, recording.LastChunk = newOffset, chunk.ID
+	}
+
+	if recording.Offset < recording.Size {
+		return http.StatusOK, nil
+	}
+	return finishRecording(ctx, db, recording)
+}
+
+// finishRecording joins the chunks, parses them as MIDI and stores the file under the user's prefix.
+// A file that isn't valid MIDI is discarded along with its upload.
+func finishRecording(ctx context.Context, db *Database, recording *Recording) (int, error) {
+	data, err := loadRecordingChunks(ctx, db, *recording)
+	if err != nil {
+		return http.StatusInternalServerError, utilities.WrapError(err, ErrFailedFinishRecording)
+	}
+
+	file, err := midi.Parse(bytes.NewReader(data))
+	if err != nil {
+		if deleteErr := deleteRecording(ctx, db, *recording); deleteErr != nil {
+			log.Error().Err(deleteErr).Str("recording", recording.ID.Hex()).Msg("Failed to discard invalid recording")
+		}
+		return http.StatusBadRequest, utilities.WrapError(err, ErrInvalidMidi)
+	}
+
+	recording.ObjectName = recordingObjectName(recording.UserID, recording.ID)
+	describeRecording(file, recording)
+	if err := uploadArtifacts(ctx, db.Config().Storage.RecordingsBucket, []artifact{{objectName: recording.ObjectName, contentType: "audio/midi", data: data}}); err != nil {
+		return http.StatusInternalServerError, utilities.WrapError(err, ErrFailedFinishRecording)
+	}
+
+	now := time.Now().UTC()
+	recording.Status = RecordingComplete
+	recording.CompletedAt = &now
+	recording.ExpiresAt = nil
+	recording.LastChunk = ""
+	if _, err := db.Collection(utilities.RecordingsCollection).ReplaceOne(ctx, bson.M{"_id": recording.ID}, recording); err != nil {
+		return http.StatusInternalServerError, utilities.WrapError(err, ErrFailedFinishRecording)
+	}
+	if _, err := db.Collection(utilities.RecordingChunksCollection).DeleteMany(ctx, bson.M{"recording_id": recording.ID}); err != nil {
+		log.Error().Err(err).Str("recording", recording.ID.Hex()).Msg("Failed to delete recording chunks")
+	}
+	log.Info().Str("object", recording.ObjectName).Str("user", recording.UserID.Hex()).Msg("Stored recording")
+	return http.StatusOK, nil
+}
+
+// describeRecording fills in the recording's metadata from the parsed file
+func describeRecording(file *midi.File, recording *Recording) {
+	notes := file.Notes()
+	recording.DurationSeconds = file.Duration()
+	recording.TrackCount = len(file.Tracks)
+	recording.NoteCount = len(notes)
+	recording.TempoBPM = midi.TempoChange{MicrosPerQuarter: midi.DefaultTempo}.BPM()
+	if tempos := file.Tempos(); len(tempos) > 0 {
+		recording.TempoBPM = tempos[0].BPM()
+	}
+	if signatures := file.TimeSignatures(); len(signatures) > 0 {
+		recording.TimeSignature = fmt.Sprintf("%d/%d", signatures[0].Numerator, signatures[0].Denominator)
+	}
+	recording.LowestPitch, recording.HighestPitch = 0, 0
+	for i, note := range notes {
+		if i == 0 || note.Pitch < recording.LowestPitch {
+			recording.LowestPitch = note.Pitch
+		}
+		if note.Pitch > recording.HighestPitch {
+			recording.HighestPitch = note.Pitch
+		}
+	}
+}
+
+// recordingObjectName keeps each user's recordings under their own prefix
+func recordingObjectName(userID, recordingID primitive.ObjectID) string {
+	return userID.Hex() + "/" + recordingID.Hex() + recordingObjectSuffix
+}
+
+func loadRecordingChunks(ctx context.Context, db *Database, recording Recording) ([]byte, error) {
+	cursor, err := db.Collection(utilities.RecordingChunksCollection).Find(ctx, bson.M{"recording_id": recording.ID})
+	if err != nil {
+		return nil, err
+	}
+	var chunks []RecordingChunk
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, err
+	}
+	return joinRecordingChunks(chunks, recording.LastChunk, recording.Size)
+}
+
+// joinRecordingChunks follows the chunks back from the last one the recording took, so chunks of attempts
+// that lost a race are left out, and checks they cover every byte from the start in order
+func joinRecordingChunks(chunks []RecordingChunk, last string, size int64) ([]byte, error) {
+	byID := make(map[string]RecordingChunk, len(chunks))
+	for _, chunk := range chunks {
+		byID[chunk.ID] = chunk
+	}
+	var taken []RecordingChunk
+	for id := last; id != ""; {
+		chunk, ok := byID[id]
+		if !ok || len(taken) == len(chunks) {
+			return nil, fmt.Errorf("chunk %s is missing", id)
+		}
+		taken = append(taken, chunk)
+		id = chunk.Previous
+	}
+	slices.Reverse(taken)
+
+	data := make([]byte, 0, size)
+	for _, chunk := range taken {
+		if chunk.Offset != int64(len(data)) {
+			return nil, fmt.Errorf("chunk at %d follows %d bytes", chunk.Offset, len(data))
+		}
+		data = append(data, chunk.Data...)
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("have %d of %d bytes", len(data), size)
+	}
+	return data, nil
+}
+
+// deleteRecording removes the recording, its stored file and any chunks of an unfinished upload
+func deleteRecording(ctx context.Context, db *Database, recording Recording) error {
+	if recording.ObjectName != "" {
+		if err := deleteObject(ctx, db.Config().Storage.RecordingsBucket, recording.ObjectName); err != nil {
+			return utilities.WrapError(err, ErrFailedDeleteRecording)
+		}
+	}
+	if _, err := db.Collection(utilities.RecordingChunksCollection).DeleteMany(ctx, bson.M{"recording_id": recording.ID}); err != nil {
+		return utilities.WrapError(err, ErrFailedDeleteRecording)
+	}
+	if _, err := db.Collection(utilities.RecordingsCollection).DeleteOne(ctx, bson.M{"_id": recording.ID}); err != nil {
+		return utilities.WrapError(err, ErrFailedDeleteRecording)
+	}
+	return nil
+}
+
+// findOwnedRecording loads a recording of the user; other users' recordings are reported as not found
+func findOwnedRecording(ctx context.Context, db *Database, hexID string, user User) (Recording, int, error) {
+	var recording Recording
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return recording, http.StatusBadRequest, utilities.WrapError(err, ErrInvalidRecordingID)
+	}
+
+	err = db.Collection(utilities.RecordingsCollection).FindOne(ctx, bson.M{"_id": id, "user_id": user.ID}).Decode(&recording)
+	if err == mongo.ErrNoDocuments {
+		return recording, http.StatusNotFound, ErrRecordingNotFound
+	}
+	if err != nil {
+		return recording, http.StatusInternalServerError, utilities.WrapError(err, fmt.Errorf("failed to load recording"))
+	}
+	return recording, http.StatusOK, nil
+}
+
+func deleteObject(ctx context.Context, bucketName, objectName string) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return utilities.WrapError(err, fmt.Errorf("failed to create client"))
+	}
+	defer client.Close()
+
+	err = client.Bucket(bucketName).Object(objectName).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"time"
 
+	"midi-file-server/config"
+	"midi-file-server/mail"
 	mongodb "midi-file-server/mongo_db"
 
 	"github.com/rs/zerolog/log"
@@ -16,6 +18,7 @@ import (
 
 	"cloud.google.com/go/storage"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2/google"
@@ -29,16 +32,36 @@ var (
 	ErrFailedHashPassword      = fmt.Errorf("failed to hash password")
 	ErrFailedRegisterUser      = fmt.Errorf("failed to register user")
 	ErrInvalidCredentials      = fmt.Errorf("invalid credentials")
+	ErrFailedLogin             = fmt.Errorf("failed to log in")
 	ErrFailedListBucket        = fmt.Errorf("failed to list bucket contents")
 	ErrFailedGenerateSignedURL = fmt.Errorf("failed to generate signed URL")
 	ErrMethodNotAllowed        = fmt.Errorf("method not allowed")
+	ErrFeatureDisabled         = fmt.Errorf("this feature is currently disabled")
 )
 
-func RegisterUser(ctx context.Context, db *mongo.Database, w http.ResponseWriter, r *http.Request) {
+// Database is the handle every handler and background job gets: the MongoDB database along with the
+// configuration, so settings are passed in rather than read from globals
+type Database struct {
+	*mongo.Database
+	Settings *config.Store
+	// Mailer sends the emails that verify addresses and reset passwords
+	Mailer mail.Mailer
+}
+
+// Config returns the configuration in effect, which may change between requests when it is reloaded
+func (db *Database) Config() *config.Config {
+	return db.Settings.Current()
+}
+
+func RegisterUser(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
 		return
 	}
+	if !db.Config().Features.Registration {
+		utilities.LogErrorAndRespond(w, ErrFeatureDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	user, err := decodeUser(r)
 	if err != nil {
@@ -53,10 +76,31 @@ func RegisterUser(ctx context.Context, db *mongo.Database, w http.ResponseWriter
 		return
 	}
 
-	if !validateOTPAndSerial(ctx, db, user.OneTimePassword, user.SerialNumber) {
+	// An address is only verified by following the link mailed to it
+	user.EmailVerified = false
+	if user.Email != "" {
+		if user.Email, err = normalizeEmail(user.Email); err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if emailExists(ctx, db, user.Email) {
+			utilities.LogErrorAndRespond(w, ErrEmailExists.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	// Accounts made in the app start without a device and pair one later with the pairing flow;
+	// older units are still claimed here with their OTP and serial number
+	claimsDevice := user.OneTimePassword != "" || user.SerialNumber != ""
+	if claimsDevice && !validateOTPAndSerial(ctx, db, user.OneTimePassword, user.SerialNumber) {
 		utilities.LogErrorAndRespond(w, ErrInvalidOTPSerial.Error(), http.StatusUnauthorized)
 		return
 	}
+	// As when pairing, a unit that already belongs to an account can't be claimed by another
+	if claimsDevice && deviceClaimed(ctx, db, user.SerialNumber) {
+		utilities.LogErrorAndRespond(w, ErrDeviceClaimed.Error(), http.StatusConflict)
+		return
+	}
 
 	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
@@ -65,13 +109,30 @@ func RegisterUser(ctx context.Context, db *mongo.Database, w http.ResponseWriter
 	}
 	user.Password = hashedPassword
 
-	if err := insertUser(ctx, db, user); err != nil {
+	userID, err := insertUser(ctx, db, user)
+	if err != nil {
 		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedRegisterUser).Error(), http.StatusInternalServerError)
 		return
 	}
+	if user.Email != "" {
+		if err := sendVerification(ctx, db, userID, user.Email); err != nil {
+			log.Error().Err(err).Str("username", user.Username).Msg("Failed to send verification email at registration")
+		}
+	}
 
+	// Claiming the device gives it a key of its own, so the password never has to be stored on it
+	response := RegisterResponse{Message: "User registered successfully"}
+	if claimsDevice {
+		if deviceKey, err := createDeviceKey(ctx, db, userID, user.SerialNumber, "claimed", DefaultDeviceScopes); err != nil {
+			log.Error().Err(err).Str("serial", user.SerialNumber).Msg("Failed to create device key at registration")
+		} else {
+			response.DeviceKey = &deviceKey
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"}); err != nil {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to respond with success message")).Error(), http.StatusInternalServerError)
 	}
 }
@@ -116,7 +177,7 @@ func OnHealthSubmit(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func LoginUser(ctx context.Context, db *mongo.Database, w http.ResponseWriter, r *http.Request) {
+func LoginUser(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
 		return
@@ -128,48 +189,80 @@ func LoginUser(ctx context.Context, db *mongo.Database, w http.ResponseWriter, r
 		return
 	}
 
+	settings := db.Config().Auth
+	counters := loginCounters(r, user.Username, settings)
+	lockedFor, err := loginLockedFor(ctx, db, counters, time.Now().UTC())
+	if err != nil && err != mongo.ErrNoDocuments {
+		// Checking the password still guards the account while the counters can't be read
+		log.Error().Err(err).Msg("Failed to check login locks")
+	}
+	if lockedFor > 0 {
+		respondLoginLocked(w, lockedFor)
+		return
+	}
+
+	// Unknown users and wrong passwords get the same answer, after the same bcrypt work
 	var dbUser User
-	if err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"username": user.Username}).Decode(&dbUser); err != nil {
-		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidCredentials).Error(), http.StatusUnauthorized)
+	hash := dummyPasswordHash()
+	err = db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"username": user.Username}).Decode(&dbUser)
+	if err == nil {
+		hash = []byte(dbUser.Password)
+	} else if err != mongo.ErrNoDocuments {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLogin).Error(), http.StatusInternalServerError)
+		return
+	}
+	if compareErr := bcrypt.CompareHashAndPassword(hash, []byte(user.Password)); err != nil || compareErr != nil {
+		recordLoginFailure(ctx, db, counters, settings, time.Now().UTC())
+		utilities.LogErrorAndRespond(w, ErrInvalidCredentials.Error(), http.StatusUnauthorized)
 		return
 	}
+	clearLoginFailures(ctx, db, user.Username)
 
-	if err := bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(user.Password)); err != nil {
-		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidCredentials).Error(), http.StatusUnauthorized)
+	token, expiresAt, err := createSession(ctx, db, dbUser.ID)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"}); err != nil {
+	if err := json.NewEncoder(w).Encode(LoginResponse{Message: "Login successful", Token: token, ExpiresAt: expiresAt}); err != nil {
 		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to respond with success message")).Error(), http.StatusInternalServerError)
 	}
 }
 
-func GetSignedUrl(ctx context.Context, w http.ResponseWriter, r *http.Request, d time.Duration) {
+// GetSignedUrl signs download URLs for the requested objects.
+// When the request carries a bearer token, each catalog song fetched is added to the user's play history,
+// along with the device named in the X-Device-Serial header.
+func GetSignedUrl(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration) {
 	var reqs SignedUrlRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
 		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("invalid download request")).Error(), http.StatusBadRequest)
 		return
 	}
 
-	responsePayload := []DownloadResponse{}
-
 	for _, currentObjectName := range reqs.ObjectName {
 		if currentObjectName == "" {
 			utilities.LogErrorAndRespond(w, "Missing midi object", http.StatusBadRequest)
 			return
 		}
+	}
 
-		signedURL, err := generateSignedURL(ctx, utilities.DefaultBucketName, currentObjectName, d)
-		if err != nil {
-			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateSignedURL).Error(), http.StatusInternalServerError)
-			return
-		}
+	responsePayload, err := signObjectNames(ctx, db.Config().Storage.SongsBucket, reqs.ObjectName, d)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		responsePayload = append(responsePayload, DownloadResponse{
-			SignedURL:  signedURL,
-			ObjectName: currentObjectName,
-		})
+	if _, hasToken := bearerToken(r); hasToken {
+		if user, err := authenticate(ctx, db, r); err == nil {
+			// Only the user's own device is recorded; any other serial is left out rather than trusted
+			serial := r.Header.Get("X-Device-Serial")
+			if requireDevice(user, serial) != nil {
+				serial = ""
+			}
+			recordFetches(ctx, db, user, reqs.ObjectName, serial)
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -178,8 +271,8 @@ func GetSignedUrl(ctx context.Context, w http.ResponseWriter, r *http.Request, d
 	}
 }
 
-func ListBucketHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	objectNames, err := ListBucketContents(ctx, utilities.DefaultBucketName)
+func ListBucketHandler(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	objectNames, err := ListBucketContents(ctx, db.Config().Storage.SongsBucket)
 	if err != nil {
 		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListBucket).Error(), http.StatusInternalServerError)
 		return
@@ -217,6 +310,22 @@ func generateSignedURL(ctx context.Context, bucketName, objectName string, d tim
 	return url, nil
 }
 
+// signObjectNames returns a signed download URL for each object in the bucket, in the given order
+func signObjectNames(ctx context.Context, bucketName string, objectNames []string, d time.Duration) ([]DownloadResponse, error) {
+	responsePayload := []DownloadResponse{}
+	for _, objectName := range objectNames {
+		signedURL, err := generateSignedURL(ctx, bucketName, objectName, d)
+		if err != nil {
+			return nil, utilities.WrapError(err, ErrFailedGenerateSignedURL, objectName)
+		}
+		responsePayload = append(responsePayload, DownloadResponse{
+			SignedURL:  signedURL,
+			ObjectName: objectName,
+		})
+	}
+	return responsePayload, nil
+}
+
 func ListBucketContents(ctx context.Context, bucketName string) ([]string, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
@@ -249,8 +358,20 @@ func decodeUser(r *http.Request) (User, error) {
 	return user, nil
 }
 
+// emailExists checks if an account already has the email address
+func emailExists(ctx context.Context, db *Database, email string) bool {
+	err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"email": email}).Err()
+	if err == nil {
+		return true
+	} else if err != mongo.ErrNoDocuments {
+		log.Error().Err(err).Msg("Failed to check existing email")
+		return true // Assume it exists in case of an error, as for usernames
+	}
+	return false
+}
+
 // userExists checks if the username already exists in the database
-func userExists(ctx context.Context, db *mongo.Database, username string) bool {
+func userExists(ctx context.Context, db *Database, username string) bool {
 	var existingUser User
 	err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"username": username}).Decode(&existingUser)
 	if err == nil {
@@ -262,10 +383,22 @@ func userExists(ctx context.Context, db *mongo.Database, username string) bool {
 	return false
 }
 
+// deviceClaimed checks if an account already has the device with the serial number
+func deviceClaimed(ctx context.Context, db *Database, serialNumber string) bool {
+	err := db.Collection(utilities.UsersCollection).FindOne(ctx, bson.M{"serialNumber": serialNumber}).Err()
+	if err == nil {
+		return true
+	} else if err != mongo.ErrNoDocuments {
+		log.Error().Err(err).Str("serial", serialNumber).Msg("Failed to check claimed device")
+		return true // Assume it is claimed in case of an error, as for usernames
+	}
+	return false
+}
+
 // validateOTPAndSerial checks if the OTP and serial number are valid
-func validateOTPAndSerial(ctx context.Context, db *mongo.Database, otp string, serialNumber string) bool {
+func validateOTPAndSerial(ctx context.Context, db *Database, otp string, serialNumber string) bool {
 	var validEntry mongodb.ValidOTPSerial
-	err := db.Collection("valid_otp_serials").FindOne(ctx, bson.M{"otp": otp, "serial_number": serialNumber}).Decode(&validEntry)
+	err := db.Collection(utilities.ValidOTPSerialsCollection).FindOne(ctx, bson.M{"otp": otp, "serial_number": serialNumber}).Decode(&validEntry)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Info().Str("otp", otp).Str("serial", serialNumber).Msg("OTP and Serial Number not found in the database")
@@ -288,11 +421,12 @@ func hashPassword(password string) (string, error) {
 }
 
 // insertUser inserts a new user into the database
-func insertUser(ctx context.Context, db *mongo.Database, user User) error {
-	_, err := db.Collection(utilities.UsersCollection).InsertOne(ctx, user)
+func insertUser(ctx context.Context, db *Database, user User) (primitive.ObjectID, error) {
+	result, err := db.Collection(utilities.UsersCollection).InsertOne(ctx, user)
 	if err != nil {
 		log.Error().Err(err).Str("username", user.Username).Msg("Failed to insert user into MongoDB")
-		return err
+		return primitive.NilObjectID, err
 	}
-	return nil
+	id, _ := result.InsertedID.(primitive.ObjectID)
+	return id, nil
 }
@@ -1,12 +1,33 @@
 package restapi
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"midi-file-server/analysis"
+	"midi-file-server/config"
+	"midi-file-server/midi"
+	"midi-file-server/schedule"
+	utilities "midi-file-server/utilities"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestOnHealthSubmit_Success(t *testing.T) {
@@ -43,3 +64,746 @@ func TestOnHealthSubmit_MethodNotAllowed(t *testing.T) {
 
 	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
 }
+
+func TestDerivedObjectName(t *testing.T) {
+	assert.Equal(t, "midi/song.pianoroll.png", derivedObjectName("midi/song.mid", pianoRollPngSuffix))
+	assert.Equal(t, "song.pianoroll.svg", derivedObjectName("song", pianoRollSvgSuffix))
+}
+
+func TestUploadMidi_MethodNotAllowed(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/upload-midi", nil)
+	w := httptest.NewRecorder()
+
+	UploadMidi(req.Context(), nil, w, req, User{})
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode)
+}
+
+func TestParseIngestOptions(t *testing.T) {
+	defaults := config.Preview{StartSeconds: 0, LengthSeconds: 30}
+	opts, err := parseIngestOptions(httptest.NewRequest(http.MethodPost, "/v1/upload-midi?previewStart=5&previewLength=60", nil), defaults)
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, opts.previewStart)
+	assert.Equal(t, 60.0, opts.previewLength)
+
+	_, err = parseIngestOptions(httptest.NewRequest(http.MethodPost, "/v1/upload-midi?previewLength=1e12", nil), defaults)
+	assert.ErrorIs(t, err, ErrInvalidPreview)
+}
+
+func TestParseExportOptions(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/songs/x/musicxml?grid=8&split=55", nil)
+	opts, err := parseExportOptions(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, opts.Grid)
+	assert.Equal(t, uint8(55), opts.SplitPitch)
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/songs/x/musicxml?grid=6", nil)
+	_, err = parseExportOptions(req)
+	assert.ErrorIs(t, err, ErrInvalidExportOptions)
+}
+
+func TestParseSongFilter(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/songs?q=Moon.light&key=c+major&minDifficulty=2&maxDifficulty=5&sort=difficulty", nil)
+	filter, sort, err := parseSongFilter(req)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"$regex": `Moon\.light`, "$options": "i"}, filter["title"])
+	assert.Equal(t, bson.M{"$regex": "^c major$", "$options": "i"}, filter["analysis.key"])
+	assert.Equal(t, bson.M{"$gte": 2, "$lte": 5}, filter["analysis.difficulty"])
+	assert.Equal(t, "analysis.difficulty", sort[0].Key)
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/songs?sort=rating", nil)
+	_, sort, err = parseSongFilter(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "popularity.rating_average", sort[0].Key)
+	assert.Equal(t, -1, sort[0].Value)
+
+	for _, query := range []string{"maxDifficulty=11", "minDifficulty=easy", "sort=newest"} {
+		req = httptest.NewRequest(http.MethodGet, "/v1/songs?"+query, nil)
+		_, _, err = parseSongFilter(req)
+		assert.ErrorIs(t, err, ErrInvalidSongFilter, query)
+	}
+}
+
+func TestParseSongPage(t *testing.T) {
+	limit, offset, err := parseSongPage(httptest.NewRequest(http.MethodGet, "/v1/songs", nil))
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultSongPage), limit)
+	assert.Zero(t, offset)
+
+	limit, offset, err = parseSongPage(httptest.NewRequest(http.MethodGet, "/v1/songs?limit=20&offset=40", nil))
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), limit)
+	assert.Equal(t, int64(40), offset)
+
+	for _, query := range []string{"limit=0", "limit=201", "limit=ten", "offset=-1"} {
+		_, _, err = parseSongPage(httptest.NewRequest(http.MethodGet, "/v1/songs?"+query, nil))
+		assert.ErrorIs(t, err, ErrInvalidSongFilter, query)
+	}
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	fingerprint := func(sha, musical string, minHash ...uint64) *analysis.Fingerprint {
+		return &analysis.Fingerprint{SHA256: sha, Musical: musical, MinHash: minHash}
+	}
+	songs := []Song{
+		{ObjectName: "a.mid", Fingerprint: fingerprint("1", "m1", 1, 2, 3, 4)},
+		{ObjectName: "b.mid", Fingerprint: fingerprint("1", "m1", 1, 2, 3, 4)},
+		{ObjectName: "c.mid", Fingerprint: fingerprint("2", "m1", 1, 2, 3, 4)},
+		{ObjectName: "d.mid", Fingerprint: fingerprint("3", "m2", 1, 2, 3, 9)},
+		{ObjectName: "e.mid", Fingerprint: fingerprint("4", "m3", 5, 6, 7, 8)},
+		{ObjectName: "f.mid", Fingerprint: fingerprint("5", "m4", 5, 6, 7, 9)},
+	}
+
+	groups := duplicateGroups(songs[:2], 0.7)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, DuplicateExact, groups[0].Kind)
+
+	groups = duplicateGroups(songs[:3], 0.7)
+	assert.Equal(t, DuplicateMusical, groups[0].Kind)
+
+	groups = duplicateGroups(songs, 0.7)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, DuplicateSimilar, groups[0].Kind)
+	assert.Len(t, groups[0].Songs, 4)
+	assert.InDelta(t, 0.75, groups[0].Similarity, 0.001)
+	assert.Equal(t, []string{"e.mid", "f.mid"}, []string{groups[1].Songs[0].ObjectName, groups[1].Songs[1].ObjectName})
+
+	assert.Empty(t, duplicateGroups(songs[3:], 0.9))
+}
+
+func TestRankSimilar(t *testing.T) {
+	melody := func(intervals ...int) *analysis.Melody {
+		return &analysis.Melody{Intervals: intervals, Rhythm: make([]int, len(intervals)-1)}
+	}
+	songs := []Song{
+		{ObjectName: "target.mid", Melody: melody(2, 2, 1, 2, 2, 2, 1)},
+		{ObjectName: "unrelated.mid", Melody: &analysis.Melody{Intervals: []int{7, -5, 9, -3, 11, -8, 4}, Rhythm: []int{1, -1, 2, -2, 1, -1}}},
+		{ObjectName: "close.mid", Melody: melody(2, 2, 1, 2, 2, 2, -1)},
+		{ObjectName: "same.mid", Melody: melody(2, 2, 1, 2, 2, 2, 1)},
+	}
+	profiles := make([]analysis.MelodyProfile, len(songs))
+	for i, song := range songs {
+		profiles[i] = analysis.NewMelodyProfile(*song.Melody)
+	}
+
+	similar := rankSimilar(0, songs, profiles, 5)
+	assert.Equal(t, []string{"same.mid", "close.mid"}, []string{similar[0].ObjectName, similar[1].ObjectName})
+	assert.InDelta(t, 1, similar[0].Score, 0.001)
+	assert.Len(t, similar, 2, "songs sharing no n-grams are left out")
+	assert.Len(t, rankSimilar(0, songs, profiles, 1), 1)
+}
+
+func TestMatchMelody(t *testing.T) {
+	songs := []Song{
+		{ObjectName: "twinkle.mid", Melody: &analysis.Melody{Intervals: []int{0, 7, 0, 2, 0, -2, -2, 0, -1, 0, -2, 0, -2}}},
+		{ObjectName: "scale.mid", Melody: &analysis.Melody{Intervals: []int{2, 2, 1, 2, 2, 2, 1}}},
+		{ObjectName: "unindexed.mid"},
+	}
+
+	matches := matchMelody(analysis.Melody{Intervals: []int{-2, 0, -1, 0, -2}}, songs, 5)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, "twinkle.mid", matches[0].ObjectName)
+
+	assert.Empty(t, matchMelody(analysis.Melody{Intervals: []int{12, -12, 12, -12}}, songs, 5))
+}
+
+func TestSearchByPlaying_RejectsShortSnippet(t *testing.T) {
+	file := midi.NewFile(96)
+	track := file.AddTrack("Snippet")
+	track.AddNote(0, 60, 80, 0, 96)
+	track.AddNote(0, 62, 80, 96, 192)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/search-by-playing", bytes.NewReader(file.Encode()))
+	rr := httptest.NewRecorder()
+	SearchByPlaying(context.Background(), nil, rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrQueryTooShort.Error())
+}
+
+func TestWithUser_MissingToken(t *testing.T) {
+	handler := WithUser(func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+		t.Fatal("handler must not run without a token")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/v1/playlists", nil)
+	req.Header.Set("Authorization", "Basic abc")
+	rr := httptest.NewRecorder()
+	handler(context.Background(), nil, rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrMissingToken.Error())
+}
+
+func TestWithDevice_NoCertificateNeedsToken(t *testing.T) {
+	handler := WithDevice(ScopeReadLibrary, ScopeManageDevice, func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+		t.Fatal("handler must not run without a token or client certificate")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/v1/devices/SN-1/queue", nil)
+	req.TLS = &tls.ConnectionState{}
+	rr := httptest.NewRecorder()
+	handler(context.Background(), nil, rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrMissingToken.Error())
+}
+
+func TestCertificateNames(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "SN-0001"},
+		DNSNames: []string{"SN-0001", "player-7.local"},
+	}
+	assert.Equal(t, []string{"SN-0001", "player-7.local"}, certificateNames(cert))
+	assert.Empty(t, certificateNames(&x509.Certificate{}))
+}
+
+func TestDecodePlaylistRequest(t *testing.T) {
+	decode := func(body string) (PlaylistRequest, error) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/playlists", strings.NewReader(body))
+		return decodePlaylistRequest(httptest.NewRecorder(), req)
+	}
+	req, err := decode(`{"name": "Warm-ups", "songIds": ["a", "b"]}`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, req.SongIDs)
+
+	ids := make([]string, maxPlaylistItems+1)
+	body, err := json.Marshal(PlaylistRequest{Name: "Too long", SongIDs: ids})
+	require.NoError(t, err)
+	_, err = decode(string(body))
+	assert.ErrorIs(t, err, ErrInvalidPlaylist)
+	assert.ErrorContains(t, err, "at most 500 songs")
+
+	_, err = decode(`{"name": "` + strings.Repeat("x", maxPlaylistRequestBytes) + `"}`)
+	assert.ErrorIs(t, err, ErrInvalidPlaylist)
+}
+
+func TestOrderPlaylistItems(t *testing.T) {
+	a, b := primitive.NewObjectID(), primitive.NewObjectID()
+	songs := []Song{{ID: a, ObjectName: "a.mid"}, {ID: b, ObjectName: "b.mid"}}
+
+	items, err := orderPlaylistItems([]primitive.ObjectID{b, a, b}, songs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.mid", "a.mid", "b.mid"}, []string{items[0].ObjectName, items[1].ObjectName, items[2].ObjectName})
+
+	_, err = orderPlaylistItems([]primitive.ObjectID{primitive.NewObjectID()}, songs)
+	assert.ErrorIs(t, err, ErrSongNotFound)
+}
+
+func TestDeviceQueue_Advance(t *testing.T) {
+	queue := DeviceQueue{Items: make([]PlaylistItem, 3), Order: queueOrder(3, false, -1), Repeat: RepeatOff}
+	assert.Equal(t, []int{0, 1, 2}, queue.Order)
+	assert.True(t, queue.advance())
+	assert.True(t, queue.advance())
+	assert.False(t, queue.advance())
+	assert.Equal(t, 2, queue.Position)
+
+	queue.Repeat = RepeatOne
+	assert.True(t, queue.advance())
+	assert.Equal(t, 2, queue.Position)
+
+	queue.Repeat = RepeatAll
+	assert.True(t, queue.advance())
+	assert.Equal(t, 0, queue.Position)
+}
+
+func TestDeviceQueue_SetShuffle(t *testing.T) {
+	queue := DeviceQueue{Items: make([]PlaylistItem, 10), Order: queueOrder(10, false, -1), Position: 4}
+
+	queue.setShuffle(true)
+	assert.Equal(t, 4, queue.Order[queue.Position], "current song keeps playing")
+	assert.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, queue.Order)
+
+	queue.advance()
+	current := queue.Order[queue.Position]
+	queue.setShuffle(false)
+	assert.Equal(t, current, queue.Order[queue.Position])
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, queue.Order)
+}
+
+func TestCountsAsPlay(t *testing.T) {
+	now := time.Now()
+	fetch := &PlayEvent{Event: PlayEventFetch, At: now.Add(-time.Minute)}
+	staleFetch := &PlayEvent{Event: PlayEventFetch, At: now.Add(-time.Hour)}
+	finish := &PlayEvent{Event: PlayEventFinish, At: now.Add(-time.Minute)}
+
+	assert.True(t, countsAsPlay(nil, PlayEventFetch, now))
+	assert.False(t, countsAsPlay(fetch, PlayEventFetch, now))
+	assert.True(t, countsAsPlay(staleFetch, PlayEventFetch, now))
+	assert.False(t, countsAsPlay(&PlayEvent{Event: PlayEventStart, At: now.Add(-time.Minute)}, PlayEventFetch, now))
+	assert.True(t, countsAsPlay(finish, PlayEventFetch, now))
+	assert.True(t, countsAsPlay(nil, PlayEventStart, now))
+	assert.False(t, countsAsPlay(fetch, PlayEventStart, now))
+	assert.True(t, countsAsPlay(staleFetch, PlayEventStart, now))
+	assert.True(t, countsAsPlay(finish, PlayEventStart, now))
+	assert.False(t, countsAsPlay(nil, PlayEventFinish, now))
+}
+
+func TestRatingChange(t *testing.T) {
+	assert.Equal(t, bson.M{"popularity.rating_total": 4, "popularity.rating_count": 1}, ratingChange(0, 4))
+	assert.Equal(t, bson.M{"popularity.rating_total": -2}, ratingChange(4, 2))
+	assert.Equal(t, bson.M{"popularity.rating_total": -2, "popularity.rating_count": -1}, ratingChange(2, 0))
+	assert.Empty(t, ratingChange(3, 3))
+}
+
+func TestHistoryLimit(t *testing.T) {
+	limit, err := historyLimit(httptest.NewRequest(http.MethodGet, "/v1/me/history", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultHistorySize, limit)
+
+	limit, err = historyLimit(httptest.NewRequest(http.MethodGet, "/v1/me/history?limit=20", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 20, limit)
+
+	for _, value := range []string{"0", "501", "many"} {
+		_, err = historyLimit(httptest.NewRequest(http.MethodGet, "/v1/me/history?limit="+value, nil))
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseScheduleRequest(t *testing.T) {
+	playlistID := primitive.NewObjectID().Hex()
+	req := DeviceScheduleRequest{
+		Name:            "Shop hours",
+		Action:          ScheduleActionPlay,
+		PlaylistID:      playlistID,
+		Cron:            "0  10 * * 1-6",
+		TimeZone:        "Europe/Berlin",
+		DurationMinutes: 480,
+		Exceptions:      []string{"12-25"},
+	}
+	sched, rule, err := parseScheduleRequest(req)
+	assert.NoError(t, err)
+	assert.True(t, sched.Enabled)
+	assert.Equal(t, "0 10 * * 1-6", sched.Cron)
+	assert.Equal(t, playlistID, sched.PlaylistID.Hex())
+	assert.Equal(t, 8*time.Hour, rule.Duration)
+
+	invalid := []func(r *DeviceScheduleRequest){
+		func(r *DeviceScheduleRequest) { r.Name = " " },
+		func(r *DeviceScheduleRequest) { r.Action = "record" },
+		func(r *DeviceScheduleRequest) { r.DurationMinutes = 0 },
+		func(r *DeviceScheduleRequest) { r.PlaylistID = "" },
+		func(r *DeviceScheduleRequest) { r.SongID = primitive.NewObjectID().Hex() },
+		func(r *DeviceScheduleRequest) { r.Cron = "every day" },
+		func(r *DeviceScheduleRequest) { r.TimeZone = "Shop/Time" },
+		func(r *DeviceScheduleRequest) { r.Exceptions = []string{"Christmas"} },
+	}
+	for i, change := range invalid {
+		bad := req
+		change(&bad)
+		_, _, err := parseScheduleRequest(bad)
+		assert.ErrorIs(t, err, ErrInvalidSchedule, i)
+	}
+
+	// Alarms play once, so any duration is dropped
+	alarm, _, err := parseScheduleRequest(DeviceScheduleRequest{
+		Name: "Wake up", Action: ScheduleActionAlarm, SongID: primitive.NewObjectID().Hex(),
+		Cron: "30 6 * * 1-5", TimeZone: "UTC", DurationMinutes: 30,
+	})
+	assert.NoError(t, err)
+	assert.Zero(t, alarm.DurationMinutes)
+}
+
+func TestPlanNextSlot(t *testing.T) {
+	sched, rule, err := parseScheduleRequest(DeviceScheduleRequest{
+		Name: "Shop hours", Action: ScheduleActionPlay, PlaylistID: primitive.NewObjectID().Hex(),
+		Cron: "0 10 * * *", TimeZone: "UTC", DurationMinutes: 480,
+	})
+	assert.NoError(t, err)
+
+	// Saved mid-window, the window in progress is dispatched straight away
+	planNextSlot(&sched, rule, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), *sched.NextStart)
+	assert.Equal(t, time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC), *sched.NextEnd)
+
+	planNextSlot(&sched, rule, time.Date(2026, 10, 19, 19, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC), *sched.NextStart)
+}
+
+func TestFollowingSlot(t *testing.T) {
+	_, rule, err := parseScheduleRequest(DeviceScheduleRequest{
+		Name: "Shop hours", Action: ScheduleActionPlay, PlaylistID: primitive.NewObjectID().Hex(),
+		Cron: "0 10 * * *", TimeZone: "UTC", DurationMinutes: 480,
+	})
+	assert.NoError(t, err)
+	slot := schedule.Slot{Start: time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC), End: time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)}
+
+	// Dispatched ahead of its start, the next day follows
+	following, ok := followingSlot(rule, slot, time.Date(2026, 10, 1, 9, 58, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 10, 2, 10, 0, 0, 0, time.UTC), following.Start)
+
+	// Weeks behind, the missed days are skipped
+	following, ok = followingSlot(rule, slot, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC), following.Start)
+}
+
+func TestNewRecording(t *testing.T) {
+	user := User{ID: primitive.NewObjectID(), SerialNumber: "ESP32-SN-001"}
+	now := time.Date(2026, 10, 19, 18, 30, 0, 0, time.UTC)
+
+	recording, err := newRecording(RecordingRequest{Size: 2048, SerialNumber: "ESP32-SN-001"}, user, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "Recording 2026-10-19 18:30", recording.Title)
+	assert.Equal(t, RecordingUploading, recording.Status)
+	assert.Equal(t, now.Add(recordingUploadTTL), *recording.ExpiresAt)
+
+	for _, size := range []int64{0, maxRecordingBytes + 1} {
+		_, err = newRecording(RecordingRequest{Size: size}, user, now)
+		assert.ErrorIs(t, err, ErrInvalidRecording, size)
+	}
+	_, err = newRecording(RecordingRequest{Size: 2048, SerialNumber: "ESP32-SN-002"}, user, now)
+	assert.ErrorIs(t, err, ErrDeviceNotOwned)
+}
+
+func TestAppendRecordingChunk_RejectsWrongOffset(t *testing.T) {
+	recording := Recording{ID: primitive.NewObjectID(), Status: RecordingUploading, Size: 100, Offset: 40}
+	req := httptest.NewRequest(http.MethodPatch, "/v1/me/recordings/"+recording.ID.Hex(), bytes.NewReader(make([]byte, 10)))
+	req.Header.Set(uploadOffsetHeader, "30")
+	w := httptest.NewRecorder()
+
+	status, err := appendRecordingChunk(context.Background(), nil, w, req, &recording)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.ErrorIs(t, err, ErrOffsetMismatch)
+	assert.Equal(t, "40", w.Header().Get(uploadOffsetHeader))
+
+	recording.Status = RecordingComplete
+	status, err = appendRecordingChunk(context.Background(), nil, w, req, &recording)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.ErrorIs(t, err, ErrRecordingComplete)
+}
+
+func TestJoinRecordingChunks(t *testing.T) {
+	chunks := []RecordingChunk{
+		{ID: "b", Offset: 3, Previous: "a", Data: []byte("def")},
+		{ID: "a", Offset: 0, Data: []byte("abc")},
+		// Sent at the same offset as b but lost the race, so the recording never took it
+		{ID: "b2", Offset: 3, Previous: "a", Data: []byte("xy")},
+		{ID: "c", Offset: 6, Previous: "b", Data: []byte("g")},
+	}
+	data, err := joinRecordingChunks(chunks, "c", 7)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefg", string(data))
+
+	_, err = joinRecordingChunks(chunks, "c", 8)
+	assert.ErrorContains(t, err, "have 7 of 8 bytes")
+	_, err = joinRecordingChunks(chunks[1:], "c", 7)
+	assert.ErrorContains(t, err, "chunk b is missing")
+	_, err = joinRecordingChunks([]RecordingChunk{{ID: "a", Data: []byte("abc")}, {ID: "c", Offset: 4, Previous: "a", Data: []byte("e")}}, "c", 5)
+	assert.ErrorContains(t, err, "chunk at 4 follows 3 bytes")
+	_, err = joinRecordingChunks([]RecordingChunk{{ID: "a", Previous: "a", Data: []byte("abc")}}, "a", 3)
+	assert.Error(t, err, "a chunk linked to itself is not followed forever")
+}
+
+func TestDescribeRecording(t *testing.T) {
+	file := midi.NewFile(96)
+	track := file.AddTrack("Piano")
+	track.AddTempo(0, 90)
+	track.AddTimeSignature(0, 3, 4)
+	track.AddNote(0, 48, 80, 0, 96)
+	track.AddNote(0, 72, 80, 96, 192)
+	track.AddNote(0, 60, 80, 192, 288)
+
+	userID, recordingID := primitive.NewObjectID(), primitive.NewObjectID()
+	recording := Recording{ObjectName: recordingObjectName(userID, recordingID)}
+	describeRecording(file, &recording)
+	assert.Equal(t, userID.Hex()+"/"+recordingID.Hex()+".mid", recording.ObjectName)
+	assert.Equal(t, 3, recording.NoteCount)
+	assert.Equal(t, 1, recording.TrackCount)
+	assert.InDelta(t, 90, recording.TempoBPM, 0.01)
+	assert.Equal(t, "3/4", recording.TimeSignature)
+	assert.Equal(t, uint8(48), recording.LowestPitch)
+	assert.Equal(t, uint8(72), recording.HighestPitch)
+	assert.InDelta(t, 2, recording.DurationSeconds, 0.01)
+}
+
+func TestSummarizeProgress(t *testing.T) {
+	songID := primitive.NewObjectID()
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	var sessions []PracticeSession
+	for i, score := range []float64{52, 71, 66} {
+		sessions = append(sessions, PracticeSession{
+			ID:        primitive.NewObjectID(),
+			SongID:    songID,
+			Result:    analysis.PracticeResult{Score: score, TempoRatio: 0.8},
+			CreatedAt: start.AddDate(0, 0, i),
+		})
+	}
+
+	progress := summarizeProgress(songID, sessions)
+	assert.Equal(t, 3, progress.Sessions)
+	assert.Equal(t, 71.0, progress.BestScore)
+	assert.Equal(t, 66.0, progress.LatestScore)
+	assert.Equal(t, 14.0, progress.Improvement)
+	assert.Len(t, progress.Points, 3)
+	assert.Equal(t, start.AddDate(0, 0, 1), progress.Points[1].At)
+
+	empty := summarizeProgress(songID, nil)
+	assert.Zero(t, empty.Sessions)
+	assert.NotNil(t, empty.Points)
+}
+
+func TestParseLoopOptions(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/songs/x/practice-loop?from=12&to=16&repeats=3&tempo=70&tempoStep=5&countIn=2", nil)
+	opts, err := parseLoopOptions(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, opts.FromMeasure)
+	assert.Equal(t, 16, opts.ToMeasure)
+	assert.Equal(t, 3, opts.Repeats)
+	assert.Equal(t, 70.0, opts.TempoPercent)
+	assert.Equal(t, ".loop-m12-16-r3-t70-s5-c2.mid", loopSuffix(opts))
+	assert.Equal(t, "practice/midi/song.loop-m12-16-r3-t70-s5-c2.mid", practiceObjectName("midi/song.mid", loopSuffix(opts)))
+
+	opts, err = parseLoopOptions(httptest.NewRequest(http.MethodGet, "/v1/songs/x/practice-loop?from=4", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, opts.ToMeasure)
+	assert.Equal(t, 4, opts.Repeats)
+
+	for _, query := range []string{"from=3&to=2", "from=x", "from=1&tempo=fast", "from=1&tempo=70.123456789", "from=1&repeats=0", "from=1&countIn=9"} {
+		_, err := parseLoopOptions(httptest.NewRequest(http.MethodGet, "/v1/songs/x/practice-loop?"+query, nil))
+		assert.ErrorIs(t, err, ErrInvalidLoopOptions, query)
+	}
+}
+
+func TestLyricFormat(t *testing.T) {
+	cases := []struct {
+		query, accept, want string
+	}{
+		{"", "", LyricFormatLRC},
+		{"format=VTT", "", LyricFormatVTT},
+		{"format=lrc", "text/vtt", LyricFormatLRC},
+		{"", "text/vtt, */*", LyricFormatVTT},
+		{"", "application/json", LyricFormatJSON},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/v1/songs/x/lyrics?"+c.query, nil)
+		req.Header.Set("Accept", c.accept)
+		format, err := lyricFormat(req)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, format, c)
+	}
+
+	_, err := lyricFormat(httptest.NewRequest(http.MethodGet, "/v1/songs/x/lyrics?format=srt", nil))
+	assert.ErrorIs(t, err, ErrInvalidLyricFormat)
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultDeviceScopes, scopes)
+
+	scopes, err = parseScopes([]string{ScopeReportStatus, ScopeManageDevice, ScopeReportStatus})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ScopeManageDevice, ScopeReportStatus}, scopes)
+
+	_, err = parseScopes([]string{"admin"})
+	assert.ErrorIs(t, err, ErrInvalidScopes)
+}
+
+func TestNewDeviceKey(t *testing.T) {
+	userID := primitive.NewObjectID()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	created, err := newDeviceKey(userID, "SN-1", " kitchen ", DefaultDeviceScopes, now)
+	assert.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(created.Key, deviceKeyPrefix))
+	assert.Equal(t, created.Key[:deviceKeyPrefixLength], created.Prefix)
+	assert.Equal(t, hashToken(created.Key), created.KeyHash)
+	assert.Equal(t, "kitchen", created.Name)
+	assert.Equal(t, now, created.CreatedAt)
+
+	// Listings never carry the key or its hash
+	listed, err := json.Marshal(created.DeviceKey)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(listed), created.Key)
+	assert.NotContains(t, string(listed), created.KeyHash)
+
+	other, err := newDeviceKey(userID, "SN-1", "", DefaultDeviceScopes, now)
+	assert.NoError(t, err)
+	assert.NotEqual(t, created.Key, other.Key)
+}
+
+func TestWithDevice_KeyScopes(t *testing.T) {
+	handler := WithDevice("", ScopeReportStatus, func(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+		t.Fatal("handler must not run for a device key without a read scope")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/v1/me/history", nil)
+	req.Header.Set(DeviceKeyHeader, "dk_0123")
+	rr := httptest.NewRecorder()
+	handler(context.Background(), nil, rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrDeviceKeyNotAccepted.Error())
+
+	post := httptest.NewRequest(http.MethodPost, "/v1/me/history", nil)
+	assert.Equal(t, ScopeReportStatus, requiredScope(post, "", ScopeReportStatus))
+	assert.Equal(t, http.StatusForbidden, authStatus(fmt.Errorf("%w: needs %s", ErrMissingScope, ScopeManageDevice)))
+	assert.Equal(t, http.StatusUnauthorized, authStatus(ErrInvalidDeviceKey))
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	assert.NoError(t, err)
+	assert.Len(t, code, userCodeLength)
+	for _, c := range code {
+		assert.Contains(t, userCodeAlphabet, string(c))
+	}
+
+	formatted := formatUserCode(code)
+	assert.Equal(t, code[:4]+"-"+code[4:], formatted)
+	assert.Equal(t, code, normalizeUserCode(formatted))
+	assert.Equal(t, "BDFGHJKL", normalizeUserCode(" bdfg hjkl "))
+	assert.Equal(t, "https://example.com/pair?code=BDFG-HJKL", withQuery("https://example.com/pair", "code", "BDFG-HJKL"))
+	assert.Equal(t, "https://example.com/pair?app=1&code=BDFG-HJKL", withQuery("https://example.com/pair?app=1", "code", "BDFG-HJKL"))
+}
+
+func TestDeviceToken_RejectsBadRequests(t *testing.T) {
+	post := func(contentType, body string) (int, DeviceTokenError) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/pairing/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		DeviceToken(context.Background(), &Database{}, w, req)
+		var response DeviceTokenError
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+		return w.Code, response
+	}
+
+	status, response := post("application/x-www-form-urlencoded", "grant_type=password&device_code=abc")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, TokenErrorUnsupportedGrant, response.Error)
+
+	status, response = post("application/json", `{"grant_type":"`+DeviceCodeGrantType+`"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, TokenErrorInvalidRequest, response.Error)
+
+	_, response = post("application/json", `{"grant_type":`)
+	assert.Equal(t, TokenErrorInvalidRequest, response.Error)
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	email, err := normalizeEmail(" Ann.Smith@Example.com ")
+	assert.NoError(t, err)
+	assert.Equal(t, "ann.smith@example.com", email)
+
+	for _, raw := range []string{"", "ann", "Ann <ann@example.com>", "ann@example.com, bob@example.com"} {
+		_, err := normalizeEmail(raw)
+		assert.ErrorIs(t, err, ErrInvalidEmail, raw)
+	}
+}
+
+func TestAccountMessages(t *testing.T) {
+	message := resetMessage("https://app.example.com/account", "ann@example.com", "abc123", 30*time.Minute)
+	assert.Equal(t, "ann@example.com", message.To)
+	assert.Contains(t, message.Body, "https://app.example.com/account?action=reset-password&token=abc123")
+	assert.Contains(t, message.Body, "30m0s")
+
+	// Without an account page the token is given to paste into the app
+	message = verificationMessage("", "ann@example.com", "abc123", 48*time.Hour)
+	assert.Contains(t, message.Body, "Code: abc123")
+	assert.NotContains(t, message.Body, "http")
+}
+
+func TestAccountEndpoints_RejectBadRequests(t *testing.T) {
+	post := func(handler func(context.Context, *Database, http.ResponseWriter, *http.Request), body string) int {
+		w := httptest.NewRecorder()
+		handler(context.Background(), &Database{}, w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, post(RequestPasswordReset, `{"email": "not an address"}`))
+	assert.Equal(t, http.StatusBadRequest, post(VerifyEmail, `{}`))
+	assert.Equal(t, http.StatusBadRequest, post(ConfirmPasswordReset, `{"token": "abc123"}`))
+	assert.Equal(t, http.StatusBadRequest, post(ConfirmPasswordReset, `{"password": "new"}`))
+
+	w := httptest.NewRecorder()
+	RequestPasswordReset(context.Background(), &Database{}, w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestLoginBackoff(t *testing.T) {
+	backoff, lockout := time.Second, 15*time.Minute
+	assert.Equal(t, time.Duration(0), loginBackoff(5, 5, backoff, lockout), "failures within the allowance aren't locked")
+	assert.Equal(t, time.Second, loginBackoff(6, 5, backoff, lockout))
+	assert.Equal(t, 2*time.Second, loginBackoff(7, 5, backoff, lockout))
+	assert.Equal(t, 512*time.Second, loginBackoff(15, 5, backoff, lockout))
+	assert.Equal(t, lockout, loginBackoff(16, 5, backoff, lockout))
+	assert.Equal(t, lockout, loginBackoff(1000, 5, backoff, lockout))
+}
+
+func TestLoginCounters(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/login", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	counters := loginCounters(req, "ann", config.Auth{LoginAttempts: 5, LoginIPAttempts: 50})
+	assert.Equal(t, "user:ann", counters[0].id())
+	assert.Equal(t, 5, counters[0].allowed)
+	assert.Equal(t, "ip:203.0.113.7", counters[1].id())
+	assert.Equal(t, 50, counters[1].allowed)
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	// The dummy hash must be a real bcrypt hash, or the compare would return early
+	assert.Equal(t, bcrypt.ErrMismatchedHashAndPassword, bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte("guess")))
+}
+
+func TestRespondLoginLocked(t *testing.T) {
+	w := httptest.NewRecorder()
+	respondLoginLocked(w, 1500*time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestLoginLocks_NeedsUsernameOrIP(t *testing.T) {
+	w := httptest.NewRecorder()
+	LoginLocks(context.Background(), &Database{}, w, httptest.NewRequest(http.MethodDelete, "/v1/admin/login-locks", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRateLimitKey_WithoutCredentials(t *testing.T) {
+	keyOf := RateLimitKey(&Database{})
+	req := httptest.NewRequest(http.MethodPost, "/v1/get-signed-url", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	assert.Equal(t, "ip:203.0.113.7", keyOf(req))
+}
+
+// testDatabase connects to the MongoDB named by MONGODB_TEST_URI, in a fresh database dropped after the test.
+// Without one it returns a database no server answers for, so lookups fail quickly.
+func testDatabase(t *testing.T) (*Database, bool) {
+	uri, ok := os.LookupEnv("MONGODB_TEST_URI")
+	opts := options.Client().ApplyURI(uri)
+	if !ok {
+		opts = options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(50 * time.Millisecond)
+	}
+	client, err := mongo.Connect(context.Background(), opts)
+	require.NoError(t, err)
+	database := client.Database(fmt.Sprintf("midi_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		if ok {
+			database.Drop(context.Background())
+		}
+		client.Disconnect(context.Background())
+	})
+	return &Database{Database: database}, ok
+}
+
+func TestRateLimitKey_ClientCertificate(t *testing.T) {
+	db, connected := testDatabase(t)
+	keyOf := RateLimitKey(db)
+	withCert := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/get-signed-url", nil)
+		req.RemoteAddr = "203.0.113.7:51234"
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+	sanOnly := &x509.Certificate{DNSNames: []string{"SN-0001"}}
+	fleetName := &x509.Certificate{Subject: pkix.Name{CommonName: "Acme players"}, DNSNames: []string{"SN-0002"}}
+
+	if !connected {
+		// A serial that can't be confirmed counts against the address, never a bucket shared by certificates
+		assert.Equal(t, "ip:203.0.113.7", keyOf(withCert(sanOnly)))
+		return
+	}
+	_, err := db.Collection(utilities.ValidOTPSerialsCollection).InsertMany(context.Background(), []any{
+		bson.M{"serial_number": "SN-0001", "otp": "111111"},
+		bson.M{"serial_number": "SN-0002", "otp": "222222"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "device:SN-0001", keyOf(withCert(sanOnly)))
+	assert.Equal(t, "device:SN-0002", keyOf(withCert(fleetName)), "keyed on the serial, not a common name devices share")
+	assert.Equal(t, "ip:203.0.113.7", keyOf(withCert(&x509.Certificate{DNSNames: []string{"SN-9999"}})))
+}
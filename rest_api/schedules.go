@@ -0,0 +1,468 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"midi-file-server/schedule"
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidSchedule      = fmt.Errorf("invalid schedule")
+	ErrInvalidScheduleID    = fmt.Errorf("invalid schedule id")
+	ErrScheduleNotFound     = fmt.Errorf("schedule not found")
+	ErrFailedSaveSchedule   = fmt.Errorf("failed to save schedule")
+	ErrFailedListSchedules  = fmt.Errorf("failed to list schedules")
+	ErrFailedDeleteSchedule = fmt.Errorf("failed to delete schedule")
+	ErrFailedLoadDueSlots   = fmt.Errorf("failed to load due schedules")
+	ErrFailedDispatchSlot   = fmt.Errorf("failed to dispatch scheduled slot")
+	ErrFailedLoadCommands   = fmt.Errorf("failed to load device commands")
+)
+
+// Schedule actions
+const (
+	ScheduleActionPlay  = "play"
+	ScheduleActionAlarm = "alarm"
+)
+
+const (
+	// schedulerInterval is how often due slots are looked for; cron has minute resolution
+	schedulerInterval = time.Minute
+	// commandGrace keeps a command available this long after its slot, for devices that were briefly offline
+	commandGrace       = 5 * time.Minute
+	maxWindowMinutes   = 24 * 60
+	maxScheduleNameLen = 100
+)
+
+// DeviceSchedules lists a device's schedules (GET) or adds one (POST)
+func DeviceSchedules(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	serial := r.PathValue("serial")
+	if err := requireDevice(user, serial); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{"owner_id": user.ID, "serial_number": serial}
+		cursor, err := db.Collection(utilities.DeviceSchedulesCollection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListSchedules).Error(), http.StatusInternalServerError)
+			return
+		}
+		schedules := []DeviceSchedule{}
+		if err := cursor.All(ctx, &schedules); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListSchedules).Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(schedules); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode schedules")).Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		var req DeviceScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidSchedule).Error(), http.StatusBadRequest)
+			return
+		}
+		sched, status, err := buildSchedule(ctx, db, req, serial, user, time.Now().UTC())
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+		sched.CreatedAt = sched.UpdatedAt
+		result, err := db.Collection(utilities.DeviceSchedulesCollection).InsertOne(ctx, sched)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveSchedule).Error(), http.StatusInternalServerError)
+			return
+		}
+		sched.ID = result.InsertedID.(primitive.ObjectID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(sched); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode schedule")).Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+	}
+}
+
+// DeviceScheduleByID returns (GET), replaces (PUT) or deletes (DELETE) one of a device's schedules
+func DeviceScheduleByID(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	serial := r.PathValue("serial")
+	if err := requireDevice(user, serial); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	existing, status, err := findOwnedSchedule(ctx, db, serial, r.PathValue("id"), user)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req DeviceScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidSchedule).Error(), http.StatusBadRequest)
+			return
+		}
+		sched, status, err := buildSchedule(ctx, db, req, serial, user, time.Now().UTC())
+		if err != nil {
+			utilities.LogErrorAndRespond(w, err.Error(), status)
+			return
+		}
+		sched.ID = existing.ID
+		sched.CreatedAt = existing.CreatedAt
+		if _, err := db.Collection(utilities.DeviceSchedulesCollection).ReplaceOne(ctx, bson.M{"_id": existing.ID, "owner_id": user.ID}, sched); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSaveSchedule).Error(), http.StatusInternalServerError)
+			return
+		}
+		existing = sched
+	case http.MethodDelete:
+		if _, err := db.Collection(utilities.DeviceSchedulesCollection).DeleteOne(ctx, bson.M{"_id": existing.ID, "owner_id": user.ID}); err != nil {
+			utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedDeleteSchedule).Error(), http.StatusInternalServerError)
+			return
+		}
+		// Slots already handed to the device are withdrawn too
+		if _, err := db.Collection(utilities.DeviceCommandsCollection).DeleteMany(ctx, bson.M{"schedule_id": existing.ID}); err != nil {
+			log.Error().Err(err).Str("schedule", existing.ID.Hex()).Msg("Failed to withdraw commands of deleted schedule")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(existing); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode schedule")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeviceCommands returns the scheduled slots waiting for a device, soonest first.
+// Devices poll it; with since (RFC 3339) only commands issued after that time are returned.
+func DeviceCommands(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	serial := r.PathValue("serial")
+	if err := requireDevice(user, serial); err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Commands of schedules set by a previous owner of the device are not handed out
+	filter := bson.M{"serial_number": serial, "owner_id": user.ID, "expires_at": bson.M{"$gt": time.Now().UTC()}}
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			utilities.LogErrorAndRespond(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		filter["created_at"] = bson.M{"$gt": since}
+	}
+
+	cursor, err := db.Collection(utilities.DeviceCommandsCollection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "start_at", Value: 1}}))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadCommands).Error(), http.StatusInternalServerError)
+		return
+	}
+	commands := []DeviceCommand{}
+	if err := cursor.All(ctx, &commands); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadCommands).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(commands); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode device commands")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// StartDeviceScheduler hands due slots to devices lead ahead of their start, checking every minute until ctx is done.
+// Signed URLs stay valid for the configured expiry after a slot's command expires, as it is at each check.
+// The returned channel is closed once it has stopped.
+func StartDeviceScheduler(ctx context.Context, db *Database, lead time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for {
+			runCtx, cancel := context.WithTimeout(ctx, schedulerInterval)
+			if err := DispatchSchedules(runCtx, db, time.Now().UTC(), lead, db.Config().Server.SignedURLExpiry); err != nil {
+				log.Error().Err(err).Msg("Schedule dispatch failed")
+			}
+			cancel()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+// DispatchSchedules issues a command for every enabled schedule whose next slot starts within lead of now,
+// then moves the schedule on to its following slot. Slots missed while the server was down are skipped.
+func DispatchSchedules(ctx context.Context, db *Database, now time.Time, lead, d time.Duration) error {
+	filter := bson.M{"enabled": true, "next_start": bson.M{"$lte": now.Add(lead)}}
+	cursor, err := db.Collection(utilities.DeviceSchedulesCollection).Find(ctx, filter)
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedLoadDueSlots)
+	}
+	var due []DeviceSchedule
+	if err := cursor.All(ctx, &due); err != nil {
+		return utilities.WrapError(err, ErrFailedLoadDueSlots)
+	}
+
+	for _, sched := range due {
+		if err := dispatchSlot(ctx, db, sched, now, d); err != nil {
+			log.Error().Err(err).Str("schedule", sched.ID.Hex()).Str("serial", sched.SerialNumber).Msg("Failed to dispatch schedule")
+		}
+	}
+	return nil
+}
+
+// dispatchSlot claims a schedule's next slot by advancing it, so only one server instance sends it, then sends it
+func dispatchSlot(ctx context.Context, db *Database, sched DeviceSchedule, now time.Time, d time.Duration) error {
+	rule, err := scheduleRule(sched)
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedDispatchSlot)
+	}
+	slot := schedule.Slot{Start: *sched.NextStart, End: *sched.NextEnd}
+
+	update := bson.M{"$unset": bson.M{"next_start": "", "next_end": ""}}
+	if following, ok := followingSlot(rule, slot, now); ok {
+		update = bson.M{"$set": bson.M{"next_start": following.Start.UTC(), "next_end": following.End.UTC()}}
+	}
+	result, err := db.Collection(utilities.DeviceSchedulesCollection).UpdateOne(ctx, bson.M{"_id": sched.ID, "next_start": slot.Start}, update)
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedDispatchSlot)
+	}
+	if result.ModifiedCount == 0 {
+		return nil
+	}
+
+	expires := commandExpiry(slot)
+	if !now.Before(expires) {
+		log.Warn().Str("schedule", sched.ID.Hex()).Time("start", slot.Start).Msg("Skipped missed schedule slot")
+		return nil
+	}
+
+	objectNames, err := scheduleObjectNames(ctx, db, sched)
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedDispatchSlot)
+	}
+	// The URLs must outlive the command, since the device may only pick it up near the end
+	downloads, err := signObjectNames(ctx, db.Config().Storage.SongsBucket, objectNames, expires.Sub(now)+d)
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedDispatchSlot)
+	}
+
+	command := DeviceCommand{
+		SerialNumber: sched.SerialNumber,
+		OwnerID:      sched.OwnerID,
+		ScheduleID:   sched.ID,
+		Action:       sched.Action,
+		StartAt:      slot.Start.UTC(),
+		Repeat:       RepeatOff,
+		Downloads:    downloads,
+		CreatedAt:    now,
+		ExpiresAt:    expires.UTC(),
+	}
+	if sched.Action == ScheduleActionPlay {
+		end := slot.End.UTC()
+		command.EndAt = &end
+		command.Repeat = RepeatAll
+	}
+	if _, err := db.Collection(utilities.DeviceCommandsCollection).InsertOne(ctx, command); err != nil {
+		return utilities.WrapError(err, ErrFailedDispatchSlot)
+	}
+	return nil
+}
+
+// buildSchedule validates a schedule request, checks the user owns what it plays and plans its first slot.
+// A play window already in progress starts right away.
+func buildSchedule(ctx context.Context, db *Database, req DeviceScheduleRequest, serial string, user User, now time.Time) (DeviceSchedule, int, error) {
+	sched, rule, err := parseScheduleRequest(req)
+	if err != nil {
+		return sched, http.StatusBadRequest, err
+	}
+	sched.OwnerID = user.ID
+	sched.SerialNumber = serial
+	sched.UpdatedAt = now
+
+	if sched.PlaylistID != nil {
+		if _, status, err := findOwnedPlaylist(ctx, db, sched.PlaylistID.Hex(), user); err != nil {
+			return sched, status, err
+		}
+	}
+	if sched.SongID != nil {
+		if _, status, err := findSong(ctx, db, sched.SongID.Hex()); err != nil {
+			return sched, status, err
+		}
+	}
+
+	planNextSlot(&sched, rule, now)
+	return sched, http.StatusOK, nil
+}
+
+// parseScheduleRequest checks a request without touching the database
+func parseScheduleRequest(req DeviceScheduleRequest) (DeviceSchedule, schedule.Rule, error) {
+	sched := DeviceSchedule{
+		Name:            strings.TrimSpace(req.Name),
+		Action:          req.Action,
+		Cron:            strings.Join(strings.Fields(req.Cron), " "),
+		TimeZone:        req.TimeZone,
+		DurationMinutes: req.DurationMinutes,
+		Exceptions:      req.Exceptions,
+		Enabled:         req.Enabled == nil || *req.Enabled,
+	}
+	if sched.Exceptions == nil {
+		sched.Exceptions = []string{}
+	}
+	invalid := func(format string, args ...any) (DeviceSchedule, schedule.Rule, error) {
+		return sched, schedule.Rule{}, utilities.WrapError(fmt.Errorf(format, args...), ErrInvalidSchedule)
+	}
+
+	if sched.Name == "" || len(sched.Name) > maxScheduleNameLen {
+		return invalid("name is required, up to %d characters", maxScheduleNameLen)
+	}
+	if req.PlaylistID != "" && req.SongID != "" {
+		return invalid("give either playlistId or songId, not both")
+	}
+	if req.PlaylistID != "" {
+		id, err := primitive.ObjectIDFromHex(req.PlaylistID)
+		if err != nil {
+			return invalid("%s", ErrInvalidPlaylistID)
+		}
+		sched.PlaylistID = &id
+	}
+	if req.SongID != "" {
+		id, err := primitive.ObjectIDFromHex(req.SongID)
+		if err != nil {
+			return invalid("%s", ErrInvalidSongID)
+		}
+		sched.SongID = &id
+	}
+
+	switch sched.Action {
+	case ScheduleActionPlay:
+		if sched.PlaylistID == nil {
+			return invalid("a play window needs a playlistId")
+		}
+		if sched.DurationMinutes < 1 || sched.DurationMinutes > maxWindowMinutes {
+			return invalid("durationMinutes must be between 1 and %d", maxWindowMinutes)
+		}
+	case ScheduleActionAlarm:
+		if sched.PlaylistID == nil && sched.SongID == nil {
+			return invalid("an alarm needs a songId or playlistId")
+		}
+		sched.DurationMinutes = 0
+	default:
+		return invalid("action must be %s or %s", ScheduleActionPlay, ScheduleActionAlarm)
+	}
+
+	rule, err := scheduleRule(sched)
+	if err != nil {
+		return invalid("%s", err)
+	}
+	return sched, rule, nil
+}
+
+func scheduleRule(sched DeviceSchedule) (schedule.Rule, error) {
+	return schedule.NewRule(sched.Cron, sched.TimeZone, time.Duration(sched.DurationMinutes)*time.Minute, sched.Exceptions)
+}
+
+// planNextSlot sets the slot the scheduler dispatches next: the window in progress, if any, or the next one
+func planNextSlot(sched *DeviceSchedule, rule schedule.Rule, now time.Time) {
+	sched.NextStart, sched.NextEnd = nil, nil
+	slot, ok := rule.Active(now)
+	if !ok {
+		slot, ok = rule.Next(now)
+	}
+	if !ok {
+		return
+	}
+	start, end := slot.Start.UTC(), slot.End.UTC()
+	sched.NextStart, sched.NextEnd = &start, &end
+}
+
+// followingSlot is the slot after the one being dispatched. It starts after now too, so a schedule that fell
+// behind, e.g. while the server was down, skips the slots it missed instead of dispatching each in turn.
+func followingSlot(rule schedule.Rule, slot schedule.Slot, now time.Time) (schedule.Slot, bool) {
+	from := slot.Start
+	if now.After(from) {
+		from = now
+	}
+	return rule.Next(from)
+}
+
+// commandExpiry is when a slot's command stops being useful to the device
+func commandExpiry(slot schedule.Slot) time.Time {
+	return slot.End.Add(commandGrace)
+}
+
+// scheduleObjectNames lists what a schedule plays, reading the playlist at dispatch time so edits are picked up
+func scheduleObjectNames(ctx context.Context, db *Database, sched DeviceSchedule) ([]string, error) {
+	if sched.SongID != nil {
+		var song Song
+		if err := db.Collection(utilities.SongsCollection).FindOne(ctx, bson.M{"_id": *sched.SongID}).Decode(&song); err != nil {
+			return nil, utilities.WrapError(err, ErrSongNotFound)
+		}
+		return []string{song.ObjectName}, nil
+	}
+
+	var playlist Playlist
+	if err := db.Collection(utilities.PlaylistsCollection).FindOne(ctx, bson.M{"_id": *sched.PlaylistID, "owner_id": sched.OwnerID}).Decode(&playlist); err != nil {
+		return nil, utilities.WrapError(err, ErrPlaylistNotFound)
+	}
+	if len(playlist.Items) == 0 {
+		return nil, ErrEmptyPlaylist
+	}
+	names := make([]string, 0, len(playlist.Items))
+	for _, item := range playlist.Items {
+		names = append(names, item.ObjectName)
+	}
+	return names, nil
+}
+
+// findOwnedSchedule loads a schedule of the user's device; anything else is reported as not found
+func findOwnedSchedule(ctx context.Context, db *Database, serial, hexID string, user User) (DeviceSchedule, int, error) {
+	var sched DeviceSchedule
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return sched, http.StatusBadRequest, utilities.WrapError(err, ErrInvalidScheduleID)
+	}
+
+	filter := bson.M{"_id": id, "owner_id": user.ID, "serial_number": serial}
+	err = db.Collection(utilities.DeviceSchedulesCollection).FindOne(ctx, filter).Decode(&sched)
+	if err == mongo.ErrNoDocuments {
+		return sched, http.StatusNotFound, ErrScheduleNotFound
+	}
+	if err != nil {
+		return sched, http.StatusInternalServerError, utilities.WrapError(err, fmt.Errorf("failed to load schedule"))
+	}
+	return sched, http.StatusOK, nil
+}
@@ -0,0 +1,101 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"midi-file-server/analysis"
+	"midi-file-server/midi"
+	utilities "midi-file-server/utilities"
+)
+
+var (
+	ErrQueryTooShort     = fmt.Errorf("snippet has too few notes to search with")
+	ErrQueryTooLong      = fmt.Errorf("snippet has too many notes to search with")
+	ErrFailedSearchSongs = fmt.Errorf("failed to search songs")
+)
+
+const (
+	maxSnippetBytes     = 64 << 10
+	defaultSearchLimit  = 5
+	maxSearchLimit      = 25
+	minSearchMatchScore = 0.3
+)
+
+// SearchByPlaying finds the songs containing a played tune.
+// The request body is a short MIDI snippet, e.g. captured from the piano by the ESP32 or from a keyboard
+// in the app. Its top line is matched by interval against every song's melody, so the key and tempo
+// it was played in don't matter. Results are best first and limited by the limit query parameter.
+func SearchByPlaying(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxSearchLimit {
+			utilities.LogErrorAndRespond(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSnippetBytes))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrUploadTooLarge).Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	file, err := midi.Parse(bytes.NewReader(data))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidMidi).Error(), http.StatusBadRequest)
+		return
+	}
+	query := analysis.ExtractMelody(file)
+	if len(query.Intervals) < analysis.MinQueryNotes-1 {
+		utilities.LogErrorAndRespond(w, fmt.Sprintf("%s: play at least %d notes", ErrQueryTooShort, analysis.MinQueryNotes), http.StatusBadRequest)
+		return
+	}
+	if len(query.Intervals) > analysis.MaxQueryNotes-1 {
+		utilities.LogErrorAndRespond(w, fmt.Sprintf("%s: play at most %d notes", ErrQueryTooLong, analysis.MaxQueryNotes), http.StatusBadRequest)
+		return
+	}
+
+	songs, err := loadMelodies(ctx, db)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedSearchSongs).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(matchMelody(query, songs, limit)); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode search results")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// matchMelody scores the query against every song and keeps the best limit matches above minSearchMatchScore
+func matchMelody(query analysis.Melody, songs []Song, limit int) []SimilarSong {
+	matches := []SimilarSong{}
+	for _, song := range songs {
+		if song.Melody == nil {
+			continue
+		}
+		score := analysis.MatchScore(query, *song.Melody)
+		if score < minSearchMatchScore {
+			continue
+		}
+		matches = append(matches, SimilarSong{ID: song.ID, ObjectName: song.ObjectName, Title: song.Title, Score: score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
@@ -0,0 +1,127 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"midi-file-server/midi"
+	"midi-file-server/notation"
+	utilities "midi-file-server/utilities"
+
+	"cloud.google.com/go/storage"
+)
+
+var (
+	ErrInvalidExportOptions = fmt.Errorf("invalid sheet music options")
+	ErrFailedDownloadObject = fmt.Errorf("failed to download object")
+)
+
+const (
+	musicXMLSuffix      = ".score.musicxml"
+	musicXMLContentType = "application/vnd.recordare.musicxml+xml"
+)
+
+// GetSongMusicXML exports a song as sheet music on demand.
+// The grid (steps per quarter note) and split (MIDI pitch dividing the treble and bass staves) query
+// parameters override the defaults used for the copy stored at ingest.
+func GetSongMusicXML(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := parseExportOptions(r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	data, err := downloadObject(ctx, db.Config().Storage.SongsBucket, song.ObjectName)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file, err := midi.Parse(bytes.NewReader(data))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrInvalidMidi, song.ObjectName).Error(), http.StatusInternalServerError)
+		return
+	}
+	score, err := notation.ExportMusicXML(file, song.Title, opts)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", musicXMLContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(derivedObjectName(song.ObjectName, musicXMLSuffix))))
+	_, _ = w.Write(score)
+}
+
+// renderMusicXML exports the default sheet music and records its object name on the song
+func renderMusicXML(file *midi.File, objectName string, song *Song) ([]artifact, error) {
+	if len(file.Notes()) == 0 {
+		return nil, nil
+	}
+
+	score, err := notation.ExportMusicXML(file, song.Title, notation.DefaultExportOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	song.MusicXMLObject = derivedObjectName(objectName, musicXMLSuffix)
+	return []artifact{{objectName: song.MusicXMLObject, contentType: musicXMLContentType, data: score}}, nil
+}
+
+// parseExportOptions reads the grid and split query parameters over the exporter defaults
+func parseExportOptions(r *http.Request) (notation.ExportOptions, error) {
+	opts := notation.DefaultExportOptions()
+	if value := r.URL.Query().Get("grid"); value != "" {
+		grid, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, utilities.WrapError(err, ErrInvalidExportOptions, "grid")
+		}
+		opts.Grid = grid
+	}
+	if value := r.URL.Query().Get("split"); value != "" {
+		split, err := strconv.ParseUint(value, 10, 7)
+		if err != nil {
+			return opts, utilities.WrapError(err, ErrInvalidExportOptions, "split")
+		}
+		opts.SplitPitch = uint8(split)
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, utilities.WrapError(err, ErrInvalidExportOptions)
+	}
+	return opts, nil
+}
+
+func downloadObject(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, utilities.WrapError(err, fmt.Errorf("failed to create client"))
+	}
+	defer client.Close()
+
+	reader, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrFailedDownloadObject, objectName)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, utilities.WrapError(err, ErrFailedDownloadObject, objectName)
+	}
+	return data, nil
+}
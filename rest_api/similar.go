@@ -0,0 +1,192 @@
+package restapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"midi-file-server/analysis"
+	utilities "midi-file-server/utilities"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrFailedRefreshSimilar = fmt.Errorf("failed to refresh similar songs")
+	ErrFailedLoadSimilar    = fmt.Errorf("failed to load similar songs")
+)
+
+const (
+	// maxStoredSimilar is how many neighbours are kept per song; requests can ask for fewer
+	maxStoredSimilar     = 25
+	defaultSimilarLimit  = 10
+	minSimilarityToStore = 0.05
+)
+
+// GetSimilarSongs returns the songs that sound most like the given one, best match first.
+// Rankings are precomputed by the refresh job; a song added since the last run is ranked on demand.
+func GetSimilarSongs(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultSimilarLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxStoredSimilar {
+			utilities.LogErrorAndRespond(w, fmt.Sprintf("limit must be between 1 and %d", maxStoredSimilar), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	var stored SimilarSongs
+	err = db.Collection(utilities.SimilarCollection).FindOne(ctx, bson.M{"_id": song.ID}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		stored, err = refreshSimilarForSong(ctx, db, song)
+	}
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedLoadSimilar).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	similar := stored.Similar
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(similar); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode similar songs")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// StartSimilarityRefresh recomputes every song's neighbours now and then once per interval until ctx is done.
+// The returned channel is closed once it has stopped.
+func StartSimilarityRefresh(ctx context.Context, db *Database, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runCtx, cancel := context.WithTimeout(ctx, interval)
+			if err := RefreshSimilarSongs(runCtx, db); err != nil {
+				log.Error().Err(err).Msg("Similar songs refresh failed")
+			}
+			cancel()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+// RefreshSimilarSongs ranks every song with a melody against the rest of the catalog and stores the results
+func RefreshSimilarSongs(ctx context.Context, db *Database) error {
+	songs, err := loadMelodies(ctx, db)
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedRefreshSimilar)
+	}
+
+	profiles := make([]analysis.MelodyProfile, len(songs))
+	for i, song := range songs {
+		profiles[i] = analysis.NewMelodyProfile(*song.Melody)
+	}
+
+	now := time.Now().UTC()
+	var writes []mongo.WriteModel
+	for i, song := range songs {
+		stored := SimilarSongs{SongID: song.ID, Similar: rankSimilar(i, songs, profiles, maxStoredSimilar), UpdatedAt: now}
+		writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": song.ID}).SetReplacement(stored).SetUpsert(true))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	if _, err := db.Collection(utilities.SimilarCollection).BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+		return utilities.WrapError(err, ErrFailedRefreshSimilar)
+	}
+	log.Info().Int("songs", len(songs)).Msg("Refreshed similar songs")
+	return nil
+}
+
+// refreshSimilarForSong ranks a single song against the catalog and stores the result
+func refreshSimilarForSong(ctx context.Context, db *Database, song Song) (SimilarSongs, error) {
+	stored := SimilarSongs{SongID: song.ID, UpdatedAt: time.Now().UTC()}
+	if song.Melody == nil {
+		return stored, nil
+	}
+
+	songs, err := loadMelodies(ctx, db)
+	if err != nil {
+		return stored, err
+	}
+	target := -1
+	profiles := make([]analysis.MelodyProfile, len(songs))
+	for i, s := range songs {
+		profiles[i] = analysis.NewMelodyProfile(*s.Melody)
+		if s.ID == song.ID {
+			target = i
+		}
+	}
+	if target < 0 {
+		songs = append(songs, song)
+		profiles = append(profiles, analysis.NewMelodyProfile(*song.Melody))
+		target = len(songs) - 1
+	}
+
+	stored.Similar = rankSimilar(target, songs, profiles, maxStoredSimilar)
+	_, err = db.Collection(utilities.SimilarCollection).ReplaceOne(ctx, bson.M{"_id": song.ID}, stored, options.Replace().SetUpsert(true))
+	return stored, err
+}
+
+// loadMelodies fetches the identifying fields and melody of every song that has one
+func loadMelodies(ctx context.Context, db *Database) ([]Song, error) {
+	projection := bson.M{"object_name": 1, "title": 1, "melody": 1}
+	cursor, err := db.Collection(utilities.SongsCollection).Find(ctx, bson.M{"melody": bson.M{"$exists": true}}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	var songs []Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return nil, err
+	}
+	return songs, nil
+}
+
+// rankSimilar scores songs[target] against every other song and keeps the best limit matches
+func rankSimilar(target int, songs []Song, profiles []analysis.MelodyProfile, limit int) []SimilarSong {
+	similar := []SimilarSong{}
+	for i, song := range songs {
+		if i == target {
+			continue
+		}
+		score := profiles[target].Similarity(profiles[i])
+		if score < minSimilarityToStore {
+			continue
+		}
+		similar = append(similar, SimilarSong{ID: song.ID, ObjectName: song.ObjectName, Title: song.Title, Score: score})
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Score > similar[j].Score })
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+	return similar
+}
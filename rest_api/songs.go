@@ -0,0 +1,634 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"midi-file-server/analysis"
+	"midi-file-server/config"
+	"midi-file-server/lyrics"
+	"midi-file-server/midi"
+	"midi-file-server/notation"
+	"midi-file-server/render"
+	utilities "midi-file-server/utilities"
+
+	"cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidMidi        = fmt.Errorf("invalid MIDI file")
+	ErrMissingObjectName  = fmt.Errorf("missing objectName")
+	ErrUploadTooLarge     = fmt.Errorf("upload exceeds maximum size")
+	ErrFailedRender       = fmt.Errorf("failed to render song preview")
+	ErrFailedUploadObject = fmt.Errorf("failed to upload object")
+	ErrFailedSaveSong     = fmt.Errorf("failed to save song")
+	ErrSongNotFound       = fmt.Errorf("song not found")
+	ErrInvalidSongID      = fmt.Errorf("invalid song id")
+	ErrFailedListSongs    = fmt.Errorf("failed to list songs")
+	ErrInvalidPreview     = fmt.Errorf("invalid preview window")
+	ErrInvalidNotation    = fmt.Errorf("invalid notation file")
+	ErrInvalidSongFilter  = fmt.Errorf("invalid song filter")
+	ErrObjectNotOwned     = fmt.Errorf("object belongs to another upload")
+)
+
+const (
+	maxMidiUploadBytes = 10 << 20
+
+	// defaultSongPage and maxSongPage bound the songs listed at once
+	defaultSongPage = 50
+	maxSongPage     = 200
+
+	pianoRollPngSuffix = ".pianoroll.png"
+	pianoRollSvgSuffix = ".pianoroll.svg"
+	audioPreviewSuffix = ".preview.wav"
+	midiSuffix         = ".mid"
+)
+
+// artifact is an object written to the bucket during ingest
+type artifact struct {
+	objectName  string
+	contentType string
+	data        []byte
+}
+
+// ingestOptions carries per-upload settings for the derived artifacts
+type ingestOptions struct {
+	previewStart   float64
+	previewLength  float64
+	allowDuplicate bool
+	// uploader is the user the stored objects and catalog entry belong to
+	uploader primitive.ObjectID
+}
+
+// songListProjection leaves out the fields only single-song routes need, which can be large
+var songListProjection = bson.M{"lyrics": 0, "melody": 0, "fingerprint": 0}
+
+// notationContentTypes lists the non-MIDI source formats accepted by UploadMidi, keyed by extension
+var notationContentTypes = map[string]string{
+	".musicxml": "application/vnd.recordare.musicxml+xml",
+	".xml":      "application/vnd.recordare.musicxml+xml",
+	".mxl":      "application/vnd.recordare.musicxml",
+	".abc":      "text/vnd.abc",
+}
+
+// UploadMidi ingests a MIDI file sent as the raw request body.
+// The file is parsed, its previews are rendered and stored next to it, and its catalog entry is upserted.
+// MusicXML (.musicxml, .xml, .mxl) and ABC (.abc) uploads are converted to MIDI first; the converted
+// file is stored next to the source under the same name with a .mid extension.
+// The audio preview window defaults to the configured preview.start_seconds/preview.length_seconds and can be
+// overridden per upload with the previewStart and previewLength query parameters.
+// A file identical to a song stored under another name is rejected with 409 Conflict unless
+// allowDuplicate=true, in which case it is stored and flagged with duplicateOf.
+// Only the user who first uploaded an object may replace it or the objects derived from it.
+func UploadMidi(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != http.MethodPost {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	if !db.Config().Features.Uploads {
+		utilities.LogErrorAndRespond(w, ErrFeatureDisabled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	objectName := strings.TrimSpace(r.URL.Query().Get("objectName"))
+	if objectName == "" {
+		utilities.LogErrorAndRespond(w, ErrMissingObjectName.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(objectName, practicePrefix) {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(fmt.Errorf("%s is kept for practice files", practicePrefix), ErrObjectNotOwned).Error(), http.StatusForbidden)
+		return
+	}
+
+	opts, err := parseIngestOptions(r, db.Config().Preview)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.uploader = user.ID
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMidiUploadBytes))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrUploadTooLarge).Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	song, err := ingestSong(ctx, db, objectName, data, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidMidi) || errors.Is(err, ErrInvalidNotation):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrDuplicateSong):
+			status = http.StatusConflict
+		case errors.Is(err, ErrObjectNotOwned):
+			status = http.StatusForbidden
+		}
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	log.Info().Str("object", song.ObjectName).Str("id", song.ID.Hex()).Str("uploader", user.ID.Hex()).Msg("Ingested MIDI file")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(song); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode song")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// ListSongs returns the song catalog without signed URLs.
+// Results can be narrowed with the q (title substring), key, minDifficulty and maxDifficulty
+// query parameters and ordered by title (default), difficulty, popular (most played) or rating with sort.
+// Songs are listed a page at a time, chosen with limit (default 50, at most 200) and offset.
+func ListSongs(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, sort, err := parseSongFilter(r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := parseSongPage(r)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := options.Find().SetSort(sort).SetProjection(songListProjection).SetSkip(offset).SetLimit(limit)
+	cursor, err := db.Collection(utilities.SongsCollection).Find(ctx, filter, opts)
+	if err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListSongs).Error(), http.StatusInternalServerError)
+		return
+	}
+	songs := []Song{}
+	if err := cursor.All(ctx, &songs); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedListSongs).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(songs); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode songs")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetSong returns a single catalog entry with signed URLs for the MIDI file, its previews and its sheet music
+func GetSong(ctx context.Context, db *Database, w http.ResponseWriter, r *http.Request, d time.Duration) {
+	if r.Method != http.MethodGet {
+		utilities.LogErrorAndRespond(w, ErrMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	song, status, err := findSong(ctx, db, r.PathValue("id"))
+	if err != nil {
+		utilities.LogErrorAndRespond(w, err.Error(), status)
+		return
+	}
+
+	if err := signSongURLs(ctx, db.Config().Storage.SongsBucket, &song, d); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, ErrFailedGenerateSignedURL).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(song); err != nil {
+		utilities.LogErrorAndRespond(w, utilities.WrapError(err, fmt.Errorf("failed to encode song")).Error(), http.StatusInternalServerError)
+	}
+}
+
+// findSong loads a song by hex id and reports the HTTP status to use on failure
+func findSong(ctx context.Context, db *Database, hexID string) (Song, int, error) {
+	var song Song
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return song, http.StatusBadRequest, utilities.WrapError(err, ErrInvalidSongID)
+	}
+
+	err = db.Collection(utilities.SongsCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&song)
+	if err == mongo.ErrNoDocuments {
+		return song, http.StatusNotFound, ErrSongNotFound
+	}
+	if err != nil {
+		return song, http.StatusInternalServerError, utilities.WrapError(err, fmt.Errorf("failed to load song"))
+	}
+	return song, http.StatusOK, nil
+}
+
+// signSongURLs fills in the signed URL fields for every stored object of a song
+func signSongURLs(ctx context.Context, bucketName string, song *Song, d time.Duration) error {
+	targets := []struct {
+		objectName string
+		url        *string
+	}{
+		{song.ObjectName, &song.SignedURL},
+		{song.SourceObject, &song.SourceURL},
+		{song.PianoRollPngObject, &song.PianoRollPngURL},
+		{song.PianoRollSvgObject, &song.PianoRollSvgURL},
+		{song.AudioPreviewObject, &song.AudioPreviewURL},
+		{song.MusicXMLObject, &song.MusicXMLURL},
+	}
+	for _, target := range targets {
+		if target.objectName == "" {
+			continue
+		}
+		url, err := generateSignedURL(ctx, bucketName, target.objectName, d)
+		if err != nil {
+			return err
+		}
+		*target.url = url
+	}
+	return nil
+}
+
+// ingestSong parses a MIDI file, renders its derived artifacts, uploads everything and saves the catalog entry
+func ingestSong(ctx context.Context, db *Database, objectName string, data []byte, opts ingestOptions) (Song, error) {
+	var artifacts []artifact
+	sourceObject := ""
+	if contentType, ok := notationContentTypes[strings.ToLower(path.Ext(objectName))]; ok {
+		converted, err := importNotation(objectName, data)
+		if err != nil {
+			return Song{}, utilities.WrapError(err, ErrInvalidNotation, objectName)
+		}
+		artifacts = append(artifacts, artifact{objectName: objectName, contentType: contentType, data: data})
+		sourceObject = objectName
+		objectName = derivedObjectName(objectName, midiSuffix)
+		data = converted.Encode()
+	}
+
+	file, err := midi.Parse(bytes.NewReader(data))
+	if err != nil {
+		return Song{}, utilities.WrapError(err, ErrInvalidMidi, objectName)
+	}
+
+	features := analysis.Analyze(file)
+	fingerprint := analysis.NewFingerprint(data, file)
+	melody := analysis.ExtractMelody(file)
+	_, hands := analysis.SeparateHands(file)
+	words := lyrics.Extract(file)
+	song := Song{
+		ObjectName:      objectName,
+		SourceObject:    sourceObject,
+		Title:           songTitle(file, objectName),
+		DurationSeconds: file.Duration(),
+		TrackCount:      len(file.Tracks),
+		NoteCount:       len(file.Notes()),
+		Analysis:        &features,
+		Fingerprint:     &fingerprint,
+		Melody:          &melody,
+		Hands:           &hands,
+		UploadedBy:      opts.uploader,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if len(words.Lines) > 0 {
+		song.Lyrics, song.LyricLines = &words, len(words.Lines)
+	}
+	artifacts = append(artifacts, artifact{objectName: objectName, contentType: "audio/midi", data: data})
+
+	// Exact copies under another name are rejected unless the upload asks to keep them, in which case they are flagged
+	existing, err := findExactDuplicate(ctx, db, song)
+	if err != nil {
+		return Song{}, utilities.WrapError(err, ErrFailedSaveSong, objectName)
+	}
+	if existing != nil {
+		if !opts.allowDuplicate {
+			return Song{}, utilities.WrapError(fmt.Errorf("matches %s", existing.ObjectName), ErrDuplicateSong, objectName)
+		}
+		song.DuplicateOf = existing.ObjectName
+	}
+
+	previews, err := renderPianoRolls(file, objectName, &song)
+	if err != nil {
+		return Song{}, utilities.WrapError(err, ErrFailedRender, objectName)
+	}
+	artifacts = append(artifacts, previews...)
+
+	audio, err := renderAudioPreview(ctx, file, objectName, opts, &song)
+	if err != nil {
+		return Song{}, utilities.WrapError(err, ErrFailedRender, objectName)
+	}
+	artifacts = append(artifacts, audio...)
+
+	score, err := renderMusicXML(file, objectName, &song)
+	if err != nil {
+		return Song{}, utilities.WrapError(err, ErrFailedRender, objectName)
+	}
+	artifacts = append(artifacts, score...)
+
+	if err := checkArtifactsOwned(ctx, db, artifacts, opts.uploader); err != nil {
+		return Song{}, err
+	}
+	if err := uploadArtifacts(ctx, db.Config().Storage.SongsBucket, artifacts); err != nil {
+		return Song{}, err
+	}
+
+	if err := saveSong(ctx, db, &song); err != nil {
+		return Song{}, utilities.WrapError(err, ErrFailedSaveSong, objectName)
+	}
+	return song, nil
+}
+
+// importNotation converts a MusicXML or ABC source file to MIDI based on its extension
+func importNotation(objectName string, data []byte) (*midi.File, error) {
+	switch strings.ToLower(path.Ext(objectName)) {
+	case ".mxl":
+		return notation.ImportMXL(data)
+	case ".abc":
+		return notation.ImportABC(bytes.NewReader(data))
+	default:
+		return notation.ImportMusicXML(bytes.NewReader(data))
+	}
+}
+
+// renderPianoRolls renders the PNG and SVG piano rolls and records their object names on the song
+func renderPianoRolls(file *midi.File, objectName string, song *Song) ([]artifact, error) {
+	// A file with no notes is still a valid song, it just has nothing to draw
+	if len(file.Notes()) == 0 {
+		return nil, nil
+	}
+
+	opts := render.DefaultPianoRollOptions()
+	pngData, err := render.PianoRollPNG(file, opts)
+	if err != nil {
+		return nil, err
+	}
+	svgData, err := render.PianoRollSVG(file, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	song.PianoRollPngObject = derivedObjectName(objectName, pianoRollPngSuffix)
+	song.PianoRollSvgObject = derivedObjectName(objectName, pianoRollSvgSuffix)
+	return []artifact{
+		{objectName: song.PianoRollPngObject, contentType: "image/png", data: pngData},
+		{objectName: song.PianoRollSvgObject, contentType: "image/svg+xml", data: svgData},
+	}, nil
+}
+
+// renderAudioPreview synthesizes the preview window to WAV and records its object name on the song
+func renderAudioPreview(ctx context.Context, file *midi.File, objectName string, opts ingestOptions, song *Song) ([]artifact, error) {
+	if len(file.Notes()) == 0 {
+		return nil, nil
+	}
+
+	synthOpts := render.DefaultSynthOptions()
+	synthOpts.Start = opts.previewStart
+	synthOpts.Length = opts.previewLength
+	// Songs shorter than the requested start still get a preview from the beginning
+	if synthOpts.Start >= file.Duration() {
+		synthOpts.Start = 0
+	}
+
+	samples, err := render.Synthesize(ctx, file, synthOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	song.AudioPreviewObject = derivedObjectName(objectName, audioPreviewSuffix)
+	song.PreviewStart = synthOpts.Start
+	song.PreviewLength = float64(len(samples)) / float64(synthOpts.SampleRate)
+	wav := render.EncodeWAV(samples, synthOpts.SampleRate)
+	return []artifact{{objectName: song.AudioPreviewObject, contentType: "audio/wav", data: wav}}, nil
+}
+
+// parseIngestOptions reads the preview window from the query, falling back to the configured defaults,
+// and whether an exact duplicate of an existing song may be stored
+func parseIngestOptions(r *http.Request, defaults config.Preview) (ingestOptions, error) {
+	opts := ingestOptions{previewStart: defaults.StartSeconds, previewLength: defaults.LengthSeconds}
+	params := []struct {
+		param  string
+		target *float64
+	}{
+		{"previewStart", &opts.previewStart},
+		{"previewLength", &opts.previewLength},
+	}
+	for _, p := range params {
+		value := r.URL.Query().Get(p.param)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return opts, utilities.WrapError(err, ErrInvalidPreview, p.param)
+		}
+		*p.target = parsed
+	}
+
+	if opts.previewStart < 0 || opts.previewLength <= 0 {
+		return opts, utilities.WrapError(render.ErrInvalidPreviewWindow, ErrInvalidPreview)
+	}
+	if opts.previewLength > render.MaxPreviewSeconds {
+		return opts, utilities.WrapError(fmt.Errorf("previewLength is at most %d seconds", render.MaxPreviewSeconds), ErrInvalidPreview)
+	}
+
+	if value := r.URL.Query().Get("allowDuplicate"); value != "" {
+		allow, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, utilities.WrapError(err, fmt.Errorf("invalid allowDuplicate"))
+		}
+		opts.allowDuplicate = allow
+	}
+	return opts, nil
+}
+
+// parseSongFilter builds the catalog query and sort order from the list parameters
+func parseSongFilter(r *http.Request) (bson.M, bson.D, error) {
+	query := r.URL.Query()
+	filter := bson.M{}
+
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		filter["title"] = bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+	}
+	if key := strings.TrimSpace(query.Get("key")); key != "" {
+		filter["analysis.key"] = bson.M{"$regex": "^" + regexp.QuoteMeta(key) + "$", "$options": "i"}
+	}
+
+	difficulty := bson.M{}
+	bounds := []struct {
+		param    string
+		operator string
+	}{
+		{"minDifficulty", "$gte"},
+		{"maxDifficulty", "$lte"},
+	}
+	for _, b := range bounds {
+		value := query.Get(b.param)
+		if value == "" {
+			continue
+		}
+		grade, err := strconv.Atoi(value)
+		if err != nil || grade < analysis.MinDifficulty || grade > analysis.MaxDifficulty {
+			return nil, nil, utilities.WrapError(fmt.Errorf("%s must be between %d and %d", b.param, analysis.MinDifficulty, analysis.MaxDifficulty), ErrInvalidSongFilter)
+		}
+		difficulty[b.operator] = grade
+	}
+	if len(difficulty) > 0 {
+		filter["analysis.difficulty"] = difficulty
+	}
+
+	switch query.Get("sort") {
+	case "", "title":
+		return filter, bson.D{{Key: "title", Value: 1}}, nil
+	case "difficulty":
+		return filter, bson.D{{Key: "analysis.difficulty", Value: 1}, {Key: "title", Value: 1}}, nil
+	case "popular":
+		return filter, bson.D{{Key: "popularity.play_count", Value: -1}, {Key: "title", Value: 1}}, nil
+	case "rating":
+		return filter, bson.D{{Key: "popularity.rating_average", Value: -1}, {Key: "popularity.rating_count", Value: -1}, {Key: "title", Value: 1}}, nil
+	default:
+		return nil, nil, utilities.WrapError(fmt.Errorf("unknown sort %q", query.Get("sort")), ErrInvalidSongFilter)
+	}
+}
+
+// parseSongPage reads the limit and offset of a page of songs
+func parseSongPage(r *http.Request) (int64, int64, error) {
+	query := r.URL.Query()
+	limit, offset := int64(defaultSongPage), int64(0)
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 || parsed > maxSongPage {
+			return 0, 0, utilities.WrapError(fmt.Errorf("limit must be between 1 and %d", maxSongPage), ErrInvalidSongFilter)
+		}
+		limit = parsed
+	}
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, 0, utilities.WrapError(fmt.Errorf("offset must be a whole number"), ErrInvalidSongFilter)
+		}
+		offset = parsed
+	}
+	return limit, offset, nil
+}
+
+// derivedObjectName places a derived artifact next to its source object, e.g. midi/song.mid -> midi/song.pianoroll.png
+func derivedObjectName(objectName, suffix string) string {
+	return strings.TrimSuffix(objectName, path.Ext(objectName)) + suffix
+}
+
+// songTitle prefers the first track name and falls back to the object's base name
+func songTitle(file *midi.File, objectName string) string {
+	for _, track := range file.Tracks {
+		if name := strings.TrimSpace(track.Name); name != "" {
+			return name
+		}
+	}
+	base := path.Base(objectName)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+func uploadArtifacts(ctx context.Context, bucketName string, artifacts []artifact) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return utilities.WrapError(err, fmt.Errorf("failed to create client"))
+	}
+	defer client.Close()
+
+	for _, a := range artifacts {
+		writer := client.Bucket(bucketName).Object(a.objectName).NewWriter(ctx)
+		writer.ContentType = a.contentType
+		if _, err := writer.Write(a.data); err != nil {
+			writer.Close()
+			return utilities.WrapError(err, ErrFailedUploadObject, a.objectName)
+		}
+		if err := writer.Close(); err != nil {
+			return utilities.WrapError(err, ErrFailedUploadObject, a.objectName)
+		}
+	}
+	return nil
+}
+
+// checkArtifactsOwned refuses to overwrite objects that belong to a song of another user, or that exist in the
+// bucket without belonging to a song of the uploader
+func checkArtifactsOwned(ctx context.Context, db *Database, artifacts []artifact, uploader primitive.ObjectID) error {
+	names := make([]string, len(artifacts))
+	for i, a := range artifacts {
+		names[i] = a.objectName
+	}
+	fields := []string{"object_name", "source_object", "piano_roll_png_object", "piano_roll_svg_object", "audio_preview_object", "music_xml_object"}
+	anyField := bson.A{}
+	for _, field := range fields {
+		anyField = append(anyField, bson.M{field: bson.M{"$in": names}})
+	}
+	cursor, err := db.Collection(utilities.SongsCollection).Find(ctx, bson.M{"$or": anyField})
+	if err != nil {
+		return utilities.WrapError(err, ErrFailedSaveSong)
+	}
+	var songs []Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return utilities.WrapError(err, ErrFailedSaveSong)
+	}
+	owned := map[string]bool{}
+	for _, song := range songs {
+		objects := []string{song.ObjectName, song.SourceObject, song.PianoRollPngObject, song.PianoRollSvgObject, song.AudioPreviewObject, song.MusicXMLObject}
+		for _, name := range objects {
+			if !slices.Contains(names, name) {
+				continue
+			}
+			if song.UploadedBy != uploader {
+				return utilities.WrapError(fmt.Errorf("%s is part of %s", name, song.ObjectName), ErrObjectNotOwned)
+			}
+			owned[name] = true
+		}
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return utilities.WrapError(err, fmt.Errorf("failed to create client"))
+	}
+	defer client.Close()
+	bucket := client.Bucket(db.Config().Storage.SongsBucket)
+	for _, name := range names {
+		if owned[name] {
+			continue
+		}
+		_, err := bucket.Object(name).Attrs(ctx)
+		if err == nil {
+			return utilities.WrapError(fmt.Errorf("%s already exists", name), ErrObjectNotOwned)
+		}
+		if !errors.Is(err, storage.ErrObjectNotExist) {
+			return utilities.WrapError(err, ErrFailedUploadObject, name)
+		}
+	}
+	return nil
+}
+
+// saveSong upserts the song by object name and stores the resulting id on it.
+// Popularity belongs to the catalog entry rather than the file, so it survives re-uploads.
+func saveSong(ctx context.Context, db *Database, song *Song) error {
+	collection := db.Collection(utilities.SongsCollection)
+	var existing Song
+	err := collection.FindOne(ctx, bson.M{"object_name": song.ObjectName}, options.FindOne().SetProjection(bson.M{"popularity": 1})).Decode(&existing)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	song.Popularity = existing.Popularity
+
+	opts := options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)
+	var saved Song
+	err = collection.FindOneAndReplace(ctx, bson.M{"object_name": song.ObjectName}, song, opts).Decode(&saved)
+	if err != nil {
+		return err
+	}
+	song.ID = saved.ID
+	return nil
+}
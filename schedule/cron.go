@@ -0,0 +1,178 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = fmt.Errorf("invalid cron expression")
+
+// maxSearchDays bounds Next; a valid expression such as "0 0 29 2 *" fires at least once in any 8 years
+const maxSearchDays = 8 * 366
+
+// Cron is a parsed five-field cron expression: minute, hour, day of month, month and day of week.
+// Fields accept *, numbers, ranges (1-5), lists (1,3,5) and steps (*/15, 8-18/2); day of week
+// is 0-7 with both 0 and 7 meaning Sunday. As in classic cron, when both day of month and day of
+// week are restricted a day matching either one fires.
+type Cron struct {
+	spec     string
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// anyDay and anyWeekday record a * so the either-or rule only applies to restricted fields
+	anyDay     bool
+	anyWeekday bool
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var (
+	minuteField  = field{"minute", 0, 59}
+	hourField    = field{"hour", 0, 23}
+	dayField     = field{"day of month", 1, 31}
+	monthField   = field{"month", 1, 12}
+	weekdayField = field{"day of week", 0, 7}
+)
+
+// ParseCron parses a five-field cron expression
+func ParseCron(spec string) (Cron, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return Cron{}, fmt.Errorf("%w: %q must have 5 fields, has %d", ErrInvalidCron, spec, len(parts))
+	}
+
+	c := Cron{spec: strings.Join(parts, " ")}
+	var err error
+	if c.minutes, err = parseField(parts[0], minuteField); err != nil {
+		return Cron{}, err
+	}
+	if c.hours, err = parseField(parts[1], hourField); err != nil {
+		return Cron{}, err
+	}
+	if c.days, err = parseField(parts[2], dayField); err != nil {
+		return Cron{}, err
+	}
+	if c.months, err = parseField(parts[3], monthField); err != nil {
+		return Cron{}, err
+	}
+	if c.weekdays, err = parseField(parts[4], weekdayField); err != nil {
+		return Cron{}, err
+	}
+	// Sunday can be written as 7
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+	c.anyDay = strings.HasPrefix(parts[2], "*")
+	c.anyWeekday = strings.HasPrefix(parts[4], "*")
+	return c, nil
+}
+
+func (c Cron) String() string {
+	return c.spec
+}
+
+// Next returns the first time after t the expression fires, in t's location.
+// Wall-clock times skipped by a daylight saving change don't fire; repeated ones fire once.
+func (c Cron) Next(t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	year, month, day := t.Date()
+	for i := 0; i < maxSearchDays; i++ {
+		date := time.Date(year, month, day+i, 0, 0, 0, 0, loc)
+		if !c.matchesDay(date) {
+			continue
+		}
+		for hour := 0; hour < 24; hour++ {
+			if c.hours&(1<<hour) == 0 {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if c.minutes&(1<<minute) == 0 {
+					continue
+				}
+				next := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, loc)
+				if next.Hour() != hour || next.Minute() != minute {
+					continue
+				}
+				if next.After(t) {
+					return next, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func (c Cron) matchesDay(date time.Time) bool {
+	if c.months&(1<<int(date.Month())) == 0 {
+		return false
+	}
+	dayMatch := c.days&(1<<date.Day()) != 0
+	weekdayMatch := c.weekdays&(1<<int(date.Weekday())) != 0
+	if !c.anyDay && !c.anyWeekday {
+		return dayMatch || weekdayMatch
+	}
+	return dayMatch && weekdayMatch
+}
+
+// parseField turns one comma separated field into a bit set of the values it allows
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed < 1 {
+				return 0, fmt.Errorf("%w: bad step %q in %s field", ErrInvalidCron, stepPart, f.name)
+			}
+			step = parsed
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			from, to, _ := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = parseValue(from, f); err != nil {
+				return 0, err
+			}
+			if high, err = parseValue(to, f); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("%w: range %q is backwards in %s field", ErrInvalidCron, rangePart, f.name)
+			}
+		default:
+			var err error
+			if low, err = parseValue(rangePart, f); err != nil {
+				return 0, err
+			}
+			// A single value with a step, e.g. 5/15, runs to the end of the field
+			high = low
+			if hasStep {
+				high = f.max
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(value string, f field) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%w: %s must be between %d and %d, got %q", ErrInvalidCron, f.name, f.min, f.max, value)
+	}
+	return v, nil
+}
@@ -0,0 +1,103 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	// Embed the time zone database; the runtime image has none
+	_ "time/tzdata"
+)
+
+var (
+	ErrInvalidTimeZone  = fmt.Errorf("invalid time zone")
+	ErrInvalidException = fmt.Errorf("invalid exception date")
+)
+
+const (
+	dateLayout        = "2006-01-02"
+	yearlyDateLayout  = "01-02"
+	MaxSlotDuration   = 24 * time.Hour
+	maxExceptionDates = 366
+)
+
+// Rule is a recurring time slot: it starts whenever Cron fires in Location and lasts Duration.
+// Exceptions are local dates with no slot, either once (2026-12-25) or every year (12-25).
+type Rule struct {
+	Cron       Cron
+	Location   *time.Location
+	Duration   time.Duration
+	exceptions map[string]bool
+}
+
+// Slot is one occurrence of a rule. End equals Start for instantaneous slots such as alarms.
+type Slot struct {
+	Start time.Time
+	End   time.Time
+}
+
+// NewRule parses and validates the parts of a rule
+func NewRule(spec, timeZone string, duration time.Duration, exceptions []string) (Rule, error) {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return Rule{}, err
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil || timeZone == "" {
+		return Rule{}, fmt.Errorf("%w: %q", ErrInvalidTimeZone, timeZone)
+	}
+	if duration < 0 || duration > MaxSlotDuration {
+		return Rule{}, fmt.Errorf("duration must be between 0 and %s", MaxSlotDuration)
+	}
+	if len(exceptions) > maxExceptionDates {
+		return Rule{}, fmt.Errorf("%w: at most %d dates", ErrInvalidException, maxExceptionDates)
+	}
+
+	rule := Rule{Cron: cron, Location: location, Duration: duration, exceptions: map[string]bool{}}
+	for _, date := range exceptions {
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			// Feb 29 is a valid yearly date, so check month-days against a leap year
+			if _, err := time.Parse(dateLayout, "2024-"+date); err != nil || len(date) != len(yearlyDateLayout) {
+				return Rule{}, fmt.Errorf("%w: %q is neither YYYY-MM-DD nor MM-DD", ErrInvalidException, date)
+			}
+		}
+		rule.exceptions[date] = true
+	}
+	return rule, nil
+}
+
+// Next returns the first slot starting after t, skipping exception dates
+func (r Rule) Next(t time.Time) (Slot, bool) {
+	current := t.In(r.Location)
+	// Bounded in case every date the expression fires on is an exception
+	for i := 0; i < maxSearchDays; i++ {
+		start, ok := r.Cron.Next(current)
+		if !ok {
+			return Slot{}, false
+		}
+		if !r.IsException(start) {
+			return Slot{Start: start, End: start.Add(r.Duration)}, true
+		}
+		// Nothing else fires on an exception date; resume searching from its last minute
+		year, month, day := start.Date()
+		current = time.Date(year, month, day, 23, 59, 0, 0, r.Location)
+	}
+	return Slot{}, false
+}
+
+// Active returns the slot in progress at t, if any, so a window can be resumed after a restart
+func (r Rule) Active(t time.Time) (Slot, bool) {
+	if r.Duration == 0 {
+		return Slot{}, false
+	}
+	slot, ok := r.Next(t.Add(-r.Duration))
+	if !ok || slot.Start.After(t) || !slot.End.After(t) {
+		return Slot{}, false
+	}
+	return slot, true
+}
+
+// IsException reports whether t falls on one of the rule's exception dates in its location
+func (r Rule) IsException(t time.Time) bool {
+	local := t.In(r.Location)
+	return r.exceptions[local.Format(dateLayout)] || r.exceptions[local.Format(yearlyDateLayout)]
+}
@@ -0,0 +1,102 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	assert.NoError(t, err)
+	return location
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := ParseCron(spec)
+		assert.ErrorIs(t, err, ErrInvalidCron, spec)
+	}
+}
+
+func TestCron_Next(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	// Monday 19 October 2026
+	monday := time.Date(2026, 10, 19, 9, 30, 0, 0, berlin)
+
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"0 10 * * 1-6", monday, time.Date(2026, 10, 19, 10, 0, 0, 0, berlin)},
+		{"0 10 * * 1-6", monday.Add(time.Hour), time.Date(2026, 10, 20, 10, 0, 0, 0, berlin)},
+		{"*/15 * * * *", monday, time.Date(2026, 10, 19, 9, 45, 0, 0, berlin)},
+		{"30 7 * * 0,6", monday, time.Date(2026, 10, 24, 7, 30, 0, 0, berlin)},
+		{"0 8 * * 7", monday, time.Date(2026, 10, 25, 8, 0, 0, 0, berlin)},
+		{"0 0 29 2 *", monday, time.Date(2028, 2, 29, 0, 0, 0, 0, berlin)},
+		// Restricted day of month and day of week fire on either: the 1st or any Friday
+		{"0 12 1 * 5", monday, time.Date(2026, 10, 23, 12, 0, 0, 0, berlin)},
+		{"5/20 9 * * *", monday, time.Date(2026, 10, 19, 9, 45, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		next, ok := mustCron(t, tt.spec).Next(tt.from)
+		assert.True(t, ok, tt.spec)
+		assert.True(t, tt.want.Equal(next), "%s: want %s, got %s", tt.spec, tt.want, next)
+	}
+}
+
+func TestCron_NextSkipsDaylightSavingGap(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	// Clocks go from 02:00 to 03:00 on 29 March 2026, so 02:30 doesn't exist that day
+	next, ok := mustCron(t, "30 2 * * *").Next(time.Date(2026, 3, 28, 12, 0, 0, 0, berlin))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 3, 30, 2, 30, 0, 0, berlin), next)
+}
+
+func TestRule_NextSkipsExceptions(t *testing.T) {
+	rule, err := NewRule("0 10 * * 1-6", "America/New_York", 8*time.Hour, []string{"2026-11-26", "12-25"})
+	assert.NoError(t, err)
+	newYork := rule.Location
+
+	slot, ok := rule.Next(time.Date(2026, 11, 25, 19, 0, 0, 0, newYork))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 11, 27, 10, 0, 0, 0, newYork), slot.Start)
+	assert.Equal(t, time.Date(2026, 11, 27, 18, 0, 0, 0, newYork), slot.End)
+
+	// Yearly exceptions apply every year
+	slot, ok = rule.Next(time.Date(2027, 12, 24, 19, 0, 0, 0, newYork))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2027, 12, 27, 10, 0, 0, 0, newYork), slot.Start)
+}
+
+func TestRule_Active(t *testing.T) {
+	rule, err := NewRule("0 10 * * *", "Asia/Tokyo", 8*time.Hour, nil)
+	assert.NoError(t, err)
+	tokyo := rule.Location
+
+	slot, ok := rule.Active(time.Date(2026, 10, 19, 12, 0, 0, 0, tokyo))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 10, 19, 10, 0, 0, 0, tokyo), slot.Start)
+
+	_, ok = rule.Active(time.Date(2026, 10, 19, 19, 0, 0, 0, tokyo))
+	assert.False(t, ok)
+}
+
+func TestNewRule_Invalid(t *testing.T) {
+	_, err := NewRule("0 10 * * *", "Mars/Olympus", time.Hour, nil)
+	assert.ErrorIs(t, err, ErrInvalidTimeZone)
+	_, err = NewRule("0 10 * * *", "", time.Hour, nil)
+	assert.ErrorIs(t, err, ErrInvalidTimeZone)
+	_, err = NewRule("0 10 * * *", "UTC", time.Hour, []string{"25/12"})
+	assert.ErrorIs(t, err, ErrInvalidException)
+	_, err = NewRule("0 10 * * *", "UTC", 25*time.Hour, nil)
+	assert.Error(t, err)
+}
+
+func mustCron(t *testing.T, spec string) Cron {
+	cron, err := ParseCron(spec)
+	assert.NoError(t, err, spec)
+	return cron
+}
@@ -2,25 +2,38 @@ package utilities
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/rs/zerolog/log"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Errors
-var ()
-
-var (
-	HTTP_CONTEXT_TIMEOUT          = GetEnv("HTTP_CONTEXT_TIMEOUT", "2")
-	MongoDBURI                    = GetEnv("MONGODB_URI", "mongodb://mongodb-service:27017")
-	DatabaseName                  = GetEnv("DATABASE_NAME", "testdb")
-	UsersCollection               = GetEnv("USERS_COLLECTION", "users")
-	DefaultBucketName             = GetEnv("DEFAULT_BUCKET_NAME", "midi_file_storage")
-	SIGNED_URL_EXPIRATION_MINUTES = GetEnv("SIGNED_URL_EXPIRATION_MINUTES", "5")
+// Collection names are part of the schema, so they are fixed rather than configured
+const (
+	UsersCollection                = "users"
+	SongsCollection                = "songs"
+	SimilarCollection              = "similar_songs"
+	SessionsCollection             = "sessions"
+	PlaylistsCollection            = "playlists"
+	DeviceQueuesCollection         = "device_queues"
+	FavoritesCollection            = "favorites"
+	RatingsCollection              = "ratings"
+	PlayEventsCollection           = "play_events"
+	DeviceSchedulesCollection      = "device_schedules"
+	DeviceCommandsCollection       = "device_commands"
+	RecordingsCollection           = "recordings"
+	RecordingChunksCollection      = "recording_chunks"
+	PracticeSessionsCollection     = "practice_sessions"
+	DeviceKeysCollection           = "device_keys"
+	DeviceAuthorizationsCollection = "device_authorizations"
+	AccountTokensCollection        = "account_tokens"
+	LoginFailuresCollection        = "login_failures"
+	RateLimitsCollection           = "rate_limits"
+	// ValidOTPSerialsCollection is the device registry: every serial number shipped, with its one-time password
+	ValidOTPSerialsCollection = "valid_otp_serials"
 )
 
 func WrapError(err error, customErr error, contextInfo ...string) error {
@@ -34,46 +47,72 @@ func WrapError(err error, customErr error, contextInfo ...string) error {
 	return nil
 }
 
-// Use a fresh timeout for each request
-func WithTimeout(handler func(context.Context, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+// Use a fresh timeout for each request. timeout is asked for every request, so a reloaded value applies straight away.
+func WithTimeout(timeout func() time.Duration, handler func(context.Context, http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		timedContext, cancel := context.WithTimeout(r.Context(), GetSignedTimeDurationMinutes(HTTP_CONTEXT_TIMEOUT))
+		timedContext, cancel := context.WithTimeout(r.Context(), timeout())
 		defer cancel()
 		handler(timedContext, w, r)
 	}
 }
 
-func WithTimeoutDb(db *mongo.Database, handler func(context.Context, *mongo.Database, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+// WithTimeoutDb is WithTimeout for handlers that also need the database, whatever type it is handed over as
+func WithTimeoutDb[DB any](timeout func() time.Duration, db DB, handler func(context.Context, DB, http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		timedContext, cancel := context.WithTimeout(r.Context(), GetSignedTimeDurationMinutes(HTTP_CONTEXT_TIMEOUT))
+		timedContext, cancel := context.WithTimeout(r.Context(), timeout())
 		defer cancel()
 		handler(timedContext, db, w, r)
 	}
 }
 
 // withSignedUrlDuration allows passing an additional argument like time.Duration to handlers
-func WithSignedUrlDuration(d time.Duration, handler func(context.Context, http.ResponseWriter, *http.Request, time.Duration)) http.HandlerFunc {
+func WithSignedUrlDuration(duration func() time.Duration, handler func(context.Context, http.ResponseWriter, *http.Request, time.Duration)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		d := duration()
 		timedContext, cancel := context.WithTimeout(r.Context(), d)
 		defer cancel()
 		handler(timedContext, w, r, d)
 	}
 }
-func LogErrorAndRespond(w http.ResponseWriter, message string, statusCode int) {
-	log.Error().Int("status_code", statusCode).Msg(message)
-	http.Error(w, message, statusCode)
+
+// WithSignedUrlDurationDb is WithSignedUrlDuration for handlers that also need the database
+func WithSignedUrlDurationDb[DB any](db DB, duration func() time.Duration, handler func(context.Context, DB, http.ResponseWriter, *http.Request, time.Duration)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := duration()
+		timedContext, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		handler(timedContext, db, w, r, d)
+	}
 }
-func GetEnv(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+
+// WithAdminKey only lets requests through that carry the current admin key in the X-Admin-Key header.
+// Admin endpoints are disabled while no key is configured.
+func WithAdminKey(adminKey func() string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := adminKey()
+		if key == "" {
+			LogErrorAndRespond(w, "admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Key")), []byte(key)) != 1 {
+			LogErrorAndRespond(w, "invalid admin key", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
 	}
-	return defaultValue
 }
-func GetSignedTimeDurationMinutes(timeStr string) time.Duration {
 
-	signedUrlExpirationMinutes, err := time.ParseDuration(timeStr + "m")
+// ClientIP is the address the request came from. Forwarding headers are ignored since clients can set them;
+// the Kubernetes Service keeps client addresses with externalTrafficPolicy: Local instead.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to parse signed URL expiration minutes")
+		return r.RemoteAddr
 	}
-	return signedUrlExpirationMinutes
+	return host
+}
+
+func LogErrorAndRespond(w http.ResponseWriter, message string, statusCode int) {
+	log.Error().Int("status_code", statusCode).Msg(message)
+	http.Error(w, message, statusCode)
 }
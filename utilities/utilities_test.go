@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 	"time"
 
@@ -39,25 +38,18 @@ func TestWrapError_NoError(t *testing.T) {
 	assert.Nil(t, resultErr)
 }
 
-// Test GetSignedTimeDurationMinutes
-func TestGetSignedTimeDurationMinutes(t *testing.T) {
-	os.Setenv("SIGNED_URL_EXPIRATION_MINUTES", "5")
-	duration := GetSignedTimeDurationMinutes(os.Getenv("SIGNED_URL_EXPIRATION_MINUTES"))
-	assert.Equal(t, 5*time.Minute, duration)
-}
-
 func TestWithTimeout(t *testing.T) {
-	// Set an environment variable for testing
-	os.Setenv("HTTP_CONTEXT_TIMEOUT", "1")
-
 	handler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
 		w.WriteHeader(http.StatusOK)
 	}
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
 
-	WithTimeout(handler)(w, req)
+	WithTimeout(func() time.Duration { return time.Minute }, handler)(w, req)
 
 	resp := w.Result()
 	defer resp.Body.Close()
@@ -68,9 +60,6 @@ func TestWithTimeout(t *testing.T) {
 func TestWithTimeoutDb(t *testing.T) {
 	mockDB := new(mongo.Database)
 
-	// Set environment variable for context timeout
-	os.Setenv("HTTP_CONTEXT_TIMEOUT", "1")
-
 	handler := func(ctx context.Context, db *mongo.Database, w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, mockDB, db)
 		w.WriteHeader(http.StatusOK)
@@ -79,7 +68,7 @@ func TestWithTimeoutDb(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
 
-	WithTimeoutDb(mockDB, handler)(w, req)
+	WithTimeoutDb(func() time.Duration { return time.Minute }, mockDB, handler)(w, req)
 
 	resp := w.Result()
 	defer resp.Body.Close()
@@ -96,7 +85,7 @@ func TestWithSignedUrlDuration(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
 
-	WithSignedUrlDuration(5*time.Second, handler)(w, req)
+	WithSignedUrlDuration(func() time.Duration { return 5 * time.Second }, handler)(w, req)
 
 	resp := w.Result()
 	defer resp.Body.Close()
@@ -121,3 +110,42 @@ func TestLogErrorAndRespond(t *testing.T) {
 	assert.Equal(t, statusCode, resp.StatusCode)
 	assert.Equal(t, expectedMessage, actualMessage)
 }
+
+func TestWithAdminKey(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	request := func(handler http.HandlerFunc, key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/admin/duplicates", nil)
+		if key != "" {
+			req.Header.Set("X-Admin-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	key := ""
+	handler := WithAdminKey(func() string { return key }, ok)
+	assert.Equal(t, http.StatusForbidden, request(handler, "anything"))
+
+	key = "secret"
+	assert.Equal(t, http.StatusUnauthorized, request(handler, ""))
+	assert.Equal(t, http.StatusUnauthorized, request(handler, "wrong"))
+	assert.Equal(t, http.StatusOK, request(handler, "secret"))
+
+	// A rotated key applies to the next request
+	key = "rotated"
+	assert.Equal(t, http.StatusUnauthorized, request(handler, "secret"))
+	assert.Equal(t, http.StatusOK, request(handler, "rotated"))
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "203.0.113.7", ClientIP(req), "forwarding headers are ignored")
+
+	req.RemoteAddr = "[2001:db8::1]:443"
+	assert.Equal(t, "2001:db8::1", ClientIP(req))
+}